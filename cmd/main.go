@@ -1,35 +1,80 @@
 package main
 
 import (
-	"log"
+	"context"
+	"errors"
 	"net/http"
 	"os"
+	"os/signal"
+	"replicated-log/internal/cluster"
+	"replicated-log/internal/logging"
 	"replicated-log/internal/primary"
 	"replicated-log/internal/secondary"
+	"replicated-log/internal/server"
+	"strconv"
+	"syscall"
+	"time"
 )
 
 const (
 	modePrimary   = "PRIMARY"
 	modeSecondary = "SECONDARY"
+	modeCluster   = "CLUSTER" // leader is elected automatically
 )
 
 func main() {
+	logging.Setup()
+	logger := logging.Component("main")
+
 	mode, ok := os.LookupEnv("APP_MODE")
 	if !ok {
 		mode = modePrimary
 	}
 
-	var srv *http.Server
+	gracePeriod := 25 * time.Second // default value, should be less than terminationGracePeriodSeconds in k8s
+	if gracePeriodToken, okGracePeriod := os.LookupEnv("SHUTDOWN_GRACE_PERIOD_SECONDS"); okGracePeriod {
+		value, _ := strconv.Atoi(gracePeriodToken)
+		gracePeriod = time.Duration(value) * time.Second
+	}
+
+	var srv *server.GracefulServer
 
 	switch mode {
 	case modePrimary:
 		srv = primary.NewPrimaryServer()
 	case modeSecondary:
 		srv = secondary.NewSecondaryServer()
+	case modeCluster:
+		srv = cluster.NewClusterServer()
 	default:
-		log.Fatalf("Unexpected mode flag: %s", mode)
+		logging.Fatal(logger, "Unexpected mode flag", "mode", mode)
 	}
 
-	log.Printf("Start serving HTTP at %s as a %s", srv.Addr, mode)
-	log.Fatal(srv.ListenAndServe())
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	go func() {
+		logger.Info("Start serving HTTP", "addr", srv.Addr, "mode", mode)
+		var err error
+		if srv.TLSConfig != nil {
+			// certificates are already loaded into TLS config
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if !errors.Is(err, http.ErrServerClosed) {
+			logging.Fatal(logger, "Failed to serve HTTP", "err", err)
+		}
+	}()
+
+	<-ctx.Done()
+	logger.Info("Shutting down", "mode", mode, "grace_period", gracePeriod)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), gracePeriod)
+	defer cancel()
+
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		logger.Error("Failed to shutdown gracefully", "err", err)
+	}
+	logger.Info("Bye!")
 }
@@ -0,0 +1,268 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"os"
+	"replicated-log/internal/logging"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+var logger = logging.Component("auth")
+
+const (
+	ModeNone   = "NONE"   // client API is open
+	ModeBearer = "BEARER" // 'Authorization: Bearer <token>' with one of configured tokens
+	ModeHmac   = "HMAC"   // 'Authorization: HMAC-SHA256 <signature>' of the request, see Sign
+
+	// SignatureTimestampHeader -- unix time in seconds when HMAC request was signed
+	SignatureTimestampHeader = "X-Signature-Timestamp"
+
+	bearerPrefix     = "Bearer "
+	hmacPrefix       = "HMAC-SHA256 "
+	authorizationKey = "authorization"
+
+	// signed body is read before the handler, so its size is limited here as well
+	maxSignedBodySize = 32 << 20
+)
+
+// Authenticator -- guards client, internal (replication, election) and admin (membership, test) endpoints
+// with separate credentials. Every kind of endpoint is open unless its credentials are configured.
+type Authenticator struct {
+	clientMode   string
+	clientTokens []string
+	hmacSecret   []byte
+	maxSkew      time.Duration
+	// token of the other nodes, internal endpoints also require client certificate if mutual TLS is enabled
+	internalToken     string
+	requireClientCert bool
+	adminToken        string
+	now               func() time.Time
+}
+
+// NewAuthenticator reads 'CLIENT_AUTH_MODE', 'CLIENT_AUTH_TOKENS', 'CLIENT_AUTH_HMAC_SECRET',
+// 'CLIENT_AUTH_HMAC_MAX_SKEW_SECONDS', 'INTERNAL_AUTH_TOKEN', 'ADMIN_AUTH_TOKEN' and TLS env vars
+func NewAuthenticator() *Authenticator {
+	clientMode, ok := os.LookupEnv("CLIENT_AUTH_MODE")
+	if !ok {
+		clientMode = ModeNone
+	}
+
+	var clientTokens []string
+	if tokensToken, okTokens := os.LookupEnv("CLIENT_AUTH_TOKENS"); okTokens {
+		for _, token := range strings.Split(tokensToken, ",") {
+			// "a, b" lists the same tokens as "a,b", empty entries never match
+			if token = strings.TrimSpace(token); token != "" {
+				clientTokens = append(clientTokens, token)
+			}
+		}
+	}
+	hmacSecret := os.Getenv("CLIENT_AUTH_HMAC_SECRET")
+
+	switch clientMode {
+	case ModeNone:
+		// nothing to check
+	case ModeBearer:
+		if len(clientTokens) == 0 {
+			logging.Fatal(logger, "'CLIENT_AUTH_TOKENS' env var is not set")
+		}
+	case ModeHmac:
+		if hmacSecret == "" {
+			logging.Fatal(logger, "'CLIENT_AUTH_HMAC_SECRET' env var is not set")
+		}
+	default:
+		logging.Fatal(logger, "Unexpected client auth mode", "mode", clientMode)
+	}
+
+	maxSkew := 5 * time.Minute // default value
+	if skewToken, okSkew := os.LookupEnv("CLIENT_AUTH_HMAC_MAX_SKEW_SECONDS"); okSkew {
+		value, err := strconv.Atoi(skewToken)
+		if err != nil || value < 1 {
+			logging.Fatal(logger, "Given 'CLIENT_AUTH_HMAC_MAX_SKEW_SECONDS' token is invalid", "token", skewToken)
+		}
+		maxSkew = time.Duration(value) * time.Second
+	}
+
+	return &Authenticator{
+		clientMode:        clientMode,
+		clientTokens:      clientTokens,
+		hmacSecret:        []byte(hmacSecret),
+		maxSkew:           maxSkew,
+		internalToken:     os.Getenv("INTERNAL_AUTH_TOKEN"),
+		requireClientCert: TLSFilesFromEnv().IsMutual(),
+		adminToken:        os.Getenv("ADMIN_AUTH_TOKEN"),
+		now:               time.Now,
+	}
+}
+
+// Client guards endpoints used by producers and consumers
+func (a *Authenticator) Client(next http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		var ok bool
+		switch a.clientMode {
+		case ModeBearer:
+			ok = isOneOf(bearerToken(r.Header.Get("Authorization")), a.clientTokens)
+		case ModeHmac:
+			ok = a.verifySignature(rw, r)
+		default:
+			ok = true
+		}
+
+		if !ok {
+			reject(rw, r, "client")
+			return
+		}
+		next(rw, r)
+	}
+}
+
+// Internal guards endpoints used by other nodes of the cluster
+func (a *Authenticator) Internal(next http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		if a.requireClientCert && !hasVerifiedCert(r.TLS) {
+			reject(rw, r, "internal")
+			return
+		}
+		if a.internalToken != "" && !isOneOf(bearerToken(r.Header.Get("Authorization")), []string{a.internalToken}) {
+			reject(rw, r, "internal")
+			return
+		}
+		next(rw, r)
+	}
+}
+
+// Admin guards membership and test endpoints
+func (a *Authenticator) Admin(next http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		if a.adminToken != "" && !isOneOf(bearerToken(r.Header.Get("Authorization")), []string{a.adminToken}) {
+			reject(rw, r, "admin")
+			return
+		}
+		next(rw, r)
+	}
+}
+
+func reject(rw http.ResponseWriter, r *http.Request, kind string) {
+	logger.Warn("Request is not authenticated", "kind", kind, "path", r.URL.Path, "remote_addr", r.RemoteAddr)
+	http.Error(rw, "unauthorized", http.StatusUnauthorized)
+}
+
+func hasVerifiedCert(state *tls.ConnectionState) bool {
+	return state != nil && len(state.VerifiedChains) > 0
+}
+
+func bearerToken(authorization string) string {
+	if !strings.HasPrefix(authorization, bearerPrefix) {
+		return ""
+	}
+	return strings.TrimPrefix(authorization, bearerPrefix)
+}
+
+// isOneOf compares tokens in constant time
+func isOneOf(token string, expected []string) bool {
+	if token == "" {
+		return false
+	}
+
+	found := false
+	for _, candidate := range expected {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(candidate)) == 1 {
+			found = true
+		}
+	}
+	return found
+}
+
+// Sign returns hex encoded HMAC-SHA256 of the request: method, request uri (path and query),
+// timestamp and body separated by new lines
+func Sign(secret []byte, method string, requestUri string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(method + "\n" + requestUri + "\n" + timestamp + "\n"))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifySignature reads the body to check the signature and restores it for the handler
+func (a *Authenticator) verifySignature(rw http.ResponseWriter, r *http.Request) bool {
+	authorization := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, hmacPrefix) {
+		return false
+	}
+
+	timestamp := r.Header.Get(SignatureTimestampHeader)
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	if skew := a.now().Sub(time.Unix(seconds, 0)); skew > a.maxSkew || skew < -a.maxSkew {
+		return false
+	}
+
+	var body []byte
+	if r.Body != nil {
+		if body, err = io.ReadAll(http.MaxBytesReader(rw, r.Body, maxSignedBodySize)); err != nil {
+			return false
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	expected := Sign(a.hmacSecret, r.Method, r.URL.RequestURI(), timestamp, body)
+	return hmac.Equal([]byte(strings.TrimPrefix(authorization, hmacPrefix)), []byte(expected))
+}
+
+// GrpcServerOptions guards gRPC replication with the same internal credentials as HTTP
+func (a *Authenticator) GrpcServerOptions(files TLSFiles) ([]grpc.ServerOption, error) {
+	options := []grpc.ServerOption{
+		grpc.UnaryInterceptor(func(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+			if err := a.checkInternalMetadata(ctx); err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(srv any, stream grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			if err := a.checkInternalMetadata(stream.Context()); err != nil {
+				return err
+			}
+			return handler(srv, stream)
+		}),
+	}
+
+	// gRPC port serves only internal calls, so client certificate is always required with mutual TLS
+	tlsConfig, err := files.ServerConfig(tls.RequireAndVerifyClientCert)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		options = append(options, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+
+	return options, nil
+}
+
+func (a *Authenticator) checkInternalMetadata(ctx context.Context) error {
+	if a.internalToken == "" {
+		return nil
+	}
+
+	values := metadata.ValueFromIncomingContext(ctx, authorizationKey)
+	if len(values) == 0 || !isOneOf(bearerToken(values[0]), []string{a.internalToken}) {
+		logger.Warn("gRPC call is not authenticated")
+		return status.Error(codes.Unauthenticated, "unauthorized")
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package auth
+
+import (
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func ok(rw http.ResponseWriter, _ *http.Request) {
+	rw.WriteHeader(http.StatusOK)
+}
+
+func serve(handler http.HandlerFunc, req *http.Request) int {
+	resp := httptest.NewRecorder()
+	handler(resp, req)
+	return resp.Code
+}
+
+func TestEndpointsAreOpenByDefault(t *testing.T) {
+	// GIVEN
+	a := NewAuthenticator()
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/append", nil)
+
+	// WHEN
+	codes := []int{serve(a.Client(ok), req), serve(a.Internal(ok), req), serve(a.Admin(ok), req)}
+
+	// THEN
+	require.Equal(t, []int{http.StatusOK, http.StatusOK, http.StatusOK}, codes)
+}
+
+func TestBearerTokens(t *testing.T) {
+	// GIVEN
+	t.Setenv("CLIENT_AUTH_MODE", ModeBearer)
+	t.Setenv("CLIENT_AUTH_TOKENS", "client-1, client-2") // spaces around tokens are ignored
+	t.Setenv("INTERNAL_AUTH_TOKEN", "internal")
+	t.Setenv("ADMIN_AUTH_TOKEN", "admin")
+	a := NewAuthenticator()
+
+	withToken := func(token string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		return req
+	}
+
+	tests := []struct {
+		name     string
+		handler  http.HandlerFunc
+		token    string
+		expected int
+	}{
+		{"client token opens client API", a.Client(ok), "client-2", http.StatusOK},
+		{"unknown token is rejected", a.Client(ok), "client-3", http.StatusUnauthorized},
+		{"missing token is rejected", a.Client(ok), "", http.StatusUnauthorized},
+		{"internal token opens internal API", a.Internal(ok), "internal", http.StatusOK},
+		{"client token doesn't open internal API", a.Internal(ok), "client-1", http.StatusUnauthorized},
+		{"admin token opens admin API", a.Admin(ok), "admin", http.StatusOK},
+		{"internal token doesn't open admin API", a.Admin(ok), "internal", http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.expected, serve(tt.handler, withToken(tt.token)))
+		})
+	}
+}
+
+func TestHmacSignature(t *testing.T) {
+	// GIVEN
+	t.Setenv("CLIENT_AUTH_MODE", ModeHmac)
+	t.Setenv("CLIENT_AUTH_HMAC_SECRET", "secret")
+	a := NewAuthenticator()
+	now := time.Unix(1700000000, 0)
+	a.now = func() time.Time { return now }
+
+	body := `{"message":"hello"}`
+	signed := func(secret string, timestamp time.Time, signedBody string) *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/append?w=1", strings.NewReader(body))
+		ts := strconv.FormatInt(timestamp.Unix(), 10)
+		req.Header.Set(SignatureTimestampHeader, ts)
+		req.Header.Set("Authorization", "HMAC-SHA256 "+Sign([]byte(secret), http.MethodPost, "/api/v1/append?w=1", ts, []byte(signedBody)))
+		return req
+	}
+
+	var receivedBody string
+	handler := a.Client(func(rw http.ResponseWriter, r *http.Request) {
+		raw, _ := io.ReadAll(r.Body)
+		receivedBody = string(raw)
+		rw.WriteHeader(http.StatusOK)
+	})
+
+	t.Run("Valid signature is accepted and body is kept for the handler", func(t *testing.T) {
+		require.Equal(t, http.StatusOK, serve(handler, signed("secret", now, body)))
+		require.Equal(t, body, receivedBody)
+	})
+
+	t.Run("Signature with another secret is rejected", func(t *testing.T) {
+		require.Equal(t, http.StatusUnauthorized, serve(handler, signed("other", now, body)))
+	})
+
+	t.Run("Signature of another body is rejected", func(t *testing.T) {
+		require.Equal(t, http.StatusUnauthorized, serve(handler, signed("secret", now, `{"message":"bye"}`)))
+	})
+
+	t.Run("Old signature is rejected", func(t *testing.T) {
+		require.Equal(t, http.StatusUnauthorized, serve(handler, signed("secret", now.Add(-time.Hour), body)))
+	})
+}
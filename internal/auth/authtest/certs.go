@@ -0,0 +1,99 @@
+// Package authtest generates certificates for tests of mutual TLS
+package authtest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"replicated-log/internal/auth"
+	"testing"
+	"time"
+)
+
+// GenerateTLSFiles creates CA and a certificate signed by it in a temporary directory of the test.
+// The certificate is valid for 'localhost' and '127.0.0.1' both as server and as client.
+func GenerateTLSFiles(t testing.TB) auth.TLSFiles {
+	return generate(t, "ca")
+}
+
+// GenerateUntrustedTLSFiles creates certificate signed by a different CA, it should be rejected by GenerateTLSFiles ones
+func GenerateUntrustedTLSFiles(t testing.TB) auth.TLSFiles {
+	return generate(t, "untrusted-ca")
+}
+
+func generate(t testing.TB, caName string) auth.TLSFiles {
+	t.Helper()
+	dir := t.TempDir()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: caName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDer, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nodeKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "replicated-log"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	nodeDer, err := x509.CreateCertificate(rand.Reader, nodeTemplate, caTemplate, &nodeKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeKeyDer, err := x509.MarshalECPrivateKey(nodeKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := auth.TLSFiles{
+		CertFile: filepath.Join(dir, "node.crt"),
+		KeyFile:  filepath.Join(dir, "node.key"),
+		CAFile:   filepath.Join(dir, "ca.crt"),
+	}
+	writePem(t, files.CAFile, "CERTIFICATE", caDer)
+	writePem(t, files.CertFile, "CERTIFICATE", nodeDer)
+	writePem(t, files.KeyFile, "EC PRIVATE KEY", nodeKeyDer)
+
+	return files
+}
+
+func writePem(t testing.TB, path string, blockType string, der []byte) {
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Setenv configures TLS env vars of the test with the given files
+func Setenv(t *testing.T, files auth.TLSFiles) {
+	t.Setenv("TLS_CERT_FILE", files.CertFile)
+	t.Setenv("TLS_KEY_FILE", files.KeyFile)
+	t.Setenv("TLS_CA_FILE", files.CAFile)
+}
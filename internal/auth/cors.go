@@ -0,0 +1,15 @@
+package auth
+
+import (
+	"os"
+	"strings"
+)
+
+// AllowedOrigins reads comma separated 'CORS_ALLOWED_ORIGINS' env var, every origin is allowed by default
+func AllowedOrigins() []string {
+	originsToken, ok := os.LookupEnv("CORS_ALLOWED_ORIGINS")
+	if !ok || originsToken == "" {
+		return []string{"*"}
+	}
+	return strings.Split(originsToken, ",")
+}
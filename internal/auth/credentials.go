@@ -0,0 +1,93 @@
+package auth
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"os"
+	"replicated-log/internal/logging"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// Credentials -- what node presents to other nodes on internal requests
+type Credentials struct {
+	// sent as bearer token, empty if internal endpoints are not protected by token
+	Token string
+	// nil if TLS is disabled
+	TLS *tls.Config
+}
+
+// InternalCredentials reads 'INTERNAL_AUTH_TOKEN' and TLS env vars
+func InternalCredentials() Credentials {
+	tlsConfig, err := TLSFilesFromEnv().ClientConfig()
+	if err != nil {
+		logging.Fatal(logger, "Failed to load TLS certificates", "err", err)
+	}
+
+	return Credentials{
+		Token: os.Getenv("INTERNAL_AUTH_TOKEN"),
+		TLS:   tlsConfig,
+	}
+}
+
+// NewHttpClient creates client which authenticates every request with these credentials
+func (c Credentials) NewHttpClient(timeout time.Duration) http.Client {
+	return http.Client{
+		Timeout:   timeout,
+		Transport: &authorizingTransport{base: c.RoundTripper(), token: c.Token},
+	}
+}
+
+// RoundTripper returns transport which uses TLS config of the credentials, but doesn't add the token
+func (c Credentials) RoundTripper() http.RoundTripper {
+	base := http.DefaultTransport.(*http.Transport).Clone()
+	base.TLSClientConfig = c.TLS
+	return base
+}
+
+type authorizingTransport struct {
+	base  http.RoundTripper
+	token string
+}
+
+func (t *authorizingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.token != "" {
+		// RoundTripper should not modify the request
+		req = req.Clone(req.Context())
+		req.Header.Set("Authorization", bearerPrefix+t.token)
+	}
+	return t.base.RoundTrip(req)
+}
+
+// GrpcDialOptions returns options which authenticate gRPC connection and every call with these credentials
+func (c Credentials) GrpcDialOptions() []grpc.DialOption {
+	var options []grpc.DialOption
+	if c.TLS != nil {
+		options = append(options, grpc.WithTransportCredentials(credentials.NewTLS(c.TLS)))
+	} else {
+		options = append(options, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	}
+
+	if c.Token != "" {
+		options = append(options, grpc.WithPerRPCCredentials(tokenCredentials{token: c.Token, requireTLS: c.TLS != nil}))
+	}
+
+	return options
+}
+
+type tokenCredentials struct {
+	token      string
+	requireTLS bool
+}
+
+func (c tokenCredentials) GetRequestMetadata(_ context.Context, _ ...string) (map[string]string, error) {
+	return map[string]string{authorizationKey: bearerPrefix + c.token}, nil
+}
+
+func (c tokenCredentials) RequireTransportSecurity() bool {
+	return c.requireTLS
+}
@@ -0,0 +1,107 @@
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+	"replicated-log/internal/logging"
+)
+
+// TLSFiles -- certificate of the node, its key and CA which signs certificates of all nodes, PEM encoded
+type TLSFiles struct {
+	CertFile string
+	KeyFile  string
+	// optional, enables mutual TLS: internal endpoints require client certificate signed by this CA
+	CAFile string
+}
+
+// TLSFilesFromEnv reads 'TLS_CERT_FILE', 'TLS_KEY_FILE' and 'TLS_CA_FILE' env vars, TLS is disabled if cert is not set
+func TLSFilesFromEnv() TLSFiles {
+	return TLSFiles{
+		CertFile: os.Getenv("TLS_CERT_FILE"),
+		KeyFile:  os.Getenv("TLS_KEY_FILE"),
+		CAFile:   os.Getenv("TLS_CA_FILE"),
+	}
+}
+
+func (f TLSFiles) IsEnabled() bool {
+	return f.CertFile != ""
+}
+
+func (f TLSFiles) IsMutual() bool {
+	return f.IsEnabled() && f.CAFile != ""
+}
+
+// ServerConfig returns nil if TLS is disabled.
+// Client certificate is verified if given, internal endpoints decide whether it is required.
+func (f TLSFiles) ServerConfig(clientAuth tls.ClientAuthType) (*tls.Config, error) {
+	if !f.IsEnabled() {
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(f.CertFile, f.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if f.IsMutual() {
+		if config.ClientCAs, err = loadPool(f.CAFile); err != nil {
+			return nil, err
+		}
+		config.ClientAuth = clientAuth
+	}
+
+	return config, nil
+}
+
+// ClientConfig returns nil if TLS is disabled. Node presents its own certificate to other nodes.
+func (f TLSFiles) ClientConfig() (*tls.Config, error) {
+	if !f.IsEnabled() {
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(f.CertFile, f.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if f.CAFile != "" {
+		if config.RootCAs, err = loadPool(f.CAFile); err != nil {
+			return nil, err
+		}
+	}
+
+	return config, nil
+}
+
+func loadPool(caFile string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificates found in " + caFile)
+	}
+	return pool, nil
+}
+
+// HttpServerTLSConfig reads TLS env vars, nil if TLS is disabled. Clients are not required to present certificates,
+// internal endpoints check them on their own.
+func HttpServerTLSConfig() *tls.Config {
+	config, err := TLSFilesFromEnv().ServerConfig(tls.VerifyClientCertIfGiven)
+	if err != nil {
+		logging.Fatal(logger, "Failed to load TLS certificates", "err", err)
+	}
+	return config
+}
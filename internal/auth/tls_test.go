@@ -0,0 +1,72 @@
+package auth_test
+
+import (
+	"crypto/tls"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"replicated-log/internal/auth"
+	"replicated-log/internal/auth/authtest"
+	"testing"
+	"time"
+)
+
+func TestInternalEndpointsRequireClientCertificateWithMutualTLS(t *testing.T) {
+	// GIVEN
+	files := authtest.GenerateTLSFiles(t)
+	authtest.Setenv(t, files)
+	a := auth.NewAuthenticator()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/internal", a.Internal(func(rw http.ResponseWriter, _ *http.Request) { rw.WriteHeader(http.StatusOK) }))
+	mux.HandleFunc("/client", a.Client(func(rw http.ResponseWriter, _ *http.Request) { rw.WriteHeader(http.StatusOK) }))
+	server := httptest.NewUnstartedServer(mux)
+	server.TLS = auth.HttpServerTLSConfig()
+	server.StartTLS()
+	defer server.Close()
+
+	withCert := auth.InternalCredentials().NewHttpClient(time.Second)
+
+	clientTLS, err := files.ClientConfig()
+	require.NoError(t, err)
+	clientTLS.Certificates = nil
+	withoutCert := auth.Credentials{TLS: clientTLS}.NewHttpClient(time.Second)
+
+	untrustedTLS, err := authtest.GenerateUntrustedTLSFiles(t).ClientConfig()
+	require.NoError(t, err)
+	untrustedTLS.RootCAs = clientTLS.RootCAs
+	untrusted := auth.Credentials{TLS: untrustedTLS}.NewHttpClient(time.Second)
+
+	get := func(client http.Client, path string) int {
+		resp, err := client.Get(server.URL + path)
+		if err != nil {
+			return 0
+		}
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// WHEN
+	internalWithCert := get(withCert, "/internal")
+	internalWithoutCert := get(withoutCert, "/internal")
+	clientWithoutCert := get(withoutCert, "/client")
+	internalUntrusted := get(untrusted, "/internal")
+
+	// THEN
+	require.Equal(t, http.StatusOK, internalWithCert)
+	require.Equal(t, http.StatusUnauthorized, internalWithoutCert)
+	require.Equal(t, http.StatusOK, clientWithoutCert)
+	require.NotEqual(t, http.StatusOK, internalUntrusted)
+}
+
+func TestServerConfigIsNilIfTLSIsDisabled(t *testing.T) {
+	// GIVEN
+	files := auth.TLSFiles{}
+
+	// WHEN
+	config, err := files.ServerConfig(tls.RequireAndVerifyClientCert)
+
+	// THEN
+	require.NoError(t, err)
+	require.Nil(t, config)
+}
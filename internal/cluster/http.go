@@ -0,0 +1,363 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/handlers"
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"replicated-log/internal/auth"
+	"replicated-log/internal/election"
+	"replicated-log/internal/logging"
+	"replicated-log/internal/metrics"
+	"replicated-log/internal/model"
+	"replicated-log/internal/primary"
+	"replicated-log/internal/replication"
+	"replicated-log/internal/secondary"
+	"replicated-log/internal/server"
+	"replicated-log/internal/storage"
+	"replicated-log/internal/transport"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var logger = logging.Component("cluster")
+
+// proxiedHeader marks append requests proxied by follower, so they are never proxied twice
+const proxiedHeader = "X-Replicated-Log-Proxied"
+
+// HttpHandler -- node of a cluster where the leader is elected automatically.
+// Every node serves secondary API, the leader additionally accepts appends and replicates them to all peers.
+// Followers proxy appends to the current leader.
+type HttpHandler struct {
+	mu       *sync.Mutex
+	selfUrl  string
+	peerUrls []string
+	client   http.Client
+	// TLS config of the node, used to proxy client requests to the leader
+	proxyTransport http.RoundTripper
+	topics         *storage.Topics
+	// log of the default topic
+	storage  storage.Storage
+	election *election.Election
+	replica  *secondary.HttpHandler
+	// non-nil while this node is the leader
+	leader *primary.HttpHandler
+	// runs on the leader only, followers apply its points received through replication
+	retention     *storage.Retention
+	appendTimeout time.Duration
+	metrics       *metrics.Metrics
+}
+
+func newHttpHandler(selfUrl string, peerUrls []string, topics *storage.Topics) *HttpHandler {
+	messages := topics.Default()
+
+	requestTimeout := 50 * time.Millisecond // default value
+	if requestTimeoutToken, okTimeout := os.LookupEnv("REQUEST_TIMEOUT_MILLISECONDS"); okTimeout {
+		value, _ := strconv.Atoi(requestTimeoutToken)
+		requestTimeout = time.Duration(value) * time.Millisecond
+	}
+
+	leaderElection := election.NewElection(selfUrl, peerUrls, messages.GetOffset)
+	m := metrics.NewMetrics()
+	m.RegisterStorage(messages)
+
+	credentials := auth.InternalCredentials()
+	h := &HttpHandler{
+		mu:             &sync.Mutex{},
+		selfUrl:        selfUrl,
+		peerUrls:       peerUrls,
+		client:         credentials.NewHttpClient(requestTimeout),
+		proxyTransport: credentials.RoundTripper(),
+		topics:         topics,
+		storage:        messages,
+		election:       leaderElection,
+		replica:        secondary.NewHttpHandlerWithTopics(topics, leaderElection.AcceptTerm, m),
+		appendTimeout:  primary.AppendTimeoutFromEnv(),
+		metrics:        m,
+	}
+	leaderElection.OnLeadershipChange(h.becomeLeader, h.becomeFollower)
+	// votes compare terms of logs, stored messages don't keep their term
+	h.replica.OnStored(leaderElection.ObserveLogTerm)
+
+	return h
+}
+
+func (h *HttpHandler) AppendMessage(rw http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	leader := h.leader
+	h.mu.Unlock()
+
+	if leader != nil {
+		leader.AppendMessage(rw, r)
+		return
+	}
+
+	h.proxyToLeader(rw, r)
+}
+
+// GetClusterStatus -- replication status is known only to the leader, followers proxy the request
+func (h *HttpHandler) GetClusterStatus(rw http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	leader := h.leader
+	h.mu.Unlock()
+
+	if leader != nil {
+		leader.GetClusterStatus(rw, r)
+		return
+	}
+
+	h.proxyToLeader(rw, r)
+}
+
+// onLeader serves the request by the primary API of this node if it is the leader, followers proxy the request.
+// Topics, admin and anti-entropy state exist only on the leader.
+func (h *HttpHandler) onLeader(serve func(leader *primary.HttpHandler, rw http.ResponseWriter, r *http.Request)) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		h.mu.Lock()
+		leader := h.leader
+		h.mu.Unlock()
+
+		if leader != nil {
+			serve(leader, rw, r)
+			return
+		}
+
+		h.proxyToLeader(rw, r)
+	}
+}
+
+// ChangeMembership -- members of the cluster are configured by 'PEER_URLS', every node elects the leader among them
+func (h *HttpHandler) ChangeMembership(rw http.ResponseWriter, _ *http.Request) {
+	http.Error(rw, "members of the cluster are configured by 'PEER_URLS' and cannot be changed at runtime", http.StatusConflict)
+}
+
+// RestoreSnapshot -- only followers can be restored, the leader is the source of their messages
+func (h *HttpHandler) RestoreSnapshot(rw http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	isLeader := h.leader != nil
+	h.mu.Unlock()
+
+	if isLeader {
+		http.Error(rw, "leader cannot be restored from snapshot", http.StatusConflict)
+		return
+	}
+
+	h.replica.RestoreSnapshot(rw, r)
+}
+
+func (h *HttpHandler) proxyToLeader(rw http.ResponseWriter, r *http.Request) {
+	_, _, leaderUrl := h.election.Status()
+	if leaderUrl == "" || leaderUrl == h.selfUrl || r.Header.Get(proxiedHeader) != "" {
+		logger.Warn("No leader is known at the moment, request is rejected", "path", r.URL.Path)
+		http.Error(rw, "leader is not elected yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	target, err := url.Parse(leaderUrl)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	correlationId := r.Header.Get(logging.CorrelationIdHeader)
+	if correlationId == "" {
+		correlationId = logging.NewCorrelationId()
+		r.Header.Set(logging.CorrelationIdHeader, correlationId)
+	}
+	logger.InfoContext(logging.WithCorrelationId(r.Context(), correlationId), "Proxying request to the leader", "path", r.URL.Path, "leader", leaderUrl)
+	r.Header.Set(proxiedHeader, h.selfUrl)
+	// credentials of the client are proxied as is
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.Transport = h.proxyTransport
+	proxy.ServeHTTP(rw, r)
+}
+
+func (h *HttpHandler) becomeLeader(term uint64) {
+	logger.Info("Became leader", "term", term)
+
+	// new leader should know about every message of the previous one before assigning new ids
+	h.pullMissingMessages()
+
+	// peers talk to each other over HTTP only, 'REPLICATION_TRANSPORT' is for primary-secondary deployments
+	peerTransport := transport.NewHttpTransport(transport.RequestTimeout(), auth.InternalCredentials())
+	executor := replication.NewExecutorWithTransport(h.topics, h.peerUrls, term, peerTransport, h.metrics)
+	// peer which rejects messages of this term follows a newer leader, so this node steps down
+	executor.OnStaleTerm(func(term uint64) { h.election.AcceptTerm(term) })
+	retention := storage.NewRetention(h.topics)
+	retention.OnApplied(executor.ReplicateRetention)
+	retention.Start()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.leader = primary.NewHttpHandler(h.storage, executor, h.appendTimeout, h.metrics)
+	h.retention = retention
+	// leader is not health-checked, reads with 'max_lag' are served from its own log
+	h.replica.SetLeader(true)
+}
+
+func (h *HttpHandler) becomeFollower(term uint64) {
+	logger.Info("Became follower", "term", term)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.replica.SetLeader(false)
+	if h.retention != nil {
+		h.retention.Close()
+		h.retention = nil
+	}
+	if h.leader != nil {
+		h.leader.Close()
+		h.leader = nil
+	}
+}
+
+// pullMissingMessages fetches messages of every topic which are present on peers but missing on this node
+func (h *HttpHandler) pullMissingMessages() {
+	for _, peerUrl := range h.peerUrls {
+		var topics []secondary.TopicPartitions
+		if err := h.getJson(peerUrl+"/api/v1/internal/topics", &topics); err != nil {
+			logger.Warn("Failed to fetch topics", "peer", peerUrl, "err", err)
+			continue
+		}
+
+		for _, topic := range topics {
+			for partition := 0; partition < topic.Partitions; partition++ {
+				messages, err := h.topics.GetOrCreatePartition(topic.Name, partition)
+				if err != nil {
+					logger.Warn("Partition of peer is skipped", "peer", peerUrl, "topic", topic.Name, "partition", partition, "err", err)
+					continue
+				}
+				h.pullMissingMessagesOfPartition(peerUrl, topic.Name, partition, messages)
+			}
+		}
+	}
+}
+
+func (h *HttpHandler) pullMissingMessagesOfPartition(peerUrl string, topic string, partition int, messages storage.Storage) {
+	for {
+		var batch []model.Message
+		query := url.Values{
+			"from":      {strconv.Itoa(int(messages.GetOffset()))},
+			"limit":     {"100"},
+			"topic":     {topic},
+			"partition": {strconv.Itoa(partition)},
+		}
+		if err := h.getJson(peerUrl+"/api/v1/internal/messages?"+query.Encode(), &batch); err != nil {
+			logger.Warn("Failed to fetch messages", "peer", peerUrl, "topic", topic, "partition", partition, "err", err)
+			return
+		}
+		if len(batch) == 0 {
+			return
+		}
+
+		logger.Info("Pulled messages", "first_id", batch[0].Id, "last_id", batch[len(batch)-1].Id, "peer", peerUrl, "topic", topic, "partition", partition)
+		for _, message := range batch {
+			messages.AddMessage(message)
+		}
+	}
+}
+
+func (h *HttpHandler) getJson(requestUrl string, response any) error {
+	resp, err := h.client.Get(requestUrl)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(response)
+}
+
+func (h *HttpHandler) close(ctx context.Context) {
+	h.election.Stop()
+
+	h.mu.Lock()
+	leader, retention := h.leader, h.retention
+	h.leader, h.retention = nil, nil
+	h.mu.Unlock()
+
+	if retention != nil {
+		retention.Close()
+	}
+	if leader != nil {
+		leader.Drain(ctx)
+		leader.Close()
+	}
+	h.topics.Close()
+}
+
+func createRouter(handler *HttpHandler, a *auth.Authenticator) *mux.Router {
+	r := mux.NewRouter()
+
+	// overrides restore of secondary API, routes are matched in order
+	r.HandleFunc("/api/v1/admin/restore", a.Admin(handler.RestoreSnapshot)).Methods(http.MethodPost)
+	secondary.RegisterRoutes(r, handler.replica, a)
+	r.HandleFunc("/api/v1/append", a.Client(handler.AppendMessage)).Methods(http.MethodPost)
+	r.HandleFunc("/api/v1/topics/{name}/append", a.Client(handler.onLeader((*primary.HttpHandler).AppendTopicMessage))).Methods(http.MethodPost)
+	r.HandleFunc("/api/v1/topics/{name}/partitions/{partition}/append", a.Client(handler.onLeader((*primary.HttpHandler).AppendPartitionMessage))).Methods(http.MethodPost)
+	r.HandleFunc("/api/v1/status", a.Client(handler.onLeader((*primary.HttpHandler).GetStatus))).Methods(http.MethodGet)
+	r.HandleFunc("/api/v1/admin/secondaries", a.Admin(handler.onLeader((*primary.HttpHandler).ListSecondaries))).Methods(http.MethodGet)
+	r.HandleFunc("/api/v1/admin/secondaries", a.Admin(handler.ChangeMembership)).Methods(http.MethodPost, http.MethodDelete)
+	r.HandleFunc("/api/v1/admin/topics", a.Admin(handler.onLeader((*primary.HttpHandler).ListTopics))).Methods(http.MethodGet)
+	r.HandleFunc("/api/v1/admin/topics", a.Admin(handler.onLeader((*primary.HttpHandler).CreateTopic))).Methods(http.MethodPost)
+	r.HandleFunc("/api/v1/admin/topics/{name}", a.Admin(handler.onLeader((*primary.HttpHandler).DeleteTopic))).Methods(http.MethodDelete)
+	r.HandleFunc("/api/v1/admin/divergence", a.Admin(handler.onLeader((*primary.HttpHandler).GetDivergence))).Methods(http.MethodGet)
+	r.HandleFunc("/api/v1/cluster/leader", a.Client(handler.election.HandleStatus)).Methods(http.MethodGet)
+	r.HandleFunc("/api/v1/cluster/status", a.Client(handler.GetClusterStatus)).Methods(http.MethodGet)
+	r.HandleFunc("/api/v1/internal/election/vote", a.Internal(handler.election.HandleVote)).Methods(http.MethodPost)
+	r.HandleFunc("/api/v1/internal/election/heartbeat", a.Internal(handler.election.HandleHeartbeat)).Methods(http.MethodPost)
+
+	return r
+}
+
+func NewClusterServer() *server.GracefulServer {
+	selfUrl, ok := os.LookupEnv("SELF_URL")
+	if !ok {
+		logging.Fatal(logger, "'SELF_URL' env var is not set")
+	}
+
+	var peerUrls []string
+	if peerUrlsToken, okPeers := os.LookupEnv("PEER_URLS"); okPeers && peerUrlsToken != "" {
+		peerUrls = strings.Split(peerUrlsToken, ",")
+	}
+
+	port, ok := os.LookupEnv("CLUSTER_SERVER_PORT")
+	if !ok {
+		port = "8080"
+	}
+
+	topics := storage.NewTopics()
+	handler := newHttpHandler(selfUrl, peerUrls, topics)
+
+	headersOk := handlers.AllowedHeaders([]string{"X-Requested-With", "Authorization", "Content-Type", logging.CorrelationIdHeader, primary.IdempotencyKeyHeader, auth.SignatureTimestampHeader})
+	originsOk := handlers.AllowedOrigins(auth.AllowedOrigins())
+	methodsOk := handlers.AllowedMethods([]string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete, http.MethodOptions})
+
+	srv := server.NewGracefulServer(&http.Server{
+		Handler:      handlers.CORS(originsOk, headersOk, methodsOk)(createRouter(handler, auth.NewAuthenticator())),
+		Addr:         "0.0.0.0:" + port,
+		TLSConfig:    auth.HttpServerTLSConfig(),
+		WriteTimeout: 15 * time.Second,
+		ReadTimeout:  15 * time.Second,
+	})
+
+	// streams are closed first, otherwise shutdown waits for them until timeout
+	srv.RegisterOnShutdown(handler.replica.CloseSubscriptions)
+	srv.RegisterOnDrain(func(ctx context.Context) {
+		handler.close(ctx)
+	})
+	handler.election.Start()
+
+	return srv
+}
@@ -0,0 +1,217 @@
+package cluster
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"replicated-log/internal/auth"
+	"replicated-log/internal/election"
+	"replicated-log/internal/primary"
+	"replicated-log/internal/storage"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testNode struct {
+	handler   *HttpHandler
+	server    *httptest.Server
+	isStopped bool
+}
+
+func (n *testNode) stop() {
+	if !n.isStopped {
+		n.isStopped = true
+		n.handler.election.Stop()
+		n.server.Close()
+	}
+}
+
+func startCluster(t *testing.T, size int) []*testNode {
+	t.Setenv("ELECTION_TIMEOUT_MILLISECONDS", "100")
+	t.Setenv("HEARTBEAT_PERIOD_MILLISECONDS", "20")
+	t.Setenv("HEALTHCHECK_PERIOD_MILLISECOND", "20")
+	t.Setenv("REQUEST_TIMEOUT_MILLISECONDS", "200")
+
+	nodes := make([]*testNode, size)
+	for i := range nodes {
+		nodes[i] = &testNode{server: httptest.NewUnstartedServer(nil)}
+	}
+
+	for i, node := range nodes {
+		var peerUrls []string
+		for j, peer := range nodes {
+			if i != j {
+				peerUrls = append(peerUrls, "http://"+peer.server.Listener.Addr().String())
+			}
+		}
+		selfUrl := "http://" + node.server.Listener.Addr().String()
+
+		node.handler = newHttpHandler(selfUrl, peerUrls, storage.NewTopicsWithDefault(storage.NewInMemoryStorage()))
+		node.server.Config.Handler = createRouter(node.handler, auth.NewAuthenticator())
+		node.server.Start()
+	}
+
+	for _, node := range nodes {
+		node.handler.election.Start()
+	}
+
+	t.Cleanup(func() {
+		for _, node := range nodes {
+			node.stop()
+		}
+	})
+
+	return nodes
+}
+
+func waitForLeader(t *testing.T, nodes []*testNode) *testNode {
+	var leader *testNode
+	require.Eventually(t, func() bool {
+		for _, node := range nodes {
+			node.handler.mu.Lock()
+			isReady := node.handler.leader != nil
+			node.handler.mu.Unlock()
+			if isReady {
+				leader = node
+				return true
+			}
+		}
+		return false
+	}, 5*time.Second, 10*time.Millisecond)
+
+	return leader
+}
+
+func appendMessage(t *testing.T, node *testNode, message string, w int) int {
+	b, _ := json.Marshal(primary.AppendMessageRequest{Message: message, W: w})
+	resp, err := http.Post(node.server.URL+"/api/v1/append", "application/json", strings.NewReader(string(b)))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestClusterElectsLeaderAndFollowersProxyAppends(t *testing.T) {
+	// GIVEN
+	nodes := startCluster(t, 3)
+	leader := waitForLeader(t, nodes)
+
+	var follower *testNode
+	for _, node := range nodes {
+		if node != leader {
+			follower = node
+		}
+	}
+
+	// WHEN
+	status := appendMessage(t, follower, "via follower", 3)
+
+	// THEN
+	require.Equal(t, http.StatusOK, status)
+	for _, node := range nodes {
+		require.Equal(t, []string{"via follower"}, node.handler.storage.GetMessages())
+	}
+
+	for _, node := range nodes {
+		_, state, leaderUrl := node.handler.election.Status()
+		if node == leader {
+			require.Equal(t, election.LEADER, state)
+		} else {
+			require.Equal(t, election.FOLLOWER, state)
+		}
+		require.Equal(t, "http://"+leader.server.Listener.Addr().String(), leaderUrl)
+	}
+}
+
+func TestLeaderServesReadsWithMaxLag(t *testing.T) {
+	// GIVEN
+	nodes := startCluster(t, 3)
+	leader := waitForLeader(t, nodes)
+	require.Equal(t, http.StatusOK, appendMessage(t, leader, "first", 3))
+
+	// WHEN
+	resp, err := http.Get(leader.server.URL + "/api/v1/messages?max_lag=0")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	// THEN
+	require.Equal(t, http.StatusOK, resp.StatusCode, "leader is never behind its own log")
+}
+
+func TestClusterFailsOverWhenLeaderDies(t *testing.T) {
+	// GIVEN
+	nodes := startCluster(t, 3)
+	oldLeader := waitForLeader(t, nodes)
+	require.Equal(t, http.StatusOK, appendMessage(t, oldLeader, "first", 3))
+	oldTerm, _, _ := oldLeader.handler.election.Status()
+
+	// WHEN
+	oldLeader.stop()
+
+	var alive []*testNode
+	for _, node := range nodes {
+		if node != oldLeader {
+			alive = append(alive, node)
+		}
+	}
+	newLeader := waitForLeader(t, alive)
+
+	// THEN
+	newTerm, _, _ := newLeader.handler.election.Status()
+	require.Greater(t, newTerm, oldTerm)
+
+	require.Equal(t, http.StatusOK, appendMessage(t, newLeader, "second", 2))
+	for _, node := range alive {
+		require.Equal(t, []string{"first", "second"}, node.handler.storage.GetMessages())
+	}
+
+	t.Run("Stale leader is fenced off", func(t *testing.T) {
+		require.False(t, newLeader.handler.election.AcceptTerm(oldTerm))
+	})
+}
+
+func TestFollowersProxyTopicAndAdminRequestsToLeader(t *testing.T) {
+	// GIVEN
+	nodes := startCluster(t, 3)
+	leader := waitForLeader(t, nodes)
+
+	var follower *testNode
+	for _, node := range nodes {
+		if node != leader {
+			follower = node
+		}
+	}
+
+	post := func(path string, request any) int {
+		b, _ := json.Marshal(request)
+		resp, err := http.Post(follower.server.URL+path, "application/json", strings.NewReader(string(b)))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// WHEN
+	created := post("/api/v1/admin/topics", primary.TopicRequest{Name: "orders", Partitions: 1})
+	appended := post("/api/v1/topics/orders/append", primary.AppendMessageRequest{Message: "via follower", W: 3})
+
+	// THEN
+	require.Equal(t, http.StatusCreated, created)
+	require.Equal(t, http.StatusOK, appended)
+	for _, node := range nodes {
+		messages, err := node.handler.topics.Partition("orders", 0)
+		require.NoError(t, err)
+		require.Equal(t, []string{"via follower"}, messages.GetMessages())
+	}
+
+	t.Run("Divergence is reported by the leader", func(t *testing.T) {
+		resp, err := http.Get(follower.server.URL + "/api/v1/admin/divergence")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+
+	t.Run("Members of the cluster cannot be changed at runtime", func(t *testing.T) {
+		require.Equal(t, http.StatusConflict, post("/api/v1/admin/secondaries", map[string]string{"url": "http://other"}))
+	})
+}
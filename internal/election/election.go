@@ -0,0 +1,540 @@
+package election
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"replicated-log/internal/auth"
+	"replicated-log/internal/logging"
+	"replicated-log/internal/model"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var logger = logging.Component("election")
+
+const (
+	FOLLOWER  = "FOLLOWER"
+	CANDIDATE = "CANDIDATE"
+	LEADER    = "LEADER"
+)
+
+type VoteRequest struct {
+	Term         uint64          `json:"term"`
+	CandidateUrl string          `json:"candidate_url"`
+	Offset       model.MessageId `json:"offset"`
+	LastLogTerm  uint64          `json:"last_log_term"`
+}
+
+type VoteResponse struct {
+	Term        uint64 `json:"term"`
+	VoteGranted bool   `json:"vote_granted"`
+}
+
+type HeartbeatRequest struct {
+	Term      uint64 `json:"term"`
+	LeaderUrl string `json:"leader_url"`
+}
+
+type HeartbeatResponse struct {
+	Term    uint64 `json:"term"`
+	Success bool   `json:"success"`
+}
+
+type StatusResponse struct {
+	Term      uint64 `json:"term"`
+	State     string `json:"state"`
+	LeaderUrl string `json:"leader_url"`
+}
+
+// persistentState -- part of state which must survive restarts, otherwise node can vote twice in one term
+type persistentState struct {
+	Term     uint64 `json:"term"`
+	VotedFor string `json:"voted_for"`
+	// term of the leader which has written the end of the log, stored messages don't keep their term
+	LastLogTerm uint64 `json:"last_log_term"`
+}
+
+// transition -- change of leadership of this node, delivered to listener in order
+type transition struct {
+	isLeader bool
+	term     uint64
+}
+
+// Election -- Raft-style leader election over HTTP.
+// Leader sends heartbeats to all peers, follower which has not heard from leader during election timeout
+// becomes candidate and asks peers for votes. Leader which has not heard from a majority during election timeout
+// steps down (check-quorum of Raft), so a partitioned leader stops accepting appends. Vote is granted only to candidates whose log is at least as
+// complete as voter's one: log which ends in a newer term wins, logs of the same term are compared by offset.
+type Election struct {
+	mu       *sync.Mutex
+	selfUrl  string
+	peerUrls []string
+	client   http.Client
+	// persistent state
+	term        uint64
+	votedFor    string
+	lastLogTerm uint64
+	statePath   string
+	// volatile state
+	state         string
+	leaderUrl     string
+	lastHeartbeat time.Time
+	timeout       time.Duration
+	// when every peer has last answered heartbeat of this leader
+	lastPeerAcks map[string]time.Time
+	// config
+	minElectionTimeout time.Duration
+	heartbeatPeriod    time.Duration
+	// log completeness of this node
+	offset func() model.MessageId
+	// leadership listener. Transitions are queued under lock and delivered by a background goroutine,
+	// so slow listener or listener which calls back into election never blocks votes and heartbeats.
+	transitions []transition
+	// wakes up delivery of queued transitions
+	transitionsQueued chan struct{}
+	onLeader          func(term uint64)
+	onFollower        func(term uint64)
+	quit              chan struct{}
+}
+
+func NewElection(selfUrl string, peerUrls []string, offset func() model.MessageId) *Election {
+	requestTimeout := 50 * time.Millisecond // default value
+	if requestTimeoutToken, okTimeout := os.LookupEnv("REQUEST_TIMEOUT_MILLISECONDS"); okTimeout {
+		value, _ := strconv.Atoi(requestTimeoutToken)
+		requestTimeout = time.Duration(value) * time.Millisecond
+	}
+
+	minElectionTimeout := 1500 * time.Millisecond // default value
+	if timeoutToken, okElectionTimeout := os.LookupEnv("ELECTION_TIMEOUT_MILLISECONDS"); okElectionTimeout {
+		value, _ := strconv.Atoi(timeoutToken)
+		minElectionTimeout = time.Duration(value) * time.Millisecond
+	}
+
+	heartbeatPeriod := 300 * time.Millisecond // default value
+	if periodToken, okPeriod := os.LookupEnv("HEARTBEAT_PERIOD_MILLISECONDS"); okPeriod {
+		value, _ := strconv.Atoi(periodToken)
+		heartbeatPeriod = time.Duration(value) * time.Millisecond
+	}
+
+	e := &Election{
+		mu:                 &sync.Mutex{},
+		selfUrl:            selfUrl,
+		peerUrls:           peerUrls,
+		client:             auth.InternalCredentials().NewHttpClient(requestTimeout),
+		statePath:          os.Getenv("ELECTION_STATE_PATH"),
+		state:              FOLLOWER,
+		lastHeartbeat:      time.Now(),
+		lastPeerAcks:       map[string]time.Time{},
+		minElectionTimeout: minElectionTimeout,
+		heartbeatPeriod:    heartbeatPeriod,
+		offset:             offset,
+		transitionsQueued:  make(chan struct{}, 1),
+		onLeader:           func(uint64) {},
+		onFollower:         func(uint64) {},
+		quit:               make(chan struct{}),
+	}
+	e.timeout = e.randomElectionTimeout()
+	e.loadState()
+
+	return e
+}
+
+// OnLeadershipChange registers callbacks called when this node becomes leader or loses leadership.
+// Callbacks are called one by one in order of transitions from a single background goroutine.
+func (e *Election) OnLeadershipChange(onLeader func(term uint64), onFollower func(term uint64)) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.onLeader = onLeader
+	e.onFollower = onFollower
+}
+
+func (e *Election) Start() {
+	logger.Info("START election background thread", "self", e.selfUrl, "peers", e.peerUrls)
+
+	go func() {
+		for {
+			select {
+			case <-e.transitionsQueued:
+				e.mu.Lock()
+				transitions := e.transitions
+				e.transitions = nil
+				onLeader, onFollower := e.onLeader, e.onFollower
+				e.mu.Unlock()
+
+				for _, t := range transitions {
+					if t.isLeader {
+						onLeader(t.term)
+					} else {
+						onFollower(t.term)
+					}
+				}
+			case <-e.quit:
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(e.heartbeatPeriod)
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				e.tick()
+			case <-e.quit:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+}
+
+func (e *Election) Stop() {
+	logger.Info("FINISH election background thread")
+	close(e.quit)
+}
+
+// Status returns current term, state of this node and known leader url (empty if unknown)
+func (e *Election) Status() (uint64, string, string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.term, e.state, e.leaderUrl
+}
+
+// AcceptTerm is called on every replicated message. Returns false if message comes from stale leader.
+func (e *Election) AcceptTerm(term uint64) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if term < e.term {
+		return false
+	}
+	if term > e.term {
+		e.becomeFollower(term, "")
+	}
+	e.lastHeartbeat = time.Now()
+
+	return true
+}
+
+// ObserveLogTerm is called when messages replicated by the leader of the given term are stored to the log
+func (e *Election) ObserveLogTerm(term uint64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if term > e.lastLogTerm {
+		e.lastLogTerm = term
+		e.saveState()
+	}
+}
+
+func (e *Election) tick() {
+	e.mu.Lock()
+	state := e.state
+	isTimeout := time.Since(e.lastHeartbeat) > e.timeout
+	e.mu.Unlock()
+
+	if state == LEADER {
+		if !e.checkQuorum() {
+			return
+		}
+		e.sendHeartbeats()
+	} else if isTimeout {
+		e.startElection()
+	}
+}
+
+func (e *Election) startElection() {
+	e.mu.Lock()
+	e.term++
+	e.state = CANDIDATE
+	e.votedFor = e.selfUrl
+	e.leaderUrl = ""
+	e.lastHeartbeat = time.Now()
+	e.timeout = e.randomElectionTimeout()
+	e.saveState()
+	request := VoteRequest{Term: e.term, CandidateUrl: e.selfUrl, Offset: e.offset(), LastLogTerm: e.lastLogTerm}
+	e.mu.Unlock()
+
+	logger.Info("Start election", "term", request.Term)
+
+	votes := make(chan VoteResponse, len(e.peerUrls))
+	for _, peerUrl := range e.peerUrls {
+		go func(peerUrl string) {
+			var response VoteResponse
+			if err := e.post(peerUrl+"/api/v1/internal/election/vote", request, &response); err != nil {
+				logger.Warn("Failed to request vote", "peer", peerUrl, "err", err)
+			}
+			votes <- response
+		}(peerUrl)
+	}
+
+	granted := 1 // vote for itself
+	majority := (len(e.peerUrls)+1)/2 + 1
+	for range e.peerUrls {
+		response := <-votes
+
+		e.mu.Lock()
+		if response.Term > e.term {
+			e.becomeFollower(response.Term, "")
+		}
+		if e.state != CANDIDATE || e.term != request.Term {
+			// somebody else has already won or newer election is started
+			e.mu.Unlock()
+			return
+		}
+		e.mu.Unlock()
+
+		if response.VoteGranted {
+			granted++
+		}
+		if granted >= majority {
+			break
+		}
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if granted < majority || e.state != CANDIDATE || e.term != request.Term {
+		logger.Info("Lost election", "term", request.Term, "votes", granted)
+		return
+	}
+
+	logger.Info("Won election", "term", e.term, "votes", granted)
+	e.state = LEADER
+	e.leaderUrl = e.selfUrl
+	// peers have just answered votes, they get the whole election timeout to answer heartbeats
+	for _, peerUrl := range e.peerUrls {
+		e.lastPeerAcks[peerUrl] = time.Now()
+	}
+	// like no-op entry of Raft, log of the new leader ends in its term
+	e.lastLogTerm = e.term
+	e.saveState()
+	e.queueTransition(transition{isLeader: true, term: e.term})
+	go e.sendHeartbeats()
+}
+
+// checkQuorum steps down if less than a majority of nodes (including this one) has answered heartbeats
+// during the minimal election timeout, by then followers of the majority may have elected another leader
+func (e *Election) checkQuorum() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.state != LEADER {
+		return false
+	}
+	alive := 1 // itself
+	for _, peerUrl := range e.peerUrls {
+		if time.Since(e.lastPeerAcks[peerUrl]) <= e.minElectionTimeout {
+			alive++
+		}
+	}
+	if majority := (len(e.peerUrls)+1)/2 + 1; alive < majority {
+		logger.Warn("Majority has not answered heartbeats, step down", "term", e.term, "alive", alive, "majority", majority)
+		e.becomeFollower(e.term, "")
+		return false
+	}
+	return true
+}
+
+func (e *Election) sendHeartbeats() {
+	e.mu.Lock()
+	request := HeartbeatRequest{Term: e.term, LeaderUrl: e.selfUrl}
+	e.mu.Unlock()
+
+	for _, peerUrl := range e.peerUrls {
+		go func(peerUrl string) {
+			var response HeartbeatResponse
+			if err := e.post(peerUrl+"/api/v1/internal/election/heartbeat", request, &response); err != nil {
+				return // peer is unavailable, it will catch up after recovery
+			}
+
+			e.mu.Lock()
+			defer e.mu.Unlock()
+			if response.Term > e.term {
+				logger.Info("Peer has newer term, step down", "peer", peerUrl, "term", response.Term)
+				e.becomeFollower(response.Term, "")
+			} else if response.Success && response.Term == request.Term {
+				e.lastPeerAcks[peerUrl] = time.Now()
+			}
+		}(peerUrl)
+	}
+}
+
+// becomeFollower should be called under lock
+func (e *Election) becomeFollower(term uint64, leaderUrl string) {
+	wasLeader := e.state == LEADER
+
+	if term > e.term {
+		e.term = term
+		e.votedFor = ""
+		e.saveState()
+	}
+	e.state = FOLLOWER
+	e.leaderUrl = leaderUrl
+	e.lastHeartbeat = time.Now()
+
+	if wasLeader {
+		logger.Info("Lost leadership", "term", e.term)
+		e.queueTransition(transition{isLeader: false, term: e.term})
+	}
+}
+
+// queueTransition should be called under lock, it never blocks
+func (e *Election) queueTransition(t transition) {
+	e.transitions = append(e.transitions, t)
+	select {
+	case e.transitionsQueued <- struct{}{}:
+	default: // delivery is already pending, it takes all queued transitions
+	}
+}
+
+func (e *Election) HandleVote(rw http.ResponseWriter, r *http.Request) {
+	var request VoteRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	e.mu.Lock()
+	if request.Term > e.term {
+		e.becomeFollower(request.Term, "")
+	}
+
+	isLogComplete := request.LastLogTerm > e.lastLogTerm ||
+		(request.LastLogTerm == e.lastLogTerm && request.Offset >= e.offset())
+	canVote := e.votedFor == "" || e.votedFor == request.CandidateUrl
+	response := VoteResponse{Term: e.term, VoteGranted: false}
+
+	if request.Term == e.term && canVote && isLogComplete {
+		e.votedFor = request.CandidateUrl
+		e.lastHeartbeat = time.Now()
+		e.saveState()
+		response.VoteGranted = true
+	}
+	e.mu.Unlock()
+
+	logger.Info("Vote is requested", "candidate", request.CandidateUrl, "term", request.Term, "granted", response.VoteGranted)
+	writeJson(rw, response)
+}
+
+func (e *Election) HandleHeartbeat(rw http.ResponseWriter, r *http.Request) {
+	var request HeartbeatRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	e.mu.Lock()
+	response := HeartbeatResponse{Term: e.term, Success: false}
+	if request.Term >= e.term {
+		if request.Term > e.term || e.state != FOLLOWER || e.leaderUrl != request.LeaderUrl {
+			logger.Info("New leader is discovered", "leader", request.LeaderUrl, "term", request.Term)
+		}
+		e.becomeFollower(request.Term, request.LeaderUrl)
+		response = HeartbeatResponse{Term: e.term, Success: true}
+	}
+	e.mu.Unlock()
+
+	writeJson(rw, response)
+}
+
+func (e *Election) HandleStatus(rw http.ResponseWriter, _ *http.Request) {
+	term, state, leaderUrl := e.Status()
+	writeJson(rw, StatusResponse{Term: term, State: state, LeaderUrl: leaderUrl})
+}
+
+func (e *Election) randomElectionTimeout() time.Duration {
+	// random timeout in [min, 2*min) to avoid split votes
+	return e.minElectionTimeout + time.Duration(rand.Int63n(int64(e.minElectionTimeout)))
+}
+
+func (e *Election) post(url string, request interface{}, response interface{}) error {
+	payload, _ := json.Marshal(request)
+	resp, err := e.client.Post(url, "application/json", strings.NewReader(string(payload)))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(response)
+}
+
+func (e *Election) loadState() {
+	if e.statePath == "" {
+		return
+	}
+
+	payload, err := os.ReadFile(e.statePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	} else if err != nil {
+		logging.Fatal(logger, "Failed to read state", "path", e.statePath, "err", err)
+	}
+
+	var state persistentState
+	if err = json.Unmarshal(payload, &state); err != nil {
+		logging.Fatal(logger, "State file is corrupted", "path", e.statePath, "err", err)
+	}
+
+	e.term = state.Term
+	e.votedFor = state.VotedFor
+	e.lastLogTerm = state.LastLogTerm
+	logger.Info("Restored term", "term", e.term, "last_log_term", e.lastLogTerm)
+}
+
+// saveState should be called under lock. State is fsynced before it is used in replies, so vote survives a crash.
+func (e *Election) saveState() {
+	if e.statePath == "" {
+		return
+	}
+
+	payload, _ := json.Marshal(persistentState{Term: e.term, VotedFor: e.votedFor, LastLogTerm: e.lastLogTerm})
+	tmpPath := e.statePath + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		logging.Fatal(logger, "Failed to save state", "path", tmpPath, "err", err)
+	}
+	if _, err = file.Write(payload); err != nil {
+		logging.Fatal(logger, "Failed to save state", "path", tmpPath, "err", err)
+	}
+	if err = file.Sync(); err != nil {
+		logging.Fatal(logger, "Failed to fsync state", "path", tmpPath, "err", err)
+	}
+	if err = file.Close(); err != nil {
+		logging.Fatal(logger, "Failed to save state", "path", tmpPath, "err", err)
+	}
+	if err = os.Rename(tmpPath, e.statePath); err != nil {
+		logging.Fatal(logger, "Failed to save state", "path", e.statePath, "err", err)
+	}
+
+	// rename is durable only after its directory is fsynced
+	dir, err := os.Open(filepath.Dir(e.statePath))
+	if err != nil {
+		logging.Fatal(logger, "Failed to open state dir", "path", e.statePath, "err", err)
+	}
+	defer dir.Close()
+	if err = dir.Sync(); err != nil {
+		logging.Fatal(logger, "Failed to fsync state dir", "path", e.statePath, "err", err)
+	}
+}
+
+func writeJson(rw http.ResponseWriter, response interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	rawResponse, _ := json.Marshal(response)
+	_, _ = rw.Write(rawResponse)
+}
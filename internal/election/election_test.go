@@ -0,0 +1,230 @@
+package election
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"replicated-log/internal/model"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func vote(t *testing.T, e *Election, request VoteRequest) VoteResponse {
+	b, _ := json.Marshal(request)
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/internal/election/vote", strings.NewReader(string(b)))
+	resp := httptest.NewRecorder()
+
+	e.HandleVote(resp, req)
+
+	require.Equal(t, http.StatusOK, resp.Code)
+	var response VoteResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&response))
+	return response
+}
+
+func TestVoteIsGrantedOncePerTerm(t *testing.T) {
+	// GIVEN
+	e := NewElection("http://self", []string{"http://a", "http://b"}, func() model.MessageId { return 0 })
+
+	// WHEN
+	first := vote(t, e, VoteRequest{Term: 1, CandidateUrl: "http://a"})
+	second := vote(t, e, VoteRequest{Term: 1, CandidateUrl: "http://b"})
+	repeated := vote(t, e, VoteRequest{Term: 1, CandidateUrl: "http://a"})
+
+	// THEN
+	require.True(t, first.VoteGranted)
+	require.False(t, second.VoteGranted)
+	require.True(t, repeated.VoteGranted)
+}
+
+func TestVoteIsNotGrantedToCandidateWithIncompleteLog(t *testing.T) {
+	// GIVEN
+	e := NewElection("http://self", []string{"http://a"}, func() model.MessageId { return 10 })
+
+	// WHEN
+	response := vote(t, e, VoteRequest{Term: 1, CandidateUrl: "http://a", Offset: 5})
+
+	// THEN
+	require.False(t, response.VoteGranted)
+	require.Equal(t, uint64(1), response.Term)
+}
+
+func TestVoteComparesLastLogTermBeforeOffset(t *testing.T) {
+	// GIVEN
+	e := NewElection("http://self", []string{"http://a", "http://b"}, func() model.MessageId { return 10 })
+	e.ObserveLogTerm(3)
+
+	// WHEN
+	longerButOlder := vote(t, e, VoteRequest{Term: 4, CandidateUrl: "http://a", Offset: 20, LastLogTerm: 2})
+	shorterButNewer := vote(t, e, VoteRequest{Term: 5, CandidateUrl: "http://b", Offset: 5, LastLogTerm: 4})
+
+	// THEN
+	require.False(t, longerButOlder.VoteGranted, "log of the candidate ends in older term")
+	require.True(t, shorterButNewer.VoteGranted, "log of the candidate ends in newer term")
+}
+
+func TestVoteIsNotGrantedForStaleTerm(t *testing.T) {
+	// GIVEN
+	e := NewElection("http://self", []string{"http://a"}, func() model.MessageId { return 0 })
+	require.True(t, e.AcceptTerm(5))
+
+	// WHEN
+	response := vote(t, e, VoteRequest{Term: 4, CandidateUrl: "http://a"})
+
+	// THEN
+	require.False(t, response.VoteGranted)
+	require.Equal(t, uint64(5), response.Term)
+}
+
+func TestAcceptTermFencesOffStaleLeaders(t *testing.T) {
+	// GIVEN
+	e := NewElection("http://self", []string{"http://a"}, func() model.MessageId { return 0 })
+
+	// WHEN
+	newer := e.AcceptTerm(3)
+	stale := e.AcceptTerm(2)
+
+	// THEN
+	require.True(t, newer)
+	require.False(t, stale)
+}
+
+func TestSingleNodeBecomesLeader(t *testing.T) {
+	// GIVEN
+	t.Setenv("ELECTION_TIMEOUT_MILLISECONDS", "20")
+	t.Setenv("HEARTBEAT_PERIOD_MILLISECONDS", "10")
+	e := NewElection("http://self", nil, func() model.MessageId { return 0 })
+
+	becameLeader := make(chan uint64, 1)
+	e.OnLeadershipChange(func(term uint64) { becameLeader <- term }, func(uint64) {})
+
+	// WHEN
+	e.Start()
+	defer e.Stop()
+
+	// THEN
+	select {
+	case term := <-becameLeader:
+		require.Equal(t, uint64(1), term)
+	case <-time.After(time.Second):
+		t.Fatal("Node is expected to become a leader")
+	}
+	_, state, leaderUrl := e.Status()
+	require.Equal(t, LEADER, state)
+	require.Equal(t, "http://self", leaderUrl)
+}
+
+func TestLeaderStepsDownOnHeartbeatFromNewerTerm(t *testing.T) {
+	// GIVEN
+	t.Setenv("ELECTION_TIMEOUT_MILLISECONDS", "20")
+	t.Setenv("HEARTBEAT_PERIOD_MILLISECONDS", "10")
+	e := NewElection("http://self", nil, func() model.MessageId { return 0 })
+
+	becameLeader := make(chan uint64, 1)
+	becameFollower := make(chan uint64, 1)
+	e.OnLeadershipChange(func(term uint64) { becameLeader <- term }, func(term uint64) { becameFollower <- term })
+	e.Start()
+	defer e.Stop()
+	<-becameLeader
+
+	// WHEN
+	b, _ := json.Marshal(HeartbeatRequest{Term: 100, LeaderUrl: "http://other"})
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/internal/election/heartbeat", strings.NewReader(string(b)))
+	resp := httptest.NewRecorder()
+	e.HandleHeartbeat(resp, req)
+
+	// THEN
+	require.Equal(t, uint64(100), <-becameFollower)
+}
+
+func TestLeaderStepsDownWhenMajorityDoesNotAnswer(t *testing.T) {
+	// GIVEN
+	t.Setenv("ELECTION_TIMEOUT_MILLISECONDS", "20")
+	t.Setenv("HEARTBEAT_PERIOD_MILLISECONDS", "10")
+	var isPartitioned atomic.Bool
+	peer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if isPartitioned.Load() {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var request VoteRequest // heartbeat has the same term field
+		_ = json.NewDecoder(r.Body).Decode(&request)
+		b, _ := json.Marshal(map[string]any{"term": request.Term, "vote_granted": true, "success": true})
+		_, _ = rw.Write(b)
+	}))
+	defer peer.Close()
+	e := NewElection("http://self", []string{peer.URL, "http://unreachable.invalid"}, func() model.MessageId { return 0 })
+
+	becameLeader := make(chan uint64, 1)
+	becameFollower := make(chan uint64, 1)
+	e.OnLeadershipChange(func(term uint64) { becameLeader <- term }, func(term uint64) { becameFollower <- term })
+	e.Start()
+	defer e.Stop()
+	term := <-becameLeader
+	time.Sleep(100 * time.Millisecond)
+	_, state, _ := e.Status()
+	require.Equal(t, LEADER, state, "leader stays while majority answers heartbeats")
+
+	// WHEN
+	isPartitioned.Store(true)
+
+	// THEN
+	select {
+	case steppedDownTerm := <-becameFollower:
+		require.Equal(t, term, steppedDownTerm)
+	case <-time.After(time.Second):
+		t.Fatal("Leader is expected to step down")
+	}
+}
+
+func TestSlowLeadershipListenerDoesNotBlockElection(t *testing.T) {
+	// GIVEN
+	t.Setenv("ELECTION_TIMEOUT_MILLISECONDS", "20")
+	t.Setenv("HEARTBEAT_PERIOD_MILLISECONDS", "10")
+	e := NewElection("http://self", nil, func() model.MessageId { return 0 })
+
+	isLeaderCalled := make(chan struct{})
+	release := make(chan struct{})
+	becameFollower := make(chan uint64, 1)
+	e.OnLeadershipChange(func(uint64) {
+		_, _, _ = e.Status() // listener calls back into election
+		close(isLeaderCalled)
+		<-release
+	}, func(term uint64) { becameFollower <- term })
+	e.Start()
+	defer e.Stop()
+	<-isLeaderCalled
+
+	// WHEN
+	b, _ := json.Marshal(HeartbeatRequest{Term: 100, LeaderUrl: "http://other"})
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/internal/election/heartbeat", strings.NewReader(string(b)))
+	e.HandleHeartbeat(httptest.NewRecorder(), req)
+	response := vote(t, e, VoteRequest{Term: 101, CandidateUrl: "http://other", LastLogTerm: 100})
+
+	// THEN
+	require.True(t, response.VoteGranted, "node answers while listener is busy")
+	close(release)
+	require.Equal(t, uint64(100), <-becameFollower)
+}
+
+func TestTermAndVoteSurviveRestart(t *testing.T) {
+	// GIVEN
+	t.Setenv("ELECTION_STATE_PATH", filepath.Join(t.TempDir(), "election.json"))
+	e := NewElection("http://self", []string{"http://a", "http://b"}, func() model.MessageId { return 0 })
+	require.True(t, vote(t, e, VoteRequest{Term: 7, CandidateUrl: "http://a"}).VoteGranted)
+	e.ObserveLogTerm(7)
+
+	// WHEN
+	restarted := NewElection("http://self", []string{"http://a", "http://b"}, func() model.MessageId { return 0 })
+
+	// THEN
+	term, _, _ := restarted.Status()
+	require.Equal(t, uint64(7), term)
+	require.False(t, vote(t, restarted, VoteRequest{Term: 7, CandidateUrl: "http://b"}).VoteGranted)
+	require.False(t, vote(t, restarted, VoteRequest{Term: 8, CandidateUrl: "http://b", LastLogTerm: 6}).VoteGranted,
+		"last log term survives restart")
+}
@@ -1,51 +1,141 @@
 package healthcheck
 
 import (
-	"log"
-	"net/http"
+	"context"
 	"os"
+	"replicated-log/internal/logging"
+	"replicated-log/internal/model"
+	"replicated-log/internal/transport"
 	"strconv"
 	"sync"
 	"time"
 )
 
+var logger = logging.Component("health-check")
+
 const (
-	ALIVE = "ALIVE"
-	DEAD  = "DEAD"
+	ALIVE     = "ALIVE"
+	SUSPECTED = "SUSPECTED" // recent health checks failed, but secondary is not considered dead yet
+	DEAD      = "DEAD"
 )
 
+// Transition -- change of secondary health status
+type Transition struct {
+	Url  string
+	From string // empty for the first health check of the secondary
+	To   string
+	At   time.Time
+}
+
+// SecondaryHealth -- snapshot of what daemon knows about the secondary
+type SecondaryHealth struct {
+	Url    string
+	Status string
+	// time of the last successful health check, zero if secondary has never been seen
+	LastSeen time.Time
+	// round-trip time of the last successful health check
+	RTT                 time.Duration
+	ConsecutiveFailures int
+	// used to decide when DEAD secondary is ALIVE again
+	consecutiveSuccesses int
+	// offset of the secondary and offset of the primary reported by the last successful health check
+	offset        *model.MessageId
+	primaryOffset *model.MessageId
+}
+
 type MonitoringDaemon struct {
 	mu                *sync.Mutex
 	secondaryUrls     []string
-	secondaryStatuses map[string]string
-	client            http.Client
+	secondaryStatuses map[string]*SecondaryHealth
+	transport         transport.Transport
 	quit              chan struct{}
+	// failure detector config
+	deadAfterFailures   int
+	aliveAfterSuccesses int
+	// transitions are delivered to listeners in order by a separate goroutine
+	listeners   []func(transition Transition)
+	transitions chan Transition
+	// called when secondary is missing messages it should have received already
+	behindListeners []func(url string)
+	quorumPolicy    quorumPolicy
+	// optional, offset of the primary reported to secondaries
+	offsetSource func() model.MessageId
 }
 
+// NewMonitoringDaemon creates daemon which checks secondaries over transport from 'REPLICATION_TRANSPORT' env var
 func NewMonitoringDaemon(urls []string) *MonitoringDaemon {
-	requestTimeout := 50 * time.Millisecond // default value
-	if requestTimeoutToken, okTimeout := os.LookupEnv("REQUEST_TIMEOUT_MILLISECONDS"); okTimeout {
-		value, _ := strconv.Atoi(requestTimeoutToken)
-		requestTimeout = time.Duration(value) * time.Millisecond
+	return NewMonitoringDaemonWithTransport(urls, transport.NewTransport())
+}
+
+// NewMonitoringDaemonWithTransport creates daemon which checks secondaries over the given transport
+func NewMonitoringDaemonWithTransport(urls []string, t transport.Transport) *MonitoringDaemon {
+	deadAfterFailures := 3 // default value
+	if failuresToken, okFailures := os.LookupEnv("HEALTHCHECK_DEAD_AFTER_FAILURES"); okFailures {
+		deadAfterFailures, _ = strconv.Atoi(failuresToken)
+	}
+
+	aliveAfterSuccesses := 1 // default value
+	if successesToken, okSuccesses := os.LookupEnv("HEALTHCHECK_ALIVE_AFTER_SUCCESSES"); okSuccesses {
+		aliveAfterSuccesses, _ = strconv.Atoi(successesToken)
 	}
 
 	daemon := MonitoringDaemon{
-		mu:                &sync.Mutex{},
-		secondaryUrls:     urls,
-		secondaryStatuses: make(map[string]string),
-		client: http.Client{
-			Timeout: requestTimeout,
-		},
-		quit: make(chan struct{}, 1),
+		mu:                  &sync.Mutex{},
+		secondaryUrls:       append([]string{}, urls...),
+		secondaryStatuses:   make(map[string]*SecondaryHealth),
+		transport:           t,
+		quit:                make(chan struct{}, 1),
+		deadAfterFailures:   deadAfterFailures,
+		aliveAfterSuccesses: aliveAfterSuccesses,
+		transitions:         make(chan Transition, 64),
+		quorumPolicy:        quorumPolicyFromEnv(),
 	}
 
+	go daemon.dispatchTransitions()
 	daemon.doHealthCheck(true)
 
 	return &daemon
 }
 
+// Subscribe registers listener which is called on every health status transition.
+// Listeners are called one by one in order of transitions, so they should not block.
+func (daemon *MonitoringDaemon) Subscribe(listener func(transition Transition)) {
+	daemon.mu.Lock()
+	defer daemon.mu.Unlock()
+
+	daemon.listeners = append(daemon.listeners, listener)
+}
+
+// SubscribeOnRecovery registers listener which is called (in a separate goroutine) on every DEAD -> ALIVE and
+// SUSPECTED -> ALIVE transition, secondary could have restarted while its health checks were failing
+func (daemon *MonitoringDaemon) SubscribeOnRecovery(listener func(url string)) {
+	daemon.Subscribe(func(transition Transition) {
+		if (transition.From == DEAD || transition.From == SUSPECTED) && transition.To == ALIVE {
+			go listener(transition.Url)
+		}
+	})
+}
+
+// SubscribeOnFallingBehind registers listener which is called (in a separate goroutine) when secondary reports offset
+// which is smaller than its previous one (e.g. it has restarted with empty log) or than offset of the primary
+// reported by the previous health check, i.e. live replication hasn't delivered messages for a whole period
+func (daemon *MonitoringDaemon) SubscribeOnFallingBehind(listener func(url string)) {
+	daemon.mu.Lock()
+	defer daemon.mu.Unlock()
+
+	daemon.behindListeners = append(daemon.behindListeners, listener)
+}
+
+// ReportOffset makes every health check carry offset of the primary
+func (daemon *MonitoringDaemon) ReportOffset(offsetSource func() model.MessageId) {
+	daemon.mu.Lock()
+	defer daemon.mu.Unlock()
+
+	daemon.offsetSource = offsetSource
+}
+
 func (daemon *MonitoringDaemon) StartHealthCheck() {
-	log.Printf("[HEALTH-CHECK] START health check background thread")
+	logger.Info("START health check background thread")
 
 	period := 500 * time.Millisecond // default value
 	if periodToken, okTimeout := os.LookupEnv("HEALTHCHECK_PERIOD_MILLISECOND"); okTimeout {
@@ -68,14 +158,18 @@ func (daemon *MonitoringDaemon) StartHealthCheck() {
 }
 
 func (daemon *MonitoringDaemon) StopHealthCheck() {
-	log.Printf("[HEALTH-CHECK] FINISH health check background thread")
+	logger.Info("FINISH health check background thread")
 	close(daemon.quit)
 }
 
 func (daemon *MonitoringDaemon) doHealthCheck(isInit bool) {
-	log.Printf("[HEALTH-CHECK] Run periodic health check...")
+	logger.Debug("Run periodic health check")
 
-	for _, url := range daemon.secondaryUrls {
+	daemon.mu.Lock()
+	secondaryUrls := append([]string{}, daemon.secondaryUrls...)
+	daemon.mu.Unlock()
+
+	for _, url := range secondaryUrls {
 		if isInit {
 			// first time let's do blocking
 			// in order to collect initial state of system
@@ -87,45 +181,196 @@ func (daemon *MonitoringDaemon) doHealthCheck(isInit bool) {
 }
 
 func (daemon *MonitoringDaemon) checkHealth(secondaryUrl string) {
-	resp, err := daemon.client.Get(secondaryUrl + "/api/v1/healthcheck")
+	var primaryOffset *model.MessageId
+	daemon.mu.Lock()
+	if daemon.offsetSource != nil {
+		offset := daemon.offsetSource()
+		primaryOffset = &offset
+	}
+	daemon.mu.Unlock()
+
+	startedAt := time.Now()
+	secondaryOffset, err := daemon.transport.HealthCheck(context.Background(), secondaryUrl, primaryOffset)
+	rtt := time.Since(startedAt)
+	isSuccess := err == nil
 
 	daemon.mu.Lock()
-	defer daemon.mu.Unlock()
-	if err != nil || resp.StatusCode != 200 {
-		daemon.secondaryStatuses[secondaryUrl] = DEAD
+	health, ok := daemon.secondaryStatuses[secondaryUrl]
+	if !ok {
+		if !daemon.isMonitored(secondaryUrl) {
+			daemon.mu.Unlock()
+			return // secondary has been removed during the check
+		}
+		health = &SecondaryHealth{Url: secondaryUrl}
+		daemon.secondaryStatuses[secondaryUrl] = health
+	}
+
+	previousStatus := health.Status
+	var isBehind bool
+	if isSuccess {
+		health.LastSeen = time.Now()
+		health.RTT = rtt
+		health.ConsecutiveFailures = 0
+		health.consecutiveSuccesses++
+		isBehind = isFallingBehind(*health, secondaryOffset)
+		health.offset, health.primaryOffset = secondaryOffset, primaryOffset
 	} else {
-		daemon.secondaryStatuses[secondaryUrl] = ALIVE
+		health.ConsecutiveFailures++
+		health.consecutiveSuccesses = 0
+	}
+	health.Status = daemon.nextStatus(*health)
+	status := health.Status
+	var behindListeners []func(url string)
+	if isBehind {
+		behindListeners = append(behindListeners, daemon.behindListeners...)
 	}
+	daemon.mu.Unlock()
 
-	log.Printf("[HEALTH-CHECK] %s status: %s", secondaryUrl, daemon.secondaryStatuses[secondaryUrl])
+	if isBehind {
+		logger.Info("Secondary is falling behind", "secondary", secondaryUrl, "offset", *secondaryOffset)
+		for _, listener := range behindListeners {
+			go listener(secondaryUrl)
+		}
+	}
+
+	logger.Debug("Health status is checked", "secondary", secondaryUrl, "status", status, "rtt", rtt)
+
+	if previousStatus != status {
+		logger.Info("Health status is changed", "secondary", secondaryUrl, "from", previousStatus, "to", status)
+		daemon.publish(Transition{Url: secondaryUrl, From: previousStatus, To: status, At: time.Now()})
+	}
+}
+
+// isFallingBehind compares offset of the secondary with offsets reported by the previous health check
+func isFallingBehind(previous SecondaryHealth, secondaryOffset *model.MessageId) bool {
+	if secondaryOffset == nil {
+		return false // secondary doesn't report its offset
+	}
+	if previous.offset != nil && *secondaryOffset < *previous.offset {
+		return true
+	}
+	return previous.primaryOffset != nil && *secondaryOffset < *previous.primaryOffset
+}
+
+// nextStatus implements N-consecutive-failures detector:
+// ALIVE -> SUSPECTED on the first failure, SUSPECTED -> DEAD after 'deadAfterFailures' failures in a row,
+// DEAD -> ALIVE after 'aliveAfterSuccesses' successes in a row. Secondary is DEAD until it is seen for the first time.
+func (daemon *MonitoringDaemon) nextStatus(health SecondaryHealth) string {
+	if health.ConsecutiveFailures == 0 {
+		if health.Status == DEAD && health.consecutiveSuccesses < daemon.aliveAfterSuccesses {
+			return DEAD
+		}
+		return ALIVE
+	}
+
+	if health.Status == "" || health.Status == DEAD || health.ConsecutiveFailures >= daemon.deadAfterFailures {
+		return DEAD
+	}
+	return SUSPECTED
+}
+
+func (daemon *MonitoringDaemon) publish(transition Transition) {
+	select {
+	case daemon.transitions <- transition:
+	case <-daemon.quit:
+	}
+}
+
+func (daemon *MonitoringDaemon) dispatchTransitions() {
+	for {
+		select {
+		case transition := <-daemon.transitions:
+			daemon.mu.Lock()
+			listeners := append([]func(transition Transition){}, daemon.listeners...)
+			daemon.mu.Unlock()
+
+			for _, listener := range listeners {
+				listener(transition)
+			}
+		case <-daemon.quit:
+			return
+		}
+	}
+}
+
+// AddSecondary starts monitoring of the new secondary, its initial status is collected before return
+func (daemon *MonitoringDaemon) AddSecondary(url string) {
+	daemon.mu.Lock()
+	daemon.secondaryUrls = append(daemon.secondaryUrls, url)
+	daemon.mu.Unlock()
+
+	daemon.checkHealth(url)
+}
+
+func (daemon *MonitoringDaemon) RemoveSecondary(url string) {
+	daemon.mu.Lock()
+	defer daemon.mu.Unlock()
+
+	for i, secondaryUrl := range daemon.secondaryUrls {
+		if secondaryUrl == url {
+			daemon.secondaryUrls = append(daemon.secondaryUrls[:i:i], daemon.secondaryUrls[i+1:]...)
+			break
+		}
+	}
+	delete(daemon.secondaryStatuses, url)
+}
+
+// isMonitored should be called under lock
+func (daemon *MonitoringDaemon) isMonitored(url string) bool {
+	for _, secondaryUrl := range daemon.secondaryUrls {
+		if secondaryUrl == url {
+			return true
+		}
+	}
+	return false
 }
 
 func (daemon *MonitoringDaemon) GetStatus(url string) string {
+	return daemon.GetHealth(url).Status
+}
+
+// GetHealth returns snapshot of secondary health. Unknown secondary is DEAD.
+func (daemon *MonitoringDaemon) GetHealth(url string) SecondaryHealth {
 	daemon.mu.Lock()
 	defer daemon.mu.Unlock()
 
-	status, ok := daemon.secondaryStatuses[url]
+	health, ok := daemon.secondaryStatuses[url]
 
 	if !ok {
-		log.Fatalf("[HEALTH-CHECK] %s is not found!", url)
+		// removed secondary is DEAD for everybody who still tries to reach it
+		logger.Warn("Secondary is not found", "secondary", url)
+		return SecondaryHealth{Url: url, Status: DEAD}
 	}
 
-	return status
+	return *health
 }
 
-func (daemon *MonitoringDaemon) NoQuorum() bool {
+// IsAvailable returns true if it makes sense to send requests to the secondary
+func IsAvailable(status string) bool {
+	return status == ALIVE || status == SUSPECTED
+}
+
+// Quorum evaluates configured quorum policy against current health statuses.
+// SUSPECTED secondaries are counted as alive, so single failed health check does not switch primary to read-only mode.
+func (daemon *MonitoringDaemon) Quorum() QuorumStatus {
 	daemon.mu.Lock()
 	defer daemon.mu.Unlock()
 
-	if len(daemon.secondaryStatuses) == 0 {
-		log.Fatal("[HEALTH-CHECK] No data about secondaries health\n")
+	alive := 0
+	for _, health := range daemon.secondaryStatuses {
+		if IsAvailable(health.Status) {
+			alive++
+		}
 	}
 
-	for _, status := range daemon.secondaryStatuses {
-		if status == ALIVE {
-			return false
-		}
+	return daemon.quorumPolicy.evaluate(alive, len(daemon.secondaryStatuses))
+}
+
+func (daemon *MonitoringDaemon) NoQuorum() bool {
+	status := daemon.Quorum()
+	if !status.HasQuorum {
+		logger.Warn("No quorum", "reason", status.Reason)
 	}
 
-	return true
+	return !status.HasQuorum
 }
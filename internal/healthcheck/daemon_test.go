@@ -4,6 +4,7 @@ import (
 	"github.com/stretchr/testify/require"
 	"net/http"
 	"net/http/httptest"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -22,8 +23,9 @@ func TestIfMonitoringDaemonDoesHealthCheckAtMomentOfCreation(t *testing.T) {
 	require.Equal(t, daemon.GetStatus(secondary.URL), ALIVE)
 }
 
-func TestIfBadResponseSetsHealthStatusToDead(t *testing.T) {
+func TestIfBadResponsesSetHealthStatusToSuspectedAndThenToDead(t *testing.T) {
 	// GIVEN
+	t.Setenv("HEALTHCHECK_DEAD_AFTER_FAILURES", "2")
 	calls := 0
 	secondary := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
 		if calls == 0 {
@@ -39,13 +41,87 @@ func TestIfBadResponseSetsHealthStatusToDead(t *testing.T) {
 	// WHEN
 	before := daemon.GetStatus(secondary.URL)
 	daemon.checkHealth(secondary.URL)
-	after := daemon.GetStatus(secondary.URL)
+	afterFirstFailure := daemon.GetStatus(secondary.URL)
+	daemon.checkHealth(secondary.URL)
+	afterSecondFailure := daemon.GetStatus(secondary.URL)
 
 	// THEN
-	require.Equal(t, calls, 2)
+	require.Equal(t, calls, 3)
 
 	require.Equal(t, before, ALIVE)
-	require.Equal(t, after, DEAD)
+	require.Equal(t, afterFirstFailure, SUSPECTED)
+	require.Equal(t, afterSecondFailure, DEAD)
+
+	health := daemon.GetHealth(secondary.URL)
+	require.Equal(t, 2, health.ConsecutiveFailures)
+	require.False(t, health.LastSeen.IsZero())
+	require.Positive(t, health.RTT)
+}
+
+func TestSuspectedSecondaryIsBackToAliveAfterSuccessfulCheck(t *testing.T) {
+	// GIVEN
+	calls := 0
+	secondary := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		if calls == 1 {
+			rw.WriteHeader(http.StatusInternalServerError)
+		} else {
+			rw.WriteHeader(http.StatusOK)
+		}
+		calls += 1
+	}))
+	defer secondary.Close()
+	daemon := NewMonitoringDaemon([]string{secondary.URL})
+
+	// WHEN
+	daemon.checkHealth(secondary.URL)
+	suspected := daemon.GetStatus(secondary.URL)
+	daemon.checkHealth(secondary.URL)
+
+	// THEN
+	require.Equal(t, SUSPECTED, suspected)
+	require.Equal(t, ALIVE, daemon.GetStatus(secondary.URL))
+	require.False(t, daemon.NoQuorum())
+}
+
+func TestDeadSecondaryIsAliveOnlyAfterSeveralSuccessfulChecks(t *testing.T) {
+	// GIVEN
+	t.Setenv("HEALTHCHECK_ALIVE_AFTER_SUCCESSES", "2")
+	var isAlive atomic.Bool
+	secondary := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		if isAlive.Load() {
+			rw.WriteHeader(http.StatusOK)
+		} else {
+			rw.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer secondary.Close()
+	daemon := NewMonitoringDaemon([]string{secondary.URL})
+
+	transitions := make(chan Transition, 10)
+	daemon.Subscribe(func(transition Transition) {
+		if transition.From != "" { // initial status may be delivered after subscription
+			transitions <- transition
+		}
+	})
+
+	// WHEN
+	isAlive.Store(true)
+	daemon.checkHealth(secondary.URL)
+	afterFirstSuccess := daemon.GetStatus(secondary.URL)
+	daemon.checkHealth(secondary.URL)
+
+	// THEN
+	require.Equal(t, DEAD, afterFirstSuccess)
+	require.Equal(t, ALIVE, daemon.GetStatus(secondary.URL))
+
+	select {
+	case transition := <-transitions:
+		require.Equal(t, secondary.URL, transition.Url)
+		require.Equal(t, DEAD, transition.From)
+		require.Equal(t, ALIVE, transition.To)
+	case <-time.After(time.Second):
+		t.Fatal("Transition is not published")
+	}
 }
 
 func TestNoQuorumReturnsTrueIfAllSecondariesAreDead(t *testing.T) {
@@ -99,3 +175,113 @@ func TestIfClientTimeoutSetsHealthStatusToDead(t *testing.T) {
 	// THEN
 	require.Equal(t, daemon.GetStatus(secondary.URL), DEAD)
 }
+
+func TestRecoveryListenerIsNotifiedWhenDeadSecondaryBecomesAlive(t *testing.T) {
+	// GIVEN
+	calls := 0
+	secondary := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		if calls == 0 {
+			rw.WriteHeader(http.StatusInternalServerError)
+		} else {
+			rw.WriteHeader(http.StatusOK)
+		}
+		calls += 1
+	}))
+	defer secondary.Close()
+	daemon := NewMonitoringDaemon([]string{secondary.URL})
+
+	recovered := make(chan string, 1)
+	daemon.SubscribeOnRecovery(func(url string) {
+		recovered <- url
+	})
+
+	// WHEN
+	daemon.checkHealth(secondary.URL)
+
+	// THEN
+	require.Equal(t, secondary.URL, <-recovered)
+}
+
+func TestRecoveryListenerIsNotifiedWhenSuspectedSecondaryBecomesAlive(t *testing.T) {
+	// GIVEN
+	var isAlive atomic.Bool
+	isAlive.Store(true)
+	secondary := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		if isAlive.Load() {
+			rw.WriteHeader(http.StatusOK)
+		} else {
+			rw.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer secondary.Close()
+	daemon := NewMonitoringDaemon([]string{secondary.URL})
+
+	recovered := make(chan string, 1)
+	daemon.SubscribeOnRecovery(func(url string) {
+		recovered <- url
+	})
+
+	isAlive.Store(false)
+	daemon.checkHealth(secondary.URL)
+	require.Equal(t, SUSPECTED, daemon.GetStatus(secondary.URL))
+
+	// WHEN
+	isAlive.Store(true)
+	daemon.checkHealth(secondary.URL)
+
+	// THEN
+	require.Equal(t, secondary.URL, <-recovered)
+}
+
+func TestSecondariesCanBeAddedAndRemovedAtRuntime(t *testing.T) {
+	// GIVEN
+	secondary := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer secondary.Close()
+	daemon := NewMonitoringDaemon([]string{})
+	require.False(t, daemon.NoQuorum(), "primary without secondaries is the whole cluster")
+
+	// WHEN
+	daemon.AddSecondary(secondary.URL)
+
+	// THEN
+	require.Equal(t, ALIVE, daemon.GetStatus(secondary.URL))
+	require.False(t, daemon.NoQuorum())
+
+	// WHEN
+	daemon.RemoveSecondary(secondary.URL)
+
+	// THEN
+	require.Equal(t, DEAD, daemon.GetStatus(secondary.URL))
+	require.False(t, daemon.NoQuorum())
+}
+
+func TestNoQuorumRespectsConfiguredPolicy(t *testing.T) {
+	// GIVEN
+	t.Setenv("QUORUM_POLICY", QuorumAll)
+
+	liveSecondary := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer liveSecondary.Close()
+
+	deadSecondary := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer deadSecondary.Close()
+
+	// WHEN
+	daemon := NewMonitoringDaemon([]string{liveSecondary.URL, deadSecondary.URL})
+
+	// THEN
+	require.True(t, daemon.NoQuorum())
+	require.Equal(t, QuorumStatus{
+		Policy:        QuorumAll,
+		RequiredAlive: 2,
+		Alive:         1,
+		Total:         2,
+		HasQuorum:     false,
+		Reason:        "ALL policy requires 2 alive secondaries, but 1 of 2 are alive",
+	}, daemon.Quorum())
+}
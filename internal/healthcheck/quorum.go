@@ -0,0 +1,96 @@
+package healthcheck
+
+import (
+	"fmt"
+	"os"
+	"replicated-log/internal/logging"
+	"strconv"
+)
+
+const (
+	QuorumMajority = "MAJORITY"   // primary and alive secondaries form majority of the cluster
+	QuorumAll      = "ALL"        // every secondary is alive
+	QuorumAtLeastN = "AT_LEAST_N" // at least 'QUORUM_MIN_ALIVE_SECONDARIES' secondaries are alive
+)
+
+// QuorumStatus explains whether primary has quorum and accepts appends
+type QuorumStatus struct {
+	Policy        string `json:"policy"`
+	RequiredAlive int    `json:"required_alive"`
+	Alive         int    `json:"alive"`
+	Total         int    `json:"total"`
+	HasQuorum     bool   `json:"has_quorum"`
+	// why there is no quorum, empty if there is one
+	Reason string `json:"reason,omitempty"`
+}
+
+type quorumPolicy struct {
+	name     string
+	minAlive int // used only by AT_LEAST_N policy
+}
+
+func quorumPolicyFromEnv() quorumPolicy {
+	policy := quorumPolicy{name: QuorumMajority} // default value
+	if policyToken, okPolicy := os.LookupEnv("QUORUM_POLICY"); okPolicy {
+		policy.name = policyToken
+	}
+
+	switch policy.name {
+	case QuorumMajority, QuorumAll:
+		// nothing to configure
+	case QuorumAtLeastN:
+		minAliveToken, okMinAlive := os.LookupEnv("QUORUM_MIN_ALIVE_SECONDARIES")
+		if !okMinAlive {
+			logging.Fatal(logger, "'QUORUM_MIN_ALIVE_SECONDARIES' env var is not set, it is required by quorum policy", "policy", QuorumAtLeastN)
+		}
+		value, err := strconv.Atoi(minAliveToken)
+		if err != nil || value < 1 {
+			logging.Fatal(logger, "Given 'QUORUM_MIN_ALIVE_SECONDARIES' token is invalid", "token", minAliveToken)
+		}
+		policy.minAlive = value
+	default:
+		logging.Fatal(logger, "Unexpected quorum policy", "policy", policy.name)
+	}
+
+	return policy
+}
+
+// requiredAlive returns number of alive secondaries required for quorum
+func (p quorumPolicy) requiredAlive(total int) int {
+	switch p.name {
+	case QuorumAll:
+		return total
+	case QuorumAtLeastN:
+		return p.minAlive
+	default:
+		// majority of total+1 nodes is (total+1)/2+1, primary itself is always alive
+		return (total + 1) / 2
+	}
+}
+
+// evaluate treats primary without secondaries as the whole cluster, it always has quorum,
+// write concerns which need secondaries are rejected when they are checked
+func (p quorumPolicy) evaluate(alive, total int) QuorumStatus {
+	status := QuorumStatus{
+		Policy:        p.name,
+		RequiredAlive: p.requiredAlive(total),
+		Alive:         alive,
+		Total:         total,
+	}
+	if total == 0 {
+		status.RequiredAlive = 0
+	}
+
+	switch {
+	case total == 0:
+		status.HasQuorum = true
+	case status.RequiredAlive > total:
+		status.Reason = fmt.Sprintf("%s policy requires %d alive secondaries, but only %d are configured", p.name, status.RequiredAlive, total)
+	case alive < status.RequiredAlive:
+		status.Reason = fmt.Sprintf("%s policy requires %d alive secondaries, but %d of %d are alive", p.name, status.RequiredAlive, alive, total)
+	default:
+		status.HasQuorum = true
+	}
+
+	return status
+}
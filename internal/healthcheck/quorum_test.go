@@ -0,0 +1,44 @@
+package healthcheck
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestQuorumPolicies(t *testing.T) {
+	testCases := []struct {
+		name          string
+		policy        quorumPolicy
+		alive         int
+		total         int
+		requiredAlive int
+		hasQuorum     bool
+	}{
+		{"Majority of 3 nodes", quorumPolicy{name: QuorumMajority}, 1, 2, 1, true},
+		{"Majority of 4 nodes", quorumPolicy{name: QuorumMajority}, 1, 3, 2, false},
+		{"Majority of 5 nodes", quorumPolicy{name: QuorumMajority}, 2, 4, 2, true},
+		{"All secondaries are alive", quorumPolicy{name: QuorumAll}, 3, 3, 3, true},
+		{"One of secondaries is dead", quorumPolicy{name: QuorumAll}, 2, 3, 3, false},
+		{"At least N secondaries are alive", quorumPolicy{name: QuorumAtLeastN, minAlive: 2}, 2, 3, 2, true},
+		{"Less than N secondaries are alive", quorumPolicy{name: QuorumAtLeastN, minAlive: 2}, 1, 3, 2, false},
+		{"N is bigger than cluster", quorumPolicy{name: QuorumAtLeastN, minAlive: 4}, 3, 3, 4, false},
+		{"No secondaries", quorumPolicy{name: QuorumMajority}, 0, 0, 0, true},
+		{"No secondaries with at least N policy", quorumPolicy{name: QuorumAtLeastN, minAlive: 2}, 0, 0, 0, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// WHEN
+			status := tc.policy.evaluate(tc.alive, tc.total)
+
+			// THEN
+			require.Equal(t, tc.requiredAlive, status.RequiredAlive)
+			require.Equal(t, tc.hasQuorum, status.HasQuorum)
+			if tc.hasQuorum {
+				require.Empty(t, status.Reason)
+			} else {
+				require.NotEmpty(t, status.Reason)
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+)
+
+// CorrelationIdHeader carries id of the append through all nodes which take part in its replication
+const CorrelationIdHeader = "X-Correlation-Id"
+
+const (
+	formatText = "TEXT"
+	formatJson = "JSON"
+)
+
+type correlationIdKey struct{}
+
+var (
+	level = new(slog.LevelVar)
+	// message contents are never logged unless explicitly enabled
+	logPayloads = false
+)
+
+// Setup configures default logger via env vars:
+// 'LOG_LEVEL' (DEBUG, INFO, WARN, ERROR), 'LOG_FORMAT' (TEXT, JSON) and 'LOG_PAYLOADS' (true to log message contents)
+func Setup() {
+	if levelToken, okLevel := os.LookupEnv("LOG_LEVEL"); okLevel {
+		if err := level.UnmarshalText([]byte(levelToken)); err != nil {
+			Fatal(slog.Default(), "Unexpected log level", "level", levelToken)
+		}
+	}
+
+	format, ok := os.LookupEnv("LOG_FORMAT")
+	if !ok {
+		format = formatText
+	}
+
+	options := &slog.HandlerOptions{Level: level}
+	switch strings.ToUpper(format) {
+	case formatText:
+		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, options)))
+	case formatJson:
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, options)))
+	default:
+		Fatal(slog.Default(), "Unexpected log format", "format", format)
+	}
+
+	logPayloads = os.Getenv("LOG_PAYLOADS") == "true"
+}
+
+// Component returns logger of the given component.
+// It can be created before Setup is called, records always go to the current default logger.
+func Component(name string) *slog.Logger {
+	return slog.New(defaultHandler{attrs: []slog.Attr{slog.String("component", name)}})
+}
+
+// Fatal logs error and stops the process
+func Fatal(logger *slog.Logger, msg string, args ...any) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
+
+// Payload returns message contents as log attribute, contents are redacted unless 'LOG_PAYLOADS' is enabled
+func Payload(message string) slog.Attr {
+	if logPayloads {
+		return slog.String("payload", message)
+	}
+	return slog.String("payload", fmt.Sprintf("<redacted %d bytes>", len(message)))
+}
+
+func NewCorrelationId() string {
+	raw := make([]byte, 8)
+	_, _ = rand.Read(raw)
+	return hex.EncodeToString(raw)
+}
+
+// WithCorrelationId returns context whose records are logged with the given correlation id
+func WithCorrelationId(ctx context.Context, correlationId string) context.Context {
+	if correlationId == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, correlationIdKey{}, correlationId)
+}
+
+func CorrelationId(ctx context.Context) string {
+	correlationId, _ := ctx.Value(correlationIdKey{}).(string)
+	return correlationId
+}
+
+// defaultHandler delegates to the handler of current default logger and adds correlation id from context
+type defaultHandler struct {
+	attrs []slog.Attr
+}
+
+func (h defaultHandler) Enabled(ctx context.Context, l slog.Level) bool {
+	return slog.Default().Handler().Enabled(ctx, l)
+}
+
+func (h defaultHandler) Handle(ctx context.Context, record slog.Record) error {
+	if correlationId := CorrelationId(ctx); correlationId != "" {
+		record.AddAttrs(slog.String("correlation_id", correlationId))
+	}
+	return slog.Default().Handler().WithAttrs(h.attrs).Handle(ctx, record)
+}
+
+func (h defaultHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return defaultHandler{attrs: append(slices.Clip(h.attrs), attrs...)}
+}
+
+func (h defaultHandler) WithGroup(name string) slog.Handler {
+	return slog.Default().Handler().WithAttrs(h.attrs).WithGroup(name)
+}
@@ -0,0 +1,54 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/require"
+	"log/slog"
+	"testing"
+)
+
+func TestPayloadIsRedactedByDefault(t *testing.T) {
+	// WHEN
+	attr := Payload("secret")
+
+	// THEN
+	require.Equal(t, "<redacted 6 bytes>", attr.Value.String())
+}
+
+func TestPayloadIsLoggedIfEnabled(t *testing.T) {
+	// GIVEN
+	t.Setenv("LOG_PAYLOADS", "true")
+	previous := slog.Default()
+	Setup()
+	t.Cleanup(func() {
+		logPayloads = false
+		slog.SetDefault(previous)
+	})
+
+	// WHEN
+	attr := Payload("secret")
+
+	// THEN
+	require.Equal(t, "secret", attr.Value.String())
+}
+
+func TestComponentLoggerAddsCorrelationIdAndRespectsLevel(t *testing.T) {
+	// GIVEN
+	var out bytes.Buffer
+	previous := slog.Default()
+	t.Cleanup(func() { slog.SetDefault(previous) })
+
+	logger := Component("test") // created before default logger is configured
+	slog.SetDefault(slog.New(slog.NewTextHandler(&out, &slog.HandlerOptions{Level: slog.LevelInfo})))
+
+	ctx := WithCorrelationId(context.Background(), "abc")
+
+	// WHEN
+	logger.DebugContext(ctx, "hidden")
+	logger.InfoContext(ctx, "visible", "id", 1)
+
+	// THEN
+	require.NotContains(t, out.String(), "hidden")
+	require.Contains(t, out.String(), "msg=visible component=test id=1 correlation_id=abc")
+}
@@ -0,0 +1,216 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"replicated-log/internal/healthcheck"
+	"replicated-log/internal/storage"
+	"strconv"
+	"time"
+)
+
+const namespace = "replicated_log"
+
+// Metrics -- prometheus collectors of one node. Every node has its own registry,
+// so metrics can be checked in tests without global state and without Prometheus server.
+// All methods are safe to call on nil Metrics, which disables metrics.
+type Metrics struct {
+	registry *prometheus.Registry
+	// primary
+	appendLatency       *prometheus.HistogramVec
+	replicationAttempts *prometheus.CounterVec
+	replicationFailures *prometheus.CounterVec
+	replicationBackoff  *prometheus.CounterVec
+	// anti-entropy
+	divergentRanges  *prometheus.GaugeVec
+	repairedMessages *prometheus.CounterVec
+	// healthcheck
+	secondaryHealth   *prometheus.GaugeVec
+	healthTransitions *prometheus.CounterVec
+}
+
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		appendLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "append_duration_seconds",
+			Help:      "Time from append request till write concern is satisfied, by requested write concern.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 2, 15), // 1ms .. ~16s
+		}, []string{"w"}),
+		replicationAttempts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "replication_attempts_total",
+			Help:      "Number of requests sent to secondary in order to replicate messages.",
+		}, []string{"secondary"}),
+		replicationFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "replication_failures_total",
+			Help:      "Number of failed replication requests.",
+		}, []string{"secondary"}),
+		replicationBackoff: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "replication_backoff_seconds_total",
+			Help:      "Time spent sleeping between replication retries.",
+		}, []string{"secondary"}),
+		divergentRanges: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "divergent_ranges",
+			Help:      "Number of ranges where secondary differs from primary, found by the last anti-entropy check.",
+		}, []string{"secondary"}),
+		repairedMessages: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "repaired_messages_total",
+			Help:      "Number of messages sent to secondary by anti-entropy to repair divergent ranges.",
+		}, []string{"secondary"}),
+		secondaryHealth: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "secondary_health_status",
+			Help:      "Current health status of secondary, 1 for the current status and 0 for the others.",
+		}, []string{"secondary", "status"}),
+		healthTransitions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "secondary_health_transitions_total",
+			Help:      "Number of secondary health status transitions.",
+		}, []string{"secondary", "from", "to"}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.appendLatency,
+		m.replicationAttempts,
+		m.replicationFailures,
+		m.replicationBackoff,
+		m.divergentRanges,
+		m.repairedMessages,
+		m.secondaryHealth,
+		m.healthTransitions,
+	)
+
+	return m
+}
+
+// RegisterStorage exposes size of the storage, the highest id before which there are no gaps and the low-water mark
+func (m *Metrics) RegisterStorage(source storage.Storage) {
+	if m == nil {
+		return
+	}
+
+	m.registry.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "storage_messages",
+			Help:      "Number of messages in the storage.",
+		}, func() float64 {
+			return float64(source.Size())
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "storage_highest_contiguous_id",
+			Help:      "Highest id such that all messages up to it are present in the storage, -1 if there are none.",
+		}, func() float64 {
+			return float64(source.GetOffset()) - 1
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "storage_low_water_mark",
+			Help:      "Id of the first message which is not removed by retention.",
+		}, func() float64 {
+			return float64(source.GetLowWaterMark())
+		}),
+	)
+}
+
+// Handler serves metrics in Prometheus exposition format
+func (m *Metrics) Handler() http.Handler {
+	if m == nil {
+		return http.NotFoundHandler()
+	}
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{Registry: m.registry})
+}
+
+func (m *Metrics) ObserveAppend(w int, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	m.appendLatency.WithLabelValues(strconv.Itoa(w)).Observe(duration.Seconds())
+}
+
+func (m *Metrics) ReplicationAttempt(secondaryUrl string) {
+	if m == nil {
+		return
+	}
+	m.replicationAttempts.WithLabelValues(secondaryUrl).Inc()
+}
+
+func (m *Metrics) ReplicationFailure(secondaryUrl string) {
+	if m == nil {
+		return
+	}
+	m.replicationFailures.WithLabelValues(secondaryUrl).Inc()
+}
+
+func (m *Metrics) ReplicationBackoff(secondaryUrl string, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	m.replicationBackoff.WithLabelValues(secondaryUrl).Add(duration.Seconds())
+}
+
+// SetDivergentRanges reports result of the anti-entropy check of the secondary
+func (m *Metrics) SetDivergentRanges(secondaryUrl string, ranges int) {
+	if m == nil {
+		return
+	}
+	m.divergentRanges.WithLabelValues(secondaryUrl).Set(float64(ranges))
+}
+
+func (m *Metrics) RepairedMessages(secondaryUrl string, messages int) {
+	if m == nil {
+		return
+	}
+	m.repairedMessages.WithLabelValues(secondaryUrl).Add(float64(messages))
+}
+
+// SetHealthStatus marks given status as the current one of the secondary
+func (m *Metrics) SetHealthStatus(secondaryUrl string, status string) {
+	if m == nil {
+		return
+	}
+	for _, s := range []string{healthcheck.ALIVE, healthcheck.SUSPECTED, healthcheck.DEAD} {
+		value := 0.0
+		if s == status {
+			value = 1
+		}
+		m.secondaryHealth.WithLabelValues(secondaryUrl, s).Set(value)
+	}
+}
+
+// HealthTransition is a listener of MonitoringDaemon transitions
+func (m *Metrics) HealthTransition(transition healthcheck.Transition) {
+	if m == nil {
+		return
+	}
+	m.SetHealthStatus(transition.Url, transition.To)
+	if transition.From != "" {
+		m.healthTransitions.WithLabelValues(transition.Url, transition.From, transition.To).Inc()
+	}
+}
+
+// ForgetSecondary removes all series of the removed secondary
+func (m *Metrics) ForgetSecondary(secondaryUrl string) {
+	if m == nil {
+		return
+	}
+	labels := prometheus.Labels{"secondary": secondaryUrl}
+	m.replicationAttempts.DeletePartialMatch(labels)
+	m.replicationFailures.DeletePartialMatch(labels)
+	m.replicationBackoff.DeletePartialMatch(labels)
+	m.divergentRanges.DeletePartialMatch(labels)
+	m.repairedMessages.DeletePartialMatch(labels)
+	m.secondaryHealth.DeletePartialMatch(labels)
+	m.healthTransitions.DeletePartialMatch(labels)
+}
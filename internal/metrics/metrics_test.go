@@ -0,0 +1,79 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"replicated-log/internal/healthcheck"
+	"replicated-log/internal/model"
+	"replicated-log/internal/storage"
+	"testing"
+	"time"
+)
+
+func TestReplicationMetricsArePerSecondary(t *testing.T) {
+	// GIVEN
+	m := NewMetrics()
+
+	// WHEN
+	m.ReplicationAttempt("http://secondary-1")
+	m.ReplicationAttempt("http://secondary-1")
+	m.ReplicationFailure("http://secondary-1")
+	m.ReplicationBackoff("http://secondary-1", 1500*time.Millisecond)
+	m.ReplicationAttempt("http://secondary-2")
+
+	// THEN
+	require.Equal(t, 2.0, testutil.ToFloat64(m.replicationAttempts.WithLabelValues("http://secondary-1")))
+	require.Equal(t, 1.0, testutil.ToFloat64(m.replicationFailures.WithLabelValues("http://secondary-1")))
+	require.Equal(t, 1.5, testutil.ToFloat64(m.replicationBackoff.WithLabelValues("http://secondary-1")))
+	require.Equal(t, 1.0, testutil.ToFloat64(m.replicationAttempts.WithLabelValues("http://secondary-2")))
+
+	t.Run("Removed secondary is forgotten", func(t *testing.T) {
+		m.ForgetSecondary("http://secondary-1")
+		require.Equal(t, 1, testutil.CollectAndCount(m.replicationAttempts))
+	})
+}
+
+func TestHealthTransitionsUpdateStatusGauge(t *testing.T) {
+	// GIVEN
+	m := NewMetrics()
+	url := "http://secondary-1"
+
+	// WHEN
+	m.HealthTransition(healthcheck.Transition{Url: url, From: "", To: healthcheck.ALIVE})
+	m.HealthTransition(healthcheck.Transition{Url: url, From: healthcheck.ALIVE, To: healthcheck.SUSPECTED})
+
+	// THEN
+	require.Equal(t, 0.0, testutil.ToFloat64(m.secondaryHealth.WithLabelValues(url, healthcheck.ALIVE)))
+	require.Equal(t, 1.0, testutil.ToFloat64(m.secondaryHealth.WithLabelValues(url, healthcheck.SUSPECTED)))
+	require.Equal(t, 0.0, testutil.ToFloat64(m.secondaryHealth.WithLabelValues(url, healthcheck.DEAD)))
+	require.Equal(t, 1.0, testutil.ToFloat64(m.healthTransitions.WithLabelValues(url, healthcheck.ALIVE, healthcheck.SUSPECTED)))
+	require.Equal(t, 1, testutil.CollectAndCount(m.healthTransitions))
+}
+
+func TestStorageMetricsAreExposedViaHandler(t *testing.T) {
+	// GIVEN
+	m := NewMetrics()
+	messages := storage.NewInMemoryStorage()
+	m.RegisterStorage(messages)
+
+	messages.AddMessage(model.Message{Id: 0, Message: "first"})
+	messages.AddMessage(model.Message{Id: 1, Message: "second"})
+	messages.AddMessage(model.Message{Id: 3, Message: "fourth"})
+	m.ObserveAppend(2, 10*time.Millisecond)
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	resp := httptest.NewRecorder()
+
+	// WHEN
+	m.Handler().ServeHTTP(resp, req)
+
+	// THEN
+	require.Equal(t, http.StatusOK, resp.Code)
+	body := resp.Body.String()
+	require.Contains(t, body, "replicated_log_storage_messages 3")
+	require.Contains(t, body, "replicated_log_storage_highest_contiguous_id 1")
+	require.Contains(t, body, `replicated_log_append_duration_seconds_count{w="2"} 1`)
+	require.Contains(t, body, "go_goroutines")
+}
@@ -1,9 +1,42 @@
 package model
 
+// MessageId -- position of the message in its log. Ids are assigned per partition of a topic.
 type MessageId uint32 // just to make future type replacement easy
 
 // Message -- basic struct to represent messages which we want to replicate
 type Message struct {
 	Id      MessageId `json:"order"`
 	Message string    `json:"message"`
+	// Binary content of the message, base64 in JSON. Message is either text or binary
+	Payload     []byte            `json:"payload,omitempty"`
+	ContentType string            `json:"content_type,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	// Term of the leader which replicated message, used to fence off stale leaders
+	Term uint64 `json:"term,omitempty"`
+	// Key of the append given by client, used by primary to deduplicate retried appends
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+	// Name of the log which message belongs to, empty for the default topic
+	Topic string `json:"topic,omitempty"`
+	// Partition of the topic, chosen by hash of the key. Ids are assigned per partition.
+	Partition int `json:"partition,omitempty"`
+	// Routing key given by client, messages with the same key go to the same partition.
+	// Compaction keeps only the latest message of every key.
+	Key string `json:"key,omitempty"`
+	// Unix time in milliseconds when primary appended the message, used by time-based retention
+	Timestamp int64 `json:"timestamp,omitempty"`
+	// Number of ids right before this one which are removed by retention on primary,
+	// so replica does not wait for them. Matters only for replication.
+	Skipped MessageId `json:"skipped,omitempty"`
+	// Generation of the topic on primary, replica drops messages of a deleted generation instead of creating
+	// the topic again. Matters only for replication.
+	TopicGeneration uint64 `json:"topic_generation,omitempty"`
+}
+
+// Size returns number of bytes of the user content: text, payload, content type, key and headers
+func (m Message) Size() int {
+	size := len(m.Message) + len(m.Payload) + len(m.ContentType) + len(m.Key)
+	for key, value := range m.Headers {
+		size += len(key) + len(value)
+	}
+	return size
 }
@@ -1,103 +1,905 @@
 package primary
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
-	"log"
+	"io"
+	"maps"
 	"net/http"
+	"net/url"
 	"os"
+	"replicated-log/internal/auth"
+	"replicated-log/internal/healthcheck"
+	"replicated-log/internal/logging"
+	"replicated-log/internal/metrics"
+	"replicated-log/internal/model"
+	"replicated-log/internal/reader"
 	"replicated-log/internal/replication"
+	"replicated-log/internal/server"
+	"replicated-log/internal/snapshot"
 	"replicated-log/internal/storage"
+	"strconv"
 	"time"
 )
 
+var logger = logging.Component("primary")
+
+// max number of user headers of a message
+const maxMessageHeaders = 32
+
 type HttpHandler struct {
-	storage  *storage.InMemoryStorage
+	// log of the default topic
+	storage  storage.Storage
+	topics   *storage.Topics
 	executor *replication.Executor
+	// default time to wait for write concern
+	appendTimeout time.Duration
+	// limit of text, payload, content type and headers of a message in total
+	maxMessageSize int
+	metrics        *metrics.Metrics
+	subscriptions  *reader.Subscriptions
+	idempotency    *idempotencyWindows
+	partitions     *partitionRouter
 }
 
 type AppendMessageRequest struct {
 	Message string `json:"message"`
-	W       int    `json:"w"`
+	// messages with the same key go to the same partition of the topic, optional
+	Key string `json:"key,omitempty"`
+	// binary content (base64 in JSON), used instead of 'message'
+	Payload     []byte            `json:"payload,omitempty"`
+	ContentType string            `json:"content_type,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	W           int               `json:"w"`
+	// overrides default time to wait for write concern, optional
+	TimeoutMilliseconds int `json:"timeout_ms,omitempty"`
+	// retried append with the same key returns result of the original one, optional
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+}
+
+type AppendMessageResponse struct {
+	// can be passed as 'min_id' to read own write from a secondary
+	Id model.MessageId `json:"id"`
+	// ids are assigned per partition, omitted for the first one
+	Partition int `json:"partition,omitempty"`
+	// when message is appended to the primary log, the same instant as timestamp of the stored message
+	Timestamp time.Time `json:"timestamp"`
+	W         int       `json:"w"`
+	// primary and secondaries which have acknowledged the message before response, can be bigger than 'w'
+	AchievedW            int      `json:"achieved_w"`
+	AckedBy              []string `json:"acked_by"`
+	DurationMilliseconds float64  `json:"duration_ms"`
+}
+
+type MessageTooLargeErrorResponse struct {
+	Error   string `json:"error"`
+	Size    int    `json:"size"`
+	MaxSize int    `json:"max_size"`
+}
+
+type WriteConcernErrorResponse struct {
+	Error     string `json:"error"`
+	W         int    `json:"w"`
+	AchievedW int    `json:"achieved_w"`
+	// present if message is stored on primary and will be replicated in background
+	Id      *model.MessageId `json:"id,omitempty"`
+	AckedBy []string         `json:"acked_by,omitempty"`
+}
+
+type ReadOnlyErrorResponse struct {
+	Error  string                   `json:"error"`
+	Quorum healthcheck.QuorumStatus `json:"quorum"`
+}
+
+type StatusResponse struct {
+	ReadOnly bool `json:"read_only"`
+	// why primary is in read-only mode, empty if it accepts appends
+	Reason             string                   `json:"reason,omitempty"`
+	Quorum             healthcheck.QuorumStatus `json:"quorum"`
+	WriteConcernPolicy string                   `json:"write_concern_policy"`
+}
+
+type GetMessagesResponse = reader.MessagesResponse
+
+type SecondaryRequest struct {
+	Url string `json:"url"`
+}
+
+type SecondaryInfo struct {
+	Url    string `json:"url"`
+	Status string `json:"status"`
+	// time of the last successful health check, omitted if secondary has never been seen
+	LastSeen            *time.Time `json:"last_seen,omitempty"`
+	RttMilliseconds     float64    `json:"rtt_ms"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+}
+
+type ListSecondariesResponse struct {
+	Secondaries []SecondaryInfo `json:"secondaries"`
+}
+
+// DivergentRangeInfo -- ids from 'from' inclusive to 'to' exclusive where secondary differs from primary
+type DivergentRangeInfo struct {
+	Topic     string          `json:"topic"`
+	Partition int             `json:"partition"`
+	From      model.MessageId `json:"from"`
+	To        model.MessageId `json:"to"`
+	Repaired  bool            `json:"repaired"`
+}
+
+type SecondaryDivergence struct {
+	Url string `json:"url"`
+	// time of the last completed anti-entropy check, omitted if secondary has not been checked yet
+	CheckedAt *time.Time           `json:"checked_at,omitempty"`
+	Ranges    []DivergentRangeInfo `json:"ranges"`
+}
+
+type DivergenceResponse struct {
+	Secondaries []SecondaryDivergence `json:"secondaries"`
+}
+
+type SecondaryReplicationStatus struct {
+	Url    string `json:"url"`
+	Status string `json:"status"`
+	// time of the last successful health check, omitted if secondary has never been seen
+	LastSeen *time.Time `json:"last_seen,omitempty"`
+	// highest id such that secondary has acknowledged it and all messages before it, -1 if none
+	HighestAckedId int64 `json:"highest_acked_id"`
+	LagMessages    int   `json:"lag_messages"`
+	// for how long the oldest not acknowledged message is being replicated
+	LagSeconds      float64 `json:"lag_seconds"`
+	InFlightRetries int     `json:"in_flight_retries"`
+}
+
+type ClusterStatusResponse struct {
+	// first id which is not assigned yet on primary, of the default topic
+	PrimaryOffset int64                        `json:"primary_offset"`
+	Secondaries   []SecondaryReplicationStatus `json:"secondaries"`
+	// replication of named topics, omitted if there are none
+	Topics []TopicReplicationStatus `json:"topics,omitempty"`
+}
+
+type TopicReplicationStatus struct {
+	Name          string                 `json:"name"`
+	Partition     int                    `json:"partition"`
+	PrimaryOffset int64                  `json:"primary_offset"`
+	Secondaries   []SecondaryTopicStatus `json:"secondaries"`
 }
 
-type GetMessagesResponse struct {
-	Messages []string `json:"messages"`
+type SecondaryTopicStatus struct {
+	Url             string  `json:"url"`
+	HighestAckedId  int64   `json:"highest_acked_id"`
+	LagMessages     int     `json:"lag_messages"`
+	LagSeconds      float64 `json:"lag_seconds"`
+	InFlightRetries int     `json:"in_flight_retries"`
 }
 
+type TopicRequest struct {
+	Name string `json:"name"`
+	// 1 by default
+	Partitions int `json:"partitions,omitempty"`
+}
+
+type TopicInfo struct {
+	Name       string `json:"name"`
+	Partitions int    `json:"partitions"`
+	// first id which is not assigned yet per partition, always 0 for partitions owned by other primaries
+	Offsets []int64 `json:"offsets"`
+}
+
+type ListTopicsResponse struct {
+	Topics []TopicInfo `json:"topics"`
+}
+
+// AppendMessage appends to the default topic
 func (h *HttpHandler) AppendMessage(rw http.ResponseWriter, r *http.Request) {
+	if ownerUrl := h.partitions.owner(0); ownerUrl != "" {
+		h.partitions.proxy(rw, r, ownerUrl)
+		return
+	}
+	h.appendMessage(rw, r, "", 0, h.storage)
+}
+
+// AppendTopicMessage appends to the topic from path, topic should be created beforehand.
+// Partition is chosen by the key of the message.
+func (h *HttpHandler) AppendTopicMessage(rw http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	partitions, err := h.topics.Partitions(name)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	partition := 0
+	if len(partitions) > 1 {
+		// body is read beforehand to route the message by its key
+		body, err := io.ReadAll(http.MaxBytesReader(rw, r.Body, h.maxBodySize()))
+		if err != nil {
+			h.writeBodyError(rw, err)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		var routing AppendMessageRequest
+		_ = json.Unmarshal(body, &routing) // invalid body is rejected by the owner of the partition
+		partition = h.partitions.route(routingKey(routing, r), len(partitions))
+	}
+
+	h.appendToPartition(rw, r, name, partition)
+}
+
+// AppendPartitionMessage appends to the partition from path
+func (h *HttpHandler) AppendPartitionMessage(rw http.ResponseWriter, r *http.Request) {
+	partition, err := strconv.Atoi(mux.Vars(r)["partition"])
+	if err != nil {
+		http.Error(rw, "partition should be a number", http.StatusBadRequest)
+		return
+	}
+	h.appendToPartition(rw, r, mux.Vars(r)["name"], partition)
+}
+
+// routingKey returns key which defines partition of the message. Idempotency key is used if there is no key,
+// so retried append goes to the same partition.
+func routingKey(payload AppendMessageRequest, r *http.Request) string {
+	if payload.Key != "" {
+		return payload.Key
+	}
+	if payload.IdempotencyKey != "" {
+		return payload.IdempotencyKey
+	}
+	return r.Header.Get(IdempotencyKeyHeader)
+}
+
+func (h *HttpHandler) appendToPartition(rw http.ResponseWriter, r *http.Request, name string, partition int) {
+	if ownerUrl := h.partitions.owner(partition); ownerUrl != "" {
+		r.URL.Path = fmt.Sprintf("/api/v1/topics/%s/partitions/%d/append", url.PathEscape(name), partition)
+		r.URL.RawPath = ""
+		h.partitions.proxy(rw, r, ownerUrl)
+		return
+	}
+
+	messages, err := h.topics.Partition(name, partition)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusNotFound)
+		return
+	}
+	if name == storage.DefaultTopic {
+		name = "" // as in messages of the legacy API
+	}
+	h.appendMessage(rw, r, name, partition, messages)
+}
+
+// base64 of binary payload is 4/3 of its size, the exact limit is checked after decoding
+func (h *HttpHandler) maxBodySize() int64 {
+	return int64(2*h.maxMessageSize + 64*1024)
+}
+
+func (h *HttpHandler) writeBodyError(rw http.ResponseWriter, err error) {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		writeJson(rw, http.StatusRequestEntityTooLarge, MessageTooLargeErrorResponse{
+			Error:   "request body is too large",
+			Size:    int(maxBytesErr.Limit),
+			MaxSize: h.maxMessageSize,
+		})
+		return
+	}
+	http.Error(rw, err.Error(), http.StatusBadRequest)
+}
+
+// appendMessage stores message to the log of the topic partition, empty topic is the default one
+func (h *HttpHandler) appendMessage(rw http.ResponseWriter, r *http.Request, topic string, partition int, messages storage.Storage) {
 	var payload AppendMessageRequest
 
+	// id can be already assigned by the node which proxied the append
+	correlationId := r.Header.Get(logging.CorrelationIdHeader)
+	if correlationId == "" {
+		correlationId = logging.NewCorrelationId()
+	}
+	rw.Header().Set(logging.CorrelationIdHeader, correlationId)
+	requestCtx := logging.WithCorrelationId(r.Context(), correlationId)
+
+	err := json.NewDecoder(http.MaxBytesReader(rw, r.Body, h.maxBodySize())).Decode(&payload)
+	if err != nil {
+		h.writeBodyError(rw, err)
+		return
+	}
+
+	if payload.Message != "" && len(payload.Payload) > 0 {
+		http.Error(rw, "message should be either text ('message') or binary ('payload')", http.StatusBadRequest)
+		return
+	}
+	if len(payload.Headers) > maxMessageHeaders {
+		http.Error(rw, "message should have at most "+strconv.Itoa(maxMessageHeaders)+" headers", http.StatusBadRequest)
+		return
+	}
+	if size := payload.newMessage().Size(); size > h.maxMessageSize {
+		logger.WarnContext(requestCtx, "Message is too large", "size", size, "max_size", h.maxMessageSize)
+		writeJson(rw, http.StatusRequestEntityTooLarge, MessageTooLargeErrorResponse{
+			Error:   "message is " + strconv.Itoa(size) + " bytes, limit is " + strconv.Itoa(h.maxMessageSize) + " bytes",
+			Size:    size,
+			MaxSize: h.maxMessageSize,
+		})
+		return
+	}
+
+	if payload.IdempotencyKey == "" {
+		payload.IdempotencyKey = r.Header.Get(IdempotencyKeyHeader)
+	}
+
+	if payload.W < 1 {
+		http.Error(rw, "write concern should be at least 1", http.StatusBadRequest)
+		return
+	}
+
+	if quorum := h.executor.Quorum(); !quorum.HasQuorum {
+		logger.WarnContext(requestCtx, "No Quorum -- READ ONLY MODE, message is rejected", logging.Payload(payload.Message), "reason", quorum.Reason)
+		writeJson(rw, http.StatusMethodNotAllowed, ReadOnlyErrorResponse{
+			Error:  "read-only mode: " + quorum.Reason,
+			Quorum: quorum,
+		})
+		return
+	}
+
+	if err = h.executor.CheckWriteConcern(payload.W - 1); err != nil {
+		logger.WarnContext(requestCtx, "Message is rejected", logging.Payload(payload.Message), "err", err)
+		status := http.StatusBadRequest
+		if errors.Is(err, replication.ErrNotEnoughAliveSecondaries) {
+			status = http.StatusServiceUnavailable
+		}
+		writeJson(rw, status, WriteConcernErrorResponse{
+			Error: err.Error(),
+			W:     payload.W,
+		})
+		return
+	}
+
+	timeout := h.appendTimeout
+	if payload.TimeoutMilliseconds > 0 {
+		timeout = time.Duration(payload.TimeoutMilliseconds) * time.Millisecond
+	}
+	ctx, cancel := context.WithTimeout(requestCtx, timeout)
+	defer cancel()
+
+	startedAt := time.Now()
+	idempotency := h.idempotency.of(topic, partition, messages)
+	message, isRepeat, err := h.addMessage(payload, topic, partition, messages, idempotency)
+	if errors.Is(err, storage.ErrClosed) {
+		logger.WarnContext(ctx, "Message is rejected, topic is deleted", "topic", topic)
+		http.Error(rw, storage.ErrTopicNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger.WarnContext(ctx, "Message is rejected", "err", err)
+		http.Error(rw, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	var response *AppendMessageResponse
+	if isRepeat {
+		// the original append may still be replicating the message, its result is awaited
+		if response, err = idempotency.acquire(ctx, payload.IdempotencyKey); err != nil {
+			logger.WarnContext(ctx, "Original append is not finished in time", "id", message.Id, "err", err)
+			writeJson(rw, http.StatusGatewayTimeout, WriteConcernErrorResponse{
+				Error:     "original append with the same idempotency key is not finished in time, message will be replicated in background",
+				W:         payload.W,
+				AchievedW: 1, // primary
+				Id:        &message.Id,
+			})
+			return
+		}
+		if response != nil {
+			logger.InfoContext(ctx, "Append is repeated, result of the original one is returned", "id", response.Id)
+			rw.Header().Set(IdempotentReplayedHeader, "true")
+			writeJson(rw, http.StatusOK, response)
+			return
+		}
+		// original append has not satisfied write concern, so replication is driven once again
+		logger.InfoContext(ctx, "Append is repeated, message is replicated again", "id", message.Id)
+	}
+	if payload.IdempotencyKey != "" {
+		defer func() { idempotency.release(payload.IdempotencyKey, response) }()
+	}
+
+	acks, err := h.executor.ReplicateMessage(ctx, message, payload.W-1)
+	duration := time.Since(startedAt)
+	h.metrics.ObserveAppend(payload.W, duration)
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		logger.WarnContext(ctx, "Write concern is not satisfied in time", "id", message.Id, "timeout", timeout, "achieved_w", len(acks)+1, "w", payload.W)
+		writeJson(rw, http.StatusGatewayTimeout, WriteConcernErrorResponse{
+			Error:     "write concern is not satisfied in time, message will be replicated in background",
+			W:         payload.W,
+			AchievedW: len(acks) + 1, // primary
+			Id:        &message.Id,
+			AckedBy:   acks,
+		})
+		return
+	} else if errors.Is(err, replication.ErrUnsatisfiableWriteConcern) {
+		logger.WarnContext(ctx, "Write concern cannot be satisfied anymore, message will be replicated in background", "id", message.Id)
+		writeJson(rw, http.StatusServiceUnavailable, WriteConcernErrorResponse{
+			Error:     "secondaries were removed during append, message will be replicated in background",
+			W:         payload.W,
+			AchievedW: len(acks) + 1, // primary
+			Id:        &message.Id,
+			AckedBy:   acks,
+		})
+		return
+	} else if err != nil {
+		logger.InfoContext(ctx, "Client stopped waiting for replication", "id", message.Id, "err", err)
+		return
+	}
+
+	logger.InfoContext(ctx, "Replication is done", "id", message.Id, "w", payload.W)
+	response = &AppendMessageResponse{
+		Id:                   message.Id,
+		Partition:            partition,
+		Timestamp:            time.UnixMilli(message.Timestamp).UTC(),
+		W:                    payload.W,
+		AchievedW:            len(acks) + 1, // primary
+		AckedBy:              acks,
+		DurationMilliseconds: float64(duration) / float64(time.Millisecond),
+	}
+	writeJson(rw, http.StatusOK, response)
+}
+
+// addMessage stores new message. If append with the same idempotency key is repeated, the stored message is returned.
+func (h *HttpHandler) addMessage(payload AppendMessageRequest, topic string, partition int, messages storage.Storage, idempotency *idempotencyWindow) (model.Message, bool, error) {
+	newMessage := payload.newMessage()
+	newMessage.Topic = topic
+	newMessage.Partition = partition
+	if payload.IdempotencyKey == "" {
+		message := messages.AddNewMessage(newMessage)
+		// topic is deleted while the append was in progress
+		return message, false, messages.Err()
+	}
+
+	var message model.Message
+	id, isRepeat := idempotency.addOnce(payload.IdempotencyKey, func() model.MessageId {
+		message = messages.AddNewMessage(newMessage)
+		return message.Id
+	})
+	if !isRepeat {
+		return message, false, messages.Err()
+	}
+
+	newMessage.Id = id
+	if stored := messages.GetMessagesRange(id, id+1, 1); len(stored) > 0 {
+		if !isSameAppend(stored[0], newMessage) {
+			return model.Message{}, true, ErrIdempotencyKeyReused
+		}
+		newMessage = stored[0]
+	}
+	return newMessage, true, nil
+}
+
+// isSameAppend compares everything given by client, so key reused for another message is detected
+func isSameAppend(stored model.Message, repeated model.Message) bool {
+	return stored.Message == repeated.Message &&
+		bytes.Equal(stored.Payload, repeated.Payload) &&
+		stored.ContentType == repeated.ContentType &&
+		maps.Equal(stored.Headers, repeated.Headers) &&
+		stored.Key == repeated.Key
+}
+
+func (payload AppendMessageRequest) newMessage() model.Message {
+	return model.Message{
+		Message:        payload.Message,
+		Key:            payload.Key,
+		Payload:        payload.Payload,
+		ContentType:    payload.ContentType,
+		Headers:        payload.Headers,
+		IdempotencyKey: payload.IdempotencyKey,
+		Timestamp:      time.Now().UnixMilli(),
+	}
+}
+
+// GetMessages returns the whole log or its page if 'from', 'limit' or 'to' is given
+func (h *HttpHandler) GetMessages(rw http.ResponseWriter, r *http.Request) {
+	if ownerUrl := h.partitions.owner(0); ownerUrl != "" {
+		h.partitions.proxy(rw, r, ownerUrl)
+		return
+	}
+	reader.ServeMessages(rw, r, h.storage, func() (int, bool) {
+		return 0, true // primary is never behind itself
+	})
+}
+
+// Subscribe streams messages as soon as they are appended
+func (h *HttpHandler) Subscribe(rw http.ResponseWriter, r *http.Request) {
+	if ownerUrl := h.partitions.owner(0); ownerUrl != "" {
+		h.partitions.proxy(rw, r, ownerUrl)
+		return
+	}
+	h.subscriptions.Serve(rw, r, h.storage)
+}
+
+// GetTopicMessages is GetMessages for the partition from path, the first one if partition is not in path
+func (h *HttpHandler) GetTopicMessages(rw http.ResponseWriter, r *http.Request) {
+	messages, ok := h.partitionFromPath(rw, r)
+	if !ok {
+		return
+	}
+	reader.ServeMessages(rw, r, messages, func() (int, bool) {
+		return 0, true // primary is never behind itself
+	})
+}
+
+// SubscribeTopic is Subscribe for the partition from path, the first one if partition is not in path
+func (h *HttpHandler) SubscribeTopic(rw http.ResponseWriter, r *http.Request) {
+	messages, ok := h.partitionFromPath(rw, r)
+	if !ok {
+		return
+	}
+	h.subscriptions.Serve(rw, r, messages)
+}
+
+// partitionFromPath returns log of the partition, request is proxied if partition is owned by another primary
+func (h *HttpHandler) partitionFromPath(rw http.ResponseWriter, r *http.Request) (storage.Storage, bool) {
+	partition := 0
+	if partitionToken, ok := mux.Vars(r)["partition"]; ok {
+		var err error
+		if partition, err = strconv.Atoi(partitionToken); err != nil {
+			http.Error(rw, "partition should be a number", http.StatusBadRequest)
+			return nil, false
+		}
+	}
+
+	if ownerUrl := h.partitions.owner(partition); ownerUrl != "" {
+		h.partitions.proxy(rw, r, ownerUrl)
+		return nil, false
+	}
+
+	messages, err := h.topics.Partition(mux.Vars(r)["name"], partition)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusNotFound)
+		return nil, false
+	}
+	return messages, true
+}
+
+func (h *HttpHandler) ListTopics(rw http.ResponseWriter, _ *http.Request) {
+	response := ListTopicsResponse{Topics: []TopicInfo{}}
+	for _, name := range h.topics.Names() {
+		if partitions, err := h.topics.Partitions(name); err == nil {
+			response.Topics = append(response.Topics, newTopicInfo(name, partitions))
+		}
+	}
+	writeJson(rw, http.StatusOK, response)
+}
+
+func newTopicInfo(name string, partitions []storage.Storage) TopicInfo {
+	info := TopicInfo{Name: name, Partitions: len(partitions), Offsets: make([]int64, len(partitions))}
+	for partition, messages := range partitions {
+		info.Offsets[partition] = int64(messages.GetOffset())
+	}
+	return info
+}
+
+func (h *HttpHandler) CreateTopic(rw http.ResponseWriter, r *http.Request) {
+	var payload TopicRequest
+
 	err := json.NewDecoder(r.Body).Decode(&payload)
 	if err != nil {
 		http.Error(rw, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	if h.executor.NoQuorum() {
-		log.Printf("No Quorum -- READ ONLY MODE, message '%v' is rejected", payload.Message)
-		rw.WriteHeader(http.StatusMethodNotAllowed)
+	if payload.Partitions == 0 {
+		payload.Partitions = 1
+	}
+
+	err = h.executor.CreateTopic(payload.Name, payload.Partitions)
+	if errors.Is(err, storage.ErrInvalidTopicName) || errors.Is(err, storage.ErrInvalidPartitions) {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	} else if errors.Is(err, storage.ErrTopicExists) || errors.Is(err, replication.ErrTopicIsBeingDeleted) {
+		http.Error(rw, err.Error(), http.StatusConflict)
 		return
 	}
 
-	message := h.storage.AddRawMessage(payload.Message)
-	h.executor.ReplicateMessage(message, payload.W-1)
+	writeJson(rw, http.StatusCreated, TopicInfo{Name: payload.Name, Partitions: payload.Partitions, Offsets: make([]int64, payload.Partitions)})
+}
+
+// DeleteTopic removes topic with all its messages, secondaries remove it in background
+func (h *HttpHandler) DeleteTopic(rw http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	err := h.executor.DeleteTopic(name)
+	if errors.Is(err, storage.ErrDefaultTopic) {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	} else if errors.Is(err, storage.ErrTopicNotFound) {
+		http.Error(rw, err.Error(), http.StatusNotFound)
+		return
+	}
 
-	log.Printf("Replication of message %d is done!\n", message.Id)
+	h.idempotency.forget(name)
 	rw.WriteHeader(http.StatusOK)
 }
 
-func (h *HttpHandler) GetMessages(rw http.ResponseWriter, _ *http.Request) {
-	messages := h.storage.GetMessages()
+// GetStatus explains whether primary accepts appends and why
+func (h *HttpHandler) GetStatus(rw http.ResponseWriter, _ *http.Request) {
+	quorum := h.executor.Quorum()
+	writeJson(rw, http.StatusOK, StatusResponse{
+		ReadOnly:           !quorum.HasQuorum,
+		Reason:             quorum.Reason,
+		Quorum:             quorum,
+		WriteConcernPolicy: h.executor.WriteConcernPolicy(),
+	})
+}
 
-	rw.Header().Set("Content-Type", "application/json")
+// GetClusterStatus reports health and replication lag of every secondary
+func (h *HttpHandler) GetClusterStatus(rw http.ResponseWriter, _ *http.Request) {
+	response := ClusterStatusResponse{
+		PrimaryOffset: int64(h.storage.GetOffset()),
+		Secondaries:   []SecondaryReplicationStatus{},
+	}
+	for _, secondaryUrl := range h.executor.Secondaries() {
+		health := h.executor.SecondaryHealth(secondaryUrl)
+		lag := h.executor.ReplicationLag(secondaryUrl, storage.DefaultTopic, 0)
+		status := SecondaryReplicationStatus{
+			Url:             secondaryUrl,
+			Status:          health.Status,
+			HighestAckedId:  lag.HighestAckedId,
+			LagMessages:     lag.Messages,
+			LagSeconds:      lag.Duration.Seconds(),
+			InFlightRetries: lag.InFlight,
+		}
+		if !health.LastSeen.IsZero() {
+			status.LastSeen = &health.LastSeen
+		}
+		response.Secondaries = append(response.Secondaries, status)
+	}
+
+	for _, name := range h.topics.Names() {
+		partitions, err := h.topics.Partitions(name)
+		if name == storage.DefaultTopic || err != nil {
+			continue
+		}
+		for partition, messages := range partitions {
+			if h.partitions.owner(partition) != "" {
+				continue // replicated by another primary
+			}
+			response.Topics = append(response.Topics, h.partitionReplicationStatus(name, partition, messages))
+		}
+	}
+
+	writeJson(rw, http.StatusOK, response)
+}
+
+func (h *HttpHandler) partitionReplicationStatus(name string, partition int, messages storage.Storage) TopicReplicationStatus {
+	status := TopicReplicationStatus{
+		Name:          name,
+		Partition:     partition,
+		PrimaryOffset: int64(messages.GetOffset()),
+		Secondaries:   []SecondaryTopicStatus{},
+	}
+	for _, secondaryUrl := range h.executor.Secondaries() {
+		lag := h.executor.ReplicationLag(secondaryUrl, name, partition)
+		status.Secondaries = append(status.Secondaries, SecondaryTopicStatus{
+			Url:             secondaryUrl,
+			HighestAckedId:  lag.HighestAckedId,
+			LagMessages:     lag.Messages,
+			LagSeconds:      lag.Duration.Seconds(),
+			InFlightRetries: lag.InFlight,
+		})
+	}
+	return status
+}
+
+func (h *HttpHandler) CleanStorage(rw http.ResponseWriter, _ *http.Request) {
+	h.topics.Clear()
+	h.idempotency.clear()
 	rw.WriteHeader(http.StatusOK)
-	rawResponse, _ := json.Marshal(GetMessagesResponse{Messages: messages})
+}
 
-	log.Printf("Get messages: %v", messages)
+func (h *HttpHandler) ListSecondaries(rw http.ResponseWriter, _ *http.Request) {
+	response := ListSecondariesResponse{Secondaries: []SecondaryInfo{}}
+	for _, secondaryUrl := range h.executor.Secondaries() {
+		health := h.executor.SecondaryHealth(secondaryUrl)
+		info := SecondaryInfo{
+			Url:                 secondaryUrl,
+			Status:              health.Status,
+			RttMilliseconds:     float64(health.RTT) / float64(time.Millisecond),
+			ConsecutiveFailures: health.ConsecutiveFailures,
+		}
+		if !health.LastSeen.IsZero() {
+			info.LastSeen = &health.LastSeen
+		}
+		response.Secondaries = append(response.Secondaries, info)
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	rawResponse, _ := json.Marshal(response)
 	_, _ = rw.Write(rawResponse)
 }
 
-func (h *HttpHandler) CleanStorage(rw http.ResponseWriter, _ *http.Request) {
-	h.storage.Clear()
+func (h *HttpHandler) AddSecondary(rw http.ResponseWriter, r *http.Request) {
+	var payload SecondaryRequest
+
+	err := json.NewDecoder(r.Body).Decode(&payload)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = h.executor.AddSecondary(payload.Url)
+	if errors.Is(err, replication.ErrInvalidSecondaryUrl) {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	} else if errors.Is(err, replication.ErrSecondaryExists) {
+		http.Error(rw, err.Error(), http.StatusConflict)
+		return
+	}
+
+	logger.Info("Secondary is added to the cluster", "secondary", payload.Url)
 	rw.WriteHeader(http.StatusOK)
 }
 
-func createRouter(handler *HttpHandler) *mux.Router {
+func (h *HttpHandler) RemoveSecondary(rw http.ResponseWriter, r *http.Request) {
+	secondaryUrl := r.URL.Query().Get("url")
+
+	err := h.executor.RemoveSecondary(secondaryUrl)
+	if errors.Is(err, replication.ErrSecondaryNotFound) {
+		http.Error(rw, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	logger.Info("Secondary is removed from the cluster", "secondary", secondaryUrl)
+	rw.WriteHeader(http.StatusOK)
+}
+
+// GetDivergence reports ranges where secondaries differ from primary, found by the last anti-entropy check
+func (h *HttpHandler) GetDivergence(rw http.ResponseWriter, _ *http.Request) {
+	divergences := h.executor.Divergences()
+	response := DivergenceResponse{Secondaries: []SecondaryDivergence{}}
+	for _, secondaryUrl := range h.executor.Secondaries() {
+		info := SecondaryDivergence{Url: secondaryUrl, Ranges: []DivergentRangeInfo{}}
+		if divergence, ok := divergences[secondaryUrl]; ok {
+			info.CheckedAt = &divergence.CheckedAt
+			for _, divergentRange := range divergence.Ranges {
+				info.Ranges = append(info.Ranges, DivergentRangeInfo{
+					Topic:     divergentRange.Topic,
+					Partition: divergentRange.Partition,
+					From:      divergentRange.From,
+					To:        divergentRange.To,
+					Repaired:  divergentRange.Repaired,
+				})
+			}
+		}
+		response.Secondaries = append(response.Secondaries, info)
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	rawResponse, _ := json.Marshal(response)
+	_, _ = rw.Write(rawResponse)
+}
+
+// DownloadSnapshot returns archive of all messages of the primary, it can be used to seed a secondary
+func (h *HttpHandler) DownloadSnapshot(rw http.ResponseWriter, r *http.Request) {
+	snapshot.ServeDownload(rw, r, h.topics)
+}
+
+// NewHttpHandler creates handler of the topics replicated by executor, storage is the log of the default topic
+func NewHttpHandler(storage storage.Storage, executor *replication.Executor, appendTimeout time.Duration, m *metrics.Metrics) *HttpHandler {
+	maxMessageSize := 1024 * 1024 // default value
+	if sizeToken, okSize := os.LookupEnv("MAX_MESSAGE_SIZE_BYTES"); okSize {
+		maxMessageSize, _ = strconv.Atoi(sizeToken)
+	}
+
+	h := &HttpHandler{
+		storage:        storage,
+		topics:         executor.Topics(),
+		executor:       executor,
+		appendTimeout:  appendTimeout,
+		maxMessageSize: maxMessageSize,
+		metrics:        m,
+		subscriptions:  reader.NewSubscriptions(),
+		idempotency:    newIdempotencyWindows(),
+		partitions:     newPartitionRouter(),
+	}
+	// keys of the default topic are restored at once, of other topics -- on their first append
+	h.idempotency.of("", 0, storage)
+
+	return h
+}
+
+// AppendTimeoutFromEnv returns default time to wait for write concern
+func AppendTimeoutFromEnv() time.Duration {
+	appendTimeout := 10 * time.Second // default value, should be less than server WriteTimeout
+	if appendTimeoutToken, okTimeout := os.LookupEnv("APPEND_TIMEOUT_MILLISECONDS"); okTimeout {
+		value, _ := strconv.Atoi(appendTimeoutToken)
+		appendTimeout = time.Duration(value) * time.Millisecond
+	}
+	return appendTimeout
+}
+
+func (h *HttpHandler) Drain(ctx context.Context) {
+	h.executor.Drain(ctx)
+}
+
+func (h *HttpHandler) Close() {
+	h.executor.Close()
+}
+
+func writeJson(rw http.ResponseWriter, statusCode int, response any) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(statusCode)
+	rawResponse, _ := json.Marshal(response)
+	_, _ = rw.Write(rawResponse)
+}
+
+func createRouter(handler *HttpHandler, a *auth.Authenticator) *mux.Router {
 	r := mux.NewRouter()
 
-	r.HandleFunc("/api/v1/append", handler.AppendMessage).Methods(http.MethodPost)
-	r.HandleFunc("/api/v1/messages", handler.GetMessages).Methods(http.MethodGet)
-	r.HandleFunc("/api/test/clean", handler.CleanStorage).Methods(http.MethodPost)
+	r.HandleFunc("/api/v1/append", a.Client(handler.AppendMessage)).Methods(http.MethodPost)
+	r.HandleFunc("/api/v1/messages", a.Client(handler.GetMessages)).Methods(http.MethodGet)
+	r.HandleFunc("/api/v1/subscribe", a.Client(handler.Subscribe)).Methods(http.MethodGet)
+	r.HandleFunc("/api/v1/topics/{name}/append", a.Client(handler.AppendTopicMessage)).Methods(http.MethodPost)
+	r.HandleFunc("/api/v1/topics/{name}/messages", a.Client(handler.GetTopicMessages)).Methods(http.MethodGet)
+	r.HandleFunc("/api/v1/topics/{name}/subscribe", a.Client(handler.SubscribeTopic)).Methods(http.MethodGet)
+	r.HandleFunc("/api/v1/topics/{name}/partitions/{partition}/append", a.Client(handler.AppendPartitionMessage)).Methods(http.MethodPost)
+	r.HandleFunc("/api/v1/topics/{name}/partitions/{partition}/messages", a.Client(handler.GetTopicMessages)).Methods(http.MethodGet)
+	r.HandleFunc("/api/v1/topics/{name}/partitions/{partition}/subscribe", a.Client(handler.SubscribeTopic)).Methods(http.MethodGet)
+	r.HandleFunc("/api/v1/status", a.Client(handler.GetStatus)).Methods(http.MethodGet)
+	r.HandleFunc("/api/v1/cluster/status", a.Client(handler.GetClusterStatus)).Methods(http.MethodGet)
+	r.HandleFunc("/api/v1/liveness", server.Liveness).Methods(http.MethodGet)
+	r.Handle("/metrics", handler.metrics.Handler()).Methods(http.MethodGet)
+	r.HandleFunc("/api/v1/admin/secondaries", a.Admin(handler.ListSecondaries)).Methods(http.MethodGet)
+	r.HandleFunc("/api/v1/admin/secondaries", a.Admin(handler.AddSecondary)).Methods(http.MethodPost)
+	r.HandleFunc("/api/v1/admin/secondaries", a.Admin(handler.RemoveSecondary)).Methods(http.MethodDelete)
+	r.HandleFunc("/api/v1/admin/topics", a.Admin(handler.ListTopics)).Methods(http.MethodGet)
+	r.HandleFunc("/api/v1/admin/topics", a.Admin(handler.CreateTopic)).Methods(http.MethodPost)
+	r.HandleFunc("/api/v1/admin/topics/{name}", a.Admin(handler.DeleteTopic)).Methods(http.MethodDelete)
+	r.HandleFunc("/api/v1/admin/snapshot", a.Admin(handler.DownloadSnapshot)).Methods(http.MethodGet)
+	r.HandleFunc("/api/v1/admin/divergence", a.Admin(handler.GetDivergence)).Methods(http.MethodGet)
+	r.HandleFunc("/api/test/clean", a.Admin(handler.CleanStorage)).Methods(http.MethodPost)
 
 	return r
 }
 
-func NewPrimaryServer() *http.Server {
-	handler := &HttpHandler{
-		storage:  storage.NewInMemoryStorage(),
-		executor: replication.NewExecutor(),
-	}
+func NewPrimaryServer() *server.GracefulServer {
+	topics := storage.NewTopics()
+	m := metrics.NewMetrics()
+	m.RegisterStorage(topics.Default())
+	executor := replication.NewTopicsExecutor(topics, m)
+	handler := NewHttpHandler(topics.Default(), executor, AppendTimeoutFromEnv(), m)
+	// secondaries don't run retention, they follow the primary
+	retention := storage.NewRetention(topics)
+	retention.OnApplied(executor.ReplicateRetention)
+	retention.Start()
 
 	port, ok := os.LookupEnv("PRIMARY_SERVER_PORT")
 	if !ok {
 		port = "8000"
 	}
 
-	headersOk := handlers.AllowedHeaders([]string{"X-Requested-With", "Authorization", "Content-Type"})
-	originsOk := handlers.AllowedOrigins([]string{"*"})
+	headersOk := handlers.AllowedHeaders([]string{"X-Requested-With", "Authorization", "Content-Type", logging.CorrelationIdHeader, IdempotencyKeyHeader, auth.SignatureTimestampHeader})
+	originsOk := handlers.AllowedOrigins(auth.AllowedOrigins())
 	methodsOk := handlers.AllowedMethods([]string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete, http.MethodOptions})
 
-	srv := &http.Server{
-		Handler:      handlers.CORS(originsOk, headersOk, methodsOk)(createRouter(handler)),
+	srv := server.NewGracefulServer(&http.Server{
+		Handler:      handlers.CORS(originsOk, headersOk, methodsOk)(createRouter(handler, auth.NewAuthenticator())),
 		Addr:         "0.0.0.0:" + port,
+		TLSConfig:    auth.HttpServerTLSConfig(),
 		WriteTimeout: 15 * time.Second,
 		ReadTimeout:  15 * time.Second,
-	}
+	})
 
-	srv.RegisterOnShutdown(func() {
-		handler.executor.Close()
+	// streams are closed first, otherwise shutdown waits for them until timeout
+	srv.RegisterOnShutdown(handler.subscriptions.Close)
+	srv.RegisterOnDrain(func(ctx context.Context) {
+		handler.Drain(ctx)
+		handler.Close()
+		retention.Close()
+		handler.topics.Close()
 	})
 
 	return srv
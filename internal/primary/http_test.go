@@ -7,17 +7,21 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"replicated-log/internal/logging"
 	"replicated-log/internal/model"
 	"replicated-log/internal/storage"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestAppendMessageWithOneSecondary(t *testing.T) {
 	// GIVEN
 	messageRequest := AppendMessageRequest{W: 2, Message: "Test"}
 	b, _ := json.Marshal(messageRequest)
+	var replicatedTimestamp atomic.Int64
 
 	secondary := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
 		if r.Method == http.MethodGet {
@@ -29,6 +33,7 @@ func TestAppendMessageWithOneSecondary(t *testing.T) {
 			// THEN
 			assert.NoError(t, err)
 			assert.Equal(t, messageRequest.Message, actualMessage.Message)
+			replicatedTimestamp.Store(actualMessage.Timestamp)
 			rw.WriteHeader(http.StatusOK)
 		}
 	}))
@@ -63,6 +68,14 @@ func TestAppendMessageWithOneSecondary(t *testing.T) {
 
 		// THEN
 		assert.Equal(t, http.StatusOK, resp.Code)
+
+		var data AppendMessageResponse
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&data))
+		assert.Equal(t, model.MessageId(0), data.Id)
+		assert.True(t, time.UnixMilli(replicatedTimestamp.Load()).Equal(data.Timestamp), "timestamp of the stored message")
+		assert.Equal(t, 2, data.W)
+		assert.Equal(t, 2, data.AchievedW)
+		assert.Equal(t, []string{secondary.URL}, data.AckedBy)
 	})
 
 	t.Run("Update message list contains appended message", func(t *testing.T) {
@@ -256,3 +269,557 @@ func TestIfPrimaryRejectsAppendMessageIfThereIsNoQuorum(t *testing.T) {
 	// THEN
 	assert.Equal(t, http.StatusMethodNotAllowed, resp.Code)
 }
+
+func TestIfPrimaryReturnsGatewayTimeoutIfWriteConcernIsNotSatisfiedInTime(t *testing.T) {
+	// GIVEN
+	ready := make(chan struct{}) // to emulate broken secondary
+	secondary := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			// health-check
+			rw.WriteHeader(http.StatusOK)
+		} else {
+			select {
+			case <-ready:
+				rw.WriteHeader(http.StatusOK)
+			case <-r.Context().Done():
+			}
+		}
+	}))
+	defer secondary.Close()
+	defer close(ready)
+
+	t.Setenv("SECONDARY_URLS", secondary.URL)
+	t.Setenv("REQUEST_TIMEOUT_MILLISECONDS", "1000")
+
+	primary := NewPrimaryServer()
+	handler := primary.Handler
+
+	messageRequest := AppendMessageRequest{W: 2, Message: "test", TimeoutMilliseconds: 50}
+	b, _ := json.Marshal(messageRequest)
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/append", strings.NewReader(string(b)))
+	resp := httptest.NewRecorder()
+
+	// WHEN
+	handler.ServeHTTP(resp, req)
+
+	// THEN
+	assert.Equal(t, http.StatusGatewayTimeout, resp.Code)
+
+	var data WriteConcernErrorResponse
+	err := json.NewDecoder(resp.Body).Decode(&data)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, data.W)
+	assert.Equal(t, 1, data.AchievedW)
+}
+
+func TestSecondariesCanBeManagedAtRuntime(t *testing.T) {
+	// GIVEN
+	handlerFunc := func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}
+	secondaryA := httptest.NewServer(http.HandlerFunc(handlerFunc))
+	defer secondaryA.Close()
+	secondaryB := httptest.NewServer(http.HandlerFunc(handlerFunc))
+	defer secondaryB.Close()
+
+	t.Setenv("SECONDARY_URLS", secondaryA.URL)
+	primary := NewPrimaryServer()
+	handler := primary.Handler
+
+	listSecondaries := func() []SecondaryInfo {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/admin/secondaries", nil)
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		require.Equal(t, http.StatusOK, resp.Code)
+
+		var data ListSecondariesResponse
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&data))
+		for i := range data.Secondaries {
+			require.NotNil(t, data.Secondaries[i].LastSeen)
+			// only membership and status are checked
+			data.Secondaries[i] = SecondaryInfo{Url: data.Secondaries[i].Url, Status: data.Secondaries[i].Status}
+		}
+		return data.Secondaries
+	}
+
+	t.Run("Initial secondaries come from env", func(t *testing.T) {
+		assert.Equal(t, []SecondaryInfo{{Url: secondaryA.URL, Status: "ALIVE"}}, listSecondaries())
+	})
+
+	t.Run("Add secondary", func(t *testing.T) {
+		// GIVEN
+		b, _ := json.Marshal(SecondaryRequest{Url: secondaryB.URL})
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/admin/secondaries", strings.NewReader(string(b)))
+		resp := httptest.NewRecorder()
+
+		// WHEN
+		handler.ServeHTTP(resp, req)
+
+		// THEN
+		assert.Equal(t, http.StatusOK, resp.Code)
+		assert.Len(t, listSecondaries(), 2)
+	})
+
+	t.Run("Adding the same secondary again is a conflict", func(t *testing.T) {
+		// GIVEN
+		b, _ := json.Marshal(SecondaryRequest{Url: secondaryB.URL})
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/admin/secondaries", strings.NewReader(string(b)))
+		resp := httptest.NewRecorder()
+
+		// WHEN
+		handler.ServeHTTP(resp, req)
+
+		// THEN
+		assert.Equal(t, http.StatusConflict, resp.Code)
+	})
+
+	t.Run("Remove secondary", func(t *testing.T) {
+		// GIVEN
+		req := httptest.NewRequest(http.MethodDelete, "/api/v1/admin/secondaries?url="+secondaryA.URL, nil)
+		resp := httptest.NewRecorder()
+
+		// WHEN
+		handler.ServeHTTP(resp, req)
+
+		// THEN
+		assert.Equal(t, http.StatusOK, resp.Code)
+		assert.Equal(t, []SecondaryInfo{{Url: secondaryB.URL, Status: "ALIVE"}}, listSecondaries())
+	})
+
+	t.Run("Removing unknown secondary is not found", func(t *testing.T) {
+		// GIVEN
+		req := httptest.NewRequest(http.MethodDelete, "/api/v1/admin/secondaries?url="+secondaryA.URL, nil)
+		resp := httptest.NewRecorder()
+
+		// WHEN
+		handler.ServeHTTP(resp, req)
+
+		// THEN
+		assert.Equal(t, http.StatusNotFound, resp.Code)
+	})
+}
+
+func TestPrimaryWithoutSecondariesAcceptsOnlyWriteConcernOfOne(t *testing.T) {
+	// GIVEN
+	secondary := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer secondary.Close()
+
+	t.Setenv("SECONDARY_URLS", secondary.URL)
+	primary := NewPrimaryServer()
+	handler := primary.Handler
+
+	req := httptest.NewRequest(http.MethodDelete, "/api/v1/admin/secondaries?url="+secondary.URL, nil)
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	require.Equal(t, http.StatusOK, resp.Code)
+
+	appendWith := func(w int) int {
+		b, _ := json.Marshal(AppendMessageRequest{W: w, Message: "test"})
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/append", strings.NewReader(string(b)))
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		return resp.Code
+	}
+
+	// WHEN
+	singleAckCode := appendWith(1)
+	secondaryAckCode := appendWith(2)
+
+	// THEN
+	assert.Equal(t, http.StatusOK, singleAckCode, "primary alone is the whole cluster")
+	assert.Equal(t, http.StatusBadRequest, secondaryAckCode, "write concern cannot be satisfied")
+}
+
+func TestStatusExplainsWhyPrimaryIsReadOnly(t *testing.T) {
+	// GIVEN
+	secondary := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer secondary.Close()
+
+	t.Setenv("SECONDARY_URLS", secondary.URL)
+	primary := NewPrimaryServer()
+	handler := primary.Handler
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/status", nil)
+	resp := httptest.NewRecorder()
+
+	// WHEN
+	handler.ServeHTTP(resp, req)
+
+	// THEN
+	require.Equal(t, http.StatusOK, resp.Code)
+
+	var data StatusResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&data))
+	assert.True(t, data.ReadOnly)
+	assert.Equal(t, "MAJORITY policy requires 1 alive secondaries, but 0 of 1 are alive", data.Reason)
+	assert.Equal(t, 1, data.Quorum.RequiredAlive)
+	assert.Equal(t, 0, data.Quorum.Alive)
+	assert.Equal(t, "BLOCK", data.WriteConcernPolicy)
+}
+
+func TestIfPrimaryRejectsWriteConcernWhichCannotBeSatisfied(t *testing.T) {
+	// GIVEN
+	liveSecondary := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			t.Fatal("Replication is not expected to be called")
+		}
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer liveSecondary.Close()
+	deadSecondary := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer deadSecondary.Close()
+
+	t.Setenv("SECONDARY_URLS", liveSecondary.URL+","+deadSecondary.URL)
+	t.Setenv("WRITE_CONCERN_POLICY", "REJECT")
+	primary := NewPrimaryServer()
+	handler := primary.Handler
+
+	testCases := []struct {
+		name           string
+		w              int
+		expectedStatus int
+	}{
+		{"w is less than 1", 0, http.StatusBadRequest},
+		{"w is bigger than cluster", 4, http.StatusBadRequest},
+		{"w is bigger than number of alive nodes", 3, http.StatusServiceUnavailable},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			b, _ := json.Marshal(AppendMessageRequest{W: tc.w, Message: "test"})
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/append", strings.NewReader(string(b)))
+			resp := httptest.NewRecorder()
+
+			// WHEN
+			handler.ServeHTTP(resp, req)
+
+			// THEN
+			assert.Equal(t, tc.expectedStatus, resp.Code)
+		})
+	}
+
+	// rejected appends leave no trace in the log
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/messages", nil)
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	assert.JSONEq(t, `{"messages":[]}`, resp.Body.String())
+}
+
+func TestCorrelationIdIsPropagatedToSecondaries(t *testing.T) {
+	// GIVEN
+	correlationIds := make(chan string, 1)
+	secondary := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			correlationIds <- r.Header.Get(logging.CorrelationIdHeader)
+		}
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer secondary.Close()
+
+	t.Setenv("SECONDARY_URLS", secondary.URL)
+	primary := NewPrimaryServer()
+	handler := primary.Handler
+
+	b, _ := json.Marshal(AppendMessageRequest{W: 2, Message: "test"})
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/append", strings.NewReader(string(b)))
+	resp := httptest.NewRecorder()
+
+	// WHEN
+	handler.ServeHTTP(resp, req)
+
+	// THEN
+	require.Equal(t, http.StatusOK, resp.Code)
+	correlationId := resp.Header().Get(logging.CorrelationIdHeader)
+	require.NotEmpty(t, correlationId)
+	require.Equal(t, correlationId, <-correlationIds)
+}
+
+func TestClusterStatusReportsReplicationLag(t *testing.T) {
+	// GIVEN
+	secondary := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer secondary.Close()
+
+	t.Setenv("SECONDARY_URLS", secondary.URL)
+	primary := NewPrimaryServer()
+	handler := primary.Handler
+
+	for _, message := range []string{"first", "second"} {
+		b, _ := json.Marshal(AppendMessageRequest{W: 2, Message: message})
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/append", strings.NewReader(string(b)))
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		require.Equal(t, http.StatusOK, resp.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/cluster/status", nil)
+	resp := httptest.NewRecorder()
+
+	// WHEN
+	handler.ServeHTTP(resp, req)
+
+	// THEN
+	require.Equal(t, http.StatusOK, resp.Code)
+
+	var data ClusterStatusResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&data))
+	assert.Equal(t, int64(2), data.PrimaryOffset)
+	require.Len(t, data.Secondaries, 1)
+	assert.Equal(t, secondary.URL, data.Secondaries[0].Url)
+	assert.Equal(t, "ALIVE", data.Secondaries[0].Status)
+	assert.Equal(t, int64(1), data.Secondaries[0].HighestAckedId)
+	assert.Equal(t, 0, data.Secondaries[0].LagMessages)
+	assert.Equal(t, 0, data.Secondaries[0].InFlightRetries)
+}
+
+func TestRetriedAppendWithIdempotencyKeyIsNotDuplicated(t *testing.T) {
+	// GIVEN
+	secondary := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer secondary.Close()
+
+	t.Setenv("SECONDARY_URLS", secondary.URL)
+	primary := NewPrimaryServer()
+	handler := primary.Handler
+
+	appendRequest := func(request AppendMessageRequest) *httptest.ResponseRecorder {
+		request.W = 2
+		b, _ := json.Marshal(request)
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/append", strings.NewReader(string(b)))
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		return resp
+	}
+	appendMessage := func(message string, key string) *httptest.ResponseRecorder {
+		return appendRequest(AppendMessageRequest{Message: message, IdempotencyKey: key})
+	}
+
+	// WHEN
+	original := appendMessage("first", "key-1")
+	retried := appendMessage("first", "key-1")
+	reused := appendMessage("second", "key-1")
+	reusedWithHeaders := appendRequest(AppendMessageRequest{Message: "first", IdempotencyKey: "key-1", Headers: map[string]string{"a": "b"}})
+
+	// THEN
+	require.Equal(t, http.StatusOK, original.Code)
+	require.Equal(t, http.StatusOK, retried.Code)
+	assert.Equal(t, original.Body.String(), retried.Body.String())
+	assert.Equal(t, "true", retried.Header().Get(IdempotentReplayedHeader))
+	assert.Equal(t, http.StatusUnprocessableEntity, reused.Code)
+	assert.Equal(t, http.StatusUnprocessableEntity, reusedWithHeaders.Code)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/messages", nil)
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	assert.JSONEq(t, `{"messages":["first"]}`, resp.Body.String())
+}
+
+func TestConcurrentRepeatWaitsForTheOriginalAppend(t *testing.T) {
+	// GIVEN
+	correlationIds := make(chan string, 100)
+	release := make(chan struct{})
+	secondary := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			correlationIds <- r.Header.Get(logging.CorrelationIdHeader)
+			<-release
+		}
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer secondary.Close()
+
+	t.Setenv("SECONDARY_URLS", secondary.URL)
+	primary := NewPrimaryServer()
+	handler := primary.Handler
+
+	appendMessage := func(responses chan<- *httptest.ResponseRecorder) {
+		b, _ := json.Marshal(AppendMessageRequest{W: 2, Message: "first", IdempotencyKey: "key-1"})
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/append", strings.NewReader(string(b)))
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		responses <- resp
+	}
+	originalResponse := make(chan *httptest.ResponseRecorder, 1)
+	go appendMessage(originalResponse)
+	<-correlationIds
+
+	// WHEN
+	repeatedResponse := make(chan *httptest.ResponseRecorder, 1)
+	go appendMessage(repeatedResponse)
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	// THEN
+	original, repeated := <-originalResponse, <-repeatedResponse
+	require.Equal(t, http.StatusOK, original.Code)
+	require.Equal(t, http.StatusOK, repeated.Code)
+	assert.Equal(t, original.Body.String(), repeated.Body.String())
+	assert.Equal(t, "true", repeated.Header().Get(IdempotentReplayedHeader))
+	for len(correlationIds) > 0 {
+		// retries of the original append are fine
+		assert.Equal(t, original.Header().Get(logging.CorrelationIdHeader), <-correlationIds, "repeat should not replicate the message again")
+	}
+}
+
+func TestBinaryMessageIsStoredExactly(t *testing.T) {
+	// GIVEN
+	replicated := make(chan model.Message, 1)
+	secondary := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			var message model.Message
+			_ = json.NewDecoder(r.Body).Decode(&message)
+			replicated <- message
+		}
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer secondary.Close()
+
+	t.Setenv("SECONDARY_URLS", secondary.URL)
+	t.Setenv("MAX_MESSAGE_SIZE_BYTES", "64")
+	primary := NewPrimaryServer()
+	handler := primary.Handler
+
+	payload := []byte{0x00, 0xff, 0x0a, 0x80, '"'}
+	headers := map[string]string{"schema": "v1"}
+
+	t.Run("Binary message is appended", func(t *testing.T) {
+		// GIVEN
+		b, _ := json.Marshal(AppendMessageRequest{W: 2, Payload: payload, ContentType: "application/x-protobuf", Headers: headers})
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/append", strings.NewReader(string(b)))
+		resp := httptest.NewRecorder()
+
+		// WHEN
+		handler.ServeHTTP(resp, req)
+
+		// THEN
+		require.Equal(t, http.StatusOK, resp.Code)
+		message := <-replicated
+		assert.Equal(t, payload, message.Payload)
+		assert.Equal(t, "application/x-protobuf", message.ContentType)
+		assert.Equal(t, headers, message.Headers)
+	})
+
+	t.Run("Binary message is read back", func(t *testing.T) {
+		// GIVEN
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/messages?from=0", nil)
+		resp := httptest.NewRecorder()
+
+		// WHEN
+		handler.ServeHTTP(resp, req)
+
+		// THEN
+		require.Equal(t, http.StatusOK, resp.Code)
+		var data GetMessagesResponse
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&data))
+		require.Len(t, data.Entries, 1)
+		assert.Equal(t, payload, data.Entries[0].Payload)
+		assert.Equal(t, "application/x-protobuf", data.Entries[0].ContentType)
+		assert.Equal(t, headers, data.Entries[0].Headers)
+	})
+
+	t.Run("Too large message is rejected", func(t *testing.T) {
+		// GIVEN
+		b, _ := json.Marshal(AppendMessageRequest{W: 2, Payload: make([]byte, 65)})
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/append", strings.NewReader(string(b)))
+		resp := httptest.NewRecorder()
+
+		// WHEN
+		handler.ServeHTTP(resp, req)
+
+		// THEN
+		require.Equal(t, http.StatusRequestEntityTooLarge, resp.Code)
+		assert.JSONEq(t, `{"error":"message is 65 bytes, limit is 64 bytes","size":65,"max_size":64}`, resp.Body.String())
+	})
+
+	t.Run("Message cannot be both text and binary", func(t *testing.T) {
+		// GIVEN
+		b, _ := json.Marshal(AppendMessageRequest{W: 2, Message: "text", Payload: payload})
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/append", strings.NewReader(string(b)))
+		resp := httptest.NewRecorder()
+
+		// WHEN
+		handler.ServeHTTP(resp, req)
+
+		// THEN
+		require.Equal(t, http.StatusBadRequest, resp.Code)
+	})
+}
+
+func TestTopicsHaveSeparateSequences(t *testing.T) {
+	// GIVEN
+	replicated := make(chan model.Message, 10)
+	secondary := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			var message model.Message
+			_ = json.NewDecoder(r.Body).Decode(&message)
+			replicated <- message
+		}
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer secondary.Close()
+
+	t.Setenv("SECONDARY_URLS", secondary.URL)
+	primary := NewPrimaryServer()
+	handler := primary.Handler
+
+	send := func(method string, path string, body any) *httptest.ResponseRecorder {
+		b, _ := json.Marshal(body)
+		req := httptest.NewRequest(method, path, strings.NewReader(string(b)))
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		return resp
+	}
+
+	t.Run("Append to unknown topic is rejected", func(t *testing.T) {
+		resp := send(http.MethodPost, "/api/v1/topics/orders/append", AppendMessageRequest{W: 2, Message: "first"})
+		assert.Equal(t, http.StatusNotFound, resp.Code)
+	})
+
+	t.Run("Topic is created", func(t *testing.T) {
+		assert.Equal(t, http.StatusCreated, send(http.MethodPost, "/api/v1/admin/topics", TopicRequest{Name: "orders"}).Code)
+		assert.Equal(t, http.StatusConflict, send(http.MethodPost, "/api/v1/admin/topics", TopicRequest{Name: "orders"}).Code)
+		assert.Equal(t, http.StatusBadRequest, send(http.MethodPost, "/api/v1/admin/topics", TopicRequest{Name: "a/b"}).Code)
+	})
+
+	t.Run("Ids are assigned per topic", func(t *testing.T) {
+		// GIVEN
+		require.Equal(t, http.StatusOK, send(http.MethodPost, "/api/v1/append", AppendMessageRequest{W: 2, Message: "default"}).Code)
+		<-replicated
+
+		// WHEN
+		resp := send(http.MethodPost, "/api/v1/topics/orders/append", AppendMessageRequest{W: 2, Message: "first"})
+
+		// THEN
+		require.Equal(t, http.StatusOK, resp.Code)
+		var data AppendMessageResponse
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&data))
+		assert.Equal(t, model.MessageId(0), data.Id)
+		message := <-replicated
+		assert.Equal(t, "orders", message.Topic)
+	})
+
+	t.Run("Topic is read separately", func(t *testing.T) {
+		resp := send(http.MethodGet, "/api/v1/topics/orders/messages", nil)
+		assert.JSONEq(t, `{"messages":["first"]}`, resp.Body.String())
+		resp = send(http.MethodGet, "/api/v1/messages", nil)
+		assert.JSONEq(t, `{"messages":["default"]}`, resp.Body.String())
+	})
+
+	t.Run("Topics are listed", func(t *testing.T) {
+		resp := send(http.MethodGet, "/api/v1/admin/topics", nil)
+		assert.JSONEq(t, `{"topics":[{"name":"default","partitions":1,"offsets":[1]},{"name":"orders","partitions":1,"offsets":[1]}]}`, resp.Body.String())
+	})
+
+	t.Run("Topic is deleted", func(t *testing.T) {
+		assert.Equal(t, http.StatusBadRequest, send(http.MethodDelete, "/api/v1/admin/topics/default", nil).Code)
+		assert.Equal(t, http.StatusOK, send(http.MethodDelete, "/api/v1/admin/topics/orders", nil).Code)
+		assert.Equal(t, http.StatusNotFound, send(http.MethodGet, "/api/v1/topics/orders/messages", nil).Code)
+	})
+}
@@ -0,0 +1,241 @@
+package primary
+
+import (
+	"context"
+	"errors"
+	"os"
+	"replicated-log/internal/logging"
+	"replicated-log/internal/model"
+	"replicated-log/internal/storage"
+	"strconv"
+	"sync"
+)
+
+const (
+	// IdempotencyKeyHeader -- alternative to 'idempotency_key' field of the append request
+	IdempotencyKeyHeader = "Idempotency-Key"
+	// IdempotentReplayedHeader is set if response is the result of the original append
+	IdempotentReplayedHeader = "Idempotent-Replayed"
+)
+
+var ErrIdempotencyKeyReused = errors.New("idempotency key is already used for another message")
+
+// idempotencyWindow remembers ids assigned to the last appends with idempotency key,
+// so retried append does not create a second entry in the log.
+// Keys are stored in messages, so window is restored from durable storage after restart.
+type idempotencyWindow struct {
+	mu      *sync.Mutex
+	maxSize int
+	entries map[string]*idempotencyEntry
+	// keys in order of arrival, the oldest one is evicted when window is full
+	order []string
+}
+
+type idempotencyEntry struct {
+	id model.MessageId
+	// nil until write concern of the original append is satisfied
+	response *AppendMessageResponse
+	// closed when append which drives replication of the message is finished, nil if there is none
+	inProgress chan struct{}
+}
+
+// idempotencyWindowSize reads 'IDEMPOTENCY_WINDOW_SIZE' env var, zero disables deduplication
+func idempotencyWindowSize() int {
+	maxSize := 10000 // default value
+	if sizeToken, okSize := os.LookupEnv("IDEMPOTENCY_WINDOW_SIZE"); okSize {
+		value, err := strconv.Atoi(sizeToken)
+		if err != nil || value < 0 {
+			logging.Fatal(logger, "Given 'IDEMPOTENCY_WINDOW_SIZE' token is invalid", "token", sizeToken)
+		}
+		maxSize = value
+	}
+	return maxSize
+}
+
+func newIdempotencyWindow(source storage.Storage, maxSize int) *idempotencyWindow {
+	w := &idempotencyWindow{
+		mu:      &sync.Mutex{},
+		maxSize: maxSize,
+		entries: make(map[string]*idempotencyEntry),
+	}
+
+	// restore keys of the last messages
+	offset := source.GetOffset()
+	from := model.MessageId(0)
+	if int(offset) > maxSize {
+		from = offset - model.MessageId(maxSize)
+	}
+	for from < offset {
+		batch := source.GetMessagesRange(from, offset, 1000)
+		if len(batch) == 0 {
+			break
+		}
+		for _, message := range batch {
+			if message.IdempotencyKey != "" {
+				w.remember(message.IdempotencyKey, message.Id)
+			}
+		}
+		from = batch[len(batch)-1].Id + 1
+	}
+	if len(w.entries) > 0 {
+		logger.Info("Idempotency keys are restored", "keys", len(w.entries))
+	}
+
+	return w
+}
+
+// addOnce calls add only if the key is not in the window. Returns id assigned to the key and true if key is repeated.
+// Append which is not repeated drives replication of the message until release.
+func (w *idempotencyWindow) addOnce(key string, add func() model.MessageId) (model.MessageId, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if entry, ok := w.entries[key]; ok {
+		return entry.id, true
+	}
+
+	id := add()
+	w.remember(key, id)
+	if entry, ok := w.entries[key]; ok {
+		entry.inProgress = make(chan struct{})
+	}
+	return id, false
+}
+
+// acquire is called by repeated append. It waits while another append with the key drives replication and returns
+// its response if write concern is satisfied. Otherwise, the caller drives replication once again until release.
+func (w *idempotencyWindow) acquire(ctx context.Context, key string) (*AppendMessageResponse, error) {
+	for {
+		w.mu.Lock()
+		entry, ok := w.entries[key]
+		if !ok {
+			w.mu.Unlock()
+			return nil, nil // evicted, nobody else waits for it
+		}
+		if entry.response != nil {
+			w.mu.Unlock()
+			return entry.response, nil
+		}
+		inProgress := entry.inProgress
+		if inProgress == nil {
+			entry.inProgress = make(chan struct{})
+			w.mu.Unlock()
+			return nil, nil
+		}
+		w.mu.Unlock()
+
+		select {
+		case <-inProgress:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// release finishes append which drives replication, response is nil if write concern is not satisfied.
+// Repeats get the same response.
+func (w *idempotencyWindow) release(key string, response *AppendMessageResponse) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if entry, ok := w.entries[key]; ok {
+		if response != nil {
+			entry.response = response
+		}
+		entry.finish()
+	}
+}
+
+func (w *idempotencyWindow) clear() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, entry := range w.entries {
+		entry.finish()
+	}
+	w.entries = make(map[string]*idempotencyEntry)
+	w.order = nil
+}
+
+// finish wakes up repeats which wait for the entry, should be called under lock
+func (e *idempotencyEntry) finish() {
+	if e.inProgress != nil {
+		close(e.inProgress)
+		e.inProgress = nil
+	}
+}
+
+// remember should be called under lock
+func (w *idempotencyWindow) remember(key string, id model.MessageId) {
+	if w.maxSize <= 0 {
+		return
+	}
+
+	if entry, ok := w.entries[key]; ok {
+		entry.id = id
+		return
+	}
+
+	for len(w.order) >= w.maxSize {
+		w.entries[w.order[0]].finish()
+		delete(w.entries, w.order[0])
+		w.order = w.order[1:]
+	}
+	w.entries[key] = &idempotencyEntry{id: id}
+	w.order = append(w.order, key)
+}
+
+// idempotencyWindows -- ids are assigned per partition of a topic, so every partition has its own window
+type idempotencyWindows struct {
+	mu      *sync.Mutex
+	maxSize int
+	windows map[idempotencyScope]*idempotencyWindow
+}
+
+type idempotencyScope struct {
+	topic     string
+	partition int
+}
+
+func newIdempotencyWindows() *idempotencyWindows {
+	return &idempotencyWindows{
+		mu:      &sync.Mutex{},
+		maxSize: idempotencyWindowSize(), // read at startup, so invalid config is not found by the first append
+		windows: make(map[idempotencyScope]*idempotencyWindow),
+	}
+}
+
+// of returns window of the partition, it is restored from the partition storage on first use
+func (w *idempotencyWindows) of(topic string, partition int, source storage.Storage) *idempotencyWindow {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	scope := idempotencyScope{topic: topic, partition: partition}
+	window, ok := w.windows[scope]
+	if !ok {
+		window = newIdempotencyWindow(source, w.maxSize)
+		w.windows[scope] = window
+	}
+	return window
+}
+
+// forget drops windows of all partitions of the topic
+func (w *idempotencyWindows) forget(topic string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for scope := range w.windows {
+		if scope.topic == topic {
+			delete(w.windows, scope)
+		}
+	}
+}
+
+func (w *idempotencyWindows) clear() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, window := range w.windows {
+		window.clear()
+	}
+}
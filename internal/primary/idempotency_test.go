@@ -0,0 +1,55 @@
+package primary
+
+import (
+	"github.com/stretchr/testify/require"
+	"replicated-log/internal/model"
+	"replicated-log/internal/storage"
+	"testing"
+)
+
+func TestIdempotencyWindowEvictsTheOldestKey(t *testing.T) {
+	// GIVEN
+	source := storage.NewInMemoryStorage()
+	window := newIdempotencyWindow(source, 2)
+
+	add := func(key string) (model.MessageId, bool) {
+		return window.addOnce(key, func() model.MessageId {
+			return source.AddNewMessage(model.Message{Message: key, IdempotencyKey: key}).Id
+		})
+	}
+
+	// WHEN
+	_, _ = add("a")
+	_, _ = add("b")
+	idB, isRepeatB := add("b")
+	_, _ = add("c")
+	idA, isRepeatA := add("a")
+
+	// THEN
+	require.True(t, isRepeatB)
+	require.Equal(t, model.MessageId(1), idB)
+	require.False(t, isRepeatA, "key 'a' should be evicted by 'c'")
+	require.Equal(t, model.MessageId(3), idA)
+}
+
+func TestIdempotencyKeysAreRestoredFromDurableStorage(t *testing.T) {
+	// GIVEN
+	dir := t.TempDir()
+	source := storage.NewWalStorage(dir)
+	source.AddNewMessage(model.Message{Message: "first", IdempotencyKey: "key-1"})
+	source.AddRawMessage("second")
+	source.Close()
+
+	// WHEN
+	restarted := storage.NewWalStorage(dir)
+	defer restarted.Close()
+	window := newIdempotencyWindow(restarted, idempotencyWindowSize())
+
+	// THEN
+	id, isRepeat := window.addOnce("key-1", func() model.MessageId {
+		t.Fatal("Message with restored key should not be added again")
+		return 0
+	})
+	require.True(t, isRepeat)
+	require.Equal(t, model.MessageId(0), id)
+}
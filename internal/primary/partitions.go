@@ -0,0 +1,103 @@
+package primary
+
+import (
+	"hash/fnv"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"replicated-log/internal/auth"
+	"replicated-log/internal/logging"
+	"slices"
+	"strings"
+	"sync/atomic"
+)
+
+// proxiedHeader marks requests proxied to the owner of a partition, so they are never proxied twice
+const proxiedHeader = "X-Replicated-Log-Partition-Proxied"
+
+// partitionRouter -- partitions of topics are spread over primaries from 'PARTITION_PRIMARY_URLS':
+// partition p is owned by the primary number p mod number of primaries. Every primary appends and replicates
+// only partitions it owns to its own secondaries, so every partition has its own replica set.
+// Without 'PARTITION_PRIMARY_URLS' all partitions are owned by this primary.
+type partitionRouter struct {
+	selfUrl     string
+	primaryUrls []string
+	// TLS config of the node, used to proxy client requests to the owner
+	proxyTransport http.RoundTripper
+	// next partition for appends without key
+	next *atomic.Uint64
+}
+
+func newPartitionRouter() *partitionRouter {
+	var primaryUrls []string
+	if primaryUrlsToken, ok := os.LookupEnv("PARTITION_PRIMARY_URLS"); ok && primaryUrlsToken != "" {
+		primaryUrls = strings.Split(primaryUrlsToken, ",")
+	}
+
+	selfUrl := os.Getenv("SELF_URL")
+	if len(primaryUrls) > 0 && !slices.Contains(primaryUrls, selfUrl) {
+		logging.Fatal(logger, "'SELF_URL' should be one of 'PARTITION_PRIMARY_URLS'", "self_url", selfUrl)
+	}
+
+	return &partitionRouter{
+		selfUrl:        selfUrl,
+		primaryUrls:    primaryUrls,
+		proxyTransport: auth.InternalCredentials().RoundTripper(),
+		next:           &atomic.Uint64{},
+	}
+}
+
+// owner returns url of the primary which owns the partition, empty if it is this one
+func (p *partitionRouter) owner(partition int) string {
+	if len(p.primaryUrls) == 0 {
+		return ""
+	}
+	if ownerUrl := p.primaryUrls[partition%len(p.primaryUrls)]; ownerUrl != p.selfUrl {
+		return ownerUrl
+	}
+	return ""
+}
+
+// route returns partition of the message. Messages with the same key always go to the same partition,
+// messages without key are spread round-robin.
+func (p *partitionRouter) route(key string, partitions int) int {
+	if partitions <= 1 {
+		return 0
+	}
+	if key == "" {
+		return int((p.next.Add(1) - 1) % uint64(partitions))
+	}
+
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(key))
+	return int(hash.Sum32() % uint32(partitions))
+}
+
+// proxy forwards request to the owner of the partition as is, credentials of the client included
+func (p *partitionRouter) proxy(rw http.ResponseWriter, r *http.Request, ownerUrl string) {
+	if r.Header.Get(proxiedHeader) != "" {
+		// primaries disagree on partition owners, e.g. 'PARTITION_PRIMARY_URLS' differs between them
+		logger.Warn("Proxied request is not for this primary", "path", r.URL.Path, "owner", ownerUrl)
+		http.Error(rw, "partition is not owned by this primary", http.StatusMisdirectedRequest)
+		return
+	}
+
+	target, err := url.Parse(ownerUrl)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	correlationId := r.Header.Get(logging.CorrelationIdHeader)
+	if correlationId == "" {
+		correlationId = logging.NewCorrelationId()
+		r.Header.Set(logging.CorrelationIdHeader, correlationId)
+	}
+	logger.InfoContext(logging.WithCorrelationId(r.Context(), correlationId), "Proxying request to the owner of partition", "path", r.URL.Path, "owner", ownerUrl)
+	r.Header.Set(proxiedHeader, p.selfUrl)
+
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.Transport = p.proxyTransport
+	proxy.ServeHTTP(rw, r)
+}
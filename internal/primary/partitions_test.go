@@ -0,0 +1,112 @@
+package primary
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMessagesWithTheSameKeyGoToTheSamePartition(t *testing.T) {
+	// GIVEN
+	router := newPartitionRouter()
+
+	// WHEN
+	first := router.route("user-1", 8)
+	second := router.route("user-1", 8)
+	withoutKey := []int{router.route("", 3), router.route("", 3), router.route("", 3)}
+
+	// THEN
+	assert.Equal(t, first, second)
+	assert.Less(t, first, 8)
+	assert.ElementsMatch(t, []int{0, 1, 2}, withoutKey)
+	assert.Equal(t, 0, router.route("user-1", 1))
+}
+
+func TestPartitionsAreSpreadOverPrimaries(t *testing.T) {
+	// GIVEN
+	secondary := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer secondary.Close()
+	t.Setenv("SECONDARY_URLS", secondary.URL)
+
+	first := httptest.NewUnstartedServer(nil)
+	second := httptest.NewUnstartedServer(nil)
+	firstUrl, secondUrl := "http://"+first.Listener.Addr().String(), "http://"+second.Listener.Addr().String()
+	t.Setenv("PARTITION_PRIMARY_URLS", firstUrl+","+secondUrl)
+
+	t.Setenv("SELF_URL", firstUrl)
+	first.Config.Handler = NewPrimaryServer().Handler
+	t.Setenv("SELF_URL", secondUrl)
+	second.Config.Handler = NewPrimaryServer().Handler
+	first.Start()
+	defer first.Close()
+	second.Start()
+	defer second.Close()
+
+	send := func(method string, url string, body any) *http.Response {
+		b, _ := json.Marshal(body)
+		req, _ := http.NewRequest(method, url, strings.NewReader(string(b)))
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = resp.Body.Close() })
+		return resp
+	}
+
+	// topic is created on every primary
+	for _, primaryUrl := range []string{firstUrl, secondUrl} {
+		require.Equal(t, http.StatusCreated, send(http.MethodPost, primaryUrl+"/api/v1/admin/topics", TopicRequest{Name: "orders", Partitions: 2}).StatusCode)
+	}
+
+	t.Run("Append to partition of another primary is proxied", func(t *testing.T) {
+		// WHEN
+		resp := send(http.MethodPost, firstUrl+"/api/v1/topics/orders/partitions/1/append", AppendMessageRequest{W: 2, Message: "second partition"})
+
+		// THEN
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var data AppendMessageResponse
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&data))
+		assert.Equal(t, 1, data.Partition)
+	})
+
+	t.Run("Partition is stored only by its owner", func(t *testing.T) {
+		// WHEN
+		resp := send(http.MethodGet, secondUrl+"/api/v1/admin/topics", nil)
+
+		// THEN
+		var data ListTopicsResponse
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&data))
+		assert.Equal(t, []int64{0, 1}, data.Topics[1].Offsets)
+	})
+
+	t.Run("Read of partition of another primary is proxied", func(t *testing.T) {
+		// WHEN
+		resp := send(http.MethodGet, firstUrl+"/api/v1/topics/orders/partitions/1/messages", nil)
+
+		// THEN
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var data GetMessagesResponse
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&data))
+		assert.Equal(t, []string{"second partition"}, data.Messages)
+	})
+
+	t.Run("Append by key lands on the same partition from any primary", func(t *testing.T) {
+		// WHEN
+		var partitions []int
+		for _, primaryUrl := range []string{firstUrl, secondUrl, firstUrl} {
+			resp := send(http.MethodPost, primaryUrl+"/api/v1/topics/orders/append", AppendMessageRequest{W: 2, Message: "keyed", Key: "user-1"})
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			var data AppendMessageResponse
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&data))
+			partitions = append(partitions, data.Partition)
+		}
+
+		// THEN
+		assert.Equal(t, partitions[0], partitions[1])
+		assert.Equal(t, partitions[0], partitions[2])
+	})
+}
@@ -0,0 +1,91 @@
+package reader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"replicated-log/internal/model"
+	"replicated-log/internal/storage"
+	"strconv"
+	"time"
+)
+
+// default time to wait for 'min_id'
+const defaultFreshnessTimeout = time.Second
+
+var ErrNotFresh = errors.New("replica is not fresh enough")
+
+// FreshnessRequest -- read-your-writes options of a read which can be served by a replica
+type FreshnessRequest struct {
+	// wait until this id is readable, nil if not requested
+	MinId *model.MessageId
+	// max number of messages replica can be behind the primary, nil if not requested
+	MaxLag *int
+	// how long to wait for 'MinId'
+	Timeout time.Duration
+}
+
+// NotFreshErrorResponse -- read is rejected, it should be retried later or routed to the primary
+type NotFreshErrorResponse struct {
+	Error string `json:"error"`
+	// first id which is not readable on this node
+	Offset model.MessageId `json:"offset"`
+}
+
+// ParseFreshnessRequest reads 'min_id', 'max_lag' and 'timeout_ms' query parameters
+func ParseFreshnessRequest(query url.Values) (FreshnessRequest, error) {
+	request := FreshnessRequest{Timeout: defaultFreshnessTimeout}
+
+	if query.Has("min_id") {
+		minId, err := strconv.ParseUint(query.Get("min_id"), 10, 32)
+		if err != nil {
+			return request, errors.New("'min_id' should be a message id")
+		}
+		id := model.MessageId(minId)
+		request.MinId = &id
+	}
+
+	if query.Has("max_lag") {
+		maxLag, err := strconv.Atoi(query.Get("max_lag"))
+		if err != nil || maxLag < 0 {
+			return request, errors.New("'max_lag' should be a non-negative number of messages")
+		}
+		request.MaxLag = &maxLag
+	}
+
+	if query.Has("timeout_ms") {
+		timeout, err := strconv.Atoi(query.Get("timeout_ms"))
+		if err != nil || timeout < 0 || time.Duration(timeout)*time.Millisecond > maxWait {
+			return request, errors.New("'timeout_ms' should be a non-negative number not bigger than " + strconv.Itoa(int(maxWait.Milliseconds())))
+		}
+		request.Timeout = time.Duration(timeout) * time.Millisecond
+	}
+
+	return request, nil
+}
+
+// EnsureFreshness waits until 'MinId' is readable and checks that replica is not behind the primary more than 'MaxLag'.
+// lag returns number of messages replica is behind the primary, false if it is unknown.
+func EnsureFreshness(ctx context.Context, source storage.Storage, request FreshnessRequest, lag func() (int, bool)) error {
+	if request.MinId != nil {
+		waitCtx, cancel := context.WithTimeout(ctx, request.Timeout)
+		err := source.WaitForMessage(waitCtx, *request.MinId)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("%w: message %d is not replicated in %s", ErrNotFresh, *request.MinId, request.Timeout)
+		}
+	}
+
+	if request.MaxLag != nil {
+		behind, isKnown := lag()
+		if !isKnown {
+			return fmt.Errorf("%w: offset of the primary is unknown", ErrNotFresh)
+		}
+		if behind > *request.MaxLag {
+			return fmt.Errorf("%w: %d messages behind the primary", ErrNotFresh, behind)
+		}
+	}
+
+	return nil
+}
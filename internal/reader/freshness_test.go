@@ -0,0 +1,51 @@
+package reader
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"replicated-log/internal/model"
+	"replicated-log/internal/storage"
+	"testing"
+	"time"
+)
+
+func TestEnsureFreshness(t *testing.T) {
+	// GIVEN
+	source := storage.NewInMemoryStorage()
+	source.AddRawMessage("first")
+	source.AddRawMessage("second")
+
+	readableId, missingId := model.MessageId(1), model.MessageId(2)
+	zero, two := 0, 2
+
+	testCases := []struct {
+		name        string
+		request     FreshnessRequest
+		lag         int
+		isLagKnown  bool
+		expectedErr bool
+	}{
+		{"no options", FreshnessRequest{}, 0, false, false},
+		{"min_id is readable", FreshnessRequest{MinId: &readableId, Timeout: time.Millisecond}, 0, false, false},
+		{"min_id is not readable in time", FreshnessRequest{MinId: &missingId, Timeout: 10 * time.Millisecond}, 0, false, true},
+		{"lag is within max_lag", FreshnessRequest{MaxLag: &two}, 2, true, false},
+		{"lag exceeds max_lag", FreshnessRequest{MaxLag: &zero}, 1, true, true},
+		{"lag is unknown", FreshnessRequest{MaxLag: &two}, 0, false, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// WHEN
+			err := EnsureFreshness(context.Background(), source, tc.request, func() (int, bool) {
+				return tc.lag, tc.isLagKnown
+			})
+
+			// THEN
+			if tc.expectedErr {
+				assert.ErrorIs(t, err, ErrNotFresh)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package reader
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"net/url"
+	"replicated-log/internal/model"
+	"replicated-log/internal/storage"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+	// total wait of a read for 'min_id' and the first message of the page, should be less than server WriteTimeout
+	maxWait = 10 * time.Second
+)
+
+// PageRequest -- range of the log requested by a consumer, 'to' is exclusive
+type PageRequest struct {
+	From  model.MessageId
+	To    model.MessageId
+	Limit int
+	// long-poll: how long to wait for the first message of the page if it is not readable yet
+	Wait time.Duration
+}
+
+// MessagesResponse -- response of '/api/v1/messages'.
+// Ids, entries and cursor are present only if range is requested, so full log response stays the same.
+type MessagesResponse struct {
+	Messages []string          `json:"messages"`
+	Ids      []model.MessageId `json:"ids,omitempty"`
+	// full messages with binary payloads, headers and content types
+	Entries []model.Message `json:"entries,omitempty"`
+	// id to continue reading from
+	Next *model.MessageId `json:"next,omitempty"`
+	// id of the first message which is not removed by retention, omitted if nothing is removed
+	LowWaterMark model.MessageId `json:"low_water_mark,omitempty"`
+}
+
+// ParsePageRequest reads 'from', 'limit', 'to' and 'wait' query parameters.
+// Returns false if none of them is given, i.e. the whole log is requested.
+func ParsePageRequest(query url.Values) (PageRequest, bool, error) {
+	request := PageRequest{From: 0, To: math.MaxUint32, Limit: defaultPageLimit}
+	if !query.Has("from") && !query.Has("limit") && !query.Has("to") && !query.Has("wait") {
+		return request, false, nil
+	}
+
+	if query.Has("from") {
+		from, err := strconv.ParseUint(query.Get("from"), 10, 32)
+		if err != nil {
+			return request, true, errors.New("'from' should be a non-negative number")
+		}
+		request.From = model.MessageId(from)
+	}
+
+	if query.Has("to") {
+		to, err := strconv.ParseUint(query.Get("to"), 10, 32)
+		if err != nil || model.MessageId(to) < request.From {
+			return request, true, errors.New("'to' should be a number not less than 'from'")
+		}
+		request.To = model.MessageId(to)
+	}
+
+	if query.Has("limit") {
+		limit, err := strconv.Atoi(query.Get("limit"))
+		if err != nil || limit <= 0 || limit > maxPageLimit {
+			return request, true, errors.New("'limit' should be a positive number not bigger than " + strconv.Itoa(maxPageLimit))
+		}
+		request.Limit = limit
+	}
+
+	if query.Has("wait") {
+		wait, err := strconv.Atoi(query.Get("wait"))
+		if err != nil || wait < 0 || time.Duration(wait)*time.Millisecond > maxWait {
+			return request, true, errors.New("'wait' should be a non-negative number of milliseconds not bigger than " + strconv.Itoa(int(maxWait.Milliseconds())))
+		}
+		request.Wait = time.Duration(wait) * time.Millisecond
+	}
+
+	return request, true, nil
+}
+
+// ReadPage reads requested range from the contiguous part of the log.
+// If 'Wait' is set and the first message is not readable yet, waits for it (empty page is returned on timeout).
+func ReadPage(ctx context.Context, source storage.Storage, request PageRequest) MessagesResponse {
+	if request.Wait > 0 && request.From < request.To {
+		waitCtx, cancel := context.WithTimeout(ctx, request.Wait)
+		_ = source.WaitForMessage(waitCtx, request.From)
+		cancel()
+	}
+
+	messages := source.GetMessagesRange(request.From, request.To, request.Limit)
+
+	response := MessagesResponse{
+		Messages:     make([]string, len(messages)),
+		Ids:          make([]model.MessageId, len(messages)),
+		Entries:      messages,
+		LowWaterMark: source.GetLowWaterMark(),
+	}
+	for i, message := range messages {
+		response.Messages[i] = message.Message
+		response.Ids[i] = message.Id
+	}
+
+	// messages before low-water mark are never readable again
+	next := max(request.From, response.LowWaterMark)
+	if len(messages) > 0 {
+		next = messages[len(messages)-1].Id + 1
+	}
+	response.Next = &next
+
+	return response
+}
+
+// ServeMessages serves '/api/v1/messages': the whole log or its page if 'from', 'limit' or 'to' is given.
+// Read is rejected with 503 if it asks for fresher data ('min_id', 'max_lag') than this node has.
+// lag is nil if node does not track it for the source, then 'max_lag' is rejected with 400.
+func ServeMessages(rw http.ResponseWriter, r *http.Request, source storage.Storage, lag func() (int, bool)) {
+	page, isPaged, err := ParsePageRequest(r.URL.Query())
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	freshness, err := ParseFreshnessRequest(r.URL.Query())
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if freshness.MaxLag != nil && lag == nil {
+		http.Error(rw, "'max_lag' is not supported for this log, lag is tracked only for the default topic", http.StatusBadRequest)
+		return
+	}
+
+	// 'timeout_ms' and 'wait' share one budget, so response is written before server WriteTimeout
+	ctx, cancel := context.WithTimeout(r.Context(), maxWait)
+	defer cancel()
+
+	if err = EnsureFreshness(ctx, source, freshness, lag); err != nil {
+		logger.Debug("Read is rejected", "err", err)
+		writeJson(rw, http.StatusServiceUnavailable, NotFreshErrorResponse{Error: err.Error(), Offset: source.GetOffset()})
+		return
+	}
+
+	response := ReadAll(source)
+	if isPaged {
+		response = ReadPage(ctx, source, page)
+	}
+
+	logger.Debug("Get messages", "count", len(response.Messages))
+	writeJson(rw, http.StatusOK, response)
+}
+
+func writeJson(rw http.ResponseWriter, statusCode int, response any) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(statusCode)
+	rawResponse, _ := json.Marshal(response)
+	_, _ = rw.Write(rawResponse)
+}
+
+// ReadAll reads the whole contiguous part of the log
+func ReadAll(source storage.Storage) MessagesResponse {
+	return MessagesResponse{Messages: source.GetMessages(), LowWaterMark: source.GetLowWaterMark()}
+}
@@ -0,0 +1,104 @@
+package reader
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/url"
+	"replicated-log/internal/model"
+	"replicated-log/internal/storage"
+	"testing"
+	"time"
+)
+
+func TestParsePageRequest(t *testing.T) {
+	testCases := []struct {
+		name            string
+		query           string
+		expected        PageRequest
+		expectedIsPaged bool
+		expectedErr     bool
+	}{
+		{"whole log", "", PageRequest{From: 0, To: 1<<32 - 1, Limit: defaultPageLimit}, false, false},
+		{"from only", "from=5", PageRequest{From: 5, To: 1<<32 - 1, Limit: defaultPageLimit}, true, false},
+		{"full range", "from=5&to=10&limit=2", PageRequest{From: 5, To: 10, Limit: 2}, true, false},
+		{"negative from", "from=-1", PageRequest{}, true, true},
+		{"to before from", "from=5&to=4", PageRequest{}, true, true},
+		{"zero limit", "limit=0", PageRequest{}, true, true},
+		{"too big limit", "limit=1001", PageRequest{}, true, true},
+		{"long-poll", "wait=500", PageRequest{From: 0, To: 1<<32 - 1, Limit: defaultPageLimit, Wait: 500 * time.Millisecond}, true, false},
+		{"too long wait", "wait=60000", PageRequest{}, true, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			query, _ := url.ParseQuery(tc.query)
+
+			// WHEN
+			actual, isPaged, err := ParsePageRequest(query)
+
+			// THEN
+			assert.Equal(t, tc.expectedIsPaged, isPaged)
+			if tc.expectedErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, actual)
+		})
+	}
+}
+
+func TestReadPageReturnsCursorToContinueFrom(t *testing.T) {
+	// GIVEN
+	source := storage.NewInMemoryStorage()
+	for _, message := range []string{"first", "second", "third", "fourth"} {
+		source.AddRawMessage(message)
+	}
+	source.AddMessage(model.Message{Id: 5, Message: "after gap"})
+
+	// WHEN
+	firstPage := ReadPage(context.Background(), source, PageRequest{From: 0, To: 1<<32 - 1, Limit: 3})
+	secondPage := ReadPage(context.Background(), source, PageRequest{From: *firstPage.Next, To: 1<<32 - 1, Limit: 3})
+	lastPage := ReadPage(context.Background(), source, PageRequest{From: *secondPage.Next, To: 1<<32 - 1, Limit: 3})
+
+	// THEN
+	assert.Equal(t, []string{"first", "second", "third"}, firstPage.Messages)
+	assert.Equal(t, []model.MessageId{0, 1, 2}, firstPage.Ids)
+	require.Equal(t, model.MessageId(3), *firstPage.Next)
+
+	// message after the gap is not visible
+	assert.Equal(t, []string{"fourth"}, secondPage.Messages)
+	require.Equal(t, model.MessageId(4), *secondPage.Next)
+
+	assert.Empty(t, lastPage.Messages)
+	assert.Equal(t, model.MessageId(4), *lastPage.Next)
+}
+
+func TestReadPageWaitsForTheFirstMessage(t *testing.T) {
+	// GIVEN
+	source := storage.NewInMemoryStorage()
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		source.AddRawMessage("first")
+	}()
+
+	// WHEN
+	page := ReadPage(context.Background(), source, PageRequest{From: 0, To: 1<<32 - 1, Limit: 10, Wait: time.Second})
+
+	// THEN
+	assert.Equal(t, []string{"first"}, page.Messages)
+	assert.Equal(t, model.MessageId(1), *page.Next)
+}
+
+func TestReadPageReturnsEmptyPageIfNothingIsAppendedInTime(t *testing.T) {
+	// GIVEN
+	source := storage.NewInMemoryStorage()
+
+	// WHEN
+	page := ReadPage(context.Background(), source, PageRequest{From: 0, To: 1<<32 - 1, Limit: 10, Wait: 20 * time.Millisecond})
+
+	// THEN
+	assert.Empty(t, page.Messages)
+	assert.Equal(t, model.MessageId(0), *page.Next)
+}
@@ -0,0 +1,153 @@
+package reader
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"replicated-log/internal/logging"
+	"replicated-log/internal/model"
+	"replicated-log/internal/storage"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var logger = logging.Component("reader")
+
+const (
+	contentTypeSse    = "text/event-stream"
+	contentTypeNdjson = "application/x-ndjson"
+	// max number of messages read from storage at once
+	subscribeBatchSize = 100
+	// SSE comment is sent if there are no new messages for this period, so proxies don't close idle stream
+	keepAlivePeriod = 15 * time.Second
+)
+
+// Subscriptions -- streams which push messages to consumers as soon as they become contiguously readable.
+// Streams never finish by themselves, so they are closed explicitly on shutdown.
+type Subscriptions struct {
+	quit     chan struct{}
+	quitOnce *sync.Once
+}
+
+func NewSubscriptions() *Subscriptions {
+	return &Subscriptions{
+		quit:     make(chan struct{}),
+		quitOnce: &sync.Once{},
+	}
+}
+
+// Close finishes all active streams
+func (s *Subscriptions) Close() {
+	s.quitOnce.Do(func() {
+		close(s.quit)
+	})
+}
+
+// Serve streams messages starting from 'from' query parameter (0 by default).
+// Server-Sent Events are used if client accepts 'text/event-stream', newline delimited JSON otherwise.
+// SSE client which reconnects with 'Last-Event-ID' header resumes right after the last received message.
+func (s *Subscriptions) Serve(rw http.ResponseWriter, r *http.Request, source storage.Storage) {
+	isSse := strings.Contains(r.Header.Get("Accept"), contentTypeSse)
+
+	next, err := parseSubscribeOffset(r)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	go func() {
+		select {
+		case <-s.quit:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	controller := http.NewResponseController(rw)
+	// stream lives longer than server WriteTimeout
+	_ = controller.SetWriteDeadline(time.Time{})
+
+	if isSse {
+		rw.Header().Set("Content-Type", contentTypeSse)
+	} else {
+		rw.Header().Set("Content-Type", contentTypeNdjson)
+	}
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.WriteHeader(http.StatusOK)
+	if err = controller.Flush(); err != nil {
+		return
+	}
+
+	logger.Debug("Subscription is started", "from", next, "sse", isSse)
+	defer logger.Debug("Subscription is finished", "next", next)
+
+	for {
+		messages := source.GetMessagesRange(next, math.MaxUint32, subscribeBatchSize)
+		if len(messages) > 0 {
+			for _, message := range messages {
+				if err = writeMessage(rw, message, isSse); err != nil {
+					return
+				}
+			}
+			if err = controller.Flush(); err != nil {
+				return
+			}
+			next = messages[len(messages)-1].Id + 1
+			continue
+		}
+
+		waitCtx, cancelWait := context.WithTimeout(ctx, keepAlivePeriod)
+		err = source.WaitForMessage(waitCtx, next)
+		cancelWait()
+
+		if ctx.Err() != nil {
+			return // client is gone or server is shutting down
+		}
+		if err != nil && isSse {
+			if _, err = fmt.Fprint(rw, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			if err = controller.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func parseSubscribeOffset(r *http.Request) (model.MessageId, error) {
+	if lastEventId := r.Header.Get("Last-Event-ID"); lastEventId != "" {
+		id, err := strconv.ParseUint(lastEventId, 10, 32)
+		if err != nil {
+			return 0, errors.New("'Last-Event-ID' should be a message id")
+		}
+		return model.MessageId(id) + 1, nil
+	}
+
+	if !r.URL.Query().Has("from") {
+		return 0, nil
+	}
+	from, err := strconv.ParseUint(r.URL.Query().Get("from"), 10, 32)
+	if err != nil {
+		return 0, errors.New("'from' should be a non-negative number")
+	}
+	return model.MessageId(from), nil
+}
+
+func writeMessage(rw http.ResponseWriter, message model.Message, isSse bool) error {
+	payload, _ := json.Marshal(message)
+
+	var err error
+	if isSse {
+		_, err = fmt.Fprintf(rw, "id: %d\ndata: %s\n\n", message.Id, payload)
+	} else {
+		_, err = fmt.Fprintf(rw, "%s\n", payload)
+	}
+	return err
+}
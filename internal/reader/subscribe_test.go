@@ -0,0 +1,130 @@
+package reader
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"replicated-log/internal/model"
+	"replicated-log/internal/storage"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newSubscriptionServer(source storage.Storage, subscriptions *Subscriptions) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		subscriptions.Serve(rw, r, source)
+	}))
+}
+
+func TestSubscriptionStreamsMessagesAsTheyBecomeReadable(t *testing.T) {
+	// GIVEN
+	source := storage.NewInMemoryStorage()
+	source.AddRawMessage("first")
+	source.AddRawMessage("second")
+
+	subscriptions := NewSubscriptions()
+	defer subscriptions.Close()
+	server := newSubscriptionServer(source, subscriptions)
+	defer server.Close()
+
+	// WHEN
+	resp, err := http.Get(server.URL + "?from=1")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, contentTypeNdjson, resp.Header.Get("Content-Type"))
+
+	// message after the gap is pushed only when the gap is filled
+	source.AddMessage(model.Message{Id: 3, Message: "fourth"})
+	source.AddMessage(model.Message{Id: 2, Message: "third"})
+
+	// THEN
+	scanner := bufio.NewScanner(resp.Body)
+	var received []model.Message
+	for len(received) < 3 && scanner.Scan() {
+		var message model.Message
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &message))
+		received = append(received, message)
+	}
+	require.Equal(t, []model.Message{
+		{Id: 1, Message: "second"},
+		{Id: 2, Message: "third"},
+		{Id: 3, Message: "fourth"},
+	}, received)
+}
+
+func TestSseSubscriptionIsResumedFromLastEventId(t *testing.T) {
+	// GIVEN
+	source := storage.NewInMemoryStorage()
+	for _, message := range []string{"first", "second", "third"} {
+		source.AddRawMessage(message)
+	}
+
+	subscriptions := NewSubscriptions()
+	defer subscriptions.Close()
+	server := newSubscriptionServer(source, subscriptions)
+	defer server.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	req.Header.Set("Accept", contentTypeSse)
+	req.Header.Set("Last-Event-ID", "1")
+
+	// WHEN
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	// THEN
+	require.Equal(t, contentTypeSse, resp.Header.Get("Content-Type"))
+	scanner := bufio.NewScanner(resp.Body)
+	var lines []string
+	for len(lines) < 2 && scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	require.Equal(t, []string{"id: 2", `data: {"order":2,"message":"third"}`}, lines)
+}
+
+func TestSubscriptionsAreFinishedOnClose(t *testing.T) {
+	// GIVEN
+	subscriptions := NewSubscriptions()
+	server := newSubscriptionServer(storage.NewInMemoryStorage(), subscriptions)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	finished := make(chan struct{})
+	go func() {
+		_, _ = bufio.NewReader(resp.Body).ReadString('\n')
+		close(finished)
+	}()
+
+	// WHEN
+	subscriptions.Close()
+
+	// THEN
+	select {
+	case <-finished:
+	case <-time.After(time.Second):
+		t.Fatal("Stream is not finished")
+	}
+}
+
+func TestSubscriptionRejectsInvalidOffset(t *testing.T) {
+	// GIVEN
+	subscriptions := NewSubscriptions()
+	defer subscriptions.Close()
+	server := newSubscriptionServer(storage.NewInMemoryStorage(), subscriptions)
+	defer server.Close()
+
+	// WHEN
+	resp, err := http.Get(server.URL + "?from=" + strings.Repeat("9", 20))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	// THEN
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
@@ -0,0 +1,246 @@
+package replication
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"replicated-log/internal/healthcheck"
+	"replicated-log/internal/logging"
+	"replicated-log/internal/model"
+	"replicated-log/internal/storage"
+	"replicated-log/internal/transport"
+	"strconv"
+	"time"
+)
+
+var antiEntropyLogger = logging.Component("anti-entropy")
+
+// DivergentRange -- ids of a partition from 'From' inclusive to 'To' exclusive where secondary differs from primary
+type DivergentRange struct {
+	Topic     string
+	Partition int
+	From      model.MessageId
+	To        model.MessageId
+	// messages of the primary are sent to the secondary
+	Repaired bool
+}
+
+// Divergence -- result of the last completed anti-entropy check of one secondary
+type Divergence struct {
+	CheckedAt time.Time
+	Ranges    []DivergentRange
+}
+
+// startAntiEntropy compares secondaries with primary every 'ANTI_ENTROPY_INTERVAL_MILLISECONDS', disabled by default
+func (e *Executor) startAntiEntropy() {
+	e.antiEntropyLeafSize = 64 // default value
+	if leafSizeToken, okLeafSize := os.LookupEnv("ANTI_ENTROPY_LEAF_SIZE"); okLeafSize {
+		value, err := strconv.Atoi(leafSizeToken)
+		if err != nil || value < 1 {
+			logging.Fatal(antiEntropyLogger, "Given 'ANTI_ENTROPY_LEAF_SIZE' token is invalid", "token", leafSizeToken)
+		}
+		e.antiEntropyLeafSize = value
+	}
+
+	e.antiEntropyFanOut = 16 // default value
+	if fanOutToken, okFanOut := os.LookupEnv("ANTI_ENTROPY_FAN_OUT"); okFanOut {
+		value, err := strconv.Atoi(fanOutToken)
+		// range should be divided into at least 2 parts, otherwise descent never ends
+		if err != nil || value < 2 {
+			logging.Fatal(antiEntropyLogger, "Given 'ANTI_ENTROPY_FAN_OUT' token is invalid", "token", fanOutToken)
+		}
+		e.antiEntropyFanOut = value
+	}
+
+	e.antiEntropyRepair = false // default value
+	if repairToken, okRepair := os.LookupEnv("ANTI_ENTROPY_REPAIR"); okRepair {
+		e.antiEntropyRepair, _ = strconv.ParseBool(repairToken)
+	}
+
+	period := time.Duration(0) // default value, anti-entropy is disabled
+	if periodToken, okPeriod := os.LookupEnv("ANTI_ENTROPY_INTERVAL_MILLISECONDS"); okPeriod {
+		value, _ := strconv.Atoi(periodToken)
+		period = time.Duration(value) * time.Millisecond
+	}
+	if period <= 0 {
+		return
+	}
+	antiEntropyLogger.Info("Anti-entropy is enabled", "interval", period, "leaf_size", e.antiEntropyLeafSize, "fan_out", e.antiEntropyFanOut, "repair", e.antiEntropyRepair)
+
+	ticker := time.NewTicker(period)
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				e.CheckConsistency()
+			case <-e.quit:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+}
+
+// CheckConsistency compares every available secondary with primary and repairs divergent ranges if repair is enabled.
+// Secondary which cannot be checked keeps the result of its previous check.
+func (e *Executor) CheckConsistency() {
+	for _, secondaryUrl := range e.Secondaries() {
+		if !healthcheck.IsAvailable(e.health.GetStatus(secondaryUrl)) {
+			continue
+		}
+
+		ranges, err := e.checkSecondary(secondaryUrl)
+		if err != nil {
+			antiEntropyLogger.Warn("Failed to check secondary", "secondary", secondaryUrl, "err", err)
+			continue
+		}
+
+		e.antiEntropyMu.Lock()
+		if e.isSecondary(secondaryUrl) {
+			e.divergences[secondaryUrl] = Divergence{CheckedAt: time.Now(), Ranges: ranges}
+			e.metrics.SetDivergentRanges(secondaryUrl, len(ranges))
+		}
+		e.antiEntropyMu.Unlock()
+	}
+}
+
+// Divergences returns the last completed check of every secondary, secondaries which are not checked yet are absent
+func (e *Executor) Divergences() map[string]Divergence {
+	e.antiEntropyMu.Lock()
+	defer e.antiEntropyMu.Unlock()
+
+	result := make(map[string]Divergence, len(e.divergences))
+	for secondaryUrl, divergence := range e.divergences {
+		result[secondaryUrl] = divergence
+	}
+	return result
+}
+
+func (e *Executor) forgetDivergence(secondaryUrl string) {
+	e.antiEntropyMu.Lock()
+	defer e.antiEntropyMu.Unlock()
+
+	delete(e.divergences, secondaryUrl)
+}
+
+func (e *Executor) checkSecondary(secondaryUrl string) ([]DivergentRange, error) {
+	ranges := []DivergentRange{}
+	for _, topic := range e.topics.Names() {
+		partitions, err := e.topics.Partitions(topic)
+		if err != nil {
+			continue // deleted in the meantime
+		}
+		for partition, messages := range partitions {
+			select {
+			case <-e.quit:
+				return nil, errors.New("executor is stopped")
+			default:
+			}
+
+			log := partitionKey{topic: topic, partition: partition}
+			divergent, err := e.checkPartition(secondaryUrl, log, messages)
+			if err != nil {
+				return nil, err
+			}
+			for _, idRange := range divergent {
+				antiEntropyLogger.Warn("Secondary diverged from primary", "secondary", secondaryUrl, "topic", topic, "partition", partition, "from", idRange.From, "to", idRange.To)
+				ranges = append(ranges, DivergentRange{
+					Topic:     topic,
+					Partition: partition,
+					From:      idRange.From,
+					To:        idRange.To,
+					Repaired:  e.antiEntropyRepair && e.repair(secondaryUrl, log, messages, idRange),
+				})
+			}
+		}
+	}
+	return ranges, nil
+}
+
+// checkPartition compares ids which are present on both nodes: hash of the whole range first, then hashes of
+// its parts which differ, until ranges are not bigger than leaf size. Returns leaves which differ.
+func (e *Executor) checkPartition(secondaryUrl string, log partitionKey, messages storage.Storage) ([]transport.IdRange, error) {
+	request := transport.HashRequest{Topic: log.topic, Partition: log.partition}
+	response, err := e.transport.FetchHashes(context.Background(), secondaryUrl, request)
+	if err != nil {
+		return nil, err
+	}
+
+	// messages below low-water mark are removed by retention, messages after offset are not replicated yet
+	from := max(messages.GetLowWaterMark(), response.LowWaterMark)
+	to := min(messages.GetOffset(), response.Offset)
+	if from >= to {
+		return nil, nil
+	}
+
+	divergent := []transport.IdRange{}
+	for request.Ranges = []transport.IdRange{{From: from, To: to}}; len(request.Ranges) > 0; {
+		response, err = e.transport.FetchHashes(context.Background(), secondaryUrl, request)
+		if err != nil {
+			return nil, err
+		}
+		if len(response.Hashes) != len(request.Ranges) {
+			return nil, fmt.Errorf("expected %d hashes, got %d", len(request.Ranges), len(response.Hashes))
+		}
+
+		var next []transport.IdRange
+		for i, idRange := range request.Ranges {
+			if storage.HashRange(messages, idRange.From, idRange.To) == response.Hashes[i] {
+				continue
+			}
+			if int(idRange.To-idRange.From) <= e.antiEntropyLeafSize {
+				divergent = append(divergent, idRange)
+			} else {
+				next = append(next, split(idRange, e.antiEntropyFanOut)...)
+			}
+		}
+		request.Ranges = next
+	}
+
+	return divergent, nil
+}
+
+// split divides range into at most n parts of the same size
+func split(idRange transport.IdRange, n int) []transport.IdRange {
+	step := max((int(idRange.To-idRange.From)+n-1)/n, 1)
+	parts := make([]transport.IdRange, 0, n)
+	for from := idRange.From; from < idRange.To; {
+		to := min(from+model.MessageId(step), idRange.To)
+		parts = append(parts, transport.IdRange{From: from, To: to})
+		from = to
+	}
+	return parts
+}
+
+// repair overwrites messages of the range on the secondary with messages of the primary.
+// Messages which primary has removed by retention are removed from the secondary by ReplicateRetention.
+func (e *Executor) repair(secondaryUrl string, log partitionKey, messages storage.Storage, idRange transport.IdRange) bool {
+	batch := messages.GetMessagesRange(idRange.From, idRange.To, int(idRange.To-idRange.From))
+	generation, err := e.topics.Generation(log.topic)
+	if len(batch) == 0 || err != nil {
+		return false
+	}
+	for i := range batch {
+		batch[i].Term = e.term
+		batch[i].TopicGeneration = generation
+		if log.topic != storage.DefaultTopic {
+			batch[i].Topic = log.topic
+			batch[i].Partition = log.partition
+		}
+	}
+
+	err = e.transport.Repair(context.Background(), secondaryUrl, batch)
+	if errors.Is(err, transport.ErrStaleTerm) {
+		e.fencedOff(secondaryUrl)
+		err = fmt.Errorf("term %d is stale: %w", e.term, err)
+	}
+	if err != nil {
+		antiEntropyLogger.Warn("Failed to repair secondary", "secondary", secondaryUrl, "topic", log.topic, "partition", log.partition, "from", idRange.From, "to", idRange.To, "err", err)
+		return false
+	}
+
+	antiEntropyLogger.Info("Secondary is repaired", "secondary", secondaryUrl, "topic", log.topic, "partition", log.partition, "from", idRange.From, "to", idRange.To, "messages", len(batch))
+	e.metrics.RepairedMessages(secondaryUrl, len(batch))
+	return true
+}
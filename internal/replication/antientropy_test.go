@@ -0,0 +1,110 @@
+package replication
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"replicated-log/internal/model"
+	"replicated-log/internal/storage"
+	"replicated-log/internal/transport"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newSecondaryWithHashes(t *testing.T, secondaryStorage *storage.InMemoryStorage) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/healthcheck", func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/api/v1/internal/offset", func(rw http.ResponseWriter, _ *http.Request) {
+		rawResponse, _ := json.Marshal(map[string]any{"offset": secondaryStorage.GetOffset()})
+		_, _ = rw.Write(rawResponse)
+	})
+	mux.HandleFunc("/api/v1/internal/hashes", func(rw http.ResponseWriter, r *http.Request) {
+		var request transport.HashRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&request))
+		response := transport.HashResponse{LowWaterMark: secondaryStorage.GetLowWaterMark(), Offset: secondaryStorage.GetOffset()}
+		for _, idRange := range request.Ranges {
+			response.Hashes = append(response.Hashes, storage.HashRange(secondaryStorage, idRange.From, idRange.To))
+		}
+		rawResponse, _ := json.Marshal(response)
+		_, _ = rw.Write(rawResponse)
+	})
+	mux.HandleFunc("/api/v1/internal/repair", func(rw http.ResponseWriter, r *http.Request) {
+		var messages []model.Message
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&messages))
+		for _, message := range messages {
+			secondaryStorage.Replace(message)
+		}
+		rw.WriteHeader(http.StatusOK)
+	})
+
+	return httptest.NewServer(mux)
+}
+
+// newDivergedReplicas returns primary with 200 messages and secondary where message 100 differs
+func newDivergedReplicas() (*storage.InMemoryStorage, *storage.InMemoryStorage) {
+	primaryStorage := storage.NewInMemoryStorage()
+	secondaryStorage := storage.NewInMemoryStorage()
+	for i := 0; i < 200; i++ {
+		message := primaryStorage.AddRawMessage("message " + strconv.Itoa(i))
+		if i == 100 {
+			message.Message = "conflicting"
+		}
+		secondaryStorage.AddMessage(message)
+	}
+	return primaryStorage, secondaryStorage
+}
+
+func TestAntiEntropyReportsDivergentRange(t *testing.T) {
+	// GIVEN
+	primaryStorage, secondaryStorage := newDivergedReplicas()
+	secondary := newSecondaryWithHashes(t, secondaryStorage)
+	defer secondary.Close()
+
+	t.Setenv("ANTI_ENTROPY_LEAF_SIZE", "8")
+	t.Setenv("ANTI_ENTROPY_FAN_OUT", "4")
+	executor := NewExecutorWithSecondaries(primaryStorage, []string{secondary.URL}, 0, nil)
+	defer executor.Close()
+
+	// WHEN
+	executor.CheckConsistency()
+
+	// THEN
+	divergence, ok := executor.Divergences()[secondary.URL]
+	require.True(t, ok)
+	require.Len(t, divergence.Ranges, 1)
+	divergent := divergence.Ranges[0]
+	assert.LessOrEqual(t, divergent.From, model.MessageId(100))
+	assert.Greater(t, divergent.To, model.MessageId(100))
+	assert.LessOrEqual(t, int(divergent.To-divergent.From), 8)
+	assert.False(t, divergent.Repaired)
+	assert.Equal(t, "conflicting", secondaryStorage.GetMessages()[100], "nothing is repaired by default")
+}
+
+func TestAntiEntropyRepairsDivergentRange(t *testing.T) {
+	// GIVEN
+	primaryStorage, secondaryStorage := newDivergedReplicas()
+	secondary := newSecondaryWithHashes(t, secondaryStorage)
+	defer secondary.Close()
+
+	t.Setenv("ANTI_ENTROPY_REPAIR", "true")
+	t.Setenv("ANTI_ENTROPY_INTERVAL_MILLISECONDS", "10")
+	executor := NewExecutorWithSecondaries(primaryStorage, []string{secondary.URL}, 0, nil)
+	defer executor.Close()
+
+	// WHEN
+	require.Eventually(t, func() bool {
+		return len(executor.Divergences()[secondary.URL].Ranges) == 1
+	}, time.Second, 5*time.Millisecond)
+
+	// THEN
+	assert.True(t, executor.Divergences()[secondary.URL].Ranges[0].Repaired)
+	assert.Equal(t, primaryStorage.GetMessages(), secondaryStorage.GetMessages())
+
+	executor.CheckConsistency()
+	assert.Empty(t, executor.Divergences()[secondary.URL].Ranges, "repaired secondary is the same as primary")
+}
@@ -0,0 +1,267 @@
+package replication
+
+import (
+	"context"
+	"errors"
+	"replicated-log/internal/healthcheck"
+	"replicated-log/internal/logging"
+	"replicated-log/internal/model"
+	"replicated-log/internal/transport"
+	"strings"
+	"sync"
+	"time"
+)
+
+type pendingMessage struct {
+	message       model.Message
+	correlationId string
+	// receives url of the secondary which has acknowledged the message
+	notify chan<- string
+}
+
+// batcher coalesces messages pending for one secondary into batches.
+// Batch is sent when it reaches max size or when linger time is over, several batches can be in flight at once.
+type batcher struct {
+	executor     *Executor
+	secondaryUrl string
+	// messages which are not sent yet, bounded by maxBacklog
+	mu         *sync.Mutex
+	backlog    []pendingMessage
+	maxBacklog int
+	// signalled when backlog becomes non-empty
+	ready chan struct{}
+	// batch config
+	maxSize int
+	linger  time.Duration
+	// semaphore which limits number of batches sent concurrently
+	inFlight chan struct{}
+	quit     chan struct{}
+}
+
+func newBatcher(executor *Executor, secondaryUrl string, maxSize int, linger time.Duration, maxInFlight int, maxBacklog int) *batcher {
+	return &batcher{
+		executor:     executor,
+		secondaryUrl: secondaryUrl,
+		mu:           &sync.Mutex{},
+		maxBacklog:   maxBacklog,
+		ready:        make(chan struct{}, 1),
+		maxSize:      maxSize,
+		linger:       linger,
+		inFlight:     make(chan struct{}, maxInFlight),
+		quit:         make(chan struct{}),
+	}
+}
+
+// enqueue never blocks the client. Message which doesn't fit into the full backlog (e.g. secondary is DEAD)
+// is left for catch-up, which sends everything the secondary is missing and notifies the append when it is acknowledged.
+func (b *batcher) enqueue(ctx context.Context, message model.Message, notify chan<- string) {
+	item := pendingMessage{message: message, correlationId: logging.CorrelationId(ctx), notify: notify}
+
+	b.mu.Lock()
+	select {
+	case <-b.quit:
+		// secondary has been removed in the meantime
+		b.mu.Unlock()
+		b.executor.untrack(b.secondaryUrl, message)
+		return
+	default:
+	}
+	if len(b.backlog) >= b.maxBacklog {
+		b.mu.Unlock()
+		logger.WarnContext(ctx, "Batch backlog is full, message is left for catch-up", "id", message.Id, "secondary", b.secondaryUrl, "backlog", b.maxBacklog)
+		b.executor.untrack(b.secondaryUrl, message)
+		b.executor.notifyWhenAcked(b.secondaryUrl, message, notify)
+		go b.executor.catchUp(b.secondaryUrl)
+		return
+	}
+	b.backlog = append(b.backlog, item)
+	b.mu.Unlock()
+
+	b.signal()
+}
+
+func (b *batcher) signal() {
+	select {
+	case b.ready <- struct{}{}:
+	default:
+		// already signalled
+	}
+}
+
+func (b *batcher) pending() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return len(b.backlog)
+}
+
+// take removes up to max size messages from the head of the backlog
+func (b *batcher) take() []pendingMessage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	n := min(len(b.backlog), b.maxSize)
+	batch := make([]pendingMessage, n)
+	copy(batch, b.backlog)
+	b.backlog = b.backlog[n:]
+	if len(b.backlog) > 0 {
+		b.signal()
+	}
+	return batch
+}
+
+func (b *batcher) start() {
+	go func() {
+		for {
+			// wait for the first message of the next batch
+			select {
+			case <-b.ready:
+			case <-b.quit:
+				return
+			}
+
+			// linger in order to collect more messages
+			timer := time.NewTimer(b.linger)
+		collect:
+			for b.pending() < b.maxSize {
+				select {
+				case <-b.ready:
+				case <-timer.C:
+					break collect
+				case <-b.quit:
+					timer.Stop()
+					return
+				}
+			}
+			timer.Stop()
+
+			batch := b.take()
+			if len(batch) == 0 {
+				continue
+			}
+
+			select {
+			case b.inFlight <- struct{}{}:
+			case <-b.quit:
+				// batch stays tracked, so it is saved to resend queue on shutdown
+				return
+			}
+			go func(batch []pendingMessage) {
+				defer func() { <-b.inFlight }()
+				b.executor.replicateBatchWithRetry(b.secondaryUrl, batch)
+			}(batch)
+		}
+	}()
+}
+
+// stop drops the backlog, messages in it stay outstanding until they are untracked by the caller
+func (b *batcher) stop() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	close(b.quit)
+	b.backlog = nil
+}
+
+// dropTopic removes queued messages of the deleted topic, the caller untracks them
+func (b *batcher) dropTopic(name string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	kept := b.backlog[:0]
+	for _, item := range b.backlog {
+		if partitionOf(item.message).topic != name {
+			kept = append(kept, item)
+		}
+	}
+	clear(b.backlog[len(kept):])
+	b.backlog = kept
+}
+
+// withoutDeletedTopics drops messages of topics which were deleted while messages were waiting for retry
+func (e *Executor) withoutDeletedTopics(secondaryUrl string, batch []pendingMessage) []pendingMessage {
+	result := batch[:0]
+	for _, item := range batch {
+		if !e.isCurrentGeneration(item.message) {
+			e.untrack(secondaryUrl, item.message)
+			continue
+		}
+		result = append(result, item)
+	}
+	return result
+}
+
+func (e *Executor) replicateBatchWithRetry(secondaryUrl string, batch []pendingMessage) {
+	messages := make([]model.Message, len(batch))
+	var correlationIds []string
+	for i, item := range batch {
+		messages[i] = item.message
+		if item.correlationId != "" {
+			correlationIds = append(correlationIds, item.correlationId)
+		}
+	}
+	firstId, lastId := messages[0].Id, messages[len(messages)-1].Id
+	ctx := logging.WithCorrelationId(context.Background(), strings.Join(correlationIds, ","))
+
+	// WHILE NOT SUCCESS:
+	for attempt := 0; ; attempt++ {
+		if !e.isSecondary(secondaryUrl) {
+			logger.InfoContext(ctx, "Secondary is removed, stop replication of batch", "secondary", secondaryUrl, "first_id", firstId, "last_id", lastId)
+			for _, item := range batch {
+				e.untrack(secondaryUrl, item.message)
+			}
+			return
+		}
+		if batch = e.withoutDeletedTopics(secondaryUrl, batch); len(batch) == 0 {
+			logger.InfoContext(ctx, "Topic is deleted, stop replication of batch", "secondary", secondaryUrl, "first_id", firstId, "last_id", lastId)
+			return
+		}
+		messages = messages[:0]
+		for _, item := range batch {
+			messages = append(messages, item.message)
+		}
+
+		// 0) Check if Secondary is ALIVE
+		if healthcheck.IsAvailable(e.health.GetStatus(secondaryUrl)) {
+			// 1) Send Request
+			logger.DebugContext(ctx, "Sending batch", "size", len(messages), "first_id", firstId, "last_id", lastId, "secondary", secondaryUrl, "attempt", attempt)
+			e.metrics.ReplicationAttempt(secondaryUrl)
+			err := e.sendBatch(ctx, secondaryUrl, messages)
+			if errors.Is(err, transport.ErrConflict) {
+				logger.WarnContext(ctx, "Secondary has conflicting messages, overwrite them", "secondary", secondaryUrl, "first_id", firstId, "last_id", lastId, "err", err)
+				err = e.overwrite(ctx, secondaryUrl, messages)
+			}
+
+			// 2) Handle Response
+			if errors.Is(err, transport.ErrStaleTerm) {
+				// retry doesn't help, secondary follows a newer leader
+				e.metrics.ReplicationFailure(secondaryUrl)
+				for _, item := range batch {
+					e.untrack(secondaryUrl, item.message)
+				}
+				e.fencedOff(secondaryUrl)
+				return
+			} else if err != nil {
+				logger.WarnContext(ctx, "Failed to replicate batch", "secondary", secondaryUrl, "err", err)
+				e.metrics.ReplicationFailure(secondaryUrl)
+			} else {
+				logger.DebugContext(ctx, "ACK", "first_id", firstId, "last_id", lastId, "secondary", secondaryUrl)
+				// SUCCESS! Notify waiting appends and exit...
+				e.markAcked(secondaryUrl, messages...)
+				for _, item := range batch {
+					e.untrack(secondaryUrl, item.message)
+					item.notify <- secondaryUrl
+				}
+				return
+			}
+		} else {
+			logger.DebugContext(ctx, "Secondary is DEAD, batch is not sent", "first_id", firstId, "last_id", lastId, "secondary", secondaryUrl, "attempt", attempt)
+		}
+
+		// 3) Sleep in case of Failure or DEAD Secondary
+		if !e.sleepBeforeRetry(secondaryUrl, attempt) {
+			logger.InfoContext(ctx, "Executor is closed, stop replication of batch", "first_id", firstId, "last_id", lastId, "secondary", secondaryUrl)
+			return
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package replication
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"replicated-log/internal/model"
+	"replicated-log/internal/storage"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newBatchRecordingSecondary(t *testing.T, batches *[][]model.Message, mu *sync.Mutex) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			// health-check
+			rw.WriteHeader(http.StatusOK)
+		} else {
+			require.Equal(t, "/api/v1/internal/replicate/batch", r.URL.Path)
+			var batch []model.Message
+			err := json.NewDecoder(r.Body).Decode(&batch)
+			require.NoError(t, err)
+
+			mu.Lock()
+			*batches = append(*batches, batch)
+			mu.Unlock()
+			rw.WriteHeader(http.StatusOK)
+		}
+	}))
+}
+
+func TestBatchModeCoalescesConcurrentMessages(t *testing.T) {
+	// GIVEN
+	var mu sync.Mutex
+	var batches [][]model.Message
+	secondary := newBatchRecordingSecondary(t, &batches, &mu)
+	defer secondary.Close()
+
+	t.Setenv("SECONDARY_URLS", secondary.URL)
+	t.Setenv("REPLICATION_MODE", "BATCH")
+	t.Setenv("REPLICATION_BATCH_MAX_SIZE", "3")
+	t.Setenv("REPLICATION_BATCH_LINGER_MILLISECONDS", "1000")
+
+	executor := NewExecutor(storage.NewInMemoryStorage(), nil)
+	defer executor.Close()
+
+	// WHEN
+	var wg sync.WaitGroup
+	for id := 0; id < 3; id++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			executor.ReplicateMessage(context.Background(), model.Message{Id: model.MessageId(id), Message: "test"}, 1)
+		}(id)
+	}
+	wg.Wait()
+
+	// THEN
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, batches, 1, "batch is full, so it should be sent before linger time is over")
+	require.Len(t, batches[0], 3)
+}
+
+func TestBatchModeSendsIncompleteBatchAfterLinger(t *testing.T) {
+	// GIVEN
+	var mu sync.Mutex
+	var batches [][]model.Message
+	secondary := newBatchRecordingSecondary(t, &batches, &mu)
+	defer secondary.Close()
+
+	t.Setenv("SECONDARY_URLS", secondary.URL)
+	t.Setenv("REPLICATION_MODE", "BATCH")
+	t.Setenv("REPLICATION_BATCH_MAX_SIZE", "100")
+	t.Setenv("REPLICATION_BATCH_LINGER_MILLISECONDS", "1")
+
+	executor := NewExecutor(storage.NewInMemoryStorage(), nil)
+	defer executor.Close()
+
+	// WHEN
+	message := model.Message{Id: 0, Message: "first one"}
+	executor.ReplicateMessage(context.Background(), message, 1)
+
+	// THEN
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, [][]model.Message{{message}}, batches)
+}
+
+func TestReplicateBatchWithRetryNotifiesEveryMessage(t *testing.T) {
+	// GIVEN
+	maxTrials := 3
+	currentTrial := 0
+
+	secondary := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			// health-check
+			rw.WriteHeader(http.StatusOK)
+		} else if currentTrial >= maxTrials {
+			rw.WriteHeader(http.StatusOK)
+		} else {
+			rw.WriteHeader(http.StatusInternalServerError)
+			currentTrial++
+		}
+	}))
+	defer secondary.Close()
+
+	t.Setenv("SECONDARY_URLS", secondary.URL)
+
+	success := make(chan string, 2)
+	batch := []pendingMessage{
+		{message: model.Message{Id: 0, Message: "first"}, notify: success},
+		{message: model.Message{Id: 1, Message: "second"}, notify: success},
+	}
+
+	// WHEN
+	NewExecutor(storage.NewInMemoryStorage(), nil).replicateBatchWithRetry(secondary.URL, batch)
+
+	// THEN
+	<-success
+	<-success
+	require.Equal(t, currentTrial, maxTrials)
+}
+
+func TestFullBatchBacklogLeavesMessagesForCatchUp(t *testing.T) {
+	// GIVEN
+	secondary := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer secondary.Close()
+
+	executor := NewExecutorWithSecondaries(storage.NewInMemoryStorage(), []string{secondary.URL}, 0, nil)
+	defer executor.Close()
+	b := newBatcher(executor, secondary.URL, 1, time.Millisecond, 1, 2)
+
+	// WHEN
+	for id := 0; id < 5; id++ {
+		message := model.Message{Id: model.MessageId(id), Message: "test"}
+		executor.track(secondary.URL, message)
+		b.enqueue(context.Background(), message, make(chan string, 1))
+	}
+
+	// THEN
+	require.Equal(t, 2, b.pending())
+	require.Equal(t, 2, executor.outstandingCount(secondary.URL, partitionKey{topic: storage.DefaultTopic}),
+		"messages which don't fit into backlog are not outstanding anymore")
+}
+
+func TestMessageLeftForCatchUpIsAcknowledgedByCatchUp(t *testing.T) {
+	// GIVEN
+	secondary := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer secondary.Close()
+
+	executor := NewExecutorWithSecondaries(storage.NewInMemoryStorage(), []string{secondary.URL}, 0, nil)
+	defer executor.Close()
+	b := newBatcher(executor, secondary.URL, 1, time.Millisecond, 1, 0)
+	message := model.Message{Id: 0, Message: "test"}
+	executor.track(secondary.URL, message)
+	notify := make(chan string, 1)
+	b.enqueue(context.Background(), message, notify)
+	require.Empty(t, notify)
+
+	// WHEN
+	executor.markAckedBefore(secondary.URL, partitionKey{topic: storage.DefaultTopic}, 1)
+
+	// THEN
+	require.Equal(t, secondary.URL, <-notify)
+}
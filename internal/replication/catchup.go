@@ -0,0 +1,168 @@
+package replication
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"replicated-log/internal/healthcheck"
+	"replicated-log/internal/logging"
+	"replicated-log/internal/model"
+	"replicated-log/internal/storage"
+	"replicated-log/internal/transport"
+)
+
+var catchUpLogger = logging.Component("catch-up")
+
+// catchUp streams all messages missed by the secondary (e.g. after restart) in batches.
+// Live replication keeps working in parallel, duplicates are dropped by secondary storage.
+func (e *Executor) catchUp(secondaryUrl string) {
+	if !e.startCatchUp(secondaryUrl) {
+		catchUpLogger.Debug("Catch-up is already in progress", "secondary", secondaryUrl)
+		return
+	}
+	defer e.finishCatchUp(secondaryUrl)
+
+	for _, topic := range e.topics.Names() {
+		partitions, err := e.topics.Partitions(topic)
+		if err != nil {
+			continue // deleted in the meantime
+		}
+		for partition, messages := range partitions {
+			if !e.catchUpPartition(secondaryUrl, partitionKey{topic: topic, partition: partition}, messages) {
+				return
+			}
+		}
+	}
+}
+
+// catchUpPartition returns false if catch-up of the secondary should be stopped for all partitions
+func (e *Executor) catchUpPartition(secondaryUrl string, log partitionKey, messages storage.Storage) bool {
+	if messages.GetOffset() == 0 {
+		return true // nothing to catch up
+	}
+	topic, partition := log.topic, log.partition
+
+	offset, err := e.transport.FetchOffset(context.Background(), secondaryUrl, topic, partition)
+	for attempt := 0; err != nil; attempt++ {
+		catchUpLogger.Warn("Failed to get offset", "secondary", secondaryUrl, "topic", topic, "partition", partition, "attempt", attempt, "err", err)
+		if !e.isSecondary(secondaryUrl) || !healthcheck.IsAvailable(e.health.GetStatus(secondaryUrl)) {
+			catchUpLogger.Info("Secondary is not available, stop catch-up", "secondary", secondaryUrl, "topic", topic, "partition", partition)
+			return false
+		}
+		if !e.sleepBeforeRetry(secondaryUrl, attempt) {
+			return false
+		}
+		offset, err = e.transport.FetchOffset(context.Background(), secondaryUrl, topic, partition)
+	}
+	generation, err := e.topics.Generation(topic)
+	if err != nil {
+		catchUpLogger.Info("Topic is deleted, skip its catch-up", "secondary", secondaryUrl, "topic", topic, "partition", partition)
+		return true
+	}
+	catchUpLogger.Info("Start catch-up", "secondary", secondaryUrl, "topic", topic, "partition", partition, "secondary_offset", offset, "primary_offset", messages.GetOffset())
+	e.markAckedBefore(secondaryUrl, log, offset)
+
+	for attempt := 0; ; {
+		batch := messages.GetMessagesFrom(offset, e.catchUpBatchSize)
+		if len(batch) == 0 {
+			catchUpLogger.Info("Secondary is up to date", "secondary", secondaryUrl, "topic", topic, "partition", partition)
+			return true
+		}
+		storage.MarkSkipped(offset, batch)
+		for i := range batch {
+			if topic != storage.DefaultTopic {
+				batch[i].Topic = topic
+				batch[i].Partition = partition
+			}
+			batch[i].TopicGeneration = generation
+		}
+
+		if !healthcheck.IsAvailable(e.health.GetStatus(secondaryUrl)) {
+			// will be restarted by recovery of the secondary or when it reports that it is behind
+			catchUpLogger.Info("Secondary is DEAD, stop catch-up", "secondary", secondaryUrl, "topic", topic, "partition", partition, "offset", offset)
+			return false
+		}
+		if !e.isCurrentGeneration(batch[0]) {
+			catchUpLogger.Info("Topic is deleted, stop its catch-up", "secondary", secondaryUrl, "topic", topic, "partition", partition)
+			return true
+		}
+
+		e.markSent(secondaryUrl, batch...)
+		e.metrics.ReplicationAttempt(secondaryUrl)
+		err = e.sendBatch(context.Background(), secondaryUrl, batch)
+		if errors.Is(err, transport.ErrConflict) {
+			catchUpLogger.Warn("Secondary has conflicting messages, overwrite them", "first_id", batch[0].Id, "last_id", batch[len(batch)-1].Id, "secondary", secondaryUrl, "topic", topic, "partition", partition, "err", err)
+			err = e.overwrite(context.Background(), secondaryUrl, batch)
+		}
+		if errors.Is(err, transport.ErrStaleTerm) {
+			e.metrics.ReplicationFailure(secondaryUrl)
+			catchUpLogger.Warn("Secondary follows a newer leader, stop catch-up", "secondary", secondaryUrl, "topic", topic, "partition", partition, "term", e.term)
+			e.fencedOff(secondaryUrl)
+			return false
+		}
+		if err != nil {
+			e.metrics.ReplicationFailure(secondaryUrl)
+			catchUpLogger.Warn("Failed to send messages", "first_id", batch[0].Id, "last_id", batch[len(batch)-1].Id, "secondary", secondaryUrl, "topic", topic, "partition", partition, "err", err)
+			if !e.sleepBeforeRetry(secondaryUrl, attempt) {
+				return false
+			}
+			attempt++
+			continue
+		}
+
+		catchUpLogger.Debug("ACK", "first_id", batch[0].Id, "last_id", batch[len(batch)-1].Id, "secondary", secondaryUrl, "topic", topic, "partition", partition)
+		e.markAcked(secondaryUrl, batch...)
+		attempt = 0
+		offset = batch[len(batch)-1].Id + 1
+	}
+}
+
+func (e *Executor) startCatchUp(secondaryUrl string) bool {
+	e.catchUpMu.Lock()
+	defer e.catchUpMu.Unlock()
+
+	if e.catchUpInProgress[secondaryUrl] {
+		return false
+	}
+	e.catchUpInProgress[secondaryUrl] = true
+
+	return true
+}
+
+func (e *Executor) finishCatchUp(secondaryUrl string) {
+	e.catchUpMu.Lock()
+	defer e.catchUpMu.Unlock()
+
+	delete(e.catchUpInProgress, secondaryUrl)
+}
+
+// sendBatch sends messages at once, ctx carries correlation ids of appends which are replicated
+func (e *Executor) sendBatch(ctx context.Context, secondaryUrl string, batch []model.Message) error {
+	err := e.transport.ReplicateBatch(ctx, secondaryUrl, e.stamped(batch))
+	if errors.Is(err, transport.ErrStaleTerm) {
+		return fmt.Errorf("term %d is stale: %w", e.term, err)
+	}
+	return err
+}
+
+// overwrite replaces diverged messages of the secondary with the ones of this leader, log of the leader wins as in Raft
+func (e *Executor) overwrite(ctx context.Context, secondaryUrl string, batch []model.Message) error {
+	err := e.transport.Repair(ctx, secondaryUrl, e.stamped(batch))
+	if errors.Is(err, transport.ErrStaleTerm) {
+		return fmt.Errorf("term %d is stale: %w", e.term, err)
+	}
+	if err == nil {
+		e.metrics.RepairedMessages(secondaryUrl, len(batch))
+	}
+	return err
+}
+
+// stamped returns copy of messages with term of this leader
+func (e *Executor) stamped(batch []model.Message) []model.Message {
+	stamped := make([]model.Message, len(batch))
+	for i, message := range batch {
+		stamped[i] = message
+		stamped[i].Term = e.term
+	}
+	return stamped
+}
@@ -0,0 +1,307 @@
+package replication
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"replicated-log/internal/healthcheck"
+	"replicated-log/internal/model"
+	"replicated-log/internal/storage"
+	"replicated-log/internal/transport"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newSecondaryWithStorage(t *testing.T, secondaryStorage *storage.InMemoryStorage, isAlive func() bool) *httptest.Server {
+	var current atomic.Pointer[storage.InMemoryStorage]
+	current.Store(secondaryStorage)
+	return newRestartableSecondary(t, &current, isAlive)
+}
+
+// newRestartableSecondary serves the current storage, so restart of the secondary is emulated by its replacement
+func newRestartableSecondary(t *testing.T, current *atomic.Pointer[storage.InMemoryStorage], isAlive func() bool) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/healthcheck", func(rw http.ResponseWriter, _ *http.Request) {
+		if isAlive() {
+			rw.Header().Set(transport.SecondaryOffsetHeader, strconv.Itoa(int(current.Load().GetOffset())))
+			rw.WriteHeader(http.StatusOK)
+		} else {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+	mux.HandleFunc("/api/v1/internal/offset", func(rw http.ResponseWriter, _ *http.Request) {
+		rawResponse, _ := json.Marshal(map[string]any{"offset": current.Load().GetOffset()})
+		_, _ = rw.Write(rawResponse)
+	})
+	mux.HandleFunc("/api/v1/internal/replicate/batch", func(rw http.ResponseWriter, r *http.Request) {
+		var messages []model.Message
+		err := json.NewDecoder(r.Body).Decode(&messages)
+		require.NoError(t, err)
+		for _, message := range messages {
+			current.Load().AddMessage(message)
+		}
+		rw.WriteHeader(http.StatusOK)
+	})
+
+	return httptest.NewServer(mux)
+}
+
+func TestCatchUpOfSecondaryWhichIsBehindAtStartup(t *testing.T) {
+	// GIVEN
+	primaryStorage := storage.NewInMemoryStorage()
+	for _, message := range []string{"first", "second", "third", "fourth", "fifth"} {
+		primaryStorage.AddRawMessage(message)
+	}
+
+	secondaryStorage := storage.NewInMemoryStorage()
+	secondaryStorage.AddMessage(model.Message{Id: 0, Message: "first"})
+	secondaryStorage.AddMessage(model.Message{Id: 3, Message: "fourth"})
+
+	secondary := newSecondaryWithStorage(t, secondaryStorage, func() bool { return true })
+	defer secondary.Close()
+
+	t.Setenv("SECONDARY_URLS", secondary.URL)
+	t.Setenv("CATCH_UP_BATCH_SIZE", "2")
+
+	// WHEN
+	executor := NewExecutor(primaryStorage, nil)
+	defer executor.Close()
+
+	// THEN
+	require.Eventually(t, func() bool {
+		return len(secondaryStorage.GetMessages()) == 5
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, primaryStorage.GetMessages(), secondaryStorage.GetMessages())
+}
+
+func TestCatchUpOfSecondaryAfterRecovery(t *testing.T) {
+	// GIVEN
+	primaryStorage := storage.NewInMemoryStorage()
+	primaryStorage.AddRawMessage("first")
+	primaryStorage.AddRawMessage("second")
+
+	var isAlive atomic.Bool // secondary is DEAD at the beginning
+
+	secondaryStorage := storage.NewInMemoryStorage()
+	secondary := newSecondaryWithStorage(t, secondaryStorage, isAlive.Load)
+	defer secondary.Close()
+
+	t.Setenv("SECONDARY_URLS", secondary.URL)
+	t.Setenv("HEALTHCHECK_PERIOD_MILLISECOND", "10")
+
+	executor := NewExecutor(primaryStorage, nil)
+	defer executor.Close()
+	require.Empty(t, secondaryStorage.GetMessages())
+
+	// WHEN
+	isAlive.Store(true)
+
+	// THEN
+	require.Eventually(t, func() bool {
+		return len(secondaryStorage.GetMessages()) == 2
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, primaryStorage.GetMessages(), secondaryStorage.GetMessages())
+}
+
+func TestCatchUpOfSecondaryWhichIsBehindRetentionOfPrimary(t *testing.T) {
+	// GIVEN
+	primaryStorage := storage.NewInMemoryStorage()
+	for _, message := range []string{"first", "second", "third", "fourth", "fifth"} {
+		primaryStorage.AddNewMessage(model.Message{Message: message, Key: "key-" + message})
+	}
+	primaryStorage.AddNewMessage(model.Message{Message: "sixth", Key: "key-fifth"})
+	primaryStorage.Trim(2)
+	primaryStorage.Compact(primaryStorage.GetOffset())
+
+	secondaryStorage := storage.NewInMemoryStorage()
+	secondaryStorage.AddMessage(model.Message{Id: 0, Message: "first"})
+
+	secondary := newSecondaryWithStorage(t, secondaryStorage, func() bool { return true })
+	defer secondary.Close()
+
+	t.Setenv("SECONDARY_URLS", secondary.URL)
+
+	// WHEN
+	executor := NewExecutor(primaryStorage, nil)
+	defer executor.Close()
+
+	// THEN
+	require.Eventually(t, func() bool {
+		return secondaryStorage.GetOffset() == primaryStorage.GetOffset()
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, []string{"first", "third", "fourth", "sixth"}, secondaryStorage.GetMessages())
+}
+
+func TestCatchUpOfSecondaryWhichHasLostMessagesWhileAlive(t *testing.T) {
+	// GIVEN
+	primaryStorage := storage.NewInMemoryStorage()
+	primaryStorage.AddRawMessage("first")
+	primaryStorage.AddRawMessage("second")
+
+	var current atomic.Pointer[storage.InMemoryStorage]
+	current.Store(storage.NewInMemoryStorage())
+	secondary := newRestartableSecondary(t, &current, func() bool { return true })
+	defer secondary.Close()
+
+	t.Setenv("SECONDARY_URLS", secondary.URL)
+	t.Setenv("HEALTHCHECK_PERIOD_MILLISECOND", "10")
+
+	executor := NewExecutor(primaryStorage, nil)
+	defer executor.Close()
+	require.Eventually(t, func() bool {
+		return len(current.Load().GetMessages()) == 2
+	}, time.Second, 10*time.Millisecond)
+
+	// WHEN
+	restarted := storage.NewInMemoryStorage()
+	current.Store(restarted)
+
+	// THEN
+	require.Eventually(t, func() bool {
+		return len(restarted.GetMessages()) == 2
+	}, time.Second, 10*time.Millisecond, "offset of the secondary has gone backwards")
+	require.Equal(t, primaryStorage.GetMessages(), restarted.GetMessages())
+}
+
+func TestCatchUpOverwritesConflictingMessagesOfSecondary(t *testing.T) {
+	// GIVEN
+	primaryStorage := storage.NewInMemoryStorage()
+	for _, message := range []string{"first", "second", "third"} {
+		primaryStorage.AddRawMessage(message)
+	}
+
+	secondaryStorage := storage.NewInMemoryStorage()
+	secondaryStorage.AddMessage(model.Message{Id: 0, Message: "first"})
+	secondaryStorage.AddMessage(model.Message{Id: 2, Message: "diverged"})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/healthcheck", func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/api/v1/internal/offset", func(rw http.ResponseWriter, _ *http.Request) {
+		rawResponse, _ := json.Marshal(map[string]any{"offset": secondaryStorage.GetOffset()})
+		_, _ = rw.Write(rawResponse)
+	})
+	mux.HandleFunc("/api/v1/internal/replicate/batch", func(rw http.ResponseWriter, r *http.Request) {
+		var messages []model.Message
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&messages))
+		isConflict := false
+		for _, message := range messages {
+			stored := secondaryStorage.GetMessagesRange(message.Id, message.Id+1, 1)
+			if len(stored) == 1 && stored[0].Message != message.Message {
+				isConflict = true
+				continue
+			}
+			secondaryStorage.AddMessage(message)
+		}
+		if isConflict {
+			rw.WriteHeader(http.StatusUnprocessableEntity)
+		}
+	})
+	mux.HandleFunc("/api/v1/internal/repair", func(rw http.ResponseWriter, r *http.Request) {
+		var messages []model.Message
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&messages))
+		for _, message := range messages {
+			secondaryStorage.Replace(message)
+		}
+	})
+	secondary := httptest.NewServer(mux)
+	defer secondary.Close()
+
+	t.Setenv("SECONDARY_URLS", secondary.URL)
+
+	// WHEN
+	executor := NewExecutor(primaryStorage, nil)
+	defer executor.Close()
+
+	// THEN
+	require.Eventually(t, func() bool {
+		return secondaryStorage.GetMessages()[len(secondaryStorage.GetMessages())-1] == "third"
+	}, time.Second, 10*time.Millisecond, "log of the primary wins")
+	require.Equal(t, primaryStorage.GetMessages(), secondaryStorage.GetMessages())
+}
+
+func TestCatchUpRetriesFailedOffsetRequest(t *testing.T) {
+	// GIVEN
+	primaryStorage := storage.NewInMemoryStorage()
+	primaryStorage.AddRawMessage("first")
+
+	var offsetRequests atomic.Int32
+	secondaryStorage := storage.NewInMemoryStorage()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/healthcheck", func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusOK) // offset is not reported, so only startup catch-up is done
+	})
+	mux.HandleFunc("/api/v1/internal/offset", func(rw http.ResponseWriter, _ *http.Request) {
+		if offsetRequests.Add(1) <= 2 {
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		rawResponse, _ := json.Marshal(map[string]any{"offset": secondaryStorage.GetOffset()})
+		_, _ = rw.Write(rawResponse)
+	})
+	mux.HandleFunc("/api/v1/internal/replicate/batch", func(rw http.ResponseWriter, r *http.Request) {
+		var messages []model.Message
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&messages))
+		for _, message := range messages {
+			secondaryStorage.AddMessage(message)
+		}
+		rw.WriteHeader(http.StatusOK)
+	})
+	secondary := httptest.NewServer(mux)
+	defer secondary.Close()
+
+	t.Setenv("SECONDARY_URLS", secondary.URL)
+
+	// WHEN
+	executor := NewExecutor(primaryStorage, nil)
+	defer executor.Close()
+
+	// THEN
+	require.Eventually(t, func() bool {
+		return len(secondaryStorage.GetMessages()) == 1
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, int32(3), offsetRequests.Load())
+}
+
+func TestCatchUpOfSecondaryWhichRestartedEmptyWhileSuspected(t *testing.T) {
+	// GIVEN
+	primaryStorage := storage.NewInMemoryStorage()
+	primaryStorage.AddRawMessage("first")
+	primaryStorage.AddRawMessage("second")
+
+	var isAlive atomic.Bool
+	isAlive.Store(true)
+	var current atomic.Pointer[storage.InMemoryStorage]
+	current.Store(storage.NewInMemoryStorage())
+	secondary := newRestartableSecondary(t, &current, isAlive.Load)
+	defer secondary.Close()
+
+	t.Setenv("SECONDARY_URLS", secondary.URL)
+	t.Setenv("HEALTHCHECK_PERIOD_MILLISECOND", "10")
+	t.Setenv("HEALTHCHECK_DEAD_AFTER_FAILURES", "1000")
+
+	executor := NewExecutor(primaryStorage, nil)
+	defer executor.Close()
+	require.Eventually(t, func() bool {
+		return len(current.Load().GetMessages()) == 2
+	}, time.Second, 10*time.Millisecond)
+
+	// WHEN
+	isAlive.Store(false)
+	require.Eventually(t, func() bool {
+		return executor.SecondaryHealth(secondary.URL).Status == healthcheck.SUSPECTED
+	}, time.Second, 5*time.Millisecond)
+	restarted := storage.NewInMemoryStorage()
+	current.Store(restarted)
+	isAlive.Store(true)
+
+	// THEN
+	require.Eventually(t, func() bool {
+		return len(restarted.GetMessages()) == 2
+	}, time.Second, 10*time.Millisecond, "secondary has never been DEAD, but it has lost messages")
+	require.Equal(t, primaryStorage.GetMessages(), restarted.GetMessages())
+}
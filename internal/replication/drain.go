@@ -0,0 +1,195 @@
+package replication
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"replicated-log/internal/logging"
+	"replicated-log/internal/model"
+	"time"
+)
+
+type outstandingKey struct {
+	secondaryUrl string
+	log          partitionKey
+	id           model.MessageId
+}
+
+// outstandingReplication -- message which is not ACKed by secondary yet, this is what resend queue consists of
+type outstandingReplication struct {
+	SecondaryUrl string        `json:"secondary_url"`
+	Message      model.Message `json:"message"`
+}
+
+func (e *Executor) track(secondaryUrl string, message model.Message) {
+	e.outstandingMu.Lock()
+	defer e.outstandingMu.Unlock()
+
+	e.outstanding[outstandingKey{secondaryUrl: secondaryUrl, log: partitionOf(message), id: message.Id}] = message
+}
+
+func (e *Executor) untrack(secondaryUrl string, message model.Message) {
+	e.outstandingMu.Lock()
+	defer e.outstandingMu.Unlock()
+
+	delete(e.outstanding, outstandingKey{secondaryUrl: secondaryUrl, log: partitionOf(message), id: message.Id})
+}
+
+// untrackSecondary drops all outstanding replications to the secondary, e.g. queued or retried batches
+func (e *Executor) untrackSecondary(secondaryUrl string) {
+	e.outstandingMu.Lock()
+	defer e.outstandingMu.Unlock()
+
+	for key := range e.outstanding {
+		if key.secondaryUrl == secondaryUrl {
+			delete(e.outstanding, key)
+		}
+	}
+}
+
+// untrackTopic drops all outstanding replications of the deleted topic to every secondary
+func (e *Executor) untrackTopic(name string) {
+	e.outstandingMu.Lock()
+	defer e.outstandingMu.Unlock()
+
+	for key := range e.outstanding {
+		if key.log.topic == name {
+			delete(e.outstanding, key)
+		}
+	}
+}
+
+func (e *Executor) outstandingCount(secondaryUrl string, log partitionKey) int {
+	e.outstandingMu.Lock()
+	defer e.outstandingMu.Unlock()
+
+	count := 0
+	for key := range e.outstanding {
+		if key.secondaryUrl == secondaryUrl && key.log == log {
+			count++
+		}
+	}
+	return count
+}
+
+func (e *Executor) outstandingReplications() []outstandingReplication {
+	e.outstandingMu.Lock()
+	defer e.outstandingMu.Unlock()
+
+	result := make([]outstandingReplication, 0, len(e.outstanding))
+	for key, message := range e.outstanding {
+		result = append(result, outstandingReplication{SecondaryUrl: key.secondaryUrl, Message: message})
+	}
+
+	return result
+}
+
+// Drain waits till all outstanding replications are ACKed. Whatever is left when ctx is done
+// is persisted to the resend queue and replicated again after restart.
+func (e *Executor) Drain(ctx context.Context) {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		left := e.outstandingReplications()
+		if len(left) == 0 {
+			logger.Info("All replications are finished")
+			return
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			logger.Warn("Grace period is over, some replications are not finished", "replications", len(left))
+			e.saveResendQueue(left)
+			return
+		}
+	}
+}
+
+func (e *Executor) saveResendQueue(left []outstandingReplication) {
+	if e.resendQueuePath == "" {
+		logger.Warn("'RESEND_QUEUE_PATH' is not set, outstanding replications are dropped")
+		return
+	}
+
+	payload, _ := json.Marshal(left)
+	if err := writeFileAtomically(e.resendQueuePath, payload); err != nil {
+		logger.Error("Failed to save resend queue", "path", e.resendQueuePath, "err", err)
+		return
+	}
+
+	logger.Info("Saved replications to resend queue", "replications", len(left), "path", e.resendQueuePath)
+}
+
+// writeFileAtomically writes and fsyncs a temporary file first, so crash during shutdown never leaves a truncated file.
+// Directory is fsynced after rename, otherwise the rename itself can be lost.
+func writeFileAtomically(path string, payload []byte) error {
+	tmpPath := path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(payload); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return file.Sync()
+}
+
+// loadResendQueue restarts replications which were not finished before previous shutdown
+func (e *Executor) loadResendQueue() {
+	if e.resendQueuePath == "" {
+		return
+	}
+
+	payload, err := os.ReadFile(e.resendQueuePath)
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		logging.Fatal(logger, "Failed to read resend queue", "path", e.resendQueuePath, "err", err)
+	}
+
+	var left []outstandingReplication
+	if err = json.Unmarshal(payload, &left); err != nil {
+		logger.Warn("Resend queue is corrupted, skipping it", "path", e.resendQueuePath, "err", err)
+	}
+
+	logger.Info("Resending replications from resend queue", "replications", len(left), "path", e.resendQueuePath)
+	for _, replication := range left {
+		if !e.isSecondary(replication.SecondaryUrl) {
+			logger.Info("Not a secondary anymore, skipping message", "secondary", replication.SecondaryUrl, "id", replication.Message.Id)
+			continue
+		}
+		// topic gets a new generation after restart, messages of deleted topics were untracked before shutdown
+		message := replication.Message
+		message.TopicGeneration, _ = e.topics.Generation(message.Topic)
+		// nobody waits for ACK
+		e.replicateTo(context.Background(), replication.SecondaryUrl, message, make(chan string, 1))
+	}
+
+	if err = os.Remove(e.resendQueuePath); err != nil {
+		logger.Warn("Failed to remove resend queue", "path", e.resendQueuePath, "err", err)
+	}
+}
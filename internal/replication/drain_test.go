@@ -0,0 +1,92 @@
+package replication
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"replicated-log/internal/model"
+	"replicated-log/internal/storage"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDrainWaitsForOutstandingReplications(t *testing.T) {
+	// GIVEN
+	var isReplicated atomic.Bool
+	secondary := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			time.Sleep(20 * time.Millisecond) // slow replication
+			isReplicated.Store(true)
+		}
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer secondary.Close()
+
+	t.Setenv("SECONDARY_URLS", secondary.URL)
+	t.Setenv("REQUEST_TIMEOUT_MILLISECONDS", "1000")
+	executor := NewExecutor(storage.NewInMemoryStorage(), nil)
+	defer executor.Close()
+
+	_, _ = executor.ReplicateMessage(context.Background(), model.Message{Id: 0, Message: "first"}, 0)
+
+	// WHEN
+	executor.Drain(context.Background())
+
+	// THEN
+	require.True(t, isReplicated.Load())
+	require.Empty(t, executor.outstandingReplications())
+}
+
+func TestOutstandingReplicationsAreResentAfterRestart(t *testing.T) {
+	// GIVEN
+	var isAlive atomic.Bool
+	replicated := make(chan model.Message, 1)
+	secondary := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if !isAlive.Load() {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.Method != http.MethodGet {
+			var message model.Message
+			err := json.NewDecoder(r.Body).Decode(&message)
+			require.NoError(t, err)
+			replicated <- message
+		}
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer secondary.Close()
+
+	resendQueuePath := filepath.Join(t.TempDir(), "resend-queue.json")
+	t.Setenv("SECONDARY_URLS", secondary.URL)
+	t.Setenv("RESEND_QUEUE_PATH", resendQueuePath)
+
+	executor := NewExecutor(storage.NewInMemoryStorage(), nil)
+	message := model.Message{Id: 0, Message: "first"}
+	_, _ = executor.ReplicateMessage(context.Background(), message, 0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	// WHEN
+	executor.Drain(ctx)
+	executor.Close()
+
+	// THEN
+	require.FileExists(t, resendQueuePath)
+	require.NoFileExists(t, resendQueuePath+".tmp", "queue is renamed into place")
+
+	isAlive.Store(true)
+	restarted := NewExecutor(storage.NewInMemoryStorage(), nil)
+	defer restarted.Close()
+
+	require.Equal(t, message, <-replicated)
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(resendQueuePath)
+		return os.IsNotExist(err)
+	}, time.Second, 10*time.Millisecond)
+}
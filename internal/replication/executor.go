@@ -1,61 +1,127 @@
 package replication
 
 import (
-	"encoding/json"
-	"io"
-	"log"
+	"context"
+	"errors"
+	"fmt"
 	"math"
 	"math/rand"
-	"net/http"
 	"net/url"
 	"os"
 	"replicated-log/internal/healthcheck"
+	"replicated-log/internal/logging"
+	"replicated-log/internal/metrics"
 	"replicated-log/internal/model"
+	"replicated-log/internal/storage"
+	"replicated-log/internal/transport"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
+var logger = logging.Component("executor")
+
+const (
+	modeSingle = "SINGLE" // one request per message per secondary
+	modeBatch  = "BATCH"  // messages are coalesced into batches per secondary
+
+	WriteConcernBlock  = "BLOCK"  // client waits till enough secondaries become alive
+	WriteConcernReject = "REJECT" // append is rejected if there are not enough alive secondaries
+)
+
+var (
+	// ErrUnsatisfiableWriteConcern -- w is bigger than number of nodes in the cluster, it can never be satisfied
+	ErrUnsatisfiableWriteConcern = errors.New("write concern is bigger than cluster size")
+	// ErrNotEnoughAliveSecondaries -- w cannot be satisfied by currently alive secondaries
+	ErrNotEnoughAliveSecondaries = errors.New("not enough alive secondaries to satisfy write concern")
+)
+
 type Executor struct {
+	membersMu     *sync.Mutex
 	secondaryUrls []string
-	// Clients are safe for concurrent use by multiple goroutines. https://go.dev/src/net/http/client.go
-	client http.Client
+	// HTTP or gRPC, shared with health check
+	transport transport.Transport
 	// retry config
 	initialSleepTime time.Duration
 	sleepMultiplier  int
+	maxSleepTime     time.Duration
 	// jitter config
 	minInterval int64
 	maxInterval int64
 	// healthcheck
 	health *healthcheck.MonitoringDaemon
+	// catch-up config
+	topics            *storage.Topics
+	catchUpBatchSize  int
+	catchUpMu         *sync.Mutex
+	catchUpInProgress map[string]bool
+	// batch mode, nil if every message is replicated separately
+	batchers         map[string]*batcher
+	batchMaxSize     int
+	batchLinger      time.Duration
+	batchMaxInFlight int
+	batchMaxBacklog  int
+	// replications which are not ACKed yet, saved to resend queue on shutdown
+	outstandingMu   *sync.Mutex
+	outstanding     map[outstandingKey]model.Message
+	resendQueuePath string
+	// acknowledged messages per secondary and topic, used to calculate replication lag
+	lagMu    *sync.Mutex
+	trackers map[lagKey]*ackTracker
+	// topics which are not deleted from all secondaries yet, they cannot be created again
+	deletionsMu *sync.Mutex
+	deletions   map[string]int
+	// the last anti-entropy check per secondary
+	antiEntropyMu       *sync.Mutex
+	divergences         map[string]Divergence
+	antiEntropyLeafSize int
+	antiEntropyFanOut   int
+	antiEntropyRepair   bool
+	// what to do with append which cannot be satisfied by alive secondaries
+	writeConcernPolicy string
+	// term of the leader which owns this executor
+	term uint64
+	// called with a newer term when a secondary has fenced off this leader
+	onStaleTerm func(term uint64)
+	metrics     *metrics.Metrics
+	// closed when executor is stopped, all retries are aborted
+	quit chan struct{}
 }
 
 // isValidUrl tests a string to determine if it is a well-structured url or not.
 func isValidUrl(toTest string) bool {
 	_, err := url.ParseRequestURI(toTest)
 	if err != nil {
-		log.Printf("'%s' is an invalid URL", toTest)
+		logger.Warn("Invalid URL", "url", toTest)
 		return false
 	}
 
 	u, err := url.Parse(toTest)
 	if err != nil || u.Scheme == "" || u.Host == "" {
-		log.Printf("'%s' is an invalid URL", toTest)
+		logger.Warn("Invalid URL", "url", toTest)
 		return false
 	}
 
 	return true
 }
 
-func NewExecutor() *Executor {
+// NewExecutor creates executor which replicates messages to secondaries from 'SECONDARY_URLS' env var.
+// Replication is reported to the given metrics, nil disables metrics.
+func NewExecutor(source storage.Storage, m *metrics.Metrics) *Executor {
+	return NewTopicsExecutor(storage.NewTopicsWithDefault(source), m)
+}
+
+// NewTopicsExecutor creates executor which replicates messages of all topics to secondaries from 'SECONDARY_URLS' env var
+func NewTopicsExecutor(topics *storage.Topics, m *metrics.Metrics) *Executor {
 	secondaryUrlsToken, ok := os.LookupEnv("SECONDARY_URLS")
 	if !ok {
-		log.Fatalf("'SECONDARY_URLS' env var is not set")
+		logging.Fatal(logger, "'SECONDARY_URLS' env var is not set")
 	}
 
 	secondaryUrls := strings.Split(secondaryUrlsToken, ",")
 	if len(secondaryUrls) == 0 {
-		log.Fatalf("Given 'SECONDARY_URLS' token is empty")
+		logging.Fatal(logger, "Given 'SECONDARY_URLS' token is empty")
 	}
 
 	isValid := true
@@ -63,106 +129,354 @@ func NewExecutor() *Executor {
 		isValid = isValidUrl(secondaryUrl) && isValid
 	}
 	if !isValid {
-		log.Fatalf("Given 'SECONDARY_URLS' token is invalid: '%s'", secondaryUrlsToken)
+		logging.Fatal(logger, "Given 'SECONDARY_URLS' token is invalid", "token", secondaryUrlsToken)
 
 	}
 
-	requestTimeout := 50 * time.Millisecond // default value
-	if requestTimeoutToken, okTimeout := os.LookupEnv("REQUEST_TIMEOUT_MILLISECONDS"); okTimeout {
-		value, _ := strconv.Atoi(requestTimeoutToken)
-		requestTimeout = time.Duration(value) * time.Millisecond
-	}
+	return NewExecutorWithTransport(topics, secondaryUrls, 0, transport.NewTransport(), m)
+}
+
+// NewExecutorWithSecondaries creates executor which replicates messages to the given secondaries.
+// Every replicated message is stamped with the given leader term.
+func NewExecutorWithSecondaries(source storage.Storage, secondaryUrls []string, term uint64, m *metrics.Metrics) *Executor {
+	return NewExecutorWithTransport(storage.NewTopicsWithDefault(source), secondaryUrls, term, transport.NewTransport(), m)
+}
 
+// NewExecutorWithTransport creates executor which replicates messages of all topics to the given secondaries
+// over the given transport
+func NewExecutorWithTransport(topics *storage.Topics, secondaryUrls []string, term uint64, t transport.Transport, m *metrics.Metrics) *Executor {
 	initialSleepTime := 10 * time.Millisecond // default value
 	intervalValue := int64(initialSleepTime) / 2
 
+	maxSleepTime := 2 * time.Second // default value
+	if maxSleepTimeToken, okMaxSleep := os.LookupEnv("MAX_BACKOFF_MILLISECONDS"); okMaxSleep {
+		value, _ := strconv.Atoi(maxSleepTimeToken)
+		maxSleepTime = time.Duration(value) * time.Millisecond
+	}
+
+	catchUpBatchSize := 100 // default value
+	if batchSizeToken, okBatchSize := os.LookupEnv("CATCH_UP_BATCH_SIZE"); okBatchSize {
+		catchUpBatchSize, _ = strconv.Atoi(batchSizeToken)
+	}
+
+	writeConcernPolicy, ok := os.LookupEnv("WRITE_CONCERN_POLICY")
+	if !ok {
+		writeConcernPolicy = WriteConcernBlock
+	}
+	if writeConcernPolicy != WriteConcernBlock && writeConcernPolicy != WriteConcernReject {
+		logging.Fatal(logger, "Unexpected write concern policy", "policy", writeConcernPolicy)
+	}
+
 	executor := Executor{
+		membersMu:     &sync.Mutex{},
 		secondaryUrls: secondaryUrls,
-		client: http.Client{
-			Timeout: requestTimeout,
-		},
+		transport:     t,
 		// retry config
 		initialSleepTime: initialSleepTime,
 		sleepMultiplier:  2,
+		maxSleepTime:     maxSleepTime,
 		// jitter config
 		maxInterval: intervalValue,
 		minInterval: -intervalValue,
-		health:      healthcheck.NewMonitoringDaemon(secondaryUrls),
+		health:      healthcheck.NewMonitoringDaemonWithTransport(secondaryUrls, t),
+		// catch-up config
+		topics:            topics,
+		catchUpBatchSize:  catchUpBatchSize,
+		catchUpMu:         &sync.Mutex{},
+		catchUpInProgress: make(map[string]bool),
+		// drain config
+		outstandingMu:   &sync.Mutex{},
+		outstanding:     make(map[outstandingKey]model.Message),
+		resendQueuePath: os.Getenv("RESEND_QUEUE_PATH"),
+		// lag tracking
+		lagMu:    &sync.Mutex{},
+		trackers: make(map[lagKey]*ackTracker),
+		// topics
+		deletionsMu: &sync.Mutex{},
+		deletions:   make(map[string]int),
+		// anti-entropy
+		antiEntropyMu: &sync.Mutex{},
+		divergences:   make(map[string]Divergence),
+		// write concern
+		writeConcernPolicy: writeConcernPolicy,
+		// leadership
+		term:        term,
+		onStaleTerm: func(uint64) {},
+		metrics:     m,
+		quit:        make(chan struct{}),
+	}
+
+	mode, ok := os.LookupEnv("REPLICATION_MODE")
+	if !ok {
+		mode = modeSingle
+	}
+
+	switch mode {
+	case modeSingle:
+		// nothing to prepare
+	case modeBatch:
+		executor.startBatchers()
+	default:
+		logging.Fatal(logger, "Unexpected replication mode", "mode", mode)
+	}
+
+	executor.loadResendQueue()
+
+	// secondaries use offset of the primary to reject reads with 'max_lag'
+	executor.health.ReportOffset(topics.Default().GetOffset)
+	executor.health.Subscribe(m.HealthTransition)
+	for _, secondaryUrl := range secondaryUrls {
+		m.SetHealthStatus(secondaryUrl, executor.health.GetStatus(secondaryUrl))
+	}
+
+	// secondaries which were restarted or lost messages should receive all messages they missed
+	executor.health.SubscribeOnRecovery(executor.catchUp)
+	executor.health.SubscribeOnFallingBehind(executor.catchUp)
+	for _, secondaryUrl := range secondaryUrls {
+		if executor.health.GetStatus(secondaryUrl) == healthcheck.ALIVE {
+			go executor.catchUp(secondaryUrl)
+		}
 	}
 
 	// start daemon thread
 	executor.health.StartHealthCheck()
+	executor.startAntiEntropy()
 
 	return &executor
 }
 
-func (e *Executor) ReplicateMessage(message model.Message, w int) {
-	if w > len(e.secondaryUrls) {
-		log.Fatalf("w > primaries number, %d > %d", w, len(e.secondaryUrls))
+// ReplicateMessage sends message to all secondaries and blocks till w of them ACK it or ctx is done.
+// Returns number of collected ACKs. Replication to the rest of secondaries continues in background anyway.
+func (e *Executor) ReplicateMessage(ctx context.Context, message model.Message, w int) ([]string, error) {
+	secondaryUrls := e.Secondaries()
+	if w > len(secondaryUrls) {
+		// membership has been changed after the check
+		logger.WarnContext(ctx, "Write concern cannot be satisfied", "id", message.Id, "w", w, "secondaries", len(secondaryUrls))
+		return nil, ErrUnsatisfiableWriteConcern
 	}
 
+	// topic deleted in the meantime keeps zero generation, so its message is dropped by every secondary
+	message.TopicGeneration, _ = e.topics.Generation(message.Topic)
+
 	// Buffered channels allows to accept a limited number of values without a corresponding receiver for those values
-	replicationIsFinished := make(chan struct{}, len(e.secondaryUrls))
+	replicationIsFinished := make(chan string, len(secondaryUrls))
 
-	for _, secondaryUrl := range e.secondaryUrls {
-		go e.replicateWithRetry(secondaryUrl, message, replicationIsFinished)
+	// replication outlives the append request, only correlation id is inherited
+	replicationCtx := context.WithoutCancel(ctx)
+	for _, secondaryUrl := range secondaryUrls {
+		e.replicateTo(replicationCtx, secondaryUrl, message, replicationIsFinished)
+	}
+
+	acks := make([]string, 0, len(secondaryUrls))
+	for len(acks) < w {
+		select {
+		case secondaryUrl := <-replicationIsFinished:
+			acks = append(acks, secondaryUrl)
+		case <-ctx.Done():
+			logger.WarnContext(ctx, "Stop waiting for ACKs", "id", message.Id, "err", ctx.Err(), "acks", len(acks), "w", w)
+			return acks, ctx.Err()
+		}
+	}
+
+	// secondaries which have already acknowledged the message above write concern
+	for {
+		select {
+		case secondaryUrl := <-replicationIsFinished:
+			acks = append(acks, secondaryUrl)
+		default:
+			return acks, nil
+		}
+	}
+}
+
+// replicateTo starts replication of message in background, ctx carries correlation id of the append
+func (e *Executor) replicateTo(ctx context.Context, secondaryUrl string, message model.Message, notify chan<- string) {
+	e.membersMu.Lock()
+	isBatchMode := e.batchers != nil
+	b, ok := e.batchers[secondaryUrl]
+	e.membersMu.Unlock()
+
+	if isBatchMode && !ok {
+		return // secondary has been just removed
 	}
 
-	for w > 0 {
-		<-replicationIsFinished
-		w--
+	e.track(secondaryUrl, message)
+	e.markSent(secondaryUrl, message)
+
+	if isBatchMode {
+		b.enqueue(ctx, message, notify)
+	} else {
+		go e.replicateWithRetry(ctx, secondaryUrl, message, notify)
 	}
 }
 
 func (e *Executor) Close() {
+	close(e.quit)
 	e.health.StopHealthCheck()
+
+	e.membersMu.Lock()
+	defer e.membersMu.Unlock()
+	for _, b := range e.batchers {
+		b.stop()
+	}
+	e.transport.Close()
+}
+
+func (e *Executor) startBatchers() {
+	e.batchMaxSize = 100 // default value
+	if maxSizeToken, okSize := os.LookupEnv("REPLICATION_BATCH_MAX_SIZE"); okSize {
+		e.batchMaxSize, _ = strconv.Atoi(maxSizeToken)
+	}
+
+	e.batchLinger = 5 * time.Millisecond // default value
+	if lingerToken, okLinger := os.LookupEnv("REPLICATION_BATCH_LINGER_MILLISECONDS"); okLinger {
+		value, _ := strconv.Atoi(lingerToken)
+		e.batchLinger = time.Duration(value) * time.Millisecond
+	}
+
+	e.batchMaxInFlight = 4 // default value
+	if maxInFlightToken, okInFlight := os.LookupEnv("REPLICATION_BATCH_MAX_IN_FLIGHT"); okInFlight {
+		e.batchMaxInFlight, _ = strconv.Atoi(maxInFlightToken)
+	}
+
+	e.batchMaxBacklog = 10000 // default value
+	if maxBacklogToken, okBacklog := os.LookupEnv("REPLICATION_BATCH_MAX_BACKLOG"); okBacklog {
+		e.batchMaxBacklog, _ = strconv.Atoi(maxBacklogToken)
+	}
+
+	e.membersMu.Lock()
+	defer e.membersMu.Unlock()
+
+	e.batchers = make(map[string]*batcher)
+	for _, secondaryUrl := range e.secondaryUrls {
+		e.startBatcher(secondaryUrl)
+	}
+}
+
+// startBatcher should be called under membersMu
+func (e *Executor) startBatcher(secondaryUrl string) {
+	e.batchers[secondaryUrl] = newBatcher(e, secondaryUrl, e.batchMaxSize, e.batchLinger, e.batchMaxInFlight, e.batchMaxBacklog)
+	e.batchers[secondaryUrl].start()
 }
 
-func (e *Executor) replicateWithRetry(secondaryUrl string, message model.Message, notify chan<- struct{}) {
-	payload, _ := json.Marshal(message)
-	reqBody := string(payload)
+func (e *Executor) replicateWithRetry(ctx context.Context, secondaryUrl string, message model.Message, notify chan<- string) {
+	message.Term = e.term
 
 	// WHILE NOT SUCCESS:
 	for attempt := 0; ; attempt++ {
+		if !e.isSecondary(secondaryUrl) {
+			logger.InfoContext(ctx, "Secondary is removed, stop replication", "secondary", secondaryUrl, "id", message.Id)
+			e.untrack(secondaryUrl, message)
+			return
+		}
+		if !e.isCurrentGeneration(message) {
+			logger.InfoContext(ctx, "Topic is deleted, stop replication", "secondary", secondaryUrl, "id", message.Id, "topic", message.Topic)
+			e.untrack(secondaryUrl, message)
+			return
+		}
 
 		// 0) Check if Secondary is ALIVE
-		if e.health.GetStatus(secondaryUrl) == healthcheck.ALIVE {
+		if healthcheck.IsAvailable(e.health.GetStatus(secondaryUrl)) {
 			// 1) Send Request
-			req := io.NopCloser(strings.NewReader(reqBody))
-			log.Printf("[EXECUTOR] Sending message %d to %s. Attempt %d.", message.Id, secondaryUrl, attempt)
-			resp, err := e.client.Post(secondaryUrl+"/api/v1/internal/replicate", "application/json", req)
+			logger.DebugContext(ctx, "Sending message", "id", message.Id, "secondary", secondaryUrl, "attempt", attempt)
+			e.metrics.ReplicationAttempt(secondaryUrl)
+			err := e.transport.Replicate(ctx, secondaryUrl, message)
+			if errors.Is(err, transport.ErrConflict) {
+				logger.WarnContext(ctx, "Secondary has a conflicting message, overwrite it", "id", message.Id, "secondary", secondaryUrl)
+				err = e.overwrite(ctx, secondaryUrl, []model.Message{message})
+			}
 
 			// 2) Handle Response
-			if err != nil {
-				log.Printf("[EXECUTOR] Failed to replicate message. Err: %s", err)
-			} else if resp.StatusCode != 200 {
-				log.Printf("[EXECUTOR] Failed to replicate message. Secondary url: %s, status code: %d", secondaryUrl, resp.StatusCode)
+			if errors.Is(err, transport.ErrStaleTerm) {
+				// retry doesn't help, secondary follows a newer leader
+				e.metrics.ReplicationFailure(secondaryUrl)
+				e.untrack(secondaryUrl, message)
+				e.fencedOff(secondaryUrl)
+				return
+			} else if err != nil {
+				logger.WarnContext(ctx, "Failed to replicate message", "id", message.Id, "secondary", secondaryUrl, "err", err)
+				e.metrics.ReplicationFailure(secondaryUrl)
 			} else {
-				log.Printf("[EXECUTOR] ACK (message %d). Secondary url: %s\n", message.Id, secondaryUrl)
+				logger.DebugContext(ctx, "ACK", "id", message.Id, "secondary", secondaryUrl)
 				// SUCCESS! Notify main thread and exit...
-				notify <- struct{}{}
+				e.untrack(secondaryUrl, message)
+				e.markAcked(secondaryUrl, message)
+				notify <- secondaryUrl
 				return
 			}
 		} else {
-			log.Printf("[EXECUTOR] Sending message %d to %s. Attempt %d. Secondary is DEAD", message.Id, secondaryUrl, attempt)
+			logger.DebugContext(ctx, "Secondary is DEAD, message is not sent", "id", message.Id, "secondary", secondaryUrl, "attempt", attempt)
 		}
 
 		// 3) Sleep in case of Failure or DEAD Secondary
-		currentSleepTime := e.calculateCurrentSleepTime(attempt)
-		log.Printf("[EXECUTOR] Sleeping %v ms before next retry...", currentSleepTime)
-		time.Sleep(currentSleepTime)
+		if !e.sleepBeforeRetry(secondaryUrl, attempt) {
+			logger.InfoContext(ctx, "Executor is closed, stop replication", "id", message.Id, "secondary", secondaryUrl)
+			return
+		}
+	}
+}
+
+// OnStaleTerm registers listener which is called with a newer term when a secondary rejects messages of this leader,
+// it should be registered before the executor replicates messages
+func (e *Executor) OnStaleTerm(listener func(term uint64)) {
+	e.onStaleTerm = listener
+}
+
+// fencedOff reports that the given secondary follows a leader of a newer term, so this leader should step down
+func (e *Executor) fencedOff(secondaryUrl string) {
+	logger.Warn("Fenced off, term is stale", "secondary", secondaryUrl, "term", e.term)
+	e.onStaleTerm(e.term + 1)
+}
+
+// sleepBeforeRetry returns false if executor is closed while sleeping
+func (e *Executor) sleepBeforeRetry(secondaryUrl string, attempt int) bool {
+	currentSleepTime := e.calculateCurrentSleepTime(attempt)
+	logger.Debug("Sleeping before next retry", "secondary", secondaryUrl, "duration", currentSleepTime)
+	e.metrics.ReplicationBackoff(secondaryUrl, currentSleepTime)
+
+	select {
+	case <-time.After(currentSleepTime):
+		return true
+	case <-e.quit:
+		return false
 	}
 }
 
-// wait_interval = (base * multiplier^n) +/- (random interval)
+// wait_interval = min(base * multiplier^n, max) +/- (random interval)
 func (e *Executor) calculateCurrentSleepTime(failures int) time.Duration {
 	randomInterval := time.Duration(rand.Int63n(e.maxInterval-e.minInterval) + e.minInterval)
 	multiplierPowN := time.Duration(math.Pow(float64(e.sleepMultiplier), float64(failures)))
 
-	waitInterval := (e.initialSleepTime * multiplierPowN) + randomInterval
+	backoff := e.initialSleepTime * multiplierPowN
+	if backoff > e.maxSleepTime || backoff <= 0 { // <= 0 means overflow after many failures
+		backoff = e.maxSleepTime
+	}
+
+	waitInterval := backoff + randomInterval
 	return waitInterval
 }
 
+// CheckWriteConcern returns error if ACKs from w secondaries cannot be collected.
+// It is called before message is stored, so rejected append leaves no trace in the log.
+func (e *Executor) CheckWriteConcern(w int) error {
+	if total := len(e.Secondaries()); w > total {
+		return fmt.Errorf("%w: %d secondaries are required, %d are configured", ErrUnsatisfiableWriteConcern, w, total)
+	}
+	if quorum := e.health.Quorum(); e.writeConcernPolicy == WriteConcernReject && w > quorum.Alive {
+		return fmt.Errorf("%w: %d secondaries are required, %d are alive", ErrNotEnoughAliveSecondaries, w, quorum.Alive)
+	}
+	return nil
+}
+
+// WriteConcernPolicy returns what happens with append which cannot be satisfied by alive secondaries
+func (e *Executor) WriteConcernPolicy() string {
+	return e.writeConcernPolicy
+}
+
+func (e *Executor) Quorum() healthcheck.QuorumStatus {
+	return e.health.Quorum()
+}
+
 func (e *Executor) NoQuorum() bool {
 	return e.health.NoQuorum()
 }
@@ -1,12 +1,17 @@
 package replication
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"github.com/stretchr/testify/require"
 	"net/http"
 	"net/http/httptest"
+	"replicated-log/internal/metrics"
 	"replicated-log/internal/model"
+	"replicated-log/internal/storage"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -33,7 +38,7 @@ func TestReplicateMessageWithOneSecondary(t *testing.T) {
 	t.Setenv("SECONDARY_URLS", secondary.URL)
 
 	// WHEN
-	NewExecutor().ReplicateMessage(message, 1)
+	NewExecutor(storage.NewInMemoryStorage(), nil).ReplicateMessage(context.Background(), message, 1)
 }
 
 func TestReplicateMessageWithTwoSecondaries(t *testing.T) {
@@ -62,7 +67,7 @@ func TestReplicateMessageWithTwoSecondaries(t *testing.T) {
 	t.Setenv("SECONDARY_URLS", secondaryA.URL+","+secondaryB.URL)
 
 	// WHEN
-	NewExecutor().ReplicateMessage(message, 2)
+	NewExecutor(storage.NewInMemoryStorage(), nil).ReplicateMessage(context.Background(), message, 2)
 }
 
 func TestReplicateMessageWithTwoSecondariesDelayedResponse(t *testing.T) {
@@ -95,7 +100,7 @@ func TestReplicateMessageWithTwoSecondariesDelayedResponse(t *testing.T) {
 	// WHEN
 	ready <- struct{}{} // unblock 1 secondary server
 	// one secondary should block replication, but we need only 1 ACK
-	NewExecutor().ReplicateMessage(message, 1)
+	NewExecutor(storage.NewInMemoryStorage(), nil).ReplicateMessage(context.Background(), message, 1)
 	ready <- struct{}{} // unblock all
 }
 
@@ -131,16 +136,83 @@ func TestReplicateWithRetrySendsSameRequestEveryTimeAndNotifiesAboutSuccess(t *t
 	// just for successful initialization, doesn't play role in this test:
 	t.Setenv("SECONDARY_URLS", secondary.URL)
 
-	success := make(chan struct{}, 1)
+	success := make(chan string, 1)
 
 	// WHEN
-	NewExecutor().replicateWithRetry(secondary.URL, message, success)
+	NewExecutor(storage.NewInMemoryStorage(), nil).replicateWithRetry(context.Background(), secondary.URL, message, success)
 
 	// THEN
 	<-success // block till notification
 	require.Equal(t, currentTrial, maxTrials)
 }
 
+func TestReplicateWithRetryOverwritesConflictingMessage(t *testing.T) {
+	// GIVEN
+	var attempts atomic.Int32
+	var repaired []model.Message
+	secondary := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/internal/replicate":
+			attempts.Add(1)
+			rw.WriteHeader(http.StatusUnprocessableEntity)
+		case "/api/v1/internal/repair":
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&repaired))
+			rw.WriteHeader(http.StatusOK)
+		default:
+			// health-check
+			rw.WriteHeader(http.StatusOK)
+		}
+	}))
+	defer secondary.Close()
+
+	executor := NewExecutorWithSecondaries(storage.NewInMemoryStorage(), []string{secondary.URL}, 2, nil)
+	defer executor.Close()
+	message := model.Message{Id: 0, Message: "leader's"}
+	executor.track(secondary.URL, message)
+	success := make(chan string, 1)
+
+	// WHEN
+	executor.replicateWithRetry(context.Background(), secondary.URL, message, success)
+
+	// THEN
+	require.Equal(t, int32(1), attempts.Load(), "retry doesn't help, diverged message is overwritten")
+	require.Equal(t, []model.Message{{Id: 0, Message: "leader's", Term: 2}}, repaired)
+	require.Equal(t, secondary.URL, <-success)
+	require.Empty(t, executor.outstandingReplications())
+}
+
+func TestReplicateWithRetryStopsOnStaleTermAndReportsNewerTerm(t *testing.T) {
+	// GIVEN
+	var attempts atomic.Int32
+	secondary := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			// health-check
+			rw.WriteHeader(http.StatusOK)
+		} else {
+			attempts.Add(1)
+			rw.WriteHeader(http.StatusConflict)
+		}
+	}))
+	defer secondary.Close()
+
+	executor := NewExecutorWithSecondaries(storage.NewInMemoryStorage(), []string{secondary.URL}, 3, nil)
+	defer executor.Close()
+	var reportedTerm atomic.Uint64
+	executor.OnStaleTerm(reportedTerm.Store)
+	message := model.Message{Id: 0, Message: "fenced off"}
+	executor.track(secondary.URL, message)
+	success := make(chan string, 1)
+
+	// WHEN
+	executor.replicateWithRetry(context.Background(), secondary.URL, message, success)
+
+	// THEN
+	require.Equal(t, int32(1), attempts.Load(), "retry doesn't help, secondary follows a newer leader")
+	require.Equal(t, uint64(4), reportedTerm.Load())
+	require.Empty(t, success)
+	require.Empty(t, executor.outstandingReplications())
+}
+
 func TestReplicateWithRetryWorksCorrectWithClientTimeout(t *testing.T) {
 	// GIVEN
 	message := model.Message{Id: 0, Message: "first one"}
@@ -180,12 +252,140 @@ func TestReplicateWithRetryWorksCorrectWithClientTimeout(t *testing.T) {
 	// Client timeout is very small
 	t.Setenv("REQUEST_TIMEOUT_MILLISECONDS", "10")
 
-	success := make(chan struct{}, 1)
+	success := make(chan string, 1)
 
 	// WHEN
-	NewExecutor().replicateWithRetry(secondary.URL, message, success)
+	NewExecutor(storage.NewInMemoryStorage(), nil).replicateWithRetry(context.Background(), secondary.URL, message, success)
 
 	// THEN
 	<-success // block till notification
 	require.Equal(t, currentTrial, maxTrials)
 }
+
+func TestReplicateMessageStopsWaitingWhenContextIsDone(t *testing.T) {
+	// GIVEN
+	message := model.Message{Id: 0, Message: "first one"}
+	ready := make(chan struct{}) // to emulate broken secondary
+
+	handler := func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			// health-check
+			rw.WriteHeader(http.StatusOK)
+		} else {
+			select {
+			case <-ready:
+				rw.WriteHeader(http.StatusOK)
+			case <-r.Context().Done():
+			}
+		}
+	}
+
+	secondaryA := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer secondaryA.Close()
+	secondaryB := httptest.NewServer(http.HandlerFunc(handler))
+	defer secondaryB.Close()
+
+	t.Setenv("SECONDARY_URLS", secondaryA.URL+","+secondaryB.URL)
+	t.Setenv("REQUEST_TIMEOUT_MILLISECONDS", "1000")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	// WHEN
+	acks, err := NewExecutor(storage.NewInMemoryStorage(), nil).ReplicateMessage(ctx, message, 2)
+	close(ready)
+
+	// THEN
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Len(t, acks, 1)
+}
+
+func TestCalculateCurrentSleepTimeIsCapped(t *testing.T) {
+	// GIVEN
+	secondary := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer secondary.Close()
+
+	t.Setenv("SECONDARY_URLS", secondary.URL)
+	t.Setenv("MAX_BACKOFF_MILLISECONDS", "100")
+	executor := NewExecutor(storage.NewInMemoryStorage(), nil)
+
+	for _, failures := range []int{10, 64, 1000} {
+		// WHEN
+		sleepTime := executor.calculateCurrentSleepTime(failures)
+
+		// THEN
+		require.LessOrEqual(t, sleepTime, 100*time.Millisecond+time.Duration(executor.maxInterval))
+		require.Greater(t, sleepTime, time.Duration(0))
+	}
+}
+
+func TestWriteConcernWhichCannotBeSatisfiedIsRejected(t *testing.T) {
+	// GIVEN
+	liveSecondary := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer liveSecondary.Close()
+	deadSecondary := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer deadSecondary.Close()
+
+	t.Setenv("SECONDARY_URLS", liveSecondary.URL+","+deadSecondary.URL)
+
+	t.Run("BLOCK policy rejects only w bigger than cluster", func(t *testing.T) {
+		executor := NewExecutor(storage.NewInMemoryStorage(), nil)
+		defer executor.Close()
+
+		require.NoError(t, executor.CheckWriteConcern(2))
+		require.ErrorIs(t, executor.CheckWriteConcern(3), ErrUnsatisfiableWriteConcern)
+
+		_, err := executor.ReplicateMessage(context.Background(), model.Message{Id: 0, Message: "first"}, 3)
+		require.ErrorIs(t, err, ErrUnsatisfiableWriteConcern)
+	})
+
+	t.Run("REJECT policy rejects w bigger than number of alive secondaries", func(t *testing.T) {
+		t.Setenv("WRITE_CONCERN_POLICY", WriteConcernReject)
+		executor := NewExecutor(storage.NewInMemoryStorage(), nil)
+		defer executor.Close()
+
+		require.NoError(t, executor.CheckWriteConcern(1))
+		require.ErrorIs(t, executor.CheckWriteConcern(2), ErrNotEnoughAliveSecondaries)
+		require.ErrorIs(t, executor.CheckWriteConcern(3), ErrUnsatisfiableWriteConcern)
+	})
+}
+
+func TestFailedAttemptsAreReportedToMetrics(t *testing.T) {
+	// GIVEN
+	var calls atomic.Int32
+	secondary := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && calls.Add(1) == 1 {
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer secondary.Close()
+
+	t.Setenv("SECONDARY_URLS", secondary.URL)
+	m := metrics.NewMetrics()
+	executor := NewExecutor(storage.NewInMemoryStorage(), m)
+	defer executor.Close()
+
+	// WHEN
+	acks, err := executor.ReplicateMessage(context.Background(), model.Message{Id: 0, Message: "first"}, 1)
+
+	// THEN
+	require.NoError(t, err)
+	require.Equal(t, []string{secondary.URL}, acks)
+
+	resp := httptest.NewRecorder()
+	m.Handler().ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := resp.Body.String()
+	require.Contains(t, body, fmt.Sprintf(`replicated_log_replication_attempts_total{secondary="%s"} 2`, secondary.URL))
+	require.Contains(t, body, fmt.Sprintf(`replicated_log_replication_failures_total{secondary="%s"} 1`, secondary.URL))
+	require.Contains(t, body, fmt.Sprintf(`replicated_log_secondary_health_status{secondary="%s",status="ALIVE"} 1`, secondary.URL))
+}
@@ -0,0 +1,189 @@
+package replication
+
+import (
+	"replicated-log/internal/model"
+	"replicated-log/internal/storage"
+	"time"
+)
+
+// partitionKey -- log of a topic partition, ids are assigned per partition
+type partitionKey struct {
+	topic     string
+	partition int
+}
+
+// lagKey -- acknowledgements are tracked per secondary and partition
+type lagKey struct {
+	secondaryUrl string
+	log          partitionKey
+}
+
+// partitionOf returns log of the message, empty topic is the default one
+func partitionOf(message model.Message) partitionKey {
+	if message.Topic == "" {
+		return partitionKey{topic: storage.DefaultTopic, partition: message.Partition}
+	}
+	return partitionKey{topic: message.Topic, partition: message.Partition}
+}
+
+// ackTracker -- what primary knows about messages acknowledged by one secondary
+type ackTracker struct {
+	// first id which is not acknowledged, all messages before it are on the secondary
+	offset model.MessageId
+	// acknowledged messages after the gap
+	acked map[model.MessageId]struct{}
+	// when replication of not acknowledged messages has started
+	sentAt map[model.MessageId]time.Time
+	// appends waiting for messages which are left for catch-up
+	waiters map[model.MessageId]chan<- string
+}
+
+// ReplicationLag -- how far behind the primary the secondary is
+type ReplicationLag struct {
+	// -1 if nothing is acknowledged yet
+	HighestAckedId int64
+	Messages       int
+	// time since replication of the oldest not acknowledged message has started
+	Duration time.Duration
+	// replications which are not acknowledged yet and are being retried
+	InFlight int
+}
+
+func newAckTracker() *ackTracker {
+	return &ackTracker{
+		acked:   make(map[model.MessageId]struct{}),
+		sentAt:  make(map[model.MessageId]time.Time),
+		waiters: make(map[model.MessageId]chan<- string),
+	}
+}
+
+// tracker should be called under lagMu
+func (e *Executor) tracker(secondaryUrl string, log partitionKey) *ackTracker {
+	key := lagKey{secondaryUrl: secondaryUrl, log: log}
+	t, ok := e.trackers[key]
+	if !ok {
+		t = newAckTracker()
+		e.trackers[key] = t
+	}
+	return t
+}
+
+func (e *Executor) markSent(secondaryUrl string, messages ...model.Message) {
+	e.lagMu.Lock()
+	defer e.lagMu.Unlock()
+
+	now := time.Now()
+	for _, message := range messages {
+		t := e.tracker(secondaryUrl, partitionOf(message))
+		if _, ok := t.sentAt[message.Id]; !ok && message.Id >= t.offset {
+			t.sentAt[message.Id] = now
+		}
+	}
+}
+
+func (e *Executor) markAcked(secondaryUrl string, messages ...model.Message) {
+	e.lagMu.Lock()
+	defer e.lagMu.Unlock()
+
+	for _, message := range messages {
+		t := e.tracker(secondaryUrl, partitionOf(message))
+		if message.Id >= t.offset {
+			t.ack(secondaryUrl, message.Id)
+		}
+		t.advance()
+	}
+}
+
+// markAckedBefore records that secondary has all messages of the partition before the given offset
+func (e *Executor) markAckedBefore(secondaryUrl string, log partitionKey, offset model.MessageId) {
+	e.lagMu.Lock()
+	defer e.lagMu.Unlock()
+
+	t := e.tracker(secondaryUrl, log)
+	for id := t.offset; id < offset; id++ {
+		t.ack(secondaryUrl, id)
+	}
+	t.advance()
+}
+
+// notifyWhenAcked sends url of the secondary to notify once the message is acknowledged by catch-up
+func (e *Executor) notifyWhenAcked(secondaryUrl string, message model.Message, notify chan<- string) {
+	e.lagMu.Lock()
+	defer e.lagMu.Unlock()
+
+	t := e.tracker(secondaryUrl, partitionOf(message))
+	if _, ok := t.acked[message.Id]; ok || message.Id < t.offset {
+		notify <- secondaryUrl
+		return
+	}
+	t.waiters[message.Id] = notify
+}
+
+func (e *Executor) forgetLag(secondaryUrl string) {
+	e.lagMu.Lock()
+	defer e.lagMu.Unlock()
+
+	for key := range e.trackers {
+		if key.secondaryUrl == secondaryUrl {
+			delete(e.trackers, key)
+		}
+	}
+}
+
+func (e *Executor) forgetTopicLag(topic string) {
+	e.lagMu.Lock()
+	defer e.lagMu.Unlock()
+
+	for key := range e.trackers {
+		if key.log.topic == topic {
+			delete(e.trackers, key)
+		}
+	}
+}
+
+// ack should be called under lagMu, notify channels are buffered for every secondary, so sending never blocks
+func (t *ackTracker) ack(secondaryUrl string, id model.MessageId) {
+	t.acked[id] = struct{}{}
+	if notify, ok := t.waiters[id]; ok {
+		delete(t.waiters, id)
+		notify <- secondaryUrl
+	}
+}
+
+func (t *ackTracker) advance() {
+	for {
+		if _, ok := t.acked[t.offset]; !ok {
+			return
+		}
+		delete(t.acked, t.offset)
+		delete(t.sentAt, t.offset)
+		t.offset++
+	}
+}
+
+// ReplicationLag returns lag of the secondary behind the primary storage of the topic partition
+func (e *Executor) ReplicationLag(secondaryUrl string, topic string, partition int) ReplicationLag {
+	var primaryOffset model.MessageId
+	if source, err := e.topics.Partition(topic, partition); err == nil {
+		primaryOffset = source.GetOffset()
+	}
+	log := partitionKey{topic: topic, partition: partition}
+	inFlight := e.outstandingCount(secondaryUrl, log)
+
+	e.lagMu.Lock()
+	defer e.lagMu.Unlock()
+
+	t := e.tracker(secondaryUrl, log)
+	lag := ReplicationLag{
+		HighestAckedId: int64(t.offset) - 1,
+		InFlight:       inFlight,
+	}
+	if primaryOffset > t.offset {
+		lag.Messages = int(primaryOffset - t.offset)
+		if sentAt, ok := t.sentAt[t.offset]; ok {
+			lag.Duration = time.Since(sentAt)
+		}
+	}
+
+	return lag
+}
@@ -0,0 +1,55 @@
+package replication
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"replicated-log/internal/storage"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReplicationLagIsTrackedPerSecondary(t *testing.T) {
+	// GIVEN
+	primaryStorage := storage.NewInMemoryStorage()
+	for _, message := range []string{"first", "second", "third"} {
+		primaryStorage.AddRawMessage(message)
+	}
+
+	var isAlive atomic.Bool
+	isAlive.Store(true)
+
+	secondaryStorage := storage.NewInMemoryStorage()
+	secondary := newSecondaryWithStorage(t, secondaryStorage, isAlive.Load)
+	defer secondary.Close()
+
+	t.Setenv("SECONDARY_URLS", secondary.URL)
+	t.Setenv("HEALTHCHECK_PERIOD_MILLISECOND", "10")
+	t.Setenv("HEALTHCHECK_DEAD_AFTER_FAILURES", "1")
+
+	executor := NewExecutor(primaryStorage, nil)
+	defer executor.Close()
+
+	// catch-up acknowledges the whole log
+	require.Eventually(t, func() bool {
+		return executor.ReplicationLag(secondary.URL, storage.DefaultTopic, 0).HighestAckedId == 2
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, 0, executor.ReplicationLag(secondary.URL, storage.DefaultTopic, 0).Messages)
+
+	// WHEN
+	isAlive.Store(false)
+	require.Eventually(t, executor.NoQuorum, time.Second, 10*time.Millisecond)
+
+	message := primaryStorage.AddRawMessage("fourth")
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := executor.ReplicateMessage(ctx, message, 1)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// THEN
+	lag := executor.ReplicationLag(secondary.URL, storage.DefaultTopic, 0)
+	require.Equal(t, int64(2), lag.HighestAckedId)
+	require.Equal(t, 1, lag.Messages)
+	require.Equal(t, 1, lag.InFlight)
+	require.GreaterOrEqual(t, lag.Duration, 50*time.Millisecond)
+}
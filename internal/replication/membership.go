@@ -0,0 +1,109 @@
+package replication
+
+import (
+	"errors"
+	"replicated-log/internal/healthcheck"
+)
+
+var (
+	ErrInvalidSecondaryUrl = errors.New("invalid secondary url")
+	ErrSecondaryExists     = errors.New("secondary already exists")
+	ErrSecondaryNotFound   = errors.New("secondary is not found")
+)
+
+// Secondaries returns snapshot of current cluster members
+func (e *Executor) Secondaries() []string {
+	e.membersMu.Lock()
+	defer e.membersMu.Unlock()
+
+	result := make([]string, len(e.secondaryUrls))
+	copy(result, e.secondaryUrls)
+	return result
+}
+
+// SecondaryHealth returns health status of the secondary together with last-seen time and RTT
+func (e *Executor) SecondaryHealth(secondaryUrl string) healthcheck.SecondaryHealth {
+	return e.health.GetHealth(secondaryUrl)
+}
+
+// SubscribeOnHealthTransition registers listener of secondaries health status transitions
+func (e *Executor) SubscribeOnHealthTransition(listener func(transition healthcheck.Transition)) {
+	e.health.Subscribe(listener)
+}
+
+// AddSecondary adds new member to the cluster at runtime. New secondary is bootstrapped with the existing log.
+func (e *Executor) AddSecondary(secondaryUrl string) error {
+	if !isValidUrl(secondaryUrl) {
+		return ErrInvalidSecondaryUrl
+	}
+
+	e.membersMu.Lock()
+	for _, url := range e.secondaryUrls {
+		if url == secondaryUrl {
+			e.membersMu.Unlock()
+			return ErrSecondaryExists
+		}
+	}
+	e.secondaryUrls = append(e.secondaryUrls, secondaryUrl)
+	e.membersMu.Unlock()
+
+	// health status should be known before the first replication
+	e.health.AddSecondary(secondaryUrl)
+	e.metrics.SetHealthStatus(secondaryUrl, e.health.GetStatus(secondaryUrl))
+
+	e.membersMu.Lock()
+	if e.batchers != nil {
+		e.startBatcher(secondaryUrl)
+	}
+	e.membersMu.Unlock()
+
+	logger.Info("Secondary is added", "secondary", secondaryUrl)
+	go e.catchUp(secondaryUrl)
+
+	return nil
+}
+
+// RemoveSecondary removes member from the cluster at runtime. All pending replications to it are aborted.
+func (e *Executor) RemoveSecondary(secondaryUrl string) error {
+	e.membersMu.Lock()
+	index := -1
+	for i, url := range e.secondaryUrls {
+		if url == secondaryUrl {
+			index = i
+		}
+	}
+	if index == -1 {
+		e.membersMu.Unlock()
+		return ErrSecondaryNotFound
+	}
+	e.secondaryUrls = append(e.secondaryUrls[:index:index], e.secondaryUrls[index+1:]...)
+
+	if b, ok := e.batchers[secondaryUrl]; ok {
+		b.stop()
+		delete(e.batchers, secondaryUrl)
+	}
+	e.membersMu.Unlock()
+	// replications which are queued or waiting for retry are aborted, so nothing is left for Drain
+	e.untrackSecondary(secondaryUrl)
+
+	e.health.RemoveSecondary(secondaryUrl)
+	e.transport.Forget(secondaryUrl)
+	e.metrics.ForgetSecondary(secondaryUrl)
+	e.forgetLag(secondaryUrl)
+	e.forgetDivergence(secondaryUrl)
+	logger.Info("Secondary is removed", "secondary", secondaryUrl)
+
+	return nil
+}
+
+func (e *Executor) isSecondary(secondaryUrl string) bool {
+	e.membersMu.Lock()
+	defer e.membersMu.Unlock()
+
+	for _, url := range e.secondaryUrls {
+		if url == secondaryUrl {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,117 @@
+package replication
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"replicated-log/internal/model"
+	"replicated-log/internal/storage"
+	"testing"
+	"time"
+)
+
+func TestAddedSecondaryIsBootstrappedWithExistingLog(t *testing.T) {
+	// GIVEN
+	primaryStorage := storage.NewInMemoryStorage()
+	primaryStorage.AddRawMessage("first")
+	primaryStorage.AddRawMessage("second")
+
+	initialSecondary := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer initialSecondary.Close()
+
+	newStorage := storage.NewInMemoryStorage()
+	newSecondary := newSecondaryWithStorage(t, newStorage, func() bool { return true })
+	defer newSecondary.Close()
+
+	t.Setenv("SECONDARY_URLS", initialSecondary.URL)
+	executor := NewExecutor(primaryStorage, nil)
+	defer executor.Close()
+
+	// WHEN
+	err := executor.AddSecondary(newSecondary.URL)
+
+	// THEN
+	require.NoError(t, err)
+	require.Equal(t, []string{initialSecondary.URL, newSecondary.URL}, executor.Secondaries())
+	require.Eventually(t, func() bool {
+		return len(newStorage.GetMessages()) == 2
+	}, time.Second, 10*time.Millisecond)
+
+	t.Run("Secondary cannot be added twice", func(t *testing.T) {
+		require.ErrorIs(t, executor.AddSecondary(newSecondary.URL), ErrSecondaryExists)
+	})
+
+	t.Run("Invalid url is rejected", func(t *testing.T) {
+		require.ErrorIs(t, executor.AddSecondary("not a url"), ErrInvalidSecondaryUrl)
+	})
+}
+
+func TestRemovedSecondaryDoesNotReceiveMessages(t *testing.T) {
+	// GIVEN
+	replicated := make(chan struct{}, 10)
+	secondaryA := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer secondaryA.Close()
+	secondaryB := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			replicated <- struct{}{}
+		}
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer secondaryB.Close()
+
+	t.Setenv("SECONDARY_URLS", secondaryA.URL+","+secondaryB.URL)
+	executor := NewExecutor(storage.NewInMemoryStorage(), nil)
+	defer executor.Close()
+
+	// WHEN
+	err := executor.RemoveSecondary(secondaryB.URL)
+
+	// THEN
+	require.NoError(t, err)
+	require.Equal(t, []string{secondaryA.URL}, executor.Secondaries())
+
+	acks, err := executor.ReplicateMessage(context.Background(), model.Message{Id: 0, Message: "first"}, 1)
+	require.NoError(t, err)
+	require.Equal(t, []string{secondaryA.URL}, acks)
+	require.Empty(t, replicated)
+
+	t.Run("Unknown secondary cannot be removed", func(t *testing.T) {
+		require.ErrorIs(t, executor.RemoveSecondary(secondaryB.URL), ErrSecondaryNotFound)
+	})
+}
+
+func TestRemovedSecondaryDoesNotDelayDrain(t *testing.T) {
+	// GIVEN
+	secondary := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer secondary.Close()
+
+	t.Setenv("SECONDARY_URLS", secondary.URL)
+	t.Setenv("REPLICATION_MODE", "BATCH")
+	t.Setenv("REPLICATION_BATCH_LINGER_MILLISECONDS", "10000")
+	executor := NewExecutor(storage.NewInMemoryStorage(), nil)
+	defer executor.Close()
+
+	for id := 0; id < 3; id++ {
+		_, err := executor.ReplicateMessage(context.Background(), model.Message{Id: model.MessageId(id), Message: "test"}, 0)
+		require.NoError(t, err)
+	}
+	require.Len(t, executor.outstandingReplications(), 3, "messages are queued for batch")
+
+	// WHEN
+	require.NoError(t, executor.RemoveSecondary(secondary.URL))
+
+	// THEN
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	start := time.Now()
+	executor.Drain(ctx)
+	require.Less(t, time.Since(start), 100*time.Millisecond)
+	require.Empty(t, executor.outstandingReplications())
+}
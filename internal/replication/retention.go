@@ -0,0 +1,32 @@
+package replication
+
+import (
+	"context"
+	"errors"
+	"replicated-log/internal/healthcheck"
+	"replicated-log/internal/logging"
+	"replicated-log/internal/storage"
+	"replicated-log/internal/transport"
+)
+
+var retentionLogger = logging.Component("retention")
+
+// ReplicateRetention sends retention points of the primary to available secondaries in background, so replicas
+// trim and compact exactly the same messages. Failures are not retried, the next run of retention sends all points again.
+func (e *Executor) ReplicateRetention(points []storage.RetentionPoint) {
+	request := transport.RetentionRequest{Term: e.term, Points: points}
+	for _, secondaryUrl := range e.Secondaries() {
+		if !healthcheck.IsAvailable(e.health.GetStatus(secondaryUrl)) {
+			continue
+		}
+		go func(secondaryUrl string) {
+			err := e.transport.ApplyRetention(context.Background(), secondaryUrl, request)
+			switch {
+			case errors.Is(err, transport.ErrStaleTerm):
+				e.fencedOff(secondaryUrl)
+			case err != nil:
+				retentionLogger.Warn("Failed to replicate retention", "secondary", secondaryUrl, "err", err)
+			}
+		}(secondaryUrl)
+	}
+}
@@ -0,0 +1,51 @@
+package replication
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"replicated-log/internal/storage"
+	"replicated-log/internal/transport"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRetentionOfPrimaryIsReplicatedToSecondaries(t *testing.T) {
+	// GIVEN
+	mu := &sync.Mutex{}
+	var received []transport.RetentionRequest
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/healthcheck", func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/api/v1/internal/retention", func(rw http.ResponseWriter, r *http.Request) {
+		var request transport.RetentionRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&request))
+		mu.Lock()
+		received = append(received, request)
+		mu.Unlock()
+		rw.WriteHeader(http.StatusOK)
+	})
+	secondary := httptest.NewServer(mux)
+	defer secondary.Close()
+
+	primaryTopics := storage.NewTopicsWithDefault(storage.NewInMemoryStorage())
+	executor := NewExecutorWithTransport(primaryTopics, []string{secondary.URL}, 3, transport.NewTransport(), nil)
+	defer executor.Close()
+	points := []storage.RetentionPoint{{Topic: "orders", Partition: 1, LowWaterMark: 5, CompactedBefore: 7}}
+
+	// WHEN
+	require.Eventually(t, func() bool {
+		executor.ReplicateRetention(points)
+		mu.Lock()
+		defer mu.Unlock()
+		return len(received) > 0
+	}, time.Second, 10*time.Millisecond)
+
+	// THEN
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, transport.RetentionRequest{Term: 3, Points: points}, received[0])
+}
@@ -0,0 +1,112 @@
+package replication
+
+import (
+	"context"
+	"errors"
+	"replicated-log/internal/healthcheck"
+	"replicated-log/internal/logging"
+	"replicated-log/internal/model"
+	"replicated-log/internal/storage"
+)
+
+var topicsLogger = logging.Component("topics")
+
+// ErrTopicIsBeingDeleted -- topic cannot be created again until all secondaries have deleted its previous messages
+var ErrTopicIsBeingDeleted = errors.New("topic is being deleted from secondaries")
+
+// Topics returns logs whose messages are replicated by executor
+func (e *Executor) Topics() *storage.Topics {
+	return e.topics
+}
+
+// CreateTopic adds an empty topic with the given number of partitions on primary,
+// secondaries create partitions on their first replicated messages
+func (e *Executor) CreateTopic(name string, partitions int) error {
+	e.deletionsMu.Lock()
+	defer e.deletionsMu.Unlock()
+
+	if e.deletions[name] > 0 {
+		return ErrTopicIsBeingDeleted
+	}
+	_, err := e.topics.CreatePartitioned(name, partitions)
+	return err
+}
+
+// DeleteTopic removes topic from primary at once and from secondaries in background.
+// Pending replications of its messages are abandoned before secondaries are asked to delete it,
+// replications which are already on the way are dropped by secondaries, see model.Message.TopicGeneration.
+func (e *Executor) DeleteTopic(name string) error {
+	generation, err := e.topics.Generation(name)
+	if err != nil {
+		return err
+	}
+	if err = e.topics.Delete(name); err != nil {
+		return err
+	}
+	e.forgetTopicLag(name)
+	e.abandonTopic(name)
+
+	secondaryUrls := e.Secondaries()
+	e.deletionsMu.Lock()
+	e.deletions[name] += len(secondaryUrls)
+	e.deletionsMu.Unlock()
+
+	for _, secondaryUrl := range secondaryUrls {
+		go e.deleteTopicWithRetry(secondaryUrl, name, generation)
+	}
+	return nil
+}
+
+// abandonTopic drops queued messages of the topic from batchers and untracks all its outstanding replications,
+// retried messages notice that the topic is deleted before the next attempt
+func (e *Executor) abandonTopic(name string) {
+	e.membersMu.Lock()
+	batchers := make([]*batcher, 0, len(e.batchers))
+	for _, b := range e.batchers {
+		batchers = append(batchers, b)
+	}
+	e.membersMu.Unlock()
+
+	for _, b := range batchers {
+		b.dropTopic(name)
+	}
+	e.untrackTopic(name)
+}
+
+// isCurrentGeneration returns false if topic of the message is deleted, even if it is created again since then
+func (e *Executor) isCurrentGeneration(message model.Message) bool {
+	generation, err := e.topics.Generation(message.Topic)
+	return err == nil && generation == message.TopicGeneration
+}
+
+func (e *Executor) deleteTopicWithRetry(secondaryUrl string, name string, generation uint64) {
+	defer func() {
+		e.deletionsMu.Lock()
+		defer e.deletionsMu.Unlock()
+
+		if e.deletions[name]--; e.deletions[name] <= 0 {
+			delete(e.deletions, name)
+		}
+	}()
+
+	for attempt := 0; ; attempt++ {
+		if !e.isSecondary(secondaryUrl) {
+			topicsLogger.Info("Secondary is removed, stop deletion of topic", "secondary", secondaryUrl, "topic", name)
+			return
+		}
+
+		if healthcheck.IsAvailable(e.health.GetStatus(secondaryUrl)) {
+			err := e.transport.DeleteTopic(context.Background(), secondaryUrl, name, generation)
+			if err == nil {
+				topicsLogger.Info("Topic is deleted from secondary", "secondary", secondaryUrl, "topic", name)
+				return
+			}
+			topicsLogger.Warn("Failed to delete topic", "secondary", secondaryUrl, "topic", name, "err", err)
+		}
+
+		if !e.sleepBeforeRetry(secondaryUrl, attempt) {
+			topicsLogger.Info("Executor is closed, stop deletion of topic", "secondary", secondaryUrl, "topic", name)
+			return
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package replication
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"replicated-log/internal/model"
+	"replicated-log/internal/storage"
+	"replicated-log/internal/transport"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newSecondaryWithTopics(t *testing.T, secondaryTopics *storage.Topics) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/healthcheck", func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/api/v1/internal/offset", func(rw http.ResponseWriter, r *http.Request) {
+		offset := model.MessageId(0)
+		partition, _ := strconv.Atoi(r.URL.Query().Get("partition"))
+		if messages, err := secondaryTopics.Partition(r.URL.Query().Get("topic"), partition); err == nil {
+			offset = messages.GetOffset()
+		}
+		rawResponse, _ := json.Marshal(map[string]any{"offset": offset})
+		_, _ = rw.Write(rawResponse)
+	})
+	mux.HandleFunc("/api/v1/internal/replicate/batch", func(rw http.ResponseWriter, r *http.Request) {
+		var messages []model.Message
+		err := json.NewDecoder(r.Body).Decode(&messages)
+		require.NoError(t, err)
+		for _, message := range messages {
+			messagesOfTopic, errTopic := secondaryTopics.GetOrCreatePartition(message.Topic, message.Partition)
+			require.NoError(t, errTopic)
+			messagesOfTopic.AddMessage(message)
+		}
+		rw.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/api/v1/internal/topics/", func(rw http.ResponseWriter, r *http.Request) {
+		_ = secondaryTopics.Delete(strings.TrimPrefix(r.URL.Path, "/api/v1/internal/topics/"))
+		rw.WriteHeader(http.StatusOK)
+	})
+
+	return httptest.NewServer(mux)
+}
+
+func TestCatchUpOfEveryTopicPartition(t *testing.T) {
+	// GIVEN
+	primaryTopics := storage.NewTopicsWithDefault(storage.NewInMemoryStorage())
+	primaryTopics.Default().AddRawMessage("default")
+	partitions, err := primaryTopics.CreatePartitioned("orders", 2)
+	require.NoError(t, err)
+	for _, message := range []string{"first", "second", "third"} {
+		partitions[0].AddNewMessage(model.Message{Message: message, Topic: "orders"})
+	}
+	partitions[1].AddNewMessage(model.Message{Message: "other", Topic: "orders", Partition: 1})
+
+	secondaryTopics := storage.NewTopicsWithDefault(storage.NewInMemoryStorage())
+	secondary := newSecondaryWithTopics(t, secondaryTopics)
+	defer secondary.Close()
+
+	// WHEN
+	executor := NewExecutorWithTransport(primaryTopics, []string{secondary.URL}, 0, transport.NewTransport(), nil)
+	defer executor.Close()
+
+	// THEN
+	require.Eventually(t, func() bool {
+		secondaryOrders, errGet := secondaryTopics.Get("orders")
+		return errGet == nil && len(secondaryOrders.GetMessages()) == 3
+	}, time.Second, 10*time.Millisecond)
+	secondaryOrders, _ := secondaryTopics.Get("orders")
+	require.Equal(t, []string{"first", "second", "third"}, secondaryOrders.GetMessages())
+	require.Eventually(t, func() bool {
+		secondaryPartition, errGet := secondaryTopics.Partition("orders", 1)
+		return errGet == nil && len(secondaryPartition.GetMessages()) == 1
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, []string{"default"}, secondaryTopics.Default().GetMessages())
+}
+
+func TestDeletedTopicIsRemovedFromSecondariesAndCanBeCreatedAgain(t *testing.T) {
+	// GIVEN
+	secondaryTopics := storage.NewTopicsWithDefault(storage.NewInMemoryStorage())
+	_, err := secondaryTopics.Create("orders")
+	require.NoError(t, err)
+	secondary := newSecondaryWithTopics(t, secondaryTopics)
+	defer secondary.Close()
+
+	executor := NewExecutorWithSecondaries(storage.NewInMemoryStorage(), []string{secondary.URL}, 0, nil)
+	defer executor.Close()
+	require.NoError(t, executor.CreateTopic("orders", 1))
+
+	// WHEN
+	err = executor.DeleteTopic("orders")
+
+	// THEN
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		_, errGet := secondaryTopics.Get("orders")
+		return errGet != nil
+	}, time.Second, 10*time.Millisecond)
+	require.Eventually(t, func() bool {
+		return executor.CreateTopic("orders", 1) == nil
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestDeletedTopicIsAbandonedBeforeItIsDeletedFromSecondaries(t *testing.T) {
+	// GIVEN
+	var deletedGeneration atomic.Value
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/healthcheck", func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/api/v1/internal/topics/orders", func(rw http.ResponseWriter, r *http.Request) {
+		deletedGeneration.Store(r.URL.Query().Get("generation"))
+		rw.WriteHeader(http.StatusOK)
+	})
+	secondary := httptest.NewServer(mux)
+	defer secondary.Close()
+
+	t.Setenv("REPLICATION_MODE", "BATCH")
+	t.Setenv("REPLICATION_BATCH_LINGER_MILLISECONDS", "10000")
+	executor := NewExecutorWithSecondaries(storage.NewInMemoryStorage(), []string{secondary.URL}, 0, nil)
+	defer executor.Close()
+	require.NoError(t, executor.CreateTopic("orders", 1))
+	generation, err := executor.Topics().Generation("orders")
+	require.NoError(t, err)
+	for id := 0; id < 3; id++ {
+		_, err = executor.ReplicateMessage(context.Background(), model.Message{Id: model.MessageId(id), Topic: "orders"}, 0)
+		require.NoError(t, err)
+	}
+	require.Equal(t, 3, executor.outstandingCount(secondary.URL, partitionKey{topic: "orders"}))
+
+	// WHEN
+	err = executor.DeleteTopic("orders")
+
+	// THEN
+	require.NoError(t, err)
+	require.Equal(t, 0, executor.outstandingCount(secondary.URL, partitionKey{topic: "orders"}))
+	require.Equal(t, 0, executor.batchers[secondary.URL].pending())
+	require.Eventually(t, func() bool {
+		return deletedGeneration.Load() == strconv.FormatUint(generation, 10)
+	}, time.Second, 10*time.Millisecond)
+}
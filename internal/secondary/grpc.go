@@ -0,0 +1,86 @@
+package secondary
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"replicated-log/internal/auth"
+	"replicated-log/internal/logging"
+	"replicated-log/internal/model"
+	"replicated-log/internal/storage"
+	"replicated-log/internal/transport"
+
+	"google.golang.org/grpc"
+)
+
+// grpcHandler exposes the same replication logic as HTTP API to the gRPC transport
+type grpcHandler struct {
+	handler *HttpHandler
+}
+
+func (g grpcHandler) Replicate(ctx context.Context, messages []model.Message) error {
+	return g.handler.replicate(ctx, messages)
+}
+
+func (g grpcHandler) Offset(topic string, partition int) model.MessageId {
+	return g.handler.offset(topic, partition)
+}
+
+func (g grpcHandler) DeleteTopic(topic string, generation uint64) error {
+	if err := g.handler.topics.DeleteGeneration(topic, generation); !errors.Is(err, storage.ErrTopicNotFound) {
+		return err
+	}
+	return nil
+}
+
+func (g grpcHandler) Hashes(request transport.HashRequest) transport.HashResponse {
+	return g.handler.hashes(request)
+}
+
+func (g grpcHandler) Repair(ctx context.Context, messages []model.Message) error {
+	return g.handler.repair(ctx, messages)
+}
+
+func (g grpcHandler) ApplyRetention(ctx context.Context, request transport.RetentionRequest) error {
+	return g.handler.applyRetention(ctx, request)
+}
+
+func (g grpcHandler) IsHealthy(primaryOffset *model.MessageId) bool {
+	if primaryOffset != nil {
+		g.handler.reportPrimaryOffset(*primaryOffset)
+	}
+	if !g.handler.restoreMu.TryRLock() {
+		return false
+	}
+	defer g.handler.restoreMu.RUnlock()
+	return !g.handler.emulator.IsShouldWait()
+}
+
+// startGrpcServer serves replication and health check over gRPC on 'SECONDARY_GRPC_PORT', reads stay on HTTP
+func startGrpcServer(handler *HttpHandler, authenticator *auth.Authenticator) *grpc.Server {
+	port, ok := os.LookupEnv("SECONDARY_GRPC_PORT")
+	if !ok {
+		port = "9090"
+	}
+
+	options, err := authenticator.GrpcServerOptions(auth.TLSFilesFromEnv())
+	if err != nil {
+		logging.Fatal(logger, "Failed to load TLS certificates", "err", err)
+	}
+
+	listener, err := net.Listen("tcp", "0.0.0.0:"+port)
+	if err != nil {
+		logging.Fatal(logger, "Failed to listen gRPC port", "port", port, "err", err)
+	}
+
+	grpcServer := transport.NewGrpcServer(grpcHandler{handler: handler}, options...)
+	go func() {
+		logger.Info("gRPC server is started", "port", port)
+		if err := grpcServer.Serve(listener); err != nil {
+			logger.Error("gRPC server is stopped", "err", err)
+		}
+	}()
+
+	return grpcServer
+}
@@ -0,0 +1,76 @@
+package secondary
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"net"
+	"replicated-log/internal/metrics"
+	"replicated-log/internal/model"
+	"replicated-log/internal/replication"
+	"replicated-log/internal/storage"
+	"replicated-log/internal/transport"
+	"sync"
+	"testing"
+	"time"
+)
+
+func startTestGrpcServer(t *testing.T, handler *HttpHandler) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	grpcServer := transport.NewGrpcServer(grpcHandler{handler: handler})
+	go func() { _ = grpcServer.Serve(listener) }()
+	t.Cleanup(grpcServer.Stop)
+
+	return "grpc://" + listener.Addr().String()
+}
+
+func TestReplicationOverGrpc(t *testing.T) {
+	for _, mode := range []string{"SINGLE", "BATCH"} {
+		t.Run(mode, func(t *testing.T) {
+			// GIVEN
+			t.Setenv("REPLICATION_TRANSPORT", "GRPC")
+			t.Setenv("REPLICATION_MODE", mode)
+			t.Setenv("REQUEST_TIMEOUT_MILLISECONDS", "1000")
+			fence := &termFence{mu: &sync.Mutex{}}
+			secondaryStorage := storage.NewInMemoryStorage()
+			handler := NewHttpHandler(secondaryStorage, fence.accept, metrics.NewMetrics())
+			secondaryUrl := startTestGrpcServer(t, handler)
+
+			primaryStorage := storage.NewInMemoryStorage()
+			executor := replication.NewExecutorWithSecondaries(primaryStorage, []string{secondaryUrl}, 1, nil)
+			defer executor.Close()
+
+			// WHEN
+			message := model.Message{Id: 0, Message: "over gRPC"}
+			primaryStorage.AddMessage(message)
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			acks, err := executor.ReplicateMessage(ctx, message, 1)
+
+			// THEN
+			require.NoError(t, err)
+			require.Equal(t, []string{secondaryUrl}, acks)
+			require.Equal(t, []string{"over gRPC"}, secondaryStorage.GetMessages())
+		})
+	}
+}
+
+func TestReplicationFromStaleLeaderIsRejectedOverGrpc(t *testing.T) {
+	// GIVEN
+	fence := &termFence{mu: &sync.Mutex{}}
+	secondaryStorage := storage.NewInMemoryStorage()
+	handler := NewHttpHandler(secondaryStorage, fence.accept, metrics.NewMetrics())
+	secondaryUrl := startTestGrpcServer(t, handler)
+	client := transport.NewGrpcTransport(time.Second)
+	defer client.Close()
+
+	// WHEN
+	errNew := client.Replicate(context.Background(), secondaryUrl, model.Message{Id: 0, Message: "new", Term: 2})
+	errOld := client.ReplicateBatch(context.Background(), secondaryUrl, []model.Message{{Id: 1, Message: "old", Term: 1}})
+
+	// THEN
+	require.NoError(t, errNew)
+	require.ErrorIs(t, errOld, transport.ErrStaleTerm)
+	require.Equal(t, model.MessageId(1), secondaryStorage.GetOffset())
+}
@@ -1,25 +1,108 @@
 package secondary
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
-	"log"
 	"net/http"
 	"os"
+	"replicated-log/internal/auth"
+	"replicated-log/internal/logging"
+	"replicated-log/internal/metrics"
 	"replicated-log/internal/model"
+	"replicated-log/internal/reader"
+	"replicated-log/internal/server"
+	"replicated-log/internal/snapshot"
 	"replicated-log/internal/storage"
+	"replicated-log/internal/transport"
 	"replicated-log/internal/util"
+	"strconv"
+	"sync"
 	"time"
 )
 
+var logger = logging.Component("secondary")
+
+// errRestoring -- replicated messages are rejected while node is restored from snapshot, primary retries them
+var errRestoring = errors.New("restore from snapshot is in progress")
+
 type HttpHandler struct {
-	storage  *storage.InMemoryStorage
+	topics *storage.Topics
+	// log of the default topic
+	storage  storage.Storage
 	emulator *util.BrokenSecondaryEmulator
+	// returns false if replicated message comes from stale leader
+	acceptTerm func(term uint64) bool
+	// called with term of the leader after its messages are stored
+	onStored func(term uint64)
+	metrics  *metrics.Metrics
+	// streams of subscribed consumers
+	subscriptions *reader.Subscriptions
+	// offset of the primary reported by the last health check
+	primaryMu            *sync.Mutex
+	primaryOffset        model.MessageId
+	isPrimaryOffsetKnown bool
+	// node is the cluster leader, its log is the primary one
+	isLeader bool
+	// held for writing while node is restored from snapshot, for reading while replicated messages are stored
+	restoreMu *sync.RWMutex
+}
+
+// termFence rejects messages from leaders older than the newest one seen so far
+type termFence struct {
+	mu      *sync.Mutex
+	maxTerm uint64
+}
+
+func (f *termFence) accept(term uint64) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if term < f.maxTerm {
+		return false
+	}
+	f.maxTerm = term
+	return true
+}
+
+func NewHttpHandler(messages storage.Storage, acceptTerm func(term uint64) bool, m *metrics.Metrics) *HttpHandler {
+	return NewHttpHandlerWithTopics(storage.NewTopicsWithDefault(messages), acceptTerm, m)
+}
+
+// NewHttpHandlerWithTopics creates handler which stores replicated messages to logs of their topics
+func NewHttpHandlerWithTopics(topics *storage.Topics, acceptTerm func(term uint64) bool, m *metrics.Metrics) *HttpHandler {
+	return &HttpHandler{
+		topics:        topics,
+		storage:       topics.Default(),
+		emulator:      util.NewBrokenSecondaryEmulator(),
+		acceptTerm:    acceptTerm,
+		onStored:      func(uint64) {},
+		metrics:       m,
+		subscriptions: reader.NewSubscriptions(),
+		primaryMu:     &sync.Mutex{},
+		restoreMu:     &sync.RWMutex{},
+	}
+}
+
+// OnStored registers listener which is called with term of the leader after its messages are stored,
+// it should be registered before the handler starts serving
+func (h *HttpHandler) OnStored(listener func(term uint64)) {
+	h.onStored = listener
 }
 
-type GetMessagesResponse struct {
-	Messages []string `json:"messages"`
+type GetMessagesResponse = reader.MessagesResponse
+
+type GetOffsetResponse struct {
+	Offset model.MessageId `json:"offset"`
+}
+
+// TopicPartitions -- topic and number of its partitions known to the node
+type TopicPartitions struct {
+	Name       string `json:"name"`
+	Partitions int    `json:"partitions"`
 }
 
 type SwitchReplicationModeRequest struct {
@@ -35,29 +118,383 @@ func (h *HttpHandler) ReplicateMessage(rw http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	log.Printf("Received message %d with content '%s'\n", message.Id, message.Message)
+	ctx := logging.WithCorrelationId(r.Context(), r.Header.Get(logging.CorrelationIdHeader))
+	writeReplicateResult(rw, h.replicate(ctx, []model.Message{message}))
+}
+
+func (h *HttpHandler) ReplicateMessageBatch(rw http.ResponseWriter, r *http.Request) {
+	var messages []model.Message
+
+	err := json.NewDecoder(r.Body).Decode(&messages)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx := logging.WithCorrelationId(r.Context(), r.Header.Get(logging.CorrelationIdHeader))
+	writeReplicateResult(rw, h.replicate(ctx, messages))
+}
+
+func writeReplicateResult(rw http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errRestoring):
+		http.Error(rw, err.Error(), http.StatusServiceUnavailable)
+	case errors.Is(err, transport.ErrConflict):
+		http.Error(rw, err.Error(), http.StatusUnprocessableEntity)
+	case err != nil:
+		http.Error(rw, "stale term", http.StatusConflict)
+	default:
+		rw.WriteHeader(http.StatusOK)
+	}
+}
+
+// replicate stores messages received over HTTP or gRPC. Nothing is stored if any of them comes from stale leader.
+// Returns transport.ErrConflict if another message with the same id is stored, the rest of messages is stored anyway.
+func (h *HttpHandler) replicate(ctx context.Context, messages []model.Message) error {
+	if !h.restoreMu.TryRLock() {
+		return errRestoring
+	}
+	defer h.restoreMu.RUnlock()
+
+	if err := h.checkTerm(ctx, messages); err != nil {
+		return err
+	}
+
+	if len(messages) == 1 {
+		logger.DebugContext(ctx, "Received message", "id", messages[0].Id, logging.Payload(messages[0].Message))
+	} else {
+		logger.DebugContext(ctx, "Received batch", "size", len(messages))
+	}
+	var conflicts int
 	h.emulator.BlockActionIfNeeded(func() {
-		isAdded := h.storage.AddMessage(message)
-		log.Printf("Added message %d to the storage: %t\n", message.Id, isAdded)
+		for _, message := range messages {
+			messagesOfPartition, err := h.topics.GetOrCreatePartitionOfGeneration(message.Topic, message.Partition, message.TopicGeneration)
+			if errors.Is(err, storage.ErrTopicDeleted) {
+				logger.InfoContext(ctx, "Message is dropped, its topic is deleted", "id", message.Id, "topic", message.Topic, "partition", message.Partition, "generation", message.TopicGeneration)
+				continue
+			}
+			if err != nil {
+				logger.WarnContext(ctx, "Message is dropped, topic or partition is invalid", "id", message.Id, "topic", message.Topic, "partition", message.Partition, "err", err)
+				continue
+			}
+			isAdded := messagesOfPartition.AddMessage(message)
+			if !isAdded && messagesOfPartition.IsConflicting(message) {
+				conflicts++
+				continue
+			}
+			logger.InfoContext(ctx, "Message is replicated", "id", message.Id, "topic", message.Topic, "partition", message.Partition, "added", isAdded)
+		}
 	})
+	if conflicts > 0 {
+		return fmt.Errorf("%w: %d of %d messages", transport.ErrConflict, conflicts, len(messages))
+	}
+	h.onStored(maxTerm(messages))
+	return nil
+}
+
+func maxTerm(messages []model.Message) uint64 {
+	var term uint64
+	for _, message := range messages {
+		term = max(term, message.Term)
+	}
+	return term
+}
+
+func (h *HttpHandler) checkTerm(ctx context.Context, messages []model.Message) error {
+	for _, message := range messages {
+		if !h.acceptTerm(message.Term) {
+			logger.WarnContext(ctx, "Messages are rejected, term is stale", "id", message.Id, "term", message.Term)
+			return transport.ErrStaleTerm
+		}
+	}
+	return nil
+}
+
+// RepairMessages overwrites diverged messages, they are sent by anti-entropy of the primary
+func (h *HttpHandler) RepairMessages(rw http.ResponseWriter, r *http.Request) {
+	var messages []model.Message
+
+	err := json.NewDecoder(r.Body).Decode(&messages)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx := logging.WithCorrelationId(r.Context(), r.Header.Get(logging.CorrelationIdHeader))
+	writeReplicateResult(rw, h.repair(ctx, messages))
+}
+
+func (h *HttpHandler) repair(ctx context.Context, messages []model.Message) error {
+	if !h.restoreMu.TryRLock() {
+		return errRestoring
+	}
+	defer h.restoreMu.RUnlock()
+
+	if err := h.checkTerm(ctx, messages); err != nil {
+		return err
+	}
+
+	for _, message := range messages {
+		messagesOfPartition, err := h.topics.GetOrCreatePartitionOfGeneration(message.Topic, message.Partition, message.TopicGeneration)
+		if err != nil {
+			logger.WarnContext(ctx, "Message is not repaired, topic is deleted or partition is invalid", "id", message.Id, "topic", message.Topic, "partition", message.Partition, "err", err)
+			continue
+		}
+		isReplaced := messagesOfPartition.Replace(message)
+		logger.WarnContext(ctx, "Message is repaired", "id", message.Id, "topic", message.Topic, "partition", message.Partition, "replaced", isReplaced)
+	}
+	h.onStored(maxTerm(messages))
+	return nil
+}
+
+// ApplyRetention trims and compacts partitions up to retention points of the primary, see transport.RetentionRequest
+func (h *HttpHandler) ApplyRetention(rw http.ResponseWriter, r *http.Request) {
+	var request transport.RetentionRequest
+
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	writeReplicateResult(rw, h.applyRetention(r.Context(), request))
+}
+
+// applyRetention skips partitions unknown to the node, their messages come later with Skipped set by the primary
+func (h *HttpHandler) applyRetention(ctx context.Context, request transport.RetentionRequest) error {
+	if !h.restoreMu.TryRLock() {
+		return errRestoring
+	}
+	defer h.restoreMu.RUnlock()
+
+	if !h.acceptTerm(request.Term) {
+		logger.WarnContext(ctx, "Retention is rejected, term is stale", "term", request.Term)
+		return transport.ErrStaleTerm
+	}
+
+	for _, point := range request.Points {
+		messages, err := h.topics.Partition(point.Topic, point.Partition)
+		if err != nil {
+			continue
+		}
+		trimmed, compacted := 0, 0
+		if point.LowWaterMark > messages.GetLowWaterMark() {
+			trimmed = messages.Trim(point.LowWaterMark)
+		}
+		if point.CompactedBefore > 0 {
+			compacted = messages.Compact(point.CompactedBefore)
+		}
+		if trimmed > 0 || compacted > 0 {
+			logger.InfoContext(ctx, "Retention of the primary is applied", "topic", point.Topic, "partition", point.Partition, "trimmed", trimmed, "compacted", compacted, "low_water_mark", messages.GetLowWaterMark())
+		}
+	}
+	return nil
+}
+
+// GetHashes returns hashes of the requested ranges of a partition, see transport.HashRequest
+func (h *HttpHandler) GetHashes(rw http.ResponseWriter, r *http.Request) {
+	var request transport.HashRequest
+
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
 	rw.WriteHeader(http.StatusOK)
+	rawResponse, _ := json.Marshal(h.hashes(request))
+	_, _ = rw.Write(rawResponse)
 }
 
-func (h *HttpHandler) GetMessages(rw http.ResponseWriter, _ *http.Request) {
-	messages := h.storage.GetMessages()
+// hashes of a missing partition are not returned, it has zero offset and nothing to compare
+func (h *HttpHandler) hashes(request transport.HashRequest) transport.HashResponse {
+	response := transport.HashResponse{Hashes: []string{}}
+	messages, err := h.topics.Partition(request.Topic, request.Partition)
+	if err != nil {
+		return response
+	}
+
+	response.LowWaterMark = messages.GetLowWaterMark()
+	response.Offset = messages.GetOffset()
+	for _, idRange := range request.Ranges {
+		response.Hashes = append(response.Hashes, storage.HashRange(messages, idRange.From, idRange.To))
+	}
+	return response
+}
+
+// GetOffset returns offset of the partition from 'topic' and 'partition' query params, missing partition has zero offset
+func (h *HttpHandler) GetOffset(rw http.ResponseWriter, r *http.Request) {
+	partition, _ := strconv.Atoi(r.URL.Query().Get("partition"))
+	offset := h.offset(r.URL.Query().Get("topic"), partition)
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	rawResponse, _ := json.Marshal(GetOffsetResponse{Offset: offset})
+	_, _ = rw.Write(rawResponse)
+}
+
+func (h *HttpHandler) offset(topic string, partition int) model.MessageId {
+	messages, err := h.topics.Partition(topic, partition)
+	if err != nil {
+		return 0
+	}
+	return messages.GetOffset()
+}
+
+// GetTopics lists all topics of the node including the default one
+func (h *HttpHandler) GetTopics(rw http.ResponseWriter, _ *http.Request) {
+	response := []TopicPartitions{}
+	for _, name := range h.topics.Names() {
+		if partitions, err := h.topics.Partitions(name); err == nil {
+			response = append(response, TopicPartitions{Name: name, Partitions: len(partitions)})
+		}
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	rawResponse, _ := json.Marshal(response)
+	_, _ = rw.Write(rawResponse)
+}
+
+// DeleteTopic removes all messages of the topic, called by primary when topic is deleted.
+// Late messages of the deleted generation from 'generation' query param are dropped instead of creating the topic again.
+func (h *HttpHandler) DeleteTopic(rw http.ResponseWriter, r *http.Request) {
+	generation, _ := strconv.ParseUint(r.URL.Query().Get("generation"), 10, 64)
+	if err := h.topics.DeleteGeneration(mux.Vars(r)["name"], generation); err != nil {
+		writeTopicError(rw, err)
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+}
+
+func writeTopicError(rw http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, storage.ErrTopicNotFound), errors.Is(err, storage.ErrPartitionNotFound):
+		http.Error(rw, err.Error(), http.StatusNotFound)
+	case errors.Is(err, storage.ErrInvalidTopicName), errors.Is(err, storage.ErrDefaultTopic):
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+	default:
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (h *HttpHandler) GetMessagesFrom(rw http.ResponseWriter, r *http.Request) {
+	from, err := strconv.Atoi(r.URL.Query().Get("from"))
+	if err != nil || from < 0 {
+		http.Error(rw, "'from' should be a non-negative number", http.StatusBadRequest)
+		return
+	}
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		http.Error(rw, "'limit' should be a positive number", http.StatusBadRequest)
+		return
+	}
+
+	partition, _ := strconv.Atoi(r.URL.Query().Get("partition"))
+	source, err := h.topics.Partition(r.URL.Query().Get("topic"), partition)
+	if err != nil {
+		writeTopicError(rw, err)
+		return
+	}
+	messages := source.GetMessagesFrom(model.MessageId(from), limit)
+	storage.MarkSkipped(model.MessageId(from), messages)
 
 	rw.Header().Set("Content-Type", "application/json")
 	rw.WriteHeader(http.StatusOK)
-	rawResponse, _ := json.Marshal(GetMessagesResponse{Messages: messages})
-	log.Printf("Get messages: %v", messages)
+	rawResponse, _ := json.Marshal(messages)
 	_, _ = rw.Write(rawResponse)
 }
 
+// GetMessages returns the whole log or its page if 'from', 'limit' or 'to' is given
+func (h *HttpHandler) GetMessages(rw http.ResponseWriter, r *http.Request) {
+	reader.ServeMessages(rw, r, h.storage, h.lag)
+}
+
+// GetTopicMessages is GetMessages for a partition of a named topic, the first one if partition is not in path.
+// Lag is known only for the default topic, so reads with 'max_lag' are rejected with 400.
+func (h *HttpHandler) GetTopicMessages(rw http.ResponseWriter, r *http.Request) {
+	messages, ok := h.partitionFromPath(rw, r)
+	if !ok {
+		return
+	}
+	reader.ServeMessages(rw, r, messages, nil)
+}
+
+func (h *HttpHandler) partitionFromPath(rw http.ResponseWriter, r *http.Request) (storage.Storage, bool) {
+	partition := 0
+	if partitionToken, ok := mux.Vars(r)["partition"]; ok {
+		var err error
+		if partition, err = strconv.Atoi(partitionToken); err != nil {
+			http.Error(rw, "partition should be a number", http.StatusBadRequest)
+			return nil, false
+		}
+	}
+
+	messages, err := h.topics.Partition(mux.Vars(r)["name"], partition)
+	if err != nil {
+		writeTopicError(rw, err)
+		return nil, false
+	}
+	return messages, true
+}
+
+// lag returns number of messages this node is behind the primary, as of the last health check
+func (h *HttpHandler) lag() (int, bool) {
+	h.primaryMu.Lock()
+	primaryOffset, isKnown, isLeader := h.primaryOffset, h.isPrimaryOffsetKnown, h.isLeader
+	h.primaryMu.Unlock()
+
+	if isLeader {
+		return 0, true
+	}
+	if !isKnown {
+		return 0, false
+	}
+	if offset := h.storage.GetOffset(); primaryOffset > offset {
+		return int(primaryOffset - offset), true
+	}
+	return 0, true
+}
+
+// Subscribe streams messages as soon as they are replicated
+func (h *HttpHandler) Subscribe(rw http.ResponseWriter, r *http.Request) {
+	h.subscriptions.Serve(rw, r, h.storage)
+}
+
+// SubscribeTopic streams messages of a partition of a named topic as soon as they are replicated
+func (h *HttpHandler) SubscribeTopic(rw http.ResponseWriter, r *http.Request) {
+	messages, ok := h.partitionFromPath(rw, r)
+	if !ok {
+		return
+	}
+	h.subscriptions.Serve(rw, r, messages)
+}
+
+// CloseSubscriptions finishes all active streams, should be called on shutdown
+func (h *HttpHandler) CloseSubscriptions() {
+	h.subscriptions.Close()
+}
+
 func (h *HttpHandler) CleanStorage(rw http.ResponseWriter, _ *http.Request) {
-	h.storage.Clear()
+	h.topics.Clear()
 	rw.WriteHeader(http.StatusOK)
 }
 
+// DownloadSnapshot returns archive of all messages of the node
+func (h *HttpHandler) DownloadSnapshot(rw http.ResponseWriter, r *http.Request) {
+	snapshot.ServeDownload(rw, r, h.topics)
+}
+
+// RestoreSnapshot replaces all messages of the node with the archive from request body.
+// Replication and health checks fail while restore is in progress, catch-up continues from the snapshot afterwards.
+func (h *HttpHandler) RestoreSnapshot(rw http.ResponseWriter, r *http.Request) {
+	h.restoreMu.Lock()
+	defer h.restoreMu.Unlock()
+
+	snapshot.ServeRestore(rw, r, h.topics)
+}
+
 func (h *HttpHandler) SwitchReplicationMode(rw http.ResponseWriter, r *http.Request) {
 	var body SwitchReplicationModeRequest
 	err := json.NewDecoder(r.Body).Decode(&body)
@@ -69,48 +506,111 @@ func (h *HttpHandler) SwitchReplicationMode(rw http.ResponseWriter, r *http.Requ
 	rw.WriteHeader(http.StatusOK)
 }
 
-func (h *HttpHandler) HealthCheck(rw http.ResponseWriter, _ *http.Request) {
+func (h *HttpHandler) HealthCheck(rw http.ResponseWriter, r *http.Request) {
+	if offsetToken := r.Header.Get(transport.PrimaryOffsetHeader); offsetToken != "" {
+		if offset, err := strconv.ParseUint(offsetToken, 10, 32); err == nil {
+			h.reportPrimaryOffset(model.MessageId(offset))
+		}
+	}
+
+	if !h.restoreMu.TryRLock() {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	defer h.restoreMu.RUnlock()
+
 	if h.emulator.IsShouldWait() {
 		rw.WriteHeader(http.StatusNotAcceptable)
 	} else {
+		// primary starts catch-up if the secondary is behind or has lost messages after restart
+		rw.Header().Set(transport.SecondaryOffsetHeader, strconv.FormatUint(uint64(h.offset("", 0)), 10))
 		rw.WriteHeader(http.StatusOK)
 	}
 }
 
-func createRouter(handler *HttpHandler) *mux.Router {
-	r := mux.NewRouter()
+// SetLeader is called when the cluster node becomes leader or follower, leader is never behind its own log
+func (h *HttpHandler) SetLeader(isLeader bool) {
+	h.primaryMu.Lock()
+	defer h.primaryMu.Unlock()
 
-	r.HandleFunc("/api/v1/internal/replicate", handler.ReplicateMessage).Methods(http.MethodPost)
-	r.HandleFunc("/api/v1/messages", handler.GetMessages).Methods(http.MethodGet)
-	r.HandleFunc("/api/v1/healthcheck", handler.HealthCheck).Methods(http.MethodGet)
+	h.isLeader = isLeader
+}
 
-	r.HandleFunc("/api/test/clean", handler.CleanStorage).Methods(http.MethodPost)
-	r.HandleFunc("/api/test/replication_block", handler.SwitchReplicationMode).Methods(http.MethodPost)
+func (h *HttpHandler) reportPrimaryOffset(offset model.MessageId) {
+	h.primaryMu.Lock()
+	defer h.primaryMu.Unlock()
 
+	h.primaryOffset = offset
+	h.isPrimaryOffsetKnown = true
+}
+
+// RegisterRoutes registers secondary API on the given router, endpoints are guarded by the given authenticator
+func RegisterRoutes(r *mux.Router, handler *HttpHandler, a *auth.Authenticator) {
+	r.HandleFunc("/api/v1/internal/replicate", a.Internal(handler.ReplicateMessage)).Methods(http.MethodPost)
+	r.HandleFunc("/api/v1/internal/replicate/batch", a.Internal(handler.ReplicateMessageBatch)).Methods(http.MethodPost)
+	r.HandleFunc("/api/v1/internal/offset", a.Internal(handler.GetOffset)).Methods(http.MethodGet)
+	r.HandleFunc("/api/v1/internal/messages", a.Internal(handler.GetMessagesFrom)).Methods(http.MethodGet)
+	r.HandleFunc("/api/v1/internal/hashes", a.Internal(handler.GetHashes)).Methods(http.MethodPost)
+	r.HandleFunc("/api/v1/internal/repair", a.Internal(handler.RepairMessages)).Methods(http.MethodPost)
+	r.HandleFunc("/api/v1/internal/retention", a.Internal(handler.ApplyRetention)).Methods(http.MethodPost)
+	r.HandleFunc("/api/v1/internal/topics", a.Internal(handler.GetTopics)).Methods(http.MethodGet)
+	r.HandleFunc("/api/v1/internal/topics/{name}", a.Internal(handler.DeleteTopic)).Methods(http.MethodDelete)
+	r.HandleFunc("/api/v1/messages", a.Client(handler.GetMessages)).Methods(http.MethodGet)
+	r.HandleFunc("/api/v1/subscribe", a.Client(handler.Subscribe)).Methods(http.MethodGet)
+	r.HandleFunc("/api/v1/topics/{name}/messages", a.Client(handler.GetTopicMessages)).Methods(http.MethodGet)
+	r.HandleFunc("/api/v1/topics/{name}/subscribe", a.Client(handler.SubscribeTopic)).Methods(http.MethodGet)
+	r.HandleFunc("/api/v1/topics/{name}/partitions/{partition}/messages", a.Client(handler.GetTopicMessages)).Methods(http.MethodGet)
+	r.HandleFunc("/api/v1/topics/{name}/partitions/{partition}/subscribe", a.Client(handler.SubscribeTopic)).Methods(http.MethodGet)
+	r.HandleFunc("/api/v1/healthcheck", a.Internal(handler.HealthCheck)).Methods(http.MethodGet)
+	r.HandleFunc("/api/v1/liveness", server.Liveness).Methods(http.MethodGet)
+	r.Handle("/metrics", handler.metrics.Handler()).Methods(http.MethodGet)
+	r.HandleFunc("/api/v1/admin/snapshot", a.Admin(handler.DownloadSnapshot)).Methods(http.MethodGet)
+	r.HandleFunc("/api/v1/admin/restore", a.Admin(handler.RestoreSnapshot)).Methods(http.MethodPost)
+
+	r.HandleFunc("/api/test/clean", a.Admin(handler.CleanStorage)).Methods(http.MethodPost)
+	r.HandleFunc("/api/test/replication_block", a.Admin(handler.SwitchReplicationMode)).Methods(http.MethodPost)
+}
+
+func createRouter(handler *HttpHandler, a *auth.Authenticator) *mux.Router {
+	r := mux.NewRouter()
+	RegisterRoutes(r, handler, a)
 	return r
 }
 
-func NewSecondaryServer() *http.Server {
-	handler := &HttpHandler{
-		storage:  storage.NewInMemoryStorage(),
-		emulator: util.NewBrokenSecondaryEmulator(),
-	}
+func NewSecondaryServer() *server.GracefulServer {
+	fence := &termFence{mu: &sync.Mutex{}}
+	topics := storage.NewTopics()
+	m := metrics.NewMetrics()
+	m.RegisterStorage(topics.Default())
+	handler := NewHttpHandlerWithTopics(topics, fence.accept, m)
+	authenticator := auth.NewAuthenticator()
 
 	port, ok := os.LookupEnv("SECONDARY_SERVER_PORT")
 	if !ok {
 		port = "8080"
 	}
 
-	headersOk := handlers.AllowedHeaders([]string{"X-Requested-With", "Authorization", "Content-Type"})
-	originsOk := handlers.AllowedOrigins([]string{"*"})
+	headersOk := handlers.AllowedHeaders([]string{"X-Requested-With", "Authorization", "Content-Type", auth.SignatureTimestampHeader})
+	originsOk := handlers.AllowedOrigins(auth.AllowedOrigins())
 	methodsOk := handlers.AllowedMethods([]string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete, http.MethodOptions})
 
-	srv := &http.Server{
-		Handler:      handlers.CORS(originsOk, headersOk, methodsOk)(createRouter(handler)),
+	srv := server.NewGracefulServer(&http.Server{
+		Handler:      handlers.CORS(originsOk, headersOk, methodsOk)(createRouter(handler, authenticator)),
 		Addr:         "0.0.0.0:" + port,
+		TLSConfig:    auth.HttpServerTLSConfig(),
 		WriteTimeout: 15 * time.Second,
 		ReadTimeout:  15 * time.Second,
+	})
+
+	// streams are closed first, otherwise shutdown waits for them until timeout
+	srv.RegisterOnShutdown(handler.CloseSubscriptions)
+	if transport.IsGrpc() {
+		grpcServer := startGrpcServer(handler, authenticator)
+		srv.RegisterOnShutdown(grpcServer.GracefulStop)
 	}
+	srv.RegisterOnDrain(func(_ context.Context) {
+		handler.topics.Close()
+	})
 
 	return srv
 }
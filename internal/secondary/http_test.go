@@ -8,6 +8,9 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"replicated-log/internal/model"
+	"replicated-log/internal/snapshot"
+	"replicated-log/internal/storage"
+	"replicated-log/internal/transport"
 	"strings"
 	"testing"
 )
@@ -61,6 +64,93 @@ func TestReplicateAndGetMessages(t *testing.T) {
 	})
 }
 
+func TestGetMessagesPage(t *testing.T) {
+	secondary := NewSecondaryServer()
+	handler := secondary.Handler
+
+	for _, message := range []model.Message{{Id: 0, Message: "first"}, {Id: 1, Message: "second"}, {Id: 2, Message: "third"}} {
+		b, _ := json.Marshal(message)
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/internal/replicate", strings.NewReader(string(b)))
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	t.Run("Page contains ids and cursor", func(t *testing.T) {
+		// GIVEN
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/messages?from=1&limit=1", nil)
+		resp := httptest.NewRecorder()
+
+		// WHEN
+		handler.ServeHTTP(resp, req)
+
+		// THEN
+		assert.Equal(t, http.StatusOK, resp.Code)
+		assert.JSONEq(t, `{"messages":["second"],"ids":[1],"entries":[{"order":1,"message":"second"}],"next":2}`, resp.Body.String())
+	})
+
+	t.Run("Invalid range is rejected", func(t *testing.T) {
+		// GIVEN
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/messages?from=2&to=1", nil)
+		resp := httptest.NewRecorder()
+
+		// WHEN
+		handler.ServeHTTP(resp, req)
+
+		// THEN
+		assert.Equal(t, http.StatusBadRequest, resp.Code)
+	})
+}
+
+func TestReadIsRejectedIfSecondaryIsBehindPrimary(t *testing.T) {
+	secondary := NewSecondaryServer()
+	handler := secondary.Handler
+
+	message := model.Message{Id: 0, Message: "first"}
+	b, _ := json.Marshal(message)
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/api/v1/internal/replicate", strings.NewReader(string(b))))
+
+	t.Run("Lag is unknown until primary reports its offset", func(t *testing.T) {
+		// GIVEN
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/messages?max_lag=0", nil)
+		resp := httptest.NewRecorder()
+
+		// WHEN
+		handler.ServeHTTP(resp, req)
+
+		// THEN
+		assert.Equal(t, http.StatusServiceUnavailable, resp.Code)
+	})
+
+	// primary has 3 messages
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/healthcheck", nil)
+	req.Header.Set(transport.PrimaryOffsetHeader, "3")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	testCases := []struct {
+		name           string
+		query          string
+		expectedStatus int
+	}{
+		{"Lag is within max_lag", "max_lag=2", http.StatusOK},
+		{"Lag exceeds max_lag", "max_lag=1", http.StatusServiceUnavailable},
+		{"Replicated message is readable", "min_id=0", http.StatusOK},
+		{"Missing message is not replicated in time", "min_id=1&timeout_ms=10", http.StatusServiceUnavailable},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// GIVEN
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/messages?"+tc.query, nil)
+			resp := httptest.NewRecorder()
+
+			// WHEN
+			handler.ServeHTTP(resp, req)
+
+			// THEN
+			assert.Equal(t, tc.expectedStatus, resp.Code)
+		})
+	}
+}
+
 func TestHealthCheck(t *testing.T) {
 	secondary := NewSecondaryServer()
 	handler := secondary.Handler
@@ -75,6 +165,7 @@ func TestHealthCheck(t *testing.T) {
 
 		// THEN
 		assert.Equal(t, http.StatusOK, resp.Code)
+		assert.Equal(t, "0", resp.Header().Get(transport.SecondaryOffsetHeader))
 	})
 
 	t.Run("Block replication", func(t *testing.T) {
@@ -129,3 +220,274 @@ func TestHealthCheck(t *testing.T) {
 		assert.Equal(t, http.StatusOK, resp.Code)
 	})
 }
+
+func TestReplicateBatchAndGetOffset(t *testing.T) {
+	secondary := NewSecondaryServer()
+	handler := secondary.Handler
+
+	t.Run("Initial offset is zero", func(t *testing.T) {
+		// GIVEN
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/internal/offset", nil)
+		resp := httptest.NewRecorder()
+
+		// WHEN
+		handler.ServeHTTP(resp, req)
+
+		// THEN
+		assert.Equal(t, http.StatusOK, resp.Code)
+		body, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, "{\"offset\":0}", string(body))
+	})
+
+	t.Run("Replication of a batch with a gap", func(t *testing.T) {
+		// GIVEN
+		messages := []model.Message{{Id: 0, Message: "first"}, {Id: 1, Message: "second"}, {Id: 3, Message: "fourth"}}
+		b, _ := json.Marshal(messages)
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/internal/replicate/batch", strings.NewReader(string(b)))
+		resp := httptest.NewRecorder()
+
+		// WHEN
+		handler.ServeHTTP(resp, req)
+
+		// THEN
+		assert.Equal(t, http.StatusOK, resp.Code)
+	})
+
+	t.Run("Offset points to the first missing message", func(t *testing.T) {
+		// GIVEN
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/internal/offset", nil)
+		resp := httptest.NewRecorder()
+
+		// WHEN
+		handler.ServeHTTP(resp, req)
+
+		// THEN
+		assert.Equal(t, http.StatusOK, resp.Code)
+		body, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, "{\"offset\":2}", string(body))
+	})
+}
+
+func TestReplicationFromStaleLeaderIsRejected(t *testing.T) {
+	secondary := NewSecondaryServer()
+	handler := secondary.Handler
+
+	replicate := func(message model.Message) int {
+		b, _ := json.Marshal(message)
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/internal/replicate", strings.NewReader(string(b)))
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		return resp.Code
+	}
+
+	t.Run("Message from the newer leader is accepted", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, replicate(model.Message{Id: 0, Message: "new", Term: 2}))
+	})
+
+	t.Run("Message from the stale leader is rejected", func(t *testing.T) {
+		assert.Equal(t, http.StatusConflict, replicate(model.Message{Id: 1, Message: "old", Term: 1}))
+	})
+
+	t.Run("Repeated message is acknowledged", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, replicate(model.Message{Id: 0, Message: "new", Term: 2}))
+	})
+
+	t.Run("Different message with the same id is reported as conflict", func(t *testing.T) {
+		assert.Equal(t, http.StatusUnprocessableEntity, replicate(model.Message{Id: 0, Message: "diverged", Term: 2}))
+	})
+}
+
+func TestRetentionOfPrimaryIsApplied(t *testing.T) {
+	secondary := NewSecondaryServer()
+	handler := secondary.Handler
+
+	post := func(path string, body any) int {
+		b, _ := json.Marshal(body)
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, httptest.NewRequest(http.MethodPost, path, strings.NewReader(string(b))))
+		return resp.Code
+	}
+	getMessages := func() string {
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/api/v1/topics/orders/messages", nil))
+		return resp.Body.String()
+	}
+	assert.Equal(t, http.StatusOK, post("/api/v1/internal/replicate/batch", []model.Message{
+		{Id: 0, Message: "first", Topic: "orders", Term: 2},
+		{Id: 1, Message: "a1", Key: "a", Topic: "orders", Term: 2},
+		{Id: 2, Message: "b1", Key: "b", Topic: "orders", Term: 2},
+		{Id: 3, Message: "a2", Key: "a", Topic: "orders", Term: 2},
+	}))
+
+	t.Run("Retention from the stale leader is rejected", func(t *testing.T) {
+		// WHEN
+		code := post("/api/v1/internal/retention", transport.RetentionRequest{Term: 1, Points: []storage.RetentionPoint{
+			{Topic: "orders", LowWaterMark: 4},
+		}})
+
+		// THEN
+		assert.Equal(t, http.StatusConflict, code)
+		assert.JSONEq(t, `{"messages":["first","a1","b1","a2"]}`, getMessages())
+	})
+
+	t.Run("Messages are trimmed and compacted up to points of the primary", func(t *testing.T) {
+		// WHEN
+		code := post("/api/v1/internal/retention", transport.RetentionRequest{Term: 2, Points: []storage.RetentionPoint{
+			{Topic: "orders", LowWaterMark: 1, CompactedBefore: 4},
+			{Topic: "unknown", LowWaterMark: 10},
+		}})
+
+		// THEN
+		assert.Equal(t, http.StatusOK, code)
+		assert.JSONEq(t, `{"messages":["b1","a2"],"low_water_mark":1}`, getMessages())
+	})
+}
+
+func TestLateMessageOfDeletedTopicDoesNotCreateItAgain(t *testing.T) {
+	secondary := NewSecondaryServer()
+	handler := secondary.Handler
+
+	replicate := func(message model.Message) int {
+		b, _ := json.Marshal(message)
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, httptest.NewRequest(http.MethodPost, "/api/v1/internal/replicate", strings.NewReader(string(b))))
+		return resp.Code
+	}
+	getTopics := func() string {
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/api/v1/internal/topics", nil))
+		return resp.Body.String()
+	}
+	assert.Equal(t, http.StatusOK, replicate(model.Message{Id: 0, Message: "first", Topic: "orders", TopicGeneration: 5}))
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, httptest.NewRequest(http.MethodDelete, "/api/v1/internal/topics/orders?generation=5", nil))
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	t.Run("Late message of the deleted generation is acknowledged and dropped", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, replicate(model.Message{Id: 1, Message: "late", Topic: "orders", TopicGeneration: 5}))
+		assert.JSONEq(t, `[{"name":"default","partitions":1}]`, getTopics())
+	})
+
+	t.Run("Message of the topic created again is stored", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, replicate(model.Message{Id: 0, Message: "new", Topic: "orders", TopicGeneration: 6}))
+		assert.JSONEq(t, `[{"name":"default","partitions":1},{"name":"orders","partitions":1}]`, getTopics())
+	})
+}
+
+func TestInternalAndTestEndpointsRequireSeparateTokens(t *testing.T) {
+	t.Setenv("INTERNAL_AUTH_TOKEN", "internal")
+	t.Setenv("ADMIN_AUTH_TOKEN", "admin")
+	secondary := NewSecondaryServer()
+	handler := secondary.Handler
+
+	post := func(path string, token string) int {
+		b, _ := json.Marshal(model.Message{Id: 0, Message: "Test"})
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(string(b)))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		return resp.Code
+	}
+
+	t.Run("Replication without token is rejected", func(t *testing.T) {
+		assert.Equal(t, http.StatusUnauthorized, post("/api/v1/internal/replicate", ""))
+	})
+
+	t.Run("Replication with internal token is accepted", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, post("/api/v1/internal/replicate", "internal"))
+	})
+
+	t.Run("Internal token doesn't open test endpoints", func(t *testing.T) {
+		assert.Equal(t, http.StatusUnauthorized, post("/api/test/clean", "internal"))
+	})
+
+	t.Run("Test endpoints are open with admin token", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, post("/api/test/clean", "admin"))
+	})
+
+	t.Run("Health check requires internal token, liveness is open", func(t *testing.T) {
+		for path, expected := range map[string]int{"/api/v1/healthcheck": http.StatusUnauthorized, "/api/v1/liveness": http.StatusOK} {
+			resp := httptest.NewRecorder()
+			handler.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, path, nil))
+			assert.Equal(t, expected, resp.Code, path)
+		}
+	})
+}
+
+func TestReplicatedPartitionsAreReadSeparately(t *testing.T) {
+	secondary := NewSecondaryServer()
+	handler := secondary.Handler
+
+	messages := []model.Message{{Id: 0, Message: "first", Topic: "orders"}, {Id: 0, Message: "other", Topic: "orders", Partition: 1}}
+	b, _ := json.Marshal(messages)
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/api/v1/internal/replicate/batch", strings.NewReader(string(b))))
+
+	testCases := []struct {
+		name         string
+		path         string
+		expectedBody string
+	}{
+		{"First partition", "/api/v1/topics/orders/partitions/0/messages", `{"messages":["first"]}`},
+		{"Second partition", "/api/v1/topics/orders/partitions/1/messages", `{"messages":["other"]}`},
+		{"Offset of second partition", "/api/v1/internal/offset?topic=orders&partition=1", `{"offset":1}`},
+		{"Topics with partitions", "/api/v1/internal/topics", `[{"name":"default","partitions":1},{"name":"orders","partitions":2}]`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// GIVEN
+			req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			resp := httptest.NewRecorder()
+
+			// WHEN
+			handler.ServeHTTP(resp, req)
+
+			// THEN
+			assert.Equal(t, http.StatusOK, resp.Code)
+			assert.JSONEq(t, tc.expectedBody, resp.Body.String())
+		})
+	}
+
+	t.Run("Lag of partitions is not tracked, so 'max_lag' is rejected", func(t *testing.T) {
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/api/v1/topics/orders/messages?max_lag=10", nil))
+		assert.Equal(t, http.StatusBadRequest, resp.Code)
+	})
+}
+
+func TestSecondaryIsRestoredFromSnapshotOfAnotherNode(t *testing.T) {
+	// GIVEN
+	source := NewSecondaryServer().Handler
+	messages := []model.Message{{Id: 0, Message: "first"}, {Id: 1, Message: "second"}}
+	b, _ := json.Marshal(messages)
+	source.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/api/v1/internal/replicate/batch", strings.NewReader(string(b))))
+
+	download := httptest.NewRecorder()
+	source.ServeHTTP(download, httptest.NewRequest(http.MethodGet, "/api/v1/admin/snapshot", nil))
+	assert.Equal(t, http.StatusOK, download.Code)
+	archive := download.Body.String()
+
+	target := NewSecondaryServer().Handler
+
+	// WHEN
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/admin/restore", strings.NewReader(archive))
+	req.Header.Set(snapshot.ChecksumHeader, download.Header().Get(snapshot.ChecksumHeader))
+	resp := httptest.NewRecorder()
+	target.ServeHTTP(resp, req)
+
+	// THEN
+	assert.Equal(t, http.StatusOK, resp.Code)
+	offset := httptest.NewRecorder()
+	target.ServeHTTP(offset, httptest.NewRequest(http.MethodGet, "/api/v1/internal/offset", nil))
+	assert.Equal(t, "{\"offset\":2}", offset.Body.String(), "catch-up continues from the snapshot")
+
+	t.Run("Node with messages is not restored without force", func(t *testing.T) {
+		resp = httptest.NewRecorder()
+		target.ServeHTTP(resp, httptest.NewRequest(http.MethodPost, "/api/v1/admin/restore", strings.NewReader(archive)))
+		assert.Equal(t, http.StatusConflict, resp.Code)
+	})
+}
@@ -0,0 +1,35 @@
+package server
+
+import (
+	"context"
+	"net/http"
+)
+
+// GracefulServer -- http.Server which also drains background work of the node on shutdown
+type GracefulServer struct {
+	*http.Server
+	drainers []func(ctx context.Context)
+}
+
+func NewGracefulServer(srv *http.Server) *GracefulServer {
+	return &GracefulServer{Server: srv}
+}
+
+// RegisterOnDrain registers a function to call after all in-flight requests are finished.
+// Unlike http.Server.RegisterOnShutdown, drainers are called sequentially in order of registration and
+// Shutdown waits for them.
+func (s *GracefulServer) RegisterOnDrain(drainer func(ctx context.Context)) {
+	s.drainers = append(s.drainers, drainer)
+}
+
+// Shutdown stops accepting new connections, waits for in-flight requests and then runs drainers.
+// Drainers are called even if ctx is already done, so they have a chance to persist their state.
+func (s *GracefulServer) Shutdown(ctx context.Context) error {
+	err := s.Server.Shutdown(ctx)
+
+	for _, drainer := range s.drainers {
+		drainer(ctx)
+	}
+
+	return err
+}
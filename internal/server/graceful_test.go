@@ -0,0 +1,69 @@
+package server
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestShutdownWaitsForInFlightRequestsAndCallsDrainersInOrder(t *testing.T) {
+	// GIVEN
+	var events []string
+	started := make(chan struct{})
+	finished := make(chan struct{})
+
+	handler := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		close(started)
+		time.Sleep(50 * time.Millisecond) // in-flight request
+		events = append(events, "request")
+		rw.WriteHeader(http.StatusOK)
+	})
+
+	backend := httptest.NewUnstartedServer(handler)
+	srv := NewGracefulServer(backend.Config)
+	srv.RegisterOnDrain(func(_ context.Context) {
+		events = append(events, "first drainer")
+	})
+	srv.RegisterOnDrain(func(_ context.Context) {
+		events = append(events, "second drainer")
+	})
+	backend.Start()
+
+	go func() {
+		defer close(finished)
+		resp, err := http.Get(backend.URL)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}()
+	<-started
+
+	// WHEN
+	err := srv.Shutdown(context.Background())
+
+	// THEN
+	require.NoError(t, err)
+	<-finished
+	require.Equal(t, []string{"request", "first drainer", "second drainer"}, events)
+}
+
+func TestDrainersAreCalledEvenIfGracePeriodIsOver(t *testing.T) {
+	// GIVEN
+	isDrained := false
+	srv := NewGracefulServer(&http.Server{})
+	srv.RegisterOnDrain(func(ctx context.Context) {
+		require.Error(t, ctx.Err())
+		isDrained = true
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// WHEN
+	_ = srv.Shutdown(ctx)
+
+	// THEN
+	require.True(t, isDrained)
+}
@@ -0,0 +1,9 @@
+package server
+
+import "net/http"
+
+// Liveness answers 200 while the process serves requests. It is not authenticated, so external probes
+// (docker-compose, kubernetes) work with any auth config. Readiness of secondary is '/api/v1/healthcheck'.
+func Liveness(rw http.ResponseWriter, _ *http.Request) {
+	rw.WriteHeader(http.StatusOK)
+}
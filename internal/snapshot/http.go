@@ -0,0 +1,60 @@
+package snapshot
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"replicated-log/internal/storage"
+	"strconv"
+	"time"
+)
+
+// ServeDownload serves snapshot of all topics of the node as an archive, checksum is in ChecksumHeader
+func ServeDownload(rw http.ResponseWriter, _ *http.Request, topics *storage.Topics) {
+	// archive is built in memory first, so checksum and length are known before the body
+	var archive bytes.Buffer
+	_, checksum, err := Create(&archive, topics)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", ContentType)
+	rw.Header().Set("Content-Length", strconv.Itoa(archive.Len()))
+	rw.Header().Set("Content-Disposition", `attachment; filename="snapshot-`+time.Now().UTC().Format("20060102T150405Z")+`.tar.gz"`)
+	rw.Header().Set(ChecksumHeader, checksum)
+	rw.WriteHeader(http.StatusOK)
+	_, _ = rw.Write(archive.Bytes())
+}
+
+// ServeRestore restores the node from the archive in request body and responds with its manifest.
+// Node should be empty unless 'force=true' query parameter is given.
+func ServeRestore(rw http.ResponseWriter, r *http.Request, topics *storage.Topics) {
+	force, _ := strconv.ParseBool(r.URL.Query().Get("force"))
+
+	archive, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	manifest, err := Restore(archive, r.Header.Get(ChecksumHeader), topics, force)
+	switch {
+	case errors.Is(err, ErrNotEmpty):
+		http.Error(rw, err.Error(), http.StatusConflict)
+		return
+	case errors.Is(err, ErrInvalidSnapshot) || errors.Is(err, ErrChecksum):
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	rawResponse, _ := json.Marshal(manifest)
+	_, _ = rw.Write(rawResponse)
+}
@@ -0,0 +1,264 @@
+package snapshot
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"replicated-log/internal/logging"
+	"replicated-log/internal/model"
+	"replicated-log/internal/storage"
+	"strconv"
+	"time"
+)
+
+var logger = logging.Component("snapshot")
+
+const (
+	// ContentType of the snapshot archive
+	ContentType = "application/gzip"
+	// ChecksumHeader -- SHA-256 of the whole archive, set on download and optionally verified on restore
+	ChecksumHeader = "X-Snapshot-Checksum"
+
+	manifestName = "manifest.json"
+	readBatch    = 1000
+)
+
+var (
+	ErrInvalidSnapshot = errors.New("invalid snapshot")
+	ErrChecksum        = errors.New("snapshot checksum mismatch")
+	ErrNotEmpty        = errors.New("node already has messages, restore with 'force' to replace them")
+)
+
+// Manifest -- the first entry of the archive, describes every partition in it
+type Manifest struct {
+	CreatedAt  time.Time           `json:"created_at"`
+	Partitions []PartitionManifest `json:"partitions"`
+}
+
+// PartitionManifest -- snapshot of a partition is the contiguous part of its log, messages are stored in 'File' as JSON lines
+type PartitionManifest struct {
+	Topic        string          `json:"topic"`
+	Partition    int             `json:"partition"`
+	LowWaterMark model.MessageId `json:"low_water_mark"`
+	// id of the last included message, absent if partition is empty. Catch-up continues from the next one.
+	LastId   *model.MessageId `json:"last_id,omitempty"`
+	Messages int              `json:"messages"`
+	File     string           `json:"file"`
+	// SHA-256 of the file
+	Checksum string `json:"checksum"`
+}
+
+// Offset returns id of the first message which is not in the snapshot
+func (p PartitionManifest) Offset() model.MessageId {
+	if p.LastId == nil {
+		return p.LowWaterMark
+	}
+	return *p.LastId + 1
+}
+
+// Create writes gzipped tar archive of all topics. Every partition is read up to its offset at the moment it is reached,
+// so the snapshot never contains gaps. Returns manifest of the archive and its checksum.
+func Create(w io.Writer, topics *storage.Topics) (Manifest, string, error) {
+	manifest := Manifest{CreatedAt: time.Now().UTC(), Partitions: []PartitionManifest{}}
+	var files [][]byte
+
+	for _, name := range topics.Names() {
+		partitions, err := topics.Partitions(name)
+		if err != nil {
+			continue // deleted in the meantime
+		}
+		for partition, messages := range partitions {
+			partitionManifest, content := readPartition(name, partition, messages)
+			manifest.Partitions = append(manifest.Partitions, partitionManifest)
+			files = append(files, content)
+		}
+	}
+
+	hash := sha256.New()
+	zw := gzip.NewWriter(io.MultiWriter(w, hash))
+	tw := tar.NewWriter(zw)
+
+	rawManifest, _ := json.MarshalIndent(manifest, "", "  ")
+	if err := writeFile(tw, manifestName, rawManifest); err != nil {
+		return manifest, "", err
+	}
+	for i, content := range files {
+		if err := writeFile(tw, manifest.Partitions[i].File, content); err != nil {
+			return manifest, "", err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return manifest, "", err
+	}
+	if err := zw.Close(); err != nil {
+		return manifest, "", err
+	}
+
+	checksum := hex.EncodeToString(hash.Sum(nil))
+	logger.Info("Snapshot is created", "partitions", len(manifest.Partitions), "checksum", checksum)
+	return manifest, checksum, nil
+}
+
+func readPartition(topic string, partition int, messages storage.Storage) (PartitionManifest, []byte) {
+	offset := messages.GetOffset()
+	manifest := PartitionManifest{
+		Topic:        topic,
+		Partition:    partition,
+		LowWaterMark: messages.GetLowWaterMark(),
+		File:         "topics/" + topic + "/" + strconv.Itoa(partition) + ".jsonl",
+	}
+
+	var content bytes.Buffer
+	encoder := json.NewEncoder(&content)
+	for from := manifest.LowWaterMark; from < offset; {
+		batch := messages.GetMessagesRange(from, offset, readBatch)
+		if len(batch) == 0 {
+			break
+		}
+		for _, message := range batch {
+			_ = encoder.Encode(message)
+			lastId := message.Id
+			manifest.LastId = &lastId
+		}
+		manifest.Messages += len(batch)
+		from = batch[len(batch)-1].Id + 1
+	}
+
+	sum := sha256.Sum256(content.Bytes())
+	manifest.Checksum = hex.EncodeToString(sum[:])
+	return manifest, content.Bytes()
+}
+
+func writeFile(tw *tar.Writer, name string, content []byte) error {
+	header := &tar.Header{Name: name, Mode: 0o644, Size: int64(len(content)), ModTime: time.Now()}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := tw.Write(content)
+	return err
+}
+
+// Restore replaces all messages of the node with the snapshot. Archive is validated before anything is changed.
+// If checksum is not empty, it should match the whole archive. Node should be empty unless force is set.
+func Restore(archive []byte, checksum string, topics *storage.Topics, force bool) (Manifest, error) {
+	if checksum != "" {
+		sum := sha256.Sum256(archive)
+		if hex.EncodeToString(sum[:]) != checksum {
+			return Manifest{}, ErrChecksum
+		}
+	}
+
+	manifest, messagesByFile, err := read(archive)
+	if err != nil {
+		return manifest, err
+	}
+
+	if !force && !isEmpty(topics) {
+		return manifest, ErrNotEmpty
+	}
+
+	topics.Clear()
+	for _, partition := range manifest.Partitions {
+		messages, errPartition := topics.GetOrCreatePartition(partition.Topic, partition.Partition)
+		if errPartition != nil {
+			return manifest, fmt.Errorf("%w: %s", ErrInvalidSnapshot, errPartition)
+		}
+
+		batch := messagesByFile[partition.File]
+		messages.Trim(partition.LowWaterMark)
+		// gaps left by compaction are never filled
+		storage.MarkSkipped(partition.LowWaterMark, batch)
+		for _, message := range batch {
+			messages.AddMessage(message)
+		}
+		logger.Info("Partition is restored", "topic", partition.Topic, "partition", partition.Partition, "messages", len(batch), "offset", messages.GetOffset())
+	}
+
+	return manifest, nil
+}
+
+// read parses archive and checks every file against the manifest
+func read(archive []byte) (Manifest, map[string][]model.Message, error) {
+	var manifest Manifest
+	messagesByFile := make(map[string][]model.Message)
+
+	zr, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		return manifest, nil, fmt.Errorf("%w: %s", ErrInvalidSnapshot, err)
+	}
+	tr := tar.NewReader(zr)
+
+	header, err := tr.Next()
+	if err != nil || header.Name != manifestName {
+		return manifest, nil, fmt.Errorf("%w: manifest should be the first file", ErrInvalidSnapshot)
+	}
+	if err = json.NewDecoder(tr).Decode(&manifest); err != nil {
+		return manifest, nil, fmt.Errorf("%w: %s", ErrInvalidSnapshot, err)
+	}
+	checksums := make(map[string]string)
+	for _, partition := range manifest.Partitions {
+		checksums[partition.File] = partition.Checksum
+	}
+
+	for {
+		if header, err = tr.Next(); err == io.EOF {
+			break
+		} else if err != nil {
+			return manifest, nil, fmt.Errorf("%w: %s", ErrInvalidSnapshot, err)
+		}
+
+		expected, ok := checksums[header.Name]
+		if !ok {
+			return manifest, nil, fmt.Errorf("%w: unexpected file %s", ErrInvalidSnapshot, header.Name)
+		}
+		content, errRead := io.ReadAll(tr)
+		if errRead != nil {
+			return manifest, nil, fmt.Errorf("%w: %s", ErrInvalidSnapshot, errRead)
+		}
+		if sum := sha256.Sum256(content); hex.EncodeToString(sum[:]) != expected {
+			return manifest, nil, fmt.Errorf("%w: %s", ErrChecksum, header.Name)
+		}
+
+		messages := []model.Message{}
+		scanner := bufio.NewScanner(bytes.NewReader(content))
+		scanner.Buffer(nil, len(content)+1)
+		for scanner.Scan() {
+			var message model.Message
+			if err = json.Unmarshal(scanner.Bytes(), &message); err != nil {
+				return manifest, nil, fmt.Errorf("%w: %s", ErrInvalidSnapshot, err)
+			}
+			messages = append(messages, message)
+		}
+		messagesByFile[header.Name] = messages
+	}
+
+	for _, partition := range manifest.Partitions {
+		if _, ok := messagesByFile[partition.File]; !ok {
+			return manifest, nil, fmt.Errorf("%w: missing file %s", ErrInvalidSnapshot, partition.File)
+		}
+		if len(messagesByFile[partition.File]) != partition.Messages {
+			return manifest, nil, fmt.Errorf("%w: unexpected number of messages in %s", ErrInvalidSnapshot, partition.File)
+		}
+	}
+
+	return manifest, messagesByFile, nil
+}
+
+func isEmpty(topics *storage.Topics) bool {
+	for _, name := range topics.Names() {
+		partitions, _ := topics.Partitions(name)
+		for _, messages := range partitions {
+			if messages.Size() > 0 || messages.GetOffset() > 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
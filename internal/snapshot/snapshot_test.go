@@ -0,0 +1,83 @@
+package snapshot
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"replicated-log/internal/model"
+	"replicated-log/internal/storage"
+	"testing"
+)
+
+func TestSnapshotIsRestoredWithTheSameIds(t *testing.T) {
+	// GIVEN
+	source := storage.NewTopicsWithDefault(storage.NewInMemoryStorage())
+	for _, message := range []string{"first", "second", "third"} {
+		source.Default().AddRawMessage(message)
+	}
+	source.Default().Trim(1)
+	partitions, err := source.CreatePartitioned("orders", 2)
+	require.NoError(t, err)
+	partitions[1].AddNewMessage(model.Message{Message: "old", Key: "a", Topic: "orders", Partition: 1})
+	partitions[1].AddNewMessage(model.Message{Message: "new", Key: "a", Topic: "orders", Partition: 1})
+	partitions[1].AddNewMessage(model.Message{Message: "last", Topic: "orders", Partition: 1})
+	partitions[1].Compact(partitions[1].GetOffset())
+
+	var archive bytes.Buffer
+	manifest, checksum, err := Create(&archive, source)
+	require.NoError(t, err)
+
+	// WHEN
+	target := storage.NewTopicsWithDefault(storage.NewInMemoryStorage())
+	_, err = Restore(archive.Bytes(), checksum, target, false)
+
+	// THEN
+	require.NoError(t, err)
+	require.Len(t, manifest.Partitions, 3)
+	assert.Equal(t, model.MessageId(2), *manifest.Partitions[0].LastId)
+	assert.Equal(t, []string{"second", "third"}, target.Default().GetMessages())
+	assert.Equal(t, model.MessageId(1), target.Default().GetLowWaterMark())
+
+	restored, err := target.Partition("orders", 1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"new", "last"}, restored.GetMessages())
+	assert.Equal(t, model.MessageId(3), restored.GetOffset(), "catch-up continues after the last included id")
+	assert.Equal(t, model.MessageId(3), restored.AddRawMessage("next").Id)
+
+	t.Run("Node with messages is not restored without force", func(t *testing.T) {
+		_, err = Restore(archive.Bytes(), checksum, target, false)
+		assert.ErrorIs(t, err, ErrNotEmpty)
+
+		_, err = Restore(archive.Bytes(), checksum, target, true)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"new", "last"}, restored.GetMessages())
+	})
+}
+
+func TestCorruptedSnapshotIsRejected(t *testing.T) {
+	// GIVEN
+	source := storage.NewTopicsWithDefault(storage.NewInMemoryStorage())
+	source.Default().AddRawMessage("first")
+	var archive bytes.Buffer
+	_, _, err := Create(&archive, source)
+	require.NoError(t, err)
+
+	target := storage.NewTopicsWithDefault(storage.NewInMemoryStorage())
+
+	t.Run("Archive checksum mismatch", func(t *testing.T) {
+		// WHEN
+		_, err = Restore(archive.Bytes(), "not-a-checksum", target, false)
+
+		// THEN
+		assert.ErrorIs(t, err, ErrChecksum)
+	})
+
+	t.Run("Archive is not a snapshot", func(t *testing.T) {
+		// WHEN
+		_, err = Restore([]byte("garbage"), "", target, false)
+
+		// THEN
+		assert.ErrorIs(t, err, ErrInvalidSnapshot)
+		assert.Empty(t, target.Default().GetMessages())
+	})
+}
@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"reflect"
+	"replicated-log/internal/model"
+)
+
+const hashBatch = 1000
+
+// hashedContent -- part of the message which is the same on every replica. Term, topic, partition and
+// skipped ids are replication details, so they are not compared. Empty payload and headers are omitted,
+// so nil and empty values decoded from JSON on another replica hash the same.
+type hashedContent struct {
+	Id             model.MessageId   `json:"id"`
+	Message        string            `json:"message"`
+	Payload        []byte            `json:"payload,omitempty"`
+	ContentType    string            `json:"content_type"`
+	Headers        map[string]string `json:"headers,omitempty"`
+	Key            string            `json:"key"`
+	IdempotencyKey string            `json:"idempotency_key"`
+	Timestamp      int64             `json:"timestamp"`
+}
+
+func contentOf(message model.Message) hashedContent {
+	return hashedContent{
+		Id:             message.Id,
+		Message:        message.Message,
+		Payload:        message.Payload,
+		ContentType:    message.ContentType,
+		Headers:        message.Headers,
+		Key:            message.Key,
+		IdempotencyKey: message.IdempotencyKey,
+		Timestamp:      message.Timestamp,
+	}
+}
+
+// HashRange returns SHA-256 of stored messages with ids from 'from' inclusive to 'to' exclusive.
+// Replicas with the same messages in the range have the same hash, ids removed by retention are just absent.
+func HashRange(messages Storage, from model.MessageId, to model.MessageId) string {
+	hash := sha256.New()
+	encoder := json.NewEncoder(hash) // map keys are sorted, so encoding is canonical
+	for from < to {
+		batch := messages.GetMessagesRange(from, to, hashBatch)
+		if len(batch) == 0 {
+			break
+		}
+		for _, message := range batch {
+			_ = encoder.Encode(contentOf(message))
+		}
+		from = batch[len(batch)-1].Id + 1
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// isSameContent reports whether both messages are the same for HashRange
+func isSameContent(a model.Message, b model.Message) bool {
+	return reflect.DeepEqual(contentOf(a), contentOf(b))
+}
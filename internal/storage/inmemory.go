@@ -1,33 +1,61 @@
 package storage
 
 import (
-	"log"
+	"context"
+	"replicated-log/internal/logging"
 	"replicated-log/internal/model"
 	"sync"
 )
 
 type InMemoryStorage struct {
 	mu   *sync.Mutex
-	data map[model.MessageId]string
+	data map[model.MessageId]model.Message
+	// id of the first missing message, all messages before it are present
+	offset model.MessageId
+	// id which is assigned to the next raw message, greater than any known id
+	nextId model.MessageId
+	// id of the first message which is not trimmed by retention, ids of retained messages never change
+	lowWaterMark model.MessageId
+	// messages before it are compacted already, see Compact
+	compactedBefore model.MessageId
+	// start of gap -> id after gap, for gaps which are removed by retention on primary (see model.Message.Skipped)
+	skips map[model.MessageId]model.MessageId
+	// size of user content of stored messages
+	bytes int
+	// closed and replaced every time offset is moved, wakes up waiting readers
+	offsetChanged chan struct{}
+	// writes are ignored after Close
+	closed bool
 }
 
 func NewInMemoryStorage() *InMemoryStorage {
 	return &InMemoryStorage{
-		mu:   &sync.Mutex{},
-		data: make(map[model.MessageId]string),
+		mu:            &sync.Mutex{},
+		data:          make(map[model.MessageId]model.Message),
+		skips:         make(map[model.MessageId]model.MessageId),
+		offset:        0,
+		nextId:        0,
+		offsetChanged: make(chan struct{}),
 	}
 }
 
 func (s *InMemoryStorage) AddRawMessage(message string) model.Message {
+	return s.AddNewMessage(model.Message{Message: message})
+}
+
+func (s *InMemoryStorage) AddNewMessage(message model.Message) model.Message {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	nextId := len(s.data)
-	result := model.Message{Id: model.MessageId(nextId), Message: message}
+	result := message
+	result.Id = s.nextId
+	if s.closed {
+		return result // caller checks Err
+	}
 	isAdded := s.addMessageImpl(result)
 
 	if !isAdded {
-		log.Fatalf("Failed to add raw message \"%s\". Probably data race or logic error", result.Message)
+		logging.Fatal(logger, "Failed to add raw message. Probably data race or logic error", "id", result.Id, logging.Payload(result.Message))
 	}
 
 	return result
@@ -40,46 +68,355 @@ func (s *InMemoryStorage) AddMessage(message model.Message) bool {
 	return s.addMessageImpl(message)
 }
 
+func (s *InMemoryStorage) IsConflicting(message model.Message) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.data[message.Id]
+	return ok && !isSameContent(stored, message)
+}
+
 func (s *InMemoryStorage) addMessageImpl(message model.Message) bool {
-	if _, ok := s.data[message.Id]; ok {
+	if s.closed {
+		return false
+	}
+	if s.isKnownImpl(message.Id) {
 		// All messages should be present exactly once in the secondary log - deduplication
-		log.Printf("[DEDUPLICATION] Message %d already exists", message.Id)
+		if stored, ok := s.data[message.Id]; ok && !isSameContent(stored, message) {
+			// replicas diverged, the stored message is kept until it is repaired by anti-entropy
+			logger.Warn("Conflicting message with the same id is dropped", "id", message.Id)
+		} else {
+			logger.Debug("Message already exists, deduplicated", "id", message.Id)
+		}
 		return false
 	}
 
-	s.data[message.Id] = message.Message
+	if message.Skipped > 0 && message.Skipped <= message.Id {
+		// gap before the message is removed by retention on primary, it is never filled
+		s.skips[max(message.Id-message.Skipped, s.offset)] = message.Id
+	}
+	message.Term = 0 // term matters only for replication
+	message.Skipped = 0
+	message.TopicGeneration = 0
+	s.data[message.Id] = message
+	s.bytes += message.Size()
+
+	s.advanceOffset()
+	if message.Id >= s.nextId {
+		s.nextId = message.Id + 1
+	}
 
 	return true
 }
 
-func (s *InMemoryStorage) GetMessages() []string {
+func (s *InMemoryStorage) Replace(message model.Message) bool {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if len(s.data) == 0 {
-		return []string{}
+	stored, ok := s.data[message.Id]
+	if !ok {
+		return s.addMessageImpl(message)
+	}
+	if s.closed {
+		return false
 	}
 
-	lastId := model.MessageId(len(s.data) - 1)
+	message.Term = 0
+	message.Skipped = 0
+	message.TopicGeneration = 0
+	s.data[message.Id] = message
+	s.bytes += message.Size() - stored.Size()
 
-	var result []string
+	return true
+}
 
-	for id := model.MessageId(0); id <= lastId; id++ {
-		value, ok := s.data[id]
-		if !ok {
-			// If secondary has received messages [msg1, msg2, msg4], it shouldn’t display the message ‘msg4’ until the ‘msg3’ will be received
-			log.Printf("[TOTAL ORDER] Message %d is missing, stop getting next messages", id)
+// advanceOffset moves offset over present messages and gaps removed by retention, should be called under lock
+func (s *InMemoryStorage) advanceOffset() {
+	previousOffset := s.offset
+	for {
+		if _, ok := s.data[s.offset]; ok {
+			s.offset++
+		} else if to, isSkipped := s.skips[s.offset]; isSkipped {
+			delete(s.skips, s.offset)
+			s.offset = to
+		} else {
 			break
 		}
-		result = append(result, value)
+	}
+	if s.offset != previousOffset {
+		s.notifyOffsetChanged()
+	}
+}
+
+func (s *InMemoryStorage) GetMessages() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// If secondary has received messages [msg1, msg2, msg4], it shouldn’t display the message ‘msg4’ until the ‘msg3’ will be received
+	result := make([]string, 0, len(s.data))
+	for id := s.lowWaterMark; id < s.offset; id++ {
+		if message, ok := s.data[id]; ok { // compacted messages are skipped
+			result = append(result, message.Message)
+		}
+	}
+
+	return result
+}
+
+// GetMessagesFrom returns up to limit messages in total order starting from the given id
+func (s *InMemoryStorage) GetMessagesFrom(from model.MessageId, limit int) []model.Message {
+	return s.GetMessagesRange(from, s.GetOffset(), limit)
+}
+
+// GetMessagesRange returns up to limit messages with ids in [from, to) in total order.
+// Only contiguous part of the log is visible, messages after the first gap are not returned.
+// Messages removed by retention are skipped.
+func (s *InMemoryStorage) GetMessagesRange(from model.MessageId, to model.MessageId, limit int) []model.Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := []model.Message{}
+
+	for id := max(from, s.lowWaterMark); id < s.offset && id < to && len(result) < limit; id++ {
+		if message, ok := s.data[id]; ok {
+			result = append(result, message)
+		}
 	}
 
 	return result
 }
 
+// GetOffset returns id of the first missing message
+func (s *InMemoryStorage) GetOffset() model.MessageId {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.offset
+}
+
+// WaitForMessage blocks until message with the given id is readable or ctx is done
+func (s *InMemoryStorage) WaitForMessage(ctx context.Context, id model.MessageId) error {
+	for {
+		s.mu.Lock()
+		if id < s.offset {
+			s.mu.Unlock()
+			return nil
+		}
+		changed := s.offsetChanged
+		s.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// notifyOffsetChanged should be called under lock
+func (s *InMemoryStorage) notifyOffsetChanged() {
+	close(s.offsetChanged)
+	s.offsetChanged = make(chan struct{})
+}
+
+// isKnown returns true if message is stored or removed by retention already
+func (s *InMemoryStorage) isKnown(id model.MessageId) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.isKnownImpl(id)
+}
+
+func (s *InMemoryStorage) isKnownImpl(id model.MessageId) bool {
+	_, ok := s.data[id]
+	return ok || id < s.offset
+}
+
+// isStored returns true if message is not removed by retention, messages after gaps included
+func (s *InMemoryStorage) isStored(id model.MessageId) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.data[id]
+	return ok
+}
+
+func (s *InMemoryStorage) getNextId() model.MessageId {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.nextId
+}
+
+// Size returns number of stored messages, including the ones after gaps
+func (s *InMemoryStorage) Size() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.data)
+}
+
+func (s *InMemoryStorage) getCompactedBefore() model.MessageId {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.compactedBefore
+}
+
+// Bytes returns size of user content of stored messages
+func (s *InMemoryStorage) Bytes() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.bytes
+}
+
+// GetLowWaterMark returns id of the first message which is not trimmed
+func (s *InMemoryStorage) GetLowWaterMark() model.MessageId {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.lowWaterMark
+}
+
+// Trim removes messages with ids below before. Replica which lags behind trimmed primary
+// moves its offset to before, missing messages are never replicated. Returns number of removed messages.
+func (s *InMemoryStorage) Trim(before model.MessageId) int {
+	return len(s.trim(before))
+}
+
+// trim returns ids of removed messages
+func (s *InMemoryStorage) trim(before model.MessageId) []model.MessageId {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.trimImpl(before)
+}
+
+func (s *InMemoryStorage) trimImpl(before model.MessageId) []model.MessageId {
+	if before <= s.lowWaterMark || s.closed {
+		return nil
+	}
+
+	var removed []model.MessageId
+	if int(before-s.lowWaterMark) <= len(s.data) {
+		for id := s.lowWaterMark; id < before; id++ {
+			if s.removeImpl(id) {
+				removed = append(removed, id)
+			}
+		}
+	} else {
+		for id := range s.data {
+			if id < before && s.removeImpl(id) {
+				removed = append(removed, id)
+			}
+		}
+	}
+	for start := range s.skips {
+		if start < before {
+			delete(s.skips, start)
+		}
+	}
+
+	s.lowWaterMark = before
+	s.compactedBefore = max(s.compactedBefore, before)
+	s.nextId = max(s.nextId, before)
+	if s.offset < before {
+		s.offset = before
+		s.notifyOffsetChanged()
+	}
+	s.advanceOffset()
+
+	return removed
+}
+
+// Compact keeps only the latest message of every key among messages with ids below before,
+// messages without key are kept. Only contiguous part of the log is compacted. Returns number of removed messages.
+func (s *InMemoryStorage) Compact(before model.MessageId) int {
+	return len(s.compact(before))
+}
+
+// compact returns ids of removed messages
+func (s *InMemoryStorage) compact(before model.MessageId) []model.MessageId {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	before = min(before, s.offset)
+	if before <= s.compactedBefore || s.closed {
+		return nil // no new messages since the last compaction
+	}
+
+	latest := make(map[string]model.MessageId)
+	for id := s.lowWaterMark; id < before; id++ {
+		if message, ok := s.data[id]; ok && message.Key != "" {
+			latest[message.Key] = id
+		}
+	}
+
+	var removed []model.MessageId
+	for id := s.lowWaterMark; id < before; id++ {
+		if message, ok := s.data[id]; ok && message.Key != "" && latest[message.Key] != id && s.removeImpl(id) {
+			removed = append(removed, id)
+		}
+	}
+	s.compactedBefore = before
+
+	return removed
+}
+
+// removeImpl should be called under lock
+func (s *InMemoryStorage) removeImpl(id model.MessageId) bool {
+	message, ok := s.data[id]
+	if ok {
+		s.bytes -= message.Size()
+		delete(s.data, id)
+	}
+	return ok
+}
+
+// restoreRetention is called after recovery: messages before lowWaterMark are dropped,
+// gaps before compactedBefore are left by compaction and never filled
+func (s *InMemoryStorage) restoreRetention(lowWaterMark model.MessageId, compactedBefore model.MessageId) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.trimImpl(lowWaterMark)
+	if s.offset < compactedBefore {
+		s.offset = compactedBefore
+		s.notifyOffsetChanged()
+	}
+	s.compactedBefore = max(s.compactedBefore, compactedBefore)
+	s.nextId = max(s.nextId, s.offset)
+	s.advanceOffset()
+}
+
 func (s *InMemoryStorage) Clear() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	log.Println("Cleaning storage...")
-	s.data = make(map[model.MessageId]string) // create empty map
+	logger.Info("Cleaning storage")
+	s.data = make(map[model.MessageId]model.Message) // create empty map
+	s.skips = make(map[model.MessageId]model.MessageId)
+	s.offset = 0
+	s.nextId = 0
+	s.lowWaterMark = 0
+	s.compactedBefore = 0
+	s.bytes = 0
+	s.notifyOffsetChanged()
+}
+
+func (s *InMemoryStorage) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+}
+
+func (s *InMemoryStorage) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrClosed
+	}
+	return nil
 }
@@ -20,7 +20,7 @@ func TestAddMessage(t *testing.T) {
 		assert.Equal(t, 1, len(storage.data))
 		actual, ok := storage.data[message.Id]
 		assert.True(t, ok)
-		assert.Equal(t, message.Message, actual)
+		assert.Equal(t, message, actual)
 	})
 
 	t.Run("Item message the same ID cannot be added again", func(t *testing.T) {
@@ -90,3 +90,75 @@ func TestClear(t *testing.T) {
 	assert.True(t, before)
 	assert.False(t, after)
 }
+
+func TestGetMessagesFromAndOffset(t *testing.T) {
+	storage := NewInMemoryStorage()
+	// GIVEN
+	storage.AddMessage(model.Message{Id: 0, Message: "first"})
+	storage.AddMessage(model.Message{Id: 1, Message: "second"})
+	storage.AddMessage(model.Message{Id: 2, Message: "third"})
+	storage.AddMessage(model.Message{Id: 4, Message: "fifth"})
+
+	t.Run("Offset points to the first missing message", func(t *testing.T) {
+		assert.Equal(t, model.MessageId(3), storage.GetOffset())
+	})
+
+	t.Run("Range is limited", func(t *testing.T) {
+		assert.Equal(t, []model.Message{{Id: 1, Message: "second"}, {Id: 2, Message: "third"}}, storage.GetMessagesFrom(1, 2))
+	})
+
+	t.Run("Range stops at the first gap", func(t *testing.T) {
+		assert.Equal(t, []model.Message{{Id: 2, Message: "third"}}, storage.GetMessagesFrom(2, 10))
+		assert.Empty(t, storage.GetMessagesFrom(4, 10))
+	})
+
+	t.Run("Missing message moves offset", func(t *testing.T) {
+		storage.AddMessage(model.Message{Id: 3, Message: "fourth"})
+		assert.Equal(t, model.MessageId(5), storage.GetOffset())
+	})
+}
+
+func TestAddRawMessageNeverReusesKnownIds(t *testing.T) {
+	storage := NewInMemoryStorage()
+	// GIVEN
+	storage.AddMessage(model.Message{Id: 0, Message: "first"})
+	storage.AddMessage(model.Message{Id: 2, Message: "third"})
+	// WHEN
+	message := storage.AddRawMessage("fourth")
+	// THEN
+	assert.Equal(t, model.MessageId(3), message.Id)
+}
+
+func TestGetMessagesRange(t *testing.T) {
+	storage := NewInMemoryStorage()
+	for _, message := range []string{"first", "second", "third", "fourth"} {
+		storage.AddRawMessage(message)
+	}
+	storage.AddMessage(model.Message{Id: 5, Message: "after gap"})
+
+	testCases := []struct {
+		name     string
+		from     model.MessageId
+		to       model.MessageId
+		limit    int
+		expected []model.MessageId
+	}{
+		{"range is limited by 'to'", 1, 3, 10, []model.MessageId{1, 2}},
+		{"range is limited by 'limit'", 0, 10, 2, []model.MessageId{0, 1}},
+		{"range stops at the first gap", 2, 10, 10, []model.MessageId{2, 3}},
+		{"range after the gap is empty", 5, 10, 10, []model.MessageId{}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// when
+			messages := storage.GetMessagesRange(tc.from, tc.to, tc.limit)
+			// then
+			ids := []model.MessageId{}
+			for _, message := range messages {
+				ids = append(ids, message.Id)
+			}
+			assert.Equal(t, tc.expected, ids)
+		})
+	}
+}
@@ -0,0 +1,205 @@
+package storage
+
+import (
+	"os"
+	"replicated-log/internal/logging"
+	"replicated-log/internal/model"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var retentionLogger = logging.Component("retention")
+
+// RetentionPolicy -- limits of every partition of every topic, zero value keeps messages forever
+type RetentionPolicy struct {
+	// messages older than this are trimmed
+	MaxAge time.Duration
+	// the oldest messages are trimmed while user content of the partition is bigger than this
+	MaxBytes int
+	// keep only the latest message of every key
+	Compact bool
+}
+
+func (p RetentionPolicy) isEnabled() bool {
+	return p.MaxAge > 0 || p.MaxBytes > 0 || p.Compact
+}
+
+// RetentionPolicyFromEnv reads 'RETENTION_MAX_AGE_MILLISECONDS', 'RETENTION_MAX_BYTES' and 'RETENTION_COMPACT' env vars
+func RetentionPolicyFromEnv() RetentionPolicy {
+	policy := RetentionPolicy{} // default value, retention is disabled
+	if maxAgeToken, okAge := os.LookupEnv("RETENTION_MAX_AGE_MILLISECONDS"); okAge {
+		value, _ := strconv.Atoi(maxAgeToken)
+		policy.MaxAge = time.Duration(value) * time.Millisecond
+	}
+	if maxBytesToken, okBytes := os.LookupEnv("RETENTION_MAX_BYTES"); okBytes {
+		policy.MaxBytes, _ = strconv.Atoi(maxBytesToken)
+	}
+	if compactToken, okCompact := os.LookupEnv("RETENTION_COMPACT"); okCompact {
+		policy.Compact, _ = strconv.ParseBool(compactToken)
+	}
+	return policy
+}
+
+// RetentionPoint -- how far retention went in one partition, replicas trim and compact up to the same ids
+type RetentionPoint struct {
+	Topic     string `json:"topic,omitempty"`
+	Partition int    `json:"partition,omitempty"`
+	// messages before it are trimmed
+	LowWaterMark model.MessageId `json:"low_water_mark"`
+	// messages before it are compacted by key, zero if compaction is disabled
+	CompactedBefore model.MessageId `json:"compacted_before,omitempty"`
+}
+
+// Retention -- background job which trims the head of every partition and compacts it by key.
+// It runs on the primary only, replicas apply its points received through replication, see OnApplied.
+type Retention struct {
+	topics *Topics
+	policy RetentionPolicy
+	period time.Duration
+	now    func() time.Time
+	// receives points of all partitions after every run
+	onApplied func(points []RetentionPoint)
+	// stops the job
+	quit     chan struct{}
+	quitOnce *sync.Once
+}
+
+func NewRetention(topics *Topics) *Retention {
+	period := 10 * time.Second // default value
+	if periodToken, okPeriod := os.LookupEnv("RETENTION_CHECK_INTERVAL_MILLISECONDS"); okPeriod {
+		value, _ := strconv.Atoi(periodToken)
+		period = time.Duration(value) * time.Millisecond
+	}
+
+	return NewRetentionWithPolicy(topics, RetentionPolicyFromEnv(), period)
+}
+
+func NewRetentionWithPolicy(topics *Topics, policy RetentionPolicy, period time.Duration) *Retention {
+	return &Retention{
+		topics:   topics,
+		policy:   policy,
+		period:   period,
+		now:      time.Now,
+		quit:     make(chan struct{}),
+		quitOnce: &sync.Once{},
+	}
+}
+
+// Start runs retention periodically until Close, nothing is started if policy is empty
+func (r *Retention) Start() {
+	if !r.policy.isEnabled() {
+		return
+	}
+	retentionLogger.Info("Retention is enabled", "max_age", r.policy.MaxAge, "max_bytes", r.policy.MaxBytes, "compact", r.policy.Compact)
+
+	ticker := time.NewTicker(r.period)
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				r.Apply()
+			case <-r.quit:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+}
+
+// OnApplied subscribes listener on points of all partitions, it is called after every run even if nothing changed,
+// so replica which missed a run catches up on the next one. Must be called before Start.
+func (r *Retention) OnApplied(listener func(points []RetentionPoint)) {
+	r.onApplied = listener
+}
+
+func (r *Retention) Close() {
+	r.quitOnce.Do(func() {
+		close(r.quit)
+	})
+}
+
+// Apply enforces policy on all partitions of all topics at once
+func (r *Retention) Apply() {
+	var points []RetentionPoint
+	for _, name := range r.topics.Names() {
+		partitions, err := r.topics.Partitions(name)
+		if err != nil {
+			continue // deleted in the meantime
+		}
+		for partition, messages := range partitions {
+			trimmed, compacted, compactedBefore := r.applyTo(messages)
+			if trimmed > 0 || compacted > 0 {
+				retentionLogger.Info("Retention is applied", "topic", name, "partition", partition, "trimmed", trimmed, "compacted", compacted, "low_water_mark", messages.GetLowWaterMark())
+			}
+			points = append(points, RetentionPoint{
+				Topic:           name,
+				Partition:       partition,
+				LowWaterMark:    messages.GetLowWaterMark(),
+				CompactedBefore: compactedBefore,
+			})
+		}
+	}
+
+	if r.onApplied != nil {
+		r.onApplied(points)
+	}
+}
+
+// applyTo returns number of trimmed and compacted messages and id before which the partition is compacted
+func (r *Retention) applyTo(messages Storage) (int, int, model.MessageId) {
+	trimmed := 0
+	if before := r.trimBefore(messages); before > messages.GetLowWaterMark() {
+		trimmed = messages.Trim(before)
+	}
+
+	compacted := 0
+	var compactedBefore model.MessageId
+	if r.policy.Compact {
+		compactedBefore = messages.GetOffset()
+		compacted = messages.Compact(compactedBefore)
+	}
+
+	return trimmed, compacted, compactedBefore
+}
+
+// MarkSkipped sets Skipped of messages read starting from the given id, so replica which receives them
+// does not wait for messages removed by retention in between
+func MarkSkipped(from model.MessageId, batch []model.Message) {
+	expected := from
+	for i := range batch {
+		if batch[i].Id > expected {
+			batch[i].Skipped = batch[i].Id - expected
+		}
+		expected = batch[i].Id + 1
+	}
+}
+
+// trimBefore returns id of the first message which satisfies the policy, all messages before it are trimmed
+func (r *Retention) trimBefore(messages Storage) model.MessageId {
+	if r.policy.MaxAge <= 0 && r.policy.MaxBytes <= 0 {
+		return 0
+	}
+
+	// messages appended before timestamps were introduced have zero timestamp and are treated as expired
+	expiredBefore := r.now().Add(-r.policy.MaxAge).UnixMilli()
+	remainingBytes := messages.Bytes()
+	offset := messages.GetOffset()
+	before := messages.GetLowWaterMark()
+
+	for {
+		batch := messages.GetMessagesRange(before, offset, 1000)
+		if len(batch) == 0 {
+			return before
+		}
+		for _, message := range batch {
+			isExpired := r.policy.MaxAge > 0 && message.Timestamp < expiredBefore
+			isOversized := r.policy.MaxBytes > 0 && remainingBytes > r.policy.MaxBytes
+			if !isExpired && !isOversized {
+				return before
+			}
+			remainingBytes -= message.Size()
+			before = message.Id + 1
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package storage
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"replicated-log/internal/model"
+	"testing"
+	"time"
+)
+
+func TestTrimKeepsIdsOfRetainedMessages(t *testing.T) {
+	// given
+	storage := NewInMemoryStorage()
+	for _, message := range []string{"first", "second", "third"} {
+		storage.AddRawMessage(message)
+	}
+
+	// when
+	trimmed := storage.Trim(2)
+
+	// then
+	assert.Equal(t, 2, trimmed)
+	assert.Equal(t, model.MessageId(2), storage.GetLowWaterMark())
+	assert.Equal(t, []string{"third"}, storage.GetMessages())
+	assert.Equal(t, []model.Message{{Id: 2, Message: "third"}}, storage.GetMessagesFrom(0, 10))
+	assert.Equal(t, model.MessageId(3), storage.AddRawMessage("fourth").Id)
+	assert.False(t, storage.AddMessage(model.Message{Id: 0, Message: "first"}), "trimmed message should not come back")
+}
+
+func TestCompactionKeepsTheLatestMessageOfEveryKey(t *testing.T) {
+	// given
+	storage := NewInMemoryStorage()
+	storage.AddNewMessage(model.Message{Message: "a1", Key: "a"})
+	storage.AddNewMessage(model.Message{Message: "b1", Key: "b"})
+	storage.AddNewMessage(model.Message{Message: "no key"})
+	storage.AddNewMessage(model.Message{Message: "a2", Key: "a"})
+
+	// when
+	compacted := storage.Compact(storage.GetOffset())
+
+	// then
+	assert.Equal(t, 1, compacted)
+	assert.Equal(t, []string{"b1", "no key", "a2"}, storage.GetMessages())
+	assert.Equal(t, model.MessageId(4), storage.GetOffset())
+	assert.Equal(t, 0, storage.Compact(storage.GetOffset()), "nothing is appended since the last compaction")
+}
+
+func TestReplicaDoesNotWaitForMessagesRemovedOnPrimary(t *testing.T) {
+	// given
+	replica := NewInMemoryStorage()
+	replica.AddMessage(model.Message{Id: 0, Message: "first"})
+
+	// when
+	replica.AddMessage(model.Message{Id: 5, Message: "after gap", Skipped: 2})
+	replica.AddMessage(model.Message{Id: 2, Message: "before gap"})
+	replica.AddMessage(model.Message{Id: 1, Message: "second"})
+
+	// then
+	assert.Equal(t, []string{"first", "second", "before gap", "after gap"}, replica.GetMessages())
+	assert.Equal(t, model.MessageId(6), replica.GetOffset())
+}
+
+func TestRetentionTrimsExpiredAndOversizedMessages(t *testing.T) {
+	// given
+	topics := NewTopicsWithDefault(NewInMemoryStorage())
+	now := time.Now()
+	messages := topics.Default()
+	messages.AddNewMessage(model.Message{Message: "old", Timestamp: now.Add(-time.Hour).UnixMilli()})
+	for _, message := range []string{"aaaa", "bbbb", "cccc"} {
+		messages.AddNewMessage(model.Message{Message: message, Timestamp: now.UnixMilli()})
+	}
+
+	// when
+	NewRetentionWithPolicy(topics, RetentionPolicy{MaxAge: time.Minute, MaxBytes: 8}, time.Second).Apply()
+
+	// then
+	assert.Equal(t, model.MessageId(2), messages.GetLowWaterMark())
+	assert.Equal(t, []string{"bbbb", "cccc"}, messages.GetMessages())
+	assert.Equal(t, 8, messages.Bytes())
+}
+
+func TestRetentionReportsPointsOfEveryPartition(t *testing.T) {
+	// given
+	topics := NewTopicsWithDefault(NewInMemoryStorage())
+	topics.Default().AddNewMessage(model.Message{Message: "a1", Key: "a"})
+	topics.Default().AddNewMessage(model.Message{Message: "a2", Key: "a"})
+	partitions, err := topics.CreatePartitioned("orders", 1)
+	require.NoError(t, err)
+	partitions[0].AddNewMessage(model.Message{Message: "first", Topic: "orders"})
+	retention := NewRetentionWithPolicy(topics, RetentionPolicy{MaxBytes: 3, Compact: true}, time.Second)
+	var points []RetentionPoint
+	retention.OnApplied(func(applied []RetentionPoint) {
+		points = applied
+	})
+
+	// when
+	retention.Apply()
+
+	// then
+	assert.ElementsMatch(t, []RetentionPoint{
+		{Topic: DefaultTopic, LowWaterMark: 1, CompactedBefore: 2},
+		{Topic: "orders", LowWaterMark: 1, CompactedBefore: 1},
+	}, points)
+}
+
+func TestWalRetentionSurvivesRestart(t *testing.T) {
+	// given
+	dir := t.TempDir()
+	t.Setenv("WAL_SEGMENT_SIZE_BYTES", "100")
+	storage := NewWalStorage(dir)
+	for i := 0; i < 10; i++ {
+		storage.AddNewMessage(model.Message{Message: "value", Key: []string{"a", "b"}[i%2]})
+	}
+	storage.AddRawMessage("without key")
+	segments := len(storage.listSegments())
+
+	// when
+	storage.Trim(4)
+	storage.Compact(storage.GetOffset())
+	storage.Close()
+	recovered := NewWalStorage(dir)
+	defer recovered.Close()
+
+	// then
+	assert.Less(t, len(recovered.listSegments()), segments)
+	assert.Equal(t, model.MessageId(4), recovered.GetLowWaterMark())
+	assert.Equal(t, model.MessageId(11), recovered.GetOffset())
+	ids := []model.MessageId{}
+	for _, message := range recovered.GetMessagesFrom(0, 100) {
+		ids = append(ids, message.Id)
+	}
+	assert.Equal(t, []model.MessageId{8, 9, 10}, ids)
+	require.Equal(t, model.MessageId(11), recovered.AddRawMessage("next").Id)
+}
+
+func TestReplacedMessageChangesHashOfItsRange(t *testing.T) {
+	// given
+	storage := NewInMemoryStorage()
+	replica := NewInMemoryStorage()
+	for _, message := range []string{"first", "second", "third"} {
+		replica.AddMessage(storage.AddRawMessage(message))
+	}
+	replica.AddMessage(model.Message{Id: 1, Message: "conflicting"})
+	assert.Equal(t, HashRange(storage, 0, 3), HashRange(replica, 0, 3), "conflicting message is dropped")
+
+	// when
+	isReplaced := replica.Replace(model.Message{Id: 1, Message: "conflicting"})
+
+	// then
+	assert.True(t, isReplaced)
+	assert.NotEqual(t, HashRange(storage, 0, 3), HashRange(replica, 0, 3))
+	assert.Equal(t, HashRange(storage, 2, 3), HashRange(replica, 2, 3))
+	assert.Equal(t, len("first")+len("conflicting")+len("third"), replica.Bytes())
+}
+
+func TestEmptyAndNilContentHaveTheSameHash(t *testing.T) {
+	// given
+	storage := NewInMemoryStorage()
+	replica := NewInMemoryStorage()
+
+	// when
+	storage.AddMessage(model.Message{Id: 0, Message: "first"})
+	replica.AddMessage(model.Message{Id: 0, Message: "first", Payload: []byte{}, Headers: map[string]string{}})
+
+	// then
+	assert.Equal(t, HashRange(storage, 0, 1), HashRange(replica, 0, 1))
+}
+
+func TestWalReplacedMessageSurvivesRestart(t *testing.T) {
+	// given
+	dir := t.TempDir()
+	storage := NewWalStorage(dir)
+	storage.AddRawMessage("first")
+	storage.AddRawMessage("second")
+
+	// when
+	storage.Replace(model.Message{Id: 0, Message: "repaired"})
+	storage.Close()
+	recovered := NewWalStorage(dir)
+	defer recovered.Close()
+
+	// then
+	assert.Equal(t, []string{"repaired", "second"}, recovered.GetMessages())
+	assert.False(t, recovered.AddMessage(model.Message{Id: 0, Message: "first"}))
+}
@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"os"
+	"replicated-log/internal/logging"
+	"replicated-log/internal/model"
+)
+
+var logger = logging.Component("storage")
+
+// ErrClosed -- storage is closed, e.g. its topic is deleted while somebody still holds it
+var ErrClosed = errors.New("storage is closed")
+
+const (
+	modeInMemory = "INMEMORY"
+	modeWal      = "WAL"
+)
+
+// Storage -- common interface for all log storage backends used by primary and secondaries
+type Storage interface {
+	AddRawMessage(message string) model.Message
+	// AddNewMessage assigns the next id to the message and adds it
+	AddNewMessage(message model.Message) model.Message
+	AddMessage(message model.Message) bool
+	// IsConflicting returns true if a different message with the same id is stored, see HashRange for what is compared
+	IsConflicting(message model.Message) bool
+	// Replace overwrites the stored message with the same id, unknown message is added.
+	// Messages removed by retention are not restored. Returns false if nothing is changed.
+	Replace(message model.Message) bool
+	GetMessages() []string
+	GetMessagesFrom(from model.MessageId, limit int) []model.Message
+	GetMessagesRange(from model.MessageId, to model.MessageId, limit int) []model.Message
+	GetOffset() model.MessageId
+	// WaitForMessage blocks until message with the given id is in the contiguous part of the log
+	WaitForMessage(ctx context.Context, id model.MessageId) error
+	Size() int
+	// Bytes returns size of user content of stored messages
+	Bytes() int
+	// GetLowWaterMark returns id of the first message which is not trimmed by retention
+	GetLowWaterMark() model.MessageId
+	// Trim removes messages with ids below before, ids of the rest never change
+	Trim(before model.MessageId) int
+	// Compact keeps only the latest message of every key among messages with ids below before
+	Compact(before model.MessageId) int
+	Clear()
+	// Close releases resources, writes to closed storage are ignored: nothing is added, replaced or removed
+	Close()
+	// Err returns ErrClosed once storage is closed, so writer can tell ignored write from a duplicate
+	Err() error
+}
+
+// NewStorage creates storage backend selected by 'STORAGE_MODE' env var
+func NewStorage() Storage {
+	mode, ok := os.LookupEnv("STORAGE_MODE")
+	if !ok {
+		mode = modeInMemory
+	}
+
+	switch mode {
+	case modeInMemory:
+		return NewInMemoryStorage()
+	case modeWal:
+		dir, okDir := os.LookupEnv("STORAGE_DIR")
+		if !okDir {
+			dir = "./data"
+		}
+		return NewWalStorage(dir)
+	default:
+		logging.Fatal(logger, "Unexpected storage mode", "mode", mode)
+	}
+
+	return nil
+}
@@ -0,0 +1,356 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"replicated-log/internal/logging"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultTopic -- the log which existed before topics, legacy API reads and appends it
+const DefaultTopic = "default"
+
+// MaxPartitions -- upper limit of partitions of a topic
+const MaxPartitions = 1024
+
+var (
+	ErrTopicNotFound     = errors.New("topic not found")
+	ErrTopicExists       = errors.New("topic already exists")
+	ErrInvalidTopicName  = errors.New("topic name should be 1-64 letters, digits, '.', '_' or '-'")
+	ErrDefaultTopic      = errors.New("default topic cannot be deleted or partitioned")
+	ErrPartitionNotFound = errors.New("partition not found")
+	ErrInvalidPartitions = errors.New("number of partitions should be from 1 to " + strconv.Itoa(MaxPartitions))
+	ErrTopicDeleted      = errors.New("topic of this generation is deleted")
+)
+
+var topicNamePattern = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,64}$`)
+
+// Topics -- named logs of the node. Topic is split into partitions, every partition has its own storage and id sequence.
+type Topics struct {
+	mu     *sync.Mutex
+	topics map[string][]Storage
+	// incarnation of every topic on this node, it changes when topic is deleted and created again
+	generations    map[string]uint64
+	lastGeneration uint64
+	// generations of deleted topics given by primary, replicas refuse to create them again from late messages
+	tombstones map[string]uint64
+	// creates storage of a new partition
+	open func(name string, partition int) Storage
+	// removes persisted data of a deleted topic, storages are closed already
+	remove func(name string)
+}
+
+// NewTopics creates topics with storage backend selected by 'STORAGE_MODE' env var.
+// With WAL default topic is kept in 'STORAGE_DIR' as before, other topics -- in 'STORAGE_DIR/topics/<name>',
+// their partitions except the first one -- in 'STORAGE_DIR/topics/<name>/partitions/<partition>'.
+func NewTopics() *Topics {
+	mode, ok := os.LookupEnv("STORAGE_MODE")
+	if !ok || mode != modeWal {
+		return NewTopicsWithDefault(NewStorage())
+	}
+
+	dir, okDir := os.LookupEnv("STORAGE_DIR")
+	if !okDir {
+		dir = "./data"
+	}
+	topicsDir := filepath.Join(dir, "topics")
+
+	t := newTopics(NewStorage(),
+		func(name string, partition int) Storage {
+			return NewWalStorage(partitionDir(topicsDir, name, partition))
+		},
+		func(name string) {
+			if err := os.RemoveAll(filepath.Join(topicsDir, name)); err != nil {
+				logger.Error("Failed to remove topic dir", "topic", name, "err", err)
+			}
+		},
+	)
+
+	// topics created before restart
+	entries, err := os.ReadDir(topicsDir)
+	if err != nil && !os.IsNotExist(err) {
+		logging.Fatal(logger, "Failed to read topics dir", "dir", topicsDir, "err", err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && ValidateTopicName(entry.Name()) == nil && entry.Name() != DefaultTopic {
+			partitions := countPartitionDirs(filepath.Join(topicsDir, entry.Name()))
+			for partition := 0; partition < partitions; partition++ {
+				t.topics[entry.Name()] = append(t.topics[entry.Name()], t.open(entry.Name(), partition))
+			}
+			t.generations[entry.Name()] = t.newGeneration()
+		}
+	}
+
+	return t
+}
+
+// WAL ignores directories, so partitions are nested into the directory of the first one
+func partitionDir(topicsDir string, name string, partition int) string {
+	if partition == 0 {
+		return filepath.Join(topicsDir, name)
+	}
+	return filepath.Join(topicsDir, name, "partitions", strconv.Itoa(partition))
+}
+
+func countPartitionDirs(topicDir string) int {
+	partitions := 1
+	entries, _ := os.ReadDir(filepath.Join(topicDir, "partitions"))
+	for _, entry := range entries {
+		if partition, err := strconv.Atoi(entry.Name()); err == nil && entry.IsDir() && partition < MaxPartitions && partition >= partitions {
+			partitions = partition + 1
+		}
+	}
+	return partitions
+}
+
+// NewTopicsWithDefault creates topics around existing storage of the default topic, other topics are kept in memory
+func NewTopicsWithDefault(defaultStorage Storage) *Topics {
+	return newTopics(defaultStorage,
+		func(string, int) Storage { return NewInMemoryStorage() },
+		func(string) {},
+	)
+}
+
+func newTopics(defaultStorage Storage, open func(name string, partition int) Storage, remove func(name string)) *Topics {
+	return &Topics{
+		mu:          &sync.Mutex{},
+		topics:      map[string][]Storage{DefaultTopic: {defaultStorage}},
+		generations: map[string]uint64{},
+		tombstones:  map[string]uint64{},
+		open:        open,
+		remove:      remove,
+	}
+}
+
+// newGeneration should be called under mu. Generations are based on time, so a topic created again after restart
+// gets a bigger generation than the one deleted before.
+func (t *Topics) newGeneration() uint64 {
+	t.lastGeneration = max(uint64(time.Now().UnixNano()), t.lastGeneration+1)
+	return t.lastGeneration
+}
+
+func ValidateTopicName(name string) error {
+	if !topicNamePattern.MatchString(name) || name == "." || name == ".." {
+		return ErrInvalidTopicName
+	}
+	return nil
+}
+
+func (t *Topics) Default() Storage {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.topics[DefaultTopic][0]
+}
+
+// Get returns storage of the first partition of the topic, empty name means default topic
+func (t *Topics) Get(name string) (Storage, error) {
+	return t.Partition(name, 0)
+}
+
+// Partition returns storage of the partition of the topic, empty name means default topic
+func (t *Topics) Partition(name string, partition int) (Storage, error) {
+	if name == "" {
+		name = DefaultTopic
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	partitions, ok := t.topics[name]
+	if !ok {
+		return nil, ErrTopicNotFound
+	}
+	if partition < 0 || partition >= len(partitions) {
+		return nil, ErrPartitionNotFound
+	}
+	return partitions[partition], nil
+}
+
+// Partitions returns storages of all partitions of the topic in order
+func (t *Topics) Partitions(name string) ([]Storage, error) {
+	if name == "" {
+		name = DefaultTopic
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	partitions, ok := t.topics[name]
+	if !ok {
+		return nil, ErrTopicNotFound
+	}
+	return append([]Storage{}, partitions...), nil
+}
+
+// Create adds an empty topic with one partition
+func (t *Topics) Create(name string) (Storage, error) {
+	partitions, err := t.CreatePartitioned(name, 1)
+	if err != nil {
+		return nil, err
+	}
+	return partitions[0], nil
+}
+
+// CreatePartitioned adds an empty topic with the given number of partitions
+func (t *Topics) CreatePartitioned(name string, partitions int) ([]Storage, error) {
+	if err := ValidateTopicName(name); err != nil {
+		return nil, err
+	}
+	if partitions < 1 || partitions > MaxPartitions {
+		return nil, ErrInvalidPartitions
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.topics[name]; ok {
+		return nil, ErrTopicExists
+	}
+	storages := make([]Storage, partitions)
+	for partition := range storages {
+		storages[partition] = t.open(name, partition)
+	}
+	t.topics[name] = storages
+	t.generations[name] = t.newGeneration()
+	logger.Info("Topic is created", "topic", name, "partitions", partitions)
+
+	return append([]Storage{}, storages...), nil
+}
+
+// GetOrCreate is GetOrCreatePartition of the first partition
+func (t *Topics) GetOrCreate(name string) (Storage, error) {
+	return t.GetOrCreatePartition(name, 0)
+}
+
+// GetOrCreatePartition is used by replicas which learn about topics and their partitions from replicated messages
+func (t *Topics) GetOrCreatePartition(name string, partition int) (Storage, error) {
+	return t.getOrCreatePartition(name, partition, nil)
+}
+
+// GetOrCreatePartitionOfGeneration is GetOrCreatePartition which returns ErrTopicDeleted if the given generation
+// of the topic on primary is deleted, so late messages of the deleted topic do not create it again
+func (t *Topics) GetOrCreatePartitionOfGeneration(name string, partition int, generation uint64) (Storage, error) {
+	return t.getOrCreatePartition(name, partition, &generation)
+}
+
+func (t *Topics) getOrCreatePartition(name string, partition int, generation *uint64) (Storage, error) {
+	if name == "" {
+		name = DefaultTopic
+	}
+	if err := ValidateTopicName(name); err != nil {
+		return nil, err
+	}
+	if partition < 0 || partition >= MaxPartitions || (name == DefaultTopic && partition > 0) {
+		return nil, ErrPartitionNotFound
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if tombstone, isDeleted := t.tombstones[name]; generation != nil && isDeleted && *generation <= tombstone {
+		return nil, ErrTopicDeleted
+	}
+	partitions, ok := t.topics[name]
+	if !ok {
+		t.generations[name] = t.newGeneration()
+		logger.Info("Topic is created", "topic", name)
+	}
+	for len(partitions) <= partition {
+		partitions = append(partitions, t.open(name, len(partitions)))
+	}
+	t.topics[name] = partitions
+
+	return partitions[partition], nil
+}
+
+// Generation returns incarnation of the topic on this node, default topic is never deleted and has zero generation
+func (t *Topics) Generation(name string) (uint64, error) {
+	if name == "" {
+		name = DefaultTopic
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.topics[name]; !ok {
+		return 0, ErrTopicNotFound
+	}
+	return t.generations[name], nil
+}
+
+// Delete closes storages of all partitions of the topic and removes their data
+func (t *Topics) Delete(name string) error {
+	return t.DeleteGeneration(name, 0)
+}
+
+// DeleteGeneration is Delete which also remembers the given generation of the topic on primary,
+// messages of this and older generations don't create the topic again, see GetOrCreatePartitionOfGeneration.
+// Generation is remembered even if the topic is unknown, its messages can still be on the way.
+func (t *Topics) DeleteGeneration(name string, generation uint64) error {
+	if name == DefaultTopic {
+		return ErrDefaultTopic
+	}
+
+	t.mu.Lock()
+	partitions, ok := t.topics[name]
+	delete(t.topics, name)
+	delete(t.generations, name)
+	if generation > 0 {
+		t.tombstones[name] = max(t.tombstones[name], generation)
+	}
+	t.mu.Unlock()
+
+	if !ok {
+		return ErrTopicNotFound
+	}
+
+	for _, s := range partitions {
+		s.Clear()
+		s.Close()
+	}
+	t.remove(name)
+	logger.Info("Topic is deleted", "topic", name)
+
+	return nil
+}
+
+// Names returns sorted names of all topics including default one
+func (t *Topics) Names() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	names := make([]string, 0, len(t.topics))
+	for name := range t.topics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Clear removes messages of all topics, topics themselves are kept
+func (t *Topics) Clear() {
+	for _, name := range t.Names() {
+		partitions, _ := t.Partitions(name)
+		for _, s := range partitions {
+			s.Clear()
+		}
+	}
+}
+
+func (t *Topics) Close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, partitions := range t.topics {
+		for _, s := range partitions {
+			s.Close()
+		}
+	}
+}
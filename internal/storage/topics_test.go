@@ -0,0 +1,117 @@
+package storage
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"replicated-log/internal/model"
+	"testing"
+)
+
+func TestTopicsHaveSeparateLogs(t *testing.T) {
+	topics := NewTopicsWithDefault(NewInMemoryStorage())
+
+	t.Run("Default topic is always present", func(t *testing.T) {
+		// when
+		messages, err := topics.Get("")
+		// then
+		require.NoError(t, err)
+		assert.Same(t, topics.Default(), messages)
+		assert.Equal(t, []string{DefaultTopic}, topics.Names())
+	})
+
+	t.Run("Ids of a new topic start from zero", func(t *testing.T) {
+		// given
+		topics.Default().AddRawMessage("default")
+		// when
+		orders, err := topics.Create("orders")
+		// then
+		require.NoError(t, err)
+		assert.Equal(t, model.MessageId(0), orders.AddRawMessage("first").Id)
+	})
+
+	t.Run("Topic cannot be created twice or with invalid name", func(t *testing.T) {
+		_, err := topics.Create("orders")
+		assert.ErrorIs(t, err, ErrTopicExists)
+		_, err = topics.Create("../orders")
+		assert.ErrorIs(t, err, ErrInvalidTopicName)
+	})
+
+	t.Run("Partitions are created by replicated messages", func(t *testing.T) {
+		// when
+		partition, err := topics.GetOrCreatePartition("orders", 2)
+		// then
+		require.NoError(t, err)
+		assert.Equal(t, model.MessageId(0), partition.AddRawMessage("third partition").Id)
+		partitions, err := topics.Partitions("orders")
+		require.NoError(t, err)
+		assert.Len(t, partitions, 3)
+		_, err = topics.GetOrCreatePartition(DefaultTopic, 1)
+		assert.ErrorIs(t, err, ErrPartitionNotFound)
+	})
+
+	t.Run("Deleted topic is not found", func(t *testing.T) {
+		// when
+		err := topics.Delete("orders")
+		// then
+		require.NoError(t, err)
+		_, err = topics.Get("orders")
+		assert.ErrorIs(t, err, ErrTopicNotFound)
+		assert.ErrorIs(t, topics.Delete(DefaultTopic), ErrDefaultTopic)
+	})
+}
+
+func TestDeletedGenerationOfTopicIsNotCreatedAgain(t *testing.T) {
+	topics := NewTopicsWithDefault(NewInMemoryStorage())
+	_, err := topics.Create("orders")
+	require.NoError(t, err)
+	generation, err := topics.Generation("orders")
+	require.NoError(t, err)
+
+	t.Run("Late message of the deleted generation is refused", func(t *testing.T) {
+		// when
+		require.NoError(t, topics.DeleteGeneration("orders", generation))
+		_, err = topics.GetOrCreatePartitionOfGeneration("orders", 0, generation)
+		// then
+		assert.ErrorIs(t, err, ErrTopicDeleted)
+		assert.Equal(t, []string{DefaultTopic}, topics.Names())
+	})
+
+	t.Run("Message of the new generation creates topic again", func(t *testing.T) {
+		// when
+		_, err = topics.GetOrCreatePartitionOfGeneration("orders", 0, generation+1)
+		// then
+		require.NoError(t, err)
+		newGeneration, errGeneration := topics.Generation("orders")
+		require.NoError(t, errGeneration)
+		assert.Greater(t, newGeneration, generation)
+		_, err = topics.GetOrCreatePartitionOfGeneration("orders", 0, generation)
+		assert.ErrorIs(t, err, ErrTopicDeleted, "topic of the new generation doesn't accept messages of the deleted one")
+	})
+}
+
+func TestWalTopicsAndPartitionsAreRecoveredAfterRestart(t *testing.T) {
+	// given
+	t.Setenv("STORAGE_MODE", modeWal)
+	t.Setenv("STORAGE_DIR", t.TempDir())
+	topics := NewTopics()
+	partitions, err := topics.CreatePartitioned("orders", 3)
+	require.NoError(t, err)
+	partitions[0].AddRawMessage("first")
+	partitions[2].AddRawMessage("third partition")
+	topics.Default().AddRawMessage("default")
+	topics.Close()
+
+	// when
+	recovered := NewTopics()
+	defer recovered.Close()
+
+	// then
+	assert.Equal(t, []string{DefaultTopic, "orders"}, recovered.Names())
+	recoveredOrders, err := recovered.Get("orders")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"first"}, recoveredOrders.GetMessages())
+	recoveredPartition, err := recovered.Partition("orders", 2)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"third partition"}, recoveredPartition.GetMessages())
+	assert.Equal(t, []string{"default"}, recovered.Default().GetMessages())
+}
@@ -0,0 +1,613 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"replicated-log/internal/logging"
+	"replicated-log/internal/model"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	FsyncAlways   = "ALWAYS"   // fsync after every appended record
+	FsyncInterval = "INTERVAL" // fsync periodically in background
+	FsyncNever    = "NEVER"    // leave flushing to OS
+
+	segmentExtension = ".seg"
+	retentionFile    = "retention.json"
+	recordHeaderSize = 8                // payload length + checksum
+	maxRecordSize    = 64 * 1024 * 1024 // anything bigger is treated as garbage during recovery
+)
+
+var (
+	crcTable  = crc32.MakeTable(crc32.Castagnoli)
+	walLogger = logging.Component("wal")
+)
+
+// WalStorage -- durable storage backed by append-only segment files.
+// Each record on disk has the following layout:
+//
+//	| payload length (uint32) | CRC-32C of payload (uint32) | payload (JSON-encoded model.Message) |
+//
+// All messages are also kept in memory, so reads never touch the disk.
+// Segments which contain only trimmed messages are removed, segments with compacted messages are rewritten.
+type WalStorage struct {
+	mu     *sync.Mutex
+	memory *InMemoryStorage
+	// disk config
+	dir             string
+	fsyncPolicy     string
+	segmentMaxBytes int64
+	// active segment
+	segment     *os.File
+	segmentSeq  int
+	segmentSize int64
+	isDirty     bool
+	// ids of messages in every segment, used to find segments affected by retention
+	segmentRanges map[int]idRange
+	// background fsync
+	quit chan struct{}
+	// storage can be closed by topic deletion and by shutdown, writers may still hold it, so writes are ignored since then
+	closeOnce *sync.Once
+	closed    bool
+}
+
+func NewWalStorage(dir string) *WalStorage {
+	fsyncPolicy, ok := os.LookupEnv("WAL_FSYNC_POLICY")
+	if !ok {
+		fsyncPolicy = FsyncAlways
+	}
+	if fsyncPolicy != FsyncAlways && fsyncPolicy != FsyncInterval && fsyncPolicy != FsyncNever {
+		logging.Fatal(walLogger, "Unexpected WAL fsync policy", "policy", fsyncPolicy)
+	}
+
+	segmentMaxBytes := int64(16 * 1024 * 1024) // default value
+	if segmentSizeToken, okSize := os.LookupEnv("WAL_SEGMENT_SIZE_BYTES"); okSize {
+		value, err := strconv.ParseInt(segmentSizeToken, 10, 64)
+		if err != nil || value < 1 {
+			logging.Fatal(walLogger, "Given 'WAL_SEGMENT_SIZE_BYTES' token is invalid", "token", segmentSizeToken)
+		}
+		segmentMaxBytes = value
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		logging.Fatal(walLogger, "Failed to create storage dir", "dir", dir, "err", err)
+	}
+
+	s := &WalStorage{
+		mu:              &sync.Mutex{},
+		memory:          NewInMemoryStorage(),
+		dir:             dir,
+		fsyncPolicy:     fsyncPolicy,
+		segmentMaxBytes: segmentMaxBytes,
+		segmentRanges:   make(map[int]idRange),
+		quit:            make(chan struct{}),
+		closeOnce:       &sync.Once{},
+	}
+
+	s.recover()
+
+	if s.fsyncPolicy == FsyncInterval {
+		s.startPeriodicSync()
+	}
+
+	return s
+}
+
+func (s *WalStorage) AddRawMessage(message string) model.Message {
+	return s.AddNewMessage(model.Message{Message: message})
+}
+
+func (s *WalStorage) AddNewMessage(message model.Message) model.Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := message
+	result.Id = s.memory.getNextId()
+	if s.closed {
+		return result // caller checks Err
+	}
+	s.appendRecord(result)
+
+	if !s.memory.AddMessage(result) {
+		logging.Fatal(walLogger, "Failed to add raw message. Probably data race or logic error", "id", result.Id, logging.Payload(result.Message))
+	}
+
+	return result
+}
+
+func (s *WalStorage) AddMessage(message model.Message) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return false
+	}
+	if s.memory.isKnown(message.Id) {
+		walLogger.Debug("Message already exists, deduplicated", "id", message.Id)
+		return false
+	}
+
+	// write-ahead: message becomes visible only after it is on disk
+	s.appendRecord(message)
+
+	return s.memory.AddMessage(message)
+}
+
+func (s *WalStorage) IsConflicting(message model.Message) bool {
+	return s.memory.IsConflicting(message)
+}
+
+func (s *WalStorage) Replace(message model.Message) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return false
+	}
+	if !s.memory.isStored(message.Id) && s.memory.isKnown(message.Id) {
+		return false // removed by retention
+	}
+
+	// the latest record wins on recovery, see replaySegment
+	s.appendRecord(message)
+
+	return s.memory.Replace(message)
+}
+
+func (s *WalStorage) GetMessages() []string {
+	return s.memory.GetMessages()
+}
+
+func (s *WalStorage) GetMessagesFrom(from model.MessageId, limit int) []model.Message {
+	return s.memory.GetMessagesFrom(from, limit)
+}
+
+func (s *WalStorage) GetMessagesRange(from model.MessageId, to model.MessageId, limit int) []model.Message {
+	return s.memory.GetMessagesRange(from, to, limit)
+}
+
+func (s *WalStorage) GetOffset() model.MessageId {
+	return s.memory.GetOffset()
+}
+
+func (s *WalStorage) WaitForMessage(ctx context.Context, id model.MessageId) error {
+	return s.memory.WaitForMessage(ctx, id)
+}
+
+func (s *WalStorage) Size() int {
+	return s.memory.Size()
+}
+
+func (s *WalStorage) Bytes() int {
+	return s.memory.Bytes()
+}
+
+func (s *WalStorage) GetLowWaterMark() model.MessageId {
+	return s.memory.GetLowWaterMark()
+}
+
+// Trim persists the new low-water mark first, so trimmed messages are not recovered even if segments are not removed yet
+func (s *WalStorage) Trim(before model.MessageId) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return 0
+	}
+	previousLowWaterMark := s.memory.GetLowWaterMark()
+	removed := s.memory.trim(before)
+	if s.memory.GetLowWaterMark() == previousLowWaterMark {
+		return 0
+	}
+
+	s.saveRetention()
+	s.removeTrimmedSegments()
+
+	return len(removed)
+}
+
+// Compact persists the compacted range first, so recovery does not wait for compacted messages,
+// then rewrites segments without them
+func (s *WalStorage) Compact(before model.MessageId) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return 0
+	}
+	removed := s.memory.compact(before)
+	if len(removed) == 0 {
+		return 0
+	}
+
+	// messages which are kept by compaction should be durable before they are the only copy of their keys
+	s.sync()
+	s.saveRetention()
+	for _, seq := range s.listSegments() {
+		if s.segmentRanges[seq].containsAny(removed) {
+			s.rewriteSegment(seq)
+		}
+	}
+
+	return len(removed)
+}
+
+func (s *WalStorage) Clear() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+	walLogger.Info("Removing all segments", "dir", s.dir)
+	_ = s.segment.Close()
+	for _, seq := range s.listSegments() {
+		if err := os.Remove(s.segmentPath(seq)); err != nil {
+			logging.Fatal(walLogger, "Failed to remove segment", "segment", seq, "err", err)
+		}
+	}
+
+	if err := os.Remove(filepath.Join(s.dir, retentionFile)); err != nil && !os.IsNotExist(err) {
+		logging.Fatal(walLogger, "Failed to remove retention file", "dir", s.dir, "err", err)
+	}
+
+	s.memory.Clear()
+	s.segmentRanges = make(map[int]idRange)
+	s.openSegment(0)
+}
+
+// Close syncs and closes the active segment, only the first call has effect
+func (s *WalStorage) Close() {
+	s.closeOnce.Do(func() {
+		if s.fsyncPolicy == FsyncInterval {
+			close(s.quit)
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		s.sync()
+		if err := s.segment.Close(); err != nil {
+			walLogger.Warn("Failed to close segment", "segment", s.segmentSeq, "err", err)
+		}
+		s.closed = true
+		s.memory.Close()
+	})
+}
+
+func (s *WalStorage) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrClosed
+	}
+	return nil
+}
+
+func (s *WalStorage) appendRecord(message model.Message) {
+	payload, _ := json.Marshal(message)
+
+	record := make([]byte, recordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.Checksum(payload, crcTable))
+	copy(record[recordHeaderSize:], payload)
+
+	if _, err := s.segment.Write(record); err != nil {
+		// we cannot acknowledge message which is not persisted
+		logging.Fatal(walLogger, "Failed to write message to segment", "id", message.Id, "segment", s.segmentSeq, "err", err)
+	}
+	s.segmentSize += int64(len(record))
+	s.segmentRanges[s.segmentSeq] = s.segmentRanges[s.segmentSeq].with(message.Id)
+
+	if s.fsyncPolicy == FsyncAlways {
+		s.sync()
+	} else {
+		s.isDirty = true
+	}
+
+	if s.segmentSize >= s.segmentMaxBytes {
+		s.sync()
+		_ = s.segment.Close()
+		s.openSegment(s.segmentSeq + 1)
+	}
+}
+
+func (s *WalStorage) sync() {
+	if err := s.segment.Sync(); err != nil {
+		logging.Fatal(walLogger, "Failed to fsync segment", "segment", s.segmentSeq, "err", err)
+	}
+	s.isDirty = false
+}
+
+func (s *WalStorage) startPeriodicSync() {
+	period := 100 * time.Millisecond // default value
+	if periodToken, okPeriod := os.LookupEnv("WAL_FSYNC_INTERVAL_MILLISECONDS"); okPeriod {
+		value, _ := strconv.Atoi(periodToken)
+		period = time.Duration(value) * time.Millisecond
+	}
+
+	ticker := time.NewTicker(period)
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				s.mu.Lock()
+				if s.isDirty && !s.closed {
+					s.sync()
+				}
+				s.mu.Unlock()
+			case <-s.quit:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+}
+
+// recover replays all segments into memory. The log is cut at the first torn or corrupted record:
+// everything after it was never acknowledged as durable (or is lost anyway) and will be re-replicated.
+func (s *WalStorage) recover() {
+	segments := s.listSegments()
+	walLogger.Info("Recovering segments", "segments", len(segments), "dir", s.dir)
+
+	for i, seq := range segments {
+		validSize, isCorrupted := s.replaySegment(seq)
+		if !isCorrupted {
+			continue
+		}
+		// segment is synced before the next one is opened, so only the last write to the last segment can be torn
+		if i != len(segments)-1 {
+			logging.Fatal(walLogger, "Segment in the middle of the log is corrupted", "segment", seq, "valid_bytes", validSize, "last_segment", segments[len(segments)-1])
+		}
+
+		walLogger.Warn("Tail of the last segment is torn, truncating it", "segment", seq, "valid_bytes", validSize)
+		if err := os.Truncate(s.segmentPath(seq), validSize); err != nil {
+			logging.Fatal(walLogger, "Failed to truncate segment", "segment", seq, "err", err)
+		}
+	}
+
+	lastSeq := 0
+	if len(segments) > 0 {
+		lastSeq = segments[len(segments)-1]
+	}
+	s.openSegment(lastSeq)
+
+	lowWaterMark, compactedBefore := s.loadRetention()
+	s.memory.restoreRetention(lowWaterMark, compactedBefore)
+	s.removeTrimmedSegments()
+
+	walLogger.Info("Recovered messages", "messages", s.memory.Size())
+}
+
+func (s *WalStorage) replaySegment(seq int) (int64, bool) {
+	return s.scanSegment(seq, func(message model.Message, _ []byte) {
+		s.memory.Replace(message)
+		s.segmentRanges[seq] = s.segmentRanges[seq].with(message.Id)
+	})
+}
+
+// scanSegment calls visit for every valid record of the segment. Returns size of valid records and true if the rest is corrupted.
+func (s *WalStorage) scanSegment(seq int, visit func(message model.Message, record []byte)) (int64, bool) {
+	file, err := os.Open(s.segmentPath(seq))
+	if err != nil {
+		logging.Fatal(walLogger, "Failed to open segment", "segment", seq, "err", err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	header := make([]byte, recordHeaderSize)
+	validSize := int64(0)
+
+	for {
+		if _, err = io.ReadFull(reader, header); err == io.EOF {
+			return validSize, false // clean end of segment
+		} else if err != nil {
+			return validSize, true // torn header
+		}
+
+		length := binary.BigEndian.Uint32(header[0:4])
+		checksum := binary.BigEndian.Uint32(header[4:8])
+		if length > maxRecordSize {
+			return validSize, true
+		}
+
+		record := make([]byte, recordHeaderSize+int(length))
+		copy(record, header)
+		payload := record[recordHeaderSize:]
+		if _, err = io.ReadFull(reader, payload); err != nil {
+			return validSize, true // torn payload
+		}
+		if crc32.Checksum(payload, crcTable) != checksum {
+			return validSize, true
+		}
+
+		var message model.Message
+		if err = json.Unmarshal(payload, &message); err != nil {
+			return validSize, true
+		}
+
+		visit(message, record)
+		validSize += int64(len(record))
+	}
+}
+
+// rewriteSegment keeps only records of messages which are not removed by retention, should be called under lock
+func (s *WalStorage) rewriteSegment(seq int) {
+	isActive := seq == s.segmentSeq
+	if isActive {
+		_ = s.segment.Close()
+	}
+
+	path := s.segmentPath(seq)
+	file, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		logging.Fatal(walLogger, "Failed to create segment", "segment", seq, "err", err)
+	}
+
+	kept := idRange{}
+	s.scanSegment(seq, func(message model.Message, record []byte) {
+		if !s.memory.isStored(message.Id) {
+			return
+		}
+		if _, err = file.Write(record); err != nil {
+			logging.Fatal(walLogger, "Failed to write message to segment", "id", message.Id, "segment", seq, "err", err)
+		}
+		kept = kept.with(message.Id)
+	})
+	if err = file.Sync(); err != nil {
+		logging.Fatal(walLogger, "Failed to fsync segment", "segment", seq, "err", err)
+	}
+	_ = file.Close()
+
+	if err = os.Rename(path+".tmp", path); err != nil {
+		logging.Fatal(walLogger, "Failed to replace segment", "segment", seq, "err", err)
+	}
+	s.segmentRanges[seq] = kept
+	walLogger.Debug("Segment is rewritten", "segment", seq)
+
+	if isActive {
+		s.openSegment(seq)
+	}
+}
+
+// removeTrimmedSegments removes inactive segments which contain only trimmed messages, should be called under lock
+func (s *WalStorage) removeTrimmedSegments() {
+	lowWaterMark := s.memory.GetLowWaterMark()
+	for _, seq := range s.listSegments() {
+		if seq == s.segmentSeq || s.segmentRanges[seq].last >= lowWaterMark {
+			continue
+		}
+		if err := os.Remove(s.segmentPath(seq)); err != nil {
+			logging.Fatal(walLogger, "Failed to remove segment", "segment", seq, "err", err)
+		}
+		delete(s.segmentRanges, seq)
+		walLogger.Info("Trimmed segment is removed", "segment", seq, "low_water_mark", lowWaterMark)
+	}
+}
+
+type retentionState struct {
+	LowWaterMark    model.MessageId `json:"low_water_mark"`
+	CompactedBefore model.MessageId `json:"compacted_before"`
+}
+
+// saveRetention atomically replaces retention file, should be called under lock
+func (s *WalStorage) saveRetention() {
+	state := retentionState{LowWaterMark: s.memory.GetLowWaterMark(), CompactedBefore: s.memory.getCompactedBefore()}
+	raw, _ := json.Marshal(state)
+
+	path := filepath.Join(s.dir, retentionFile)
+	file, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		logging.Fatal(walLogger, "Failed to create retention file", "dir", s.dir, "err", err)
+	}
+	if _, err = file.Write(raw); err != nil {
+		logging.Fatal(walLogger, "Failed to write retention file", "dir", s.dir, "err", err)
+	}
+	if err = file.Sync(); err != nil {
+		logging.Fatal(walLogger, "Failed to fsync retention file", "dir", s.dir, "err", err)
+	}
+	_ = file.Close()
+
+	if err = os.Rename(path+".tmp", path); err != nil {
+		logging.Fatal(walLogger, "Failed to replace retention file", "dir", s.dir, "err", err)
+	}
+}
+
+func (s *WalStorage) loadRetention() (model.MessageId, model.MessageId) {
+	raw, err := os.ReadFile(filepath.Join(s.dir, retentionFile))
+	if os.IsNotExist(err) {
+		return 0, 0
+	}
+	var state retentionState
+	if err == nil {
+		err = json.Unmarshal(raw, &state)
+	}
+	if err != nil {
+		logging.Fatal(walLogger, "Failed to read retention file", "dir", s.dir, "err", err)
+	}
+
+	walLogger.Info("Retention is restored", "low_water_mark", state.LowWaterMark, "compacted_before", state.CompactedBefore)
+	return state.LowWaterMark, state.CompactedBefore
+}
+
+func (s *WalStorage) openSegment(seq int) {
+	file, err := os.OpenFile(s.segmentPath(seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		logging.Fatal(walLogger, "Failed to open segment", "segment", seq, "err", err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		logging.Fatal(walLogger, "Failed to stat segment", "segment", seq, "err", err)
+	}
+
+	s.segment = file
+	s.segmentSeq = seq
+	s.segmentSize = info.Size()
+}
+
+func (s *WalStorage) listSegments() []int {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		logging.Fatal(walLogger, "Failed to read storage dir", "dir", s.dir, "err", err)
+	}
+
+	var result []int
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, segmentExtension) {
+			continue
+		}
+		seq, err := strconv.Atoi(strings.TrimSuffix(name, segmentExtension))
+		if err != nil {
+			continue
+		}
+		result = append(result, seq)
+	}
+	sort.Ints(result)
+
+	return result
+}
+
+func (s *WalStorage) segmentPath(seq int) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", seq, segmentExtension))
+}
+
+// idRange -- the lowest and the highest id of messages in a segment, zero value is an empty range
+type idRange struct {
+	first    model.MessageId
+	last     model.MessageId
+	nonEmpty bool
+}
+
+func (r idRange) with(id model.MessageId) idRange {
+	if !r.nonEmpty {
+		return idRange{first: id, last: id, nonEmpty: true}
+	}
+	return idRange{first: min(r.first, id), last: max(r.last, id), nonEmpty: true}
+}
+
+func (r idRange) containsAny(ids []model.MessageId) bool {
+	if !r.nonEmpty {
+		return false
+	}
+	for _, id := range ids {
+		if id >= r.first && id <= r.last {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,182 @@
+package storage
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"replicated-log/internal/model"
+	"testing"
+)
+
+func TestWalStorageRecoversMessagesAfterRestart(t *testing.T) {
+	// GIVEN
+	dir := t.TempDir()
+	storage := NewWalStorage(dir)
+	_ = storage.AddRawMessage("first")
+	_ = storage.AddRawMessage("second")
+	storage.AddMessage(model.Message{Id: 3, Message: "out of order"})
+	storage.Close()
+
+	// WHEN
+	recovered := NewWalStorage(dir)
+	defer recovered.Close()
+
+	// THEN
+	assert.Equal(t, []string{"first", "second"}, recovered.GetMessages())
+
+	t.Run("Recovered storage keeps deduplication", func(t *testing.T) {
+		assert.False(t, recovered.AddMessage(model.Message{Id: 3, Message: "out of order"}))
+	})
+
+	t.Run("Recovered storage keeps total order", func(t *testing.T) {
+		assert.True(t, recovered.AddMessage(model.Message{Id: 2, Message: "third"}))
+		assert.Equal(t, []string{"first", "second", "third", "out of order"}, recovered.GetMessages())
+	})
+}
+
+func TestWalStorageRecoversBinaryMessagesExactly(t *testing.T) {
+	// GIVEN
+	dir := t.TempDir()
+	storage := NewWalStorage(dir)
+	message := storage.AddNewMessage(model.Message{
+		Payload:     []byte{0x00, 0xff, '\n', 0x80},
+		ContentType: "application/octet-stream",
+		Headers:     map[string]string{"key": "value"},
+	})
+	storage.Close()
+
+	// WHEN
+	recovered := NewWalStorage(dir)
+	defer recovered.Close()
+
+	// THEN
+	assert.Equal(t, []model.Message{message}, recovered.GetMessagesFrom(0, 10))
+}
+
+func TestWalStorageTruncatesTornRecord(t *testing.T) {
+	// GIVEN
+	dir := t.TempDir()
+	storage := NewWalStorage(dir)
+	_ = storage.AddRawMessage("first")
+	_ = storage.AddRawMessage("second")
+	storage.Close()
+
+	path := storage.segmentPath(0)
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	// emulate crash in the middle of the last write
+	require.NoError(t, os.Truncate(path, info.Size()-3))
+
+	// WHEN
+	recovered := NewWalStorage(dir)
+	defer recovered.Close()
+
+	// THEN
+	assert.Equal(t, []string{"first"}, recovered.GetMessages())
+	_ = recovered.AddRawMessage("second again")
+	assert.Equal(t, []string{"first", "second again"}, recovered.GetMessages())
+}
+
+func TestWalStorageDetectsChecksumMismatch(t *testing.T) {
+	// GIVEN
+	dir := t.TempDir()
+	storage := NewWalStorage(dir)
+	_ = storage.AddRawMessage("first")
+	_ = storage.AddRawMessage("second")
+	storage.Close()
+
+	path := storage.segmentPath(0)
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	data[len(data)-2] ^= 0xFF // flip bits inside the payload of the last record
+	require.NoError(t, os.WriteFile(path, data, 0o644))
+
+	// WHEN
+	recovered := NewWalStorage(dir)
+	defer recovered.Close()
+
+	// THEN
+	assert.Equal(t, []string{"first"}, recovered.GetMessages())
+}
+
+func TestWalStorageRollsSegments(t *testing.T) {
+	// GIVEN
+	dir := t.TempDir()
+	t.Setenv("WAL_SEGMENT_SIZE_BYTES", "1") // every record gets its own segment
+	storage := NewWalStorage(dir)
+
+	// WHEN
+	_ = storage.AddRawMessage("first")
+	_ = storage.AddRawMessage("second")
+	_ = storage.AddRawMessage("third")
+	storage.Close()
+
+	// THEN
+	assert.Equal(t, []int{0, 1, 2, 3}, storage.listSegments())
+
+	recovered := NewWalStorage(dir)
+	defer recovered.Close()
+	assert.Equal(t, []string{"first", "second", "third"}, recovered.GetMessages())
+}
+
+func TestWalStorageWithIntervalFsyncPolicy(t *testing.T) {
+	// GIVEN
+	dir := t.TempDir()
+	t.Setenv("WAL_FSYNC_POLICY", FsyncInterval)
+	t.Setenv("WAL_FSYNC_INTERVAL_MILLISECONDS", "1")
+	storage := NewWalStorage(dir)
+
+	// WHEN
+	_ = storage.AddRawMessage("first")
+	storage.Close()
+	storage.Close() // e.g. topic is deleted during shutdown
+
+	// THEN
+	recovered := NewWalStorage(dir)
+	defer recovered.Close()
+	assert.Equal(t, []string{"first"}, recovered.GetMessages())
+}
+
+func TestWalStorageClear(t *testing.T) {
+	// GIVEN
+	dir := t.TempDir()
+	t.Setenv("WAL_SEGMENT_SIZE_BYTES", "1")
+	storage := NewWalStorage(dir)
+	_ = storage.AddRawMessage("first")
+	_ = storage.AddRawMessage("second")
+
+	// WHEN
+	storage.Clear()
+	storage.Close()
+
+	// THEN
+	assert.Empty(t, storage.GetMessages())
+	assert.Equal(t, []int{0}, storage.listSegments())
+
+	recovered := NewWalStorage(dir)
+	defer recovered.Close()
+	assert.Empty(t, recovered.GetMessages())
+}
+
+func TestWalStorageOfDeletedTopicIgnoresWrites(t *testing.T) {
+	// GIVEN
+	t.Setenv("STORAGE_MODE", "WAL")
+	t.Setenv("STORAGE_DIR", t.TempDir())
+	topics := NewTopics()
+	defer topics.Close()
+	messages, err := topics.Create("orders")
+	require.NoError(t, err)
+	messages.AddRawMessage("first")
+
+	// WHEN
+	require.NoError(t, topics.Delete("orders"))
+
+	// THEN
+	assert.ErrorIs(t, messages.Err(), ErrClosed)
+	messages.AddRawMessage("appended by in-flight request")
+	assert.False(t, messages.AddMessage(model.Message{Id: 1, Message: "replicated"}))
+	assert.False(t, messages.Replace(model.Message{Id: 0, Message: "repaired"}))
+	assert.Equal(t, 0, messages.Trim(1))
+	assert.Equal(t, 0, messages.Compact(1))
+	assert.Empty(t, messages.GetMessages())
+}
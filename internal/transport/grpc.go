@@ -0,0 +1,529 @@
+package transport
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"replicated-log/internal/logging"
+	"replicated-log/internal/model"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Messages are encoded as JSON (same as in HTTP API), so the service needs no generated code
+const (
+	codecName   = "json"
+	serviceName = "replicatedlog.Replication"
+
+	replicateMethod       = "/" + serviceName + "/Replicate"
+	getOffsetMethod       = "/" + serviceName + "/GetOffset"
+	deleteTopicMethod     = "/" + serviceName + "/DeleteTopic"
+	hashesMethod          = "/" + serviceName + "/Hashes"
+	repairMethod          = "/" + serviceName + "/Repair"
+	retentionMethod       = "/" + serviceName + "/ApplyRetention"
+	replicateStreamMethod = "/" + serviceName + "/ReplicateStream"
+
+	correlationIdKey   = "x-correlation-id"
+	primaryOffsetKey   = "x-primary-offset"
+	secondaryOffsetKey = "x-secondary-offset"
+
+	grpcScheme = "grpc://"
+)
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v any) error {
+	return json.Unmarshal(data, v)
+}
+
+func (jsonCodec) Name() string {
+	return codecName
+}
+
+func init() {
+	encoding.RegisterCodec(jsonCodec{})
+}
+
+type replicateResponse struct{}
+
+type topicRequest struct {
+	Topic      string `json:"topic,omitempty"`
+	Partition  int    `json:"partition,omitempty"`
+	Generation uint64 `json:"generation,omitempty"`
+}
+
+// streamAck -- response to every message sent to ReplicateStream
+type streamAck struct {
+	Id       model.MessageId `json:"order"`
+	Error    string          `json:"error,omitempty"`
+	Stale    bool            `json:"stale,omitempty"`
+	Conflict bool            `json:"conflict,omitempty"`
+}
+
+// ReplicationHandler -- secondary side of the gRPC transport
+type ReplicationHandler interface {
+	// Replicate stores messages, returns ErrStaleTerm if they come from a stale leader and ErrConflict if
+	// another message with the same id is stored
+	Replicate(ctx context.Context, messages []model.Message) error
+	// Offset returns id of the first missing message of the topic partition
+	Offset(topic string, partition int) model.MessageId
+	// DeleteTopic removes topic with all its messages, unknown topic is not an error.
+	// Late messages of the given generation of the topic don't create it again.
+	DeleteTopic(topic string, generation uint64) error
+	// Hashes returns hashes of the requested ranges of the topic partition
+	Hashes(request HashRequest) HashResponse
+	// Repair overwrites messages, returns ErrStaleTerm if they come from a stale leader
+	Repair(ctx context.Context, messages []model.Message) error
+	// ApplyRetention trims and compacts known partitions, returns ErrStaleTerm if points come from a stale leader
+	ApplyRetention(ctx context.Context, request RetentionRequest) error
+	// IsHealthy returns true if node is ready to receive messages. Offset of the primary is nil if unknown.
+	IsHealthy(primaryOffset *model.MessageId) bool
+}
+
+var replicationServiceDesc = grpc.ServiceDesc{
+	ServiceName: serviceName,
+	HandlerType: (*ReplicationHandler)(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "Replicate", Handler: replicateHandler},
+		{MethodName: "GetOffset", Handler: getOffsetHandler},
+		{MethodName: "DeleteTopic", Handler: deleteTopicHandler},
+		{MethodName: "Hashes", Handler: hashesHandler},
+		{MethodName: "Repair", Handler: repairHandler},
+		{MethodName: "ApplyRetention", Handler: retentionHandler},
+	},
+	Streams: []grpc.StreamDesc{
+		{StreamName: "ReplicateStream", Handler: replicateStreamHandler, ServerStreams: true, ClientStreams: true},
+	},
+}
+
+var replicateStreamDesc = replicationServiceDesc.Streams[0]
+
+// NewGrpcServer creates server with replication and standard health services
+func NewGrpcServer(handler ReplicationHandler, opts ...grpc.ServerOption) *grpc.Server {
+	server := grpc.NewServer(opts...)
+	server.RegisterService(&replicationServiceDesc, handler)
+	grpc_health_v1.RegisterHealthServer(server, &healthServer{handler: handler})
+	return server
+}
+
+func replicateHandler(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+	var message model.Message
+	if err := dec(&message); err != nil {
+		return nil, err
+	}
+
+	handle := func(ctx context.Context, req any) (any, error) {
+		err := srv.(ReplicationHandler).Replicate(incomingContext(ctx), []model.Message{*req.(*model.Message)})
+		if err != nil {
+			return nil, toStatus(err)
+		}
+		return &replicateResponse{}, nil
+	}
+	if interceptor == nil {
+		return handle(ctx, &message)
+	}
+	return interceptor(ctx, &message, &grpc.UnaryServerInfo{Server: srv, FullMethod: replicateMethod}, handle)
+}
+
+func getOffsetHandler(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+	var request topicRequest
+	if err := dec(&request); err != nil {
+		return nil, err
+	}
+
+	handle := func(ctx context.Context, req any) (any, error) {
+		return &offsetResponse{Offset: srv.(ReplicationHandler).Offset(req.(*topicRequest).Topic, req.(*topicRequest).Partition)}, nil
+	}
+	if interceptor == nil {
+		return handle(ctx, &request)
+	}
+	return interceptor(ctx, &request, &grpc.UnaryServerInfo{Server: srv, FullMethod: getOffsetMethod}, handle)
+}
+
+func deleteTopicHandler(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+	var request topicRequest
+	if err := dec(&request); err != nil {
+		return nil, err
+	}
+
+	handle := func(ctx context.Context, req any) (any, error) {
+		if err := srv.(ReplicationHandler).DeleteTopic(req.(*topicRequest).Topic, req.(*topicRequest).Generation); err != nil {
+			return nil, toStatus(err)
+		}
+		return &replicateResponse{}, nil
+	}
+	if interceptor == nil {
+		return handle(ctx, &request)
+	}
+	return interceptor(ctx, &request, &grpc.UnaryServerInfo{Server: srv, FullMethod: deleteTopicMethod}, handle)
+}
+
+func hashesHandler(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+	var request HashRequest
+	if err := dec(&request); err != nil {
+		return nil, err
+	}
+
+	handle := func(ctx context.Context, req any) (any, error) {
+		response := srv.(ReplicationHandler).Hashes(*req.(*HashRequest))
+		return &response, nil
+	}
+	if interceptor == nil {
+		return handle(ctx, &request)
+	}
+	return interceptor(ctx, &request, &grpc.UnaryServerInfo{Server: srv, FullMethod: hashesMethod}, handle)
+}
+
+func repairHandler(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+	var messages []model.Message
+	if err := dec(&messages); err != nil {
+		return nil, err
+	}
+
+	handle := func(ctx context.Context, req any) (any, error) {
+		if err := srv.(ReplicationHandler).Repair(incomingContext(ctx), *req.(*[]model.Message)); err != nil {
+			return nil, toStatus(err)
+		}
+		return &replicateResponse{}, nil
+	}
+	if interceptor == nil {
+		return handle(ctx, &messages)
+	}
+	return interceptor(ctx, &messages, &grpc.UnaryServerInfo{Server: srv, FullMethod: repairMethod}, handle)
+}
+
+func retentionHandler(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+	var request RetentionRequest
+	if err := dec(&request); err != nil {
+		return nil, err
+	}
+
+	handle := func(ctx context.Context, req any) (any, error) {
+		if err := srv.(ReplicationHandler).ApplyRetention(incomingContext(ctx), *req.(*RetentionRequest)); err != nil {
+			return nil, toStatus(err)
+		}
+		return &replicateResponse{}, nil
+	}
+	if interceptor == nil {
+		return handle(ctx, &request)
+	}
+	return interceptor(ctx, &request, &grpc.UnaryServerInfo{Server: srv, FullMethod: retentionMethod}, handle)
+}
+
+// replicateStreamHandler acknowledges every message of the stream in order
+func replicateStreamHandler(srv any, stream grpc.ServerStream) error {
+	handler := srv.(ReplicationHandler)
+	ctx := incomingContext(stream.Context())
+
+	for {
+		var message model.Message
+		if err := stream.RecvMsg(&message); errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		ack := streamAck{Id: message.Id}
+		if err := handler.Replicate(ctx, []model.Message{message}); err != nil {
+			ack.Error = err.Error()
+			ack.Stale = errors.Is(err, ErrStaleTerm)
+			ack.Conflict = errors.Is(err, ErrConflict)
+		}
+		if err := stream.SendMsg(&ack); err != nil {
+			return err
+		}
+	}
+}
+
+// incomingContext moves correlation id from the gRPC metadata into the logging context
+func incomingContext(ctx context.Context) context.Context {
+	if values := metadata.ValueFromIncomingContext(ctx, correlationIdKey); len(values) > 0 {
+		return logging.WithCorrelationId(ctx, values[0])
+	}
+	return ctx
+}
+
+func toStatus(err error) error {
+	if errors.Is(err, ErrStaleTerm) {
+		return status.Error(codes.FailedPrecondition, err.Error())
+	}
+	if errors.Is(err, ErrConflict) {
+		return status.Error(codes.AlreadyExists, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+func fromStatus(err error) error {
+	switch status.Code(err) {
+	case codes.FailedPrecondition:
+		return ErrStaleTerm
+	case codes.AlreadyExists:
+		return ErrConflict
+	}
+	return err
+}
+
+// healthServer -- standard gRPC health service, see https://github.com/grpc/grpc/blob/master/doc/health-checking.md
+type healthServer struct {
+	grpc_health_v1.UnimplementedHealthServer
+	handler ReplicationHandler
+}
+
+func (s *healthServer) Check(ctx context.Context, req *grpc_health_v1.HealthCheckRequest) (*grpc_health_v1.HealthCheckResponse, error) {
+	if req.Service != "" && req.Service != serviceName {
+		return nil, status.Errorf(codes.NotFound, "unknown service %q", req.Service)
+	}
+
+	var primaryOffset *model.MessageId
+	if values := metadata.ValueFromIncomingContext(ctx, primaryOffsetKey); len(values) > 0 {
+		primaryOffset = parseOffset(values[0])
+	}
+
+	if s.handler.IsHealthy(primaryOffset) {
+		// health response is protobuf, so offset of the secondary is sent in header
+		offset := strconv.FormatUint(uint64(s.handler.Offset("", 0)), 10)
+		_ = grpc.SetHeader(ctx, metadata.Pairs(secondaryOffsetKey, offset))
+		return &grpc_health_v1.HealthCheckResponse{Status: grpc_health_v1.HealthCheckResponse_SERVING}, nil
+	}
+	return &grpc_health_v1.HealthCheckResponse{Status: grpc_health_v1.HealthCheckResponse_NOT_SERVING}, nil
+}
+
+// GrpcTransport -- keeps one connection per secondary, batches are sent over a bidirectional stream
+type GrpcTransport struct {
+	requestTimeout time.Duration
+	// batch streams, repairs, hashes and retention carry many messages, so they get a longer timeout
+	bulkTimeout time.Duration
+	dialOptions []grpc.DialOption
+
+	mu    *sync.Mutex
+	conns map[string]*grpc.ClientConn
+}
+
+func NewGrpcTransport(requestTimeout time.Duration, dialOptions ...grpc.DialOption) *GrpcTransport {
+	if len(dialOptions) == 0 {
+		dialOptions = []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+	}
+
+	return &GrpcTransport{
+		requestTimeout: requestTimeout,
+		bulkTimeout:    BulkRequestTimeout(),
+		dialOptions:    append(dialOptions, grpc.WithDefaultCallOptions(grpc.CallContentSubtype(codecName))),
+		mu:             &sync.Mutex{},
+		conns:          make(map[string]*grpc.ClientConn),
+	}
+}
+
+func (t *GrpcTransport) conn(secondaryUrl string) (*grpc.ClientConn, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if conn, ok := t.conns[secondaryUrl]; ok {
+		return conn, nil
+	}
+
+	// connection is established lazily on the first call, so NewClient doesn't block
+	conn, err := grpc.NewClient(strings.TrimPrefix(secondaryUrl, grpcScheme), t.dialOptions...)
+	if err != nil {
+		return nil, err
+	}
+	t.conns[secondaryUrl] = conn
+
+	return conn, nil
+}
+
+// outgoingContext applies the given timeout and puts correlation id into the gRPC metadata
+func (t *GrpcTransport) outgoingContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if correlationId := logging.CorrelationId(ctx); correlationId != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, correlationIdKey, correlationId)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+func (t *GrpcTransport) Replicate(ctx context.Context, secondaryUrl string, message model.Message) error {
+	conn, err := t.conn(secondaryUrl)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := t.outgoingContext(ctx, t.requestTimeout)
+	defer cancel()
+
+	return fromStatus(conn.Invoke(ctx, replicateMethod, &message, &replicateResponse{}))
+}
+
+func (t *GrpcTransport) ReplicateBatch(ctx context.Context, secondaryUrl string, batch []model.Message) error {
+	conn, err := t.conn(secondaryUrl)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := t.outgoingContext(ctx, t.bulkTimeout)
+	defer cancel()
+
+	stream, err := conn.NewStream(ctx, &replicateStreamDesc, replicateStreamMethod)
+	if err != nil {
+		return fromStatus(err)
+	}
+
+	// messages are sent while acks are received, so the stream doesn't stall on flow control
+	sendErr := make(chan error, 1)
+	go func() {
+		for i := range batch {
+			if err := stream.SendMsg(&batch[i]); err != nil {
+				sendErr <- err
+				return
+			}
+		}
+		sendErr <- stream.CloseSend()
+	}()
+
+	for acked := 0; acked < len(batch); acked++ {
+		var ack streamAck
+		if err = stream.RecvMsg(&ack); err != nil {
+			return fromStatus(err)
+		}
+		if ack.Stale {
+			return ErrStaleTerm
+		} else if ack.Conflict {
+			return ErrConflict
+		} else if ack.Error != "" {
+			return fmt.Errorf("message %d is not replicated: %s", ack.Id, ack.Error)
+		}
+	}
+
+	return <-sendErr
+}
+
+func (t *GrpcTransport) FetchOffset(ctx context.Context, secondaryUrl string, topic string, partition int) (model.MessageId, error) {
+	conn, err := t.conn(secondaryUrl)
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := t.outgoingContext(ctx, t.requestTimeout)
+	defer cancel()
+
+	var response offsetResponse
+	if err = conn.Invoke(ctx, getOffsetMethod, &topicRequest{Topic: topic, Partition: partition}, &response); err != nil {
+		return 0, fromStatus(err)
+	}
+
+	return response.Offset, nil
+}
+
+func (t *GrpcTransport) DeleteTopic(ctx context.Context, secondaryUrl string, topic string, generation uint64) error {
+	conn, err := t.conn(secondaryUrl)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := t.outgoingContext(ctx, t.requestTimeout)
+	defer cancel()
+
+	return fromStatus(conn.Invoke(ctx, deleteTopicMethod, &topicRequest{Topic: topic, Generation: generation}, &replicateResponse{}))
+}
+
+func (t *GrpcTransport) FetchHashes(ctx context.Context, secondaryUrl string, request HashRequest) (HashResponse, error) {
+	conn, err := t.conn(secondaryUrl)
+	if err != nil {
+		return HashResponse{}, err
+	}
+
+	ctx, cancel := t.outgoingContext(ctx, t.bulkTimeout)
+	defer cancel()
+
+	var response HashResponse
+	if err = conn.Invoke(ctx, hashesMethod, &request, &response); err != nil {
+		return HashResponse{}, fromStatus(err)
+	}
+
+	return response, nil
+}
+
+func (t *GrpcTransport) Repair(ctx context.Context, secondaryUrl string, messages []model.Message) error {
+	conn, err := t.conn(secondaryUrl)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := t.outgoingContext(ctx, t.bulkTimeout)
+	defer cancel()
+
+	return fromStatus(conn.Invoke(ctx, repairMethod, &messages, &replicateResponse{}))
+}
+
+func (t *GrpcTransport) ApplyRetention(ctx context.Context, secondaryUrl string, request RetentionRequest) error {
+	conn, err := t.conn(secondaryUrl)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := t.outgoingContext(ctx, t.bulkTimeout)
+	defer cancel()
+
+	return fromStatus(conn.Invoke(ctx, retentionMethod, &request, &replicateResponse{}))
+}
+
+func (t *GrpcTransport) HealthCheck(ctx context.Context, secondaryUrl string, primaryOffset *model.MessageId) (*model.MessageId, error) {
+	conn, err := t.conn(secondaryUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := t.outgoingContext(ctx, t.requestTimeout)
+	defer cancel()
+	if primaryOffset != nil {
+		ctx = metadata.AppendToOutgoingContext(ctx, primaryOffsetKey, strconv.FormatUint(uint64(*primaryOffset), 10))
+	}
+
+	// health service is protobuf, so default codec is used
+	var header metadata.MD
+	resp, err := grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{Service: serviceName}, grpc.CallContentSubtype("proto"), grpc.Header(&header))
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.Status != grpc_health_v1.HealthCheckResponse_SERVING {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	if values := header.Get(secondaryOffsetKey); len(values) > 0 {
+		return parseOffset(values[0]), nil
+	}
+	return nil, nil
+}
+
+func (t *GrpcTransport) Forget(secondaryUrl string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if conn, ok := t.conns[secondaryUrl]; ok {
+		_ = conn.Close()
+		delete(t.conns, secondaryUrl)
+	}
+}
+
+func (t *GrpcTransport) Close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for secondaryUrl, conn := range t.conns {
+		_ = conn.Close()
+		delete(t.conns, secondaryUrl)
+	}
+}
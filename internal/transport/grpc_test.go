@@ -0,0 +1,267 @@
+package transport
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"net"
+	"replicated-log/internal/auth"
+	"replicated-log/internal/auth/authtest"
+	"replicated-log/internal/logging"
+	"replicated-log/internal/model"
+	"replicated-log/internal/storage"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSecondary stores messages in memory, messages with term below minTerm are rejected
+type fakeSecondary struct {
+	mu             sync.Mutex
+	messages       []model.Message
+	correlationIds []string
+	minTerm        uint64
+	isHealthy      bool
+	primaryOffset  *model.MessageId
+	deletedTopics  []string
+	retention      []RetentionRequest
+}
+
+func (s *fakeSecondary) Replicate(ctx context.Context, messages []model.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, message := range messages {
+		if message.Term < s.minTerm {
+			return ErrStaleTerm
+		}
+	}
+	s.messages = append(s.messages, messages...)
+	s.correlationIds = append(s.correlationIds, logging.CorrelationId(ctx))
+	return nil
+}
+
+func (s *fakeSecondary) Offset(topic string, partition int) model.MessageId {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	offset := model.MessageId(0)
+	for _, message := range s.messages {
+		if message.Topic == topic && message.Partition == partition {
+			offset++
+		}
+	}
+	return offset
+}
+
+func (s *fakeSecondary) DeleteTopic(topic string, _ uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.deletedTopics = append(s.deletedTopics, topic)
+	return nil
+}
+
+func (s *fakeSecondary) Hashes(request HashRequest) HashResponse {
+	return HashResponse{Offset: s.Offset(request.Topic, request.Partition), Hashes: make([]string, len(request.Ranges))}
+}
+
+func (s *fakeSecondary) Repair(ctx context.Context, messages []model.Message) error {
+	return s.Replicate(ctx, messages)
+}
+
+func (s *fakeSecondary) ApplyRetention(_ context.Context, request RetentionRequest) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if request.Term < s.minTerm {
+		return ErrStaleTerm
+	}
+	s.retention = append(s.retention, request)
+	return nil
+}
+
+func (s *fakeSecondary) IsHealthy(primaryOffset *model.MessageId) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.primaryOffset = primaryOffset
+	return s.isHealthy
+}
+
+func startFakeSecondary(t *testing.T, secondary *fakeSecondary) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	server := NewGrpcServer(secondary)
+	go func() { _ = server.Serve(listener) }()
+	t.Cleanup(server.Stop)
+
+	return "grpc://" + listener.Addr().String()
+}
+
+func TestGrpcTransportReplicatesMessages(t *testing.T) {
+	// GIVEN
+	secondary := &fakeSecondary{isHealthy: true}
+	secondaryUrl := startFakeSecondary(t, secondary)
+	transport := NewGrpcTransport(time.Second)
+	defer transport.Close()
+	ctx := logging.WithCorrelationId(context.Background(), "append-1")
+
+	// WHEN
+	errOne := transport.Replicate(ctx, secondaryUrl, model.Message{Id: 0, Message: "first"})
+	errBatch := transport.ReplicateBatch(ctx, secondaryUrl, []model.Message{
+		{Id: 1, Message: "second"},
+		{Id: 2, Payload: []byte{0x00, 0xff}, ContentType: "application/octet-stream", Headers: map[string]string{"k": "v"}},
+	})
+	offset, errOffset := transport.FetchOffset(context.Background(), secondaryUrl, "", 0)
+
+	// THEN
+	require.NoError(t, errOne)
+	require.NoError(t, errBatch)
+	require.NoError(t, errOffset)
+	require.Equal(t, model.MessageId(3), offset)
+	require.Equal(t, []model.Message{
+		{Id: 0, Message: "first"},
+		{Id: 1, Message: "second"},
+		{Id: 2, Payload: []byte{0x00, 0xff}, ContentType: "application/octet-stream", Headers: map[string]string{"k": "v"}},
+	}, secondary.messages)
+	require.Equal(t, []string{"append-1", "append-1", "append-1"}, secondary.correlationIds)
+}
+
+func TestGrpcTransportManagesTopics(t *testing.T) {
+	// GIVEN
+	secondary := &fakeSecondary{isHealthy: true}
+	secondaryUrl := startFakeSecondary(t, secondary)
+	transport := NewGrpcTransport(time.Second)
+	defer transport.Close()
+	require.NoError(t, transport.ReplicateBatch(context.Background(), secondaryUrl, []model.Message{
+		{Id: 0, Message: "default"},
+		{Id: 0, Message: "first", Topic: "orders"},
+		{Id: 1, Message: "second", Topic: "orders"},
+		{Id: 0, Message: "other partition", Topic: "orders", Partition: 1},
+	}))
+
+	// WHEN
+	offset, errOffset := transport.FetchOffset(context.Background(), secondaryUrl, "orders", 0)
+	errDelete := transport.DeleteTopic(context.Background(), secondaryUrl, "orders", 1)
+
+	// THEN
+	require.NoError(t, errOffset)
+	require.Equal(t, model.MessageId(2), offset)
+	require.NoError(t, errDelete)
+	require.Equal(t, []string{"orders"}, secondary.deletedTopics)
+}
+
+func TestGrpcTransportReportsStaleTerm(t *testing.T) {
+	// GIVEN
+	secondary := &fakeSecondary{isHealthy: true, minTerm: 2}
+	secondaryUrl := startFakeSecondary(t, secondary)
+	transport := NewGrpcTransport(time.Second)
+	defer transport.Close()
+
+	// WHEN
+	errOne := transport.Replicate(context.Background(), secondaryUrl, model.Message{Id: 0, Term: 1})
+	errBatch := transport.ReplicateBatch(context.Background(), secondaryUrl, []model.Message{{Id: 0, Term: 1}})
+
+	// THEN
+	require.ErrorIs(t, errOne, ErrStaleTerm)
+	require.ErrorIs(t, errBatch, ErrStaleTerm)
+	require.Empty(t, secondary.messages)
+}
+
+func TestGrpcTransportAppliesRetention(t *testing.T) {
+	// GIVEN
+	secondary := &fakeSecondary{isHealthy: true, minTerm: 2}
+	secondaryUrl := startFakeSecondary(t, secondary)
+	transport := NewGrpcTransport(time.Second)
+	defer transport.Close()
+	request := RetentionRequest{Term: 2, Points: []storage.RetentionPoint{
+		{Topic: "orders", Partition: 1, LowWaterMark: 3, CompactedBefore: 5},
+	}}
+
+	// WHEN
+	err := transport.ApplyRetention(context.Background(), secondaryUrl, request)
+	errStale := transport.ApplyRetention(context.Background(), secondaryUrl, RetentionRequest{Term: 1})
+
+	// THEN
+	require.NoError(t, err)
+	require.ErrorIs(t, errStale, ErrStaleTerm)
+	require.Equal(t, []RetentionRequest{request}, secondary.retention)
+}
+
+func TestGrpcTransportChecksHealth(t *testing.T) {
+	// GIVEN
+	secondary := &fakeSecondary{isHealthy: true}
+	secondaryUrl := startFakeSecondary(t, secondary)
+	transport := NewGrpcTransport(time.Second)
+	defer transport.Close()
+
+	// WHEN
+	_, errHealthy := transport.HealthCheck(context.Background(), secondaryUrl, nil)
+	secondary.mu.Lock()
+	secondary.isHealthy = false
+	secondary.mu.Unlock()
+	_, errUnhealthy := transport.HealthCheck(context.Background(), secondaryUrl, nil)
+	_, errUnreachable := transport.HealthCheck(context.Background(), "grpc://127.0.0.1:1", nil)
+
+	// THEN
+	require.NoError(t, errHealthy)
+	require.Error(t, errUnhealthy)
+	require.Error(t, errUnreachable)
+}
+
+func TestGrpcTransportSendsPrimaryOffsetWithHealthCheck(t *testing.T) {
+	// GIVEN
+	secondary := &fakeSecondary{isHealthy: true}
+	secondaryUrl := startFakeSecondary(t, secondary)
+	transport := NewGrpcTransport(time.Second)
+	defer transport.Close()
+	primaryOffset := model.MessageId(5)
+
+	// WHEN
+	secondaryOffset, err := transport.HealthCheck(context.Background(), secondaryUrl, &primaryOffset)
+
+	// THEN
+	require.NoError(t, err)
+	require.Equal(t, primaryOffset, *secondary.primaryOffset)
+	require.NotNil(t, secondaryOffset, "secondary reports its offset back")
+	require.Equal(t, model.MessageId(0), *secondaryOffset)
+}
+
+func TestGrpcTransportWithMutualTLSAndToken(t *testing.T) {
+	// GIVEN
+	files := authtest.GenerateTLSFiles(t)
+	authtest.Setenv(t, files)
+	t.Setenv("INTERNAL_AUTH_TOKEN", "internal")
+	options, err := auth.NewAuthenticator().GrpcServerOptions(files)
+	require.NoError(t, err)
+
+	secondary := &fakeSecondary{isHealthy: true}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := NewGrpcServer(secondary, options...)
+	go func() { _ = server.Serve(listener) }()
+	defer server.Stop()
+	secondaryUrl := "grpc://" + listener.Addr().String()
+
+	credentials := auth.InternalCredentials()
+	trusted := NewGrpcTransport(time.Second, credentials.GrpcDialOptions()...)
+	defer trusted.Close()
+	withoutToken := NewGrpcTransport(time.Second, auth.Credentials{TLS: credentials.TLS}.GrpcDialOptions()...)
+	defer withoutToken.Close()
+	withoutTLS := NewGrpcTransport(time.Second, auth.Credentials{Token: "internal"}.GrpcDialOptions()...)
+	defer withoutTLS.Close()
+
+	// WHEN
+	errTrusted := trusted.Replicate(context.Background(), secondaryUrl, model.Message{Id: 0, Message: "secure"})
+	_, errHealth := trusted.HealthCheck(context.Background(), secondaryUrl, nil)
+	errWithoutToken := withoutToken.Replicate(context.Background(), secondaryUrl, model.Message{Id: 1})
+	errWithoutTLS := withoutTLS.ReplicateBatch(context.Background(), secondaryUrl, []model.Message{{Id: 1}})
+
+	// THEN
+	require.NoError(t, errTrusted)
+	require.NoError(t, errHealth)
+	require.Error(t, errWithoutToken)
+	require.Error(t, errWithoutTLS)
+	require.Equal(t, []model.Message{{Id: 0, Message: "secure"}}, secondary.messages)
+}
@@ -0,0 +1,169 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"replicated-log/internal/auth"
+	"replicated-log/internal/logging"
+	"replicated-log/internal/model"
+	"strconv"
+	"time"
+)
+
+// PrimaryOffsetHeader -- offset of the primary sent with every health check, so secondary knows how far behind it is
+const PrimaryOffsetHeader = "X-Primary-Offset"
+
+// SecondaryOffsetHeader -- offset of the default log of the secondary sent back, so primary sees what it is missing
+const SecondaryOffsetHeader = "X-Secondary-Offset"
+
+type offsetResponse struct {
+	Offset model.MessageId `json:"offset"`
+}
+
+// HttpTransport -- JSON over HTTP, secondary API is described in api/secondary.yaml
+type HttpTransport struct {
+	// Clients are safe for concurrent use by multiple goroutines. https://go.dev/src/net/http/client.go
+	client http.Client
+	// batches, repairs, hashes and retention carry many messages, so they get a longer timeout
+	bulkClient http.Client
+}
+
+func NewHttpTransport(requestTimeout time.Duration, credentials auth.Credentials) *HttpTransport {
+	return &HttpTransport{
+		client:     credentials.NewHttpClient(requestTimeout),
+		bulkClient: credentials.NewHttpClient(BulkRequestTimeout()),
+	}
+}
+
+func (t *HttpTransport) Replicate(ctx context.Context, secondaryUrl string, message model.Message) error {
+	return t.post(ctx, &t.client, secondaryUrl+"/api/v1/internal/replicate", message)
+}
+
+func (t *HttpTransport) ReplicateBatch(ctx context.Context, secondaryUrl string, batch []model.Message) error {
+	return t.post(ctx, &t.bulkClient, secondaryUrl+"/api/v1/internal/replicate/batch", batch)
+}
+
+func (t *HttpTransport) Repair(ctx context.Context, secondaryUrl string, messages []model.Message) error {
+	return t.post(ctx, &t.bulkClient, secondaryUrl+"/api/v1/internal/repair", messages)
+}
+
+func (t *HttpTransport) post(ctx context.Context, client *http.Client, url string, body any) error {
+	return t.postWithResponse(ctx, client, url, body, nil)
+}
+
+// postWithResponse decodes JSON response into the given value unless it is nil
+func (t *HttpTransport) postWithResponse(ctx context.Context, client *http.Client, url string, body any, response any) error {
+	payload, _ := json.Marshal(body)
+
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	req.Header.Set("Content-Type", "application/json")
+	if correlationId := logging.CorrelationId(ctx); correlationId != "" {
+		req.Header.Set(logging.CorrelationIdHeader, correlationId)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusConflict {
+		return ErrStaleTerm
+	} else if resp.StatusCode == http.StatusUnprocessableEntity {
+		return ErrConflict
+	} else if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	if response != nil {
+		return json.NewDecoder(resp.Body).Decode(response)
+	}
+	return nil
+}
+
+func (t *HttpTransport) FetchHashes(ctx context.Context, secondaryUrl string, request HashRequest) (HashResponse, error) {
+	var response HashResponse
+	err := t.postWithResponse(ctx, &t.bulkClient, secondaryUrl+"/api/v1/internal/hashes", request, &response)
+	return response, err
+}
+
+func (t *HttpTransport) FetchOffset(ctx context.Context, secondaryUrl string, topic string, partition int) (model.MessageId, error) {
+	query := url.Values{"topic": {topic}, "partition": {strconv.Itoa(partition)}}
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, secondaryUrl+"/api/v1/internal/offset?"+query.Encode(), nil)
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	var body offsetResponse
+	if err = json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return 0, err
+	}
+
+	return body.Offset, nil
+}
+
+func (t *HttpTransport) DeleteTopic(ctx context.Context, secondaryUrl string, topic string, generation uint64) error {
+	query := url.Values{"generation": {strconv.FormatUint(generation, 10)}}
+	req, _ := http.NewRequestWithContext(ctx, http.MethodDelete, secondaryUrl+"/api/v1/internal/topics/"+url.PathEscape(topic)+"?"+query.Encode(), nil)
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+
+	// topic can be unknown to the secondary if it has never received its messages
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (t *HttpTransport) ApplyRetention(ctx context.Context, secondaryUrl string, request RetentionRequest) error {
+	return t.post(ctx, &t.bulkClient, secondaryUrl+"/api/v1/internal/retention", request)
+}
+
+func (t *HttpTransport) HealthCheck(ctx context.Context, secondaryUrl string, primaryOffset *model.MessageId) (*model.MessageId, error) {
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, secondaryUrl+"/api/v1/healthcheck", nil)
+	if primaryOffset != nil {
+		req.Header.Set(PrimaryOffsetHeader, strconv.FormatUint(uint64(*primaryOffset), 10))
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return parseOffset(resp.Header.Get(SecondaryOffsetHeader)), nil
+}
+
+// parseOffset returns nil if offset is absent or malformed
+func parseOffset(token string) *model.MessageId {
+	value, err := strconv.ParseUint(token, 10, 32)
+	if err != nil {
+		return nil
+	}
+	offset := model.MessageId(value)
+	return &offset
+}
+
+func (t *HttpTransport) Forget(_ string) {
+	// connections are pooled by http.Client
+}
+
+func (t *HttpTransport) Close() {
+	t.client.CloseIdleConnections()
+}
@@ -0,0 +1,133 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"os"
+	"replicated-log/internal/auth"
+	"replicated-log/internal/logging"
+	"replicated-log/internal/model"
+	"replicated-log/internal/storage"
+	"strconv"
+	"time"
+)
+
+var logger = logging.Component("transport")
+
+const (
+	modeHttp = "HTTP" // JSON over HTTP/1.1, request per message or batch
+	modeGrpc = "GRPC" // gRPC, secondary urls should look like 'grpc://host:port'
+)
+
+var (
+	// ErrStaleTerm -- secondary rejected messages because they come from a stale leader
+	ErrStaleTerm = errors.New("fenced off, term is stale")
+	// ErrConflict -- secondary has a different message with the same id, replicas diverged and retry doesn't help,
+	// the message should be overwritten by Repair
+	ErrConflict = errors.New("secondary has a conflicting message")
+)
+
+// Transport -- how primary talks to secondaries. Implementations are safe for concurrent use.
+type Transport interface {
+	// Replicate sends one message, ctx carries correlation id of the append.
+	// Returns ErrStaleTerm if leader is fenced off, ErrConflict if secondary has another message with the same id.
+	Replicate(ctx context.Context, secondaryUrl string, message model.Message) error
+	// ReplicateBatch sends several messages, secondary acknowledges all of them or returns error
+	ReplicateBatch(ctx context.Context, secondaryUrl string, batch []model.Message) error
+	// FetchOffset returns id of the first message of the topic partition missing on the secondary
+	FetchOffset(ctx context.Context, secondaryUrl string, topic string, partition int) (model.MessageId, error)
+	// DeleteTopic removes topic with all its messages from the secondary. Late messages of the given generation
+	// of the topic don't create it again, see model.Message.TopicGeneration.
+	DeleteTopic(ctx context.Context, secondaryUrl string, topic string, generation uint64) error
+	// FetchHashes returns hashes of the requested ranges of the topic partition on the secondary, see storage.HashRange
+	FetchHashes(ctx context.Context, secondaryUrl string, request HashRequest) (HashResponse, error)
+	// Repair overwrites messages on the secondary, even if it has messages with the same ids
+	Repair(ctx context.Context, secondaryUrl string, messages []model.Message) error
+	// ApplyRetention trims and compacts partitions of the secondary up to points of the primary.
+	// Returns ErrStaleTerm if leader is fenced off.
+	ApplyRetention(ctx context.Context, secondaryUrl string, request RetentionRequest) error
+	// HealthCheck returns nil if secondary is ready to receive messages. Offset of the primary is optional.
+	// Offset of the default log of the secondary is returned, nil if secondary doesn't report it.
+	HealthCheck(ctx context.Context, secondaryUrl string, primaryOffset *model.MessageId) (*model.MessageId, error)
+	// Forget releases resources of the removed secondary
+	Forget(secondaryUrl string)
+	Close()
+}
+
+// IdRange -- ids of messages from 'from' inclusive to 'to' exclusive
+type IdRange struct {
+	From model.MessageId `json:"from"`
+	To   model.MessageId `json:"to"`
+}
+
+// HashRequest -- ranges of the topic partition which are compared by anti-entropy
+type HashRequest struct {
+	Topic     string    `json:"topic,omitempty"`
+	Partition int       `json:"partition,omitempty"`
+	Ranges    []IdRange `json:"ranges"`
+}
+
+// HashResponse -- hash of every requested range in the same order. Only ids between low-water mark and offset
+// can be compared, messages outside of them are removed by retention or not replicated yet.
+type HashResponse struct {
+	LowWaterMark model.MessageId `json:"low_water_mark"`
+	Offset       model.MessageId `json:"offset"`
+	Hashes       []string        `json:"hashes"`
+}
+
+// RetentionRequest -- retention points of all partitions of the primary, partitions unknown to the secondary are skipped
+type RetentionRequest struct {
+	Term   uint64                   `json:"term"`
+	Points []storage.RetentionPoint `json:"points"`
+}
+
+// RequestTimeout returns timeout of a single request to secondary from 'REQUEST_TIMEOUT_MILLISECONDS' env var
+func RequestTimeout() time.Duration {
+	requestTimeout := 50 * time.Millisecond // default value
+	if requestTimeoutToken, okTimeout := os.LookupEnv("REQUEST_TIMEOUT_MILLISECONDS"); okTimeout {
+		value, _ := strconv.Atoi(requestTimeoutToken)
+		requestTimeout = time.Duration(value) * time.Millisecond
+	}
+	return requestTimeout
+}
+
+// BulkRequestTimeout returns timeout of requests which carry many messages or ranges (batch streams, catch-up, repairs,
+// hashes and retention) from 'BULK_REQUEST_TIMEOUT_MILLISECONDS' env var
+func BulkRequestTimeout() time.Duration {
+	bulkTimeout := 5 * time.Second // default value
+	if bulkTimeoutToken, okTimeout := os.LookupEnv("BULK_REQUEST_TIMEOUT_MILLISECONDS"); okTimeout {
+		value, err := strconv.Atoi(bulkTimeoutToken)
+		if err != nil || value < 1 {
+			logging.Fatal(logger, "Given 'BULK_REQUEST_TIMEOUT_MILLISECONDS' token is invalid", "token", bulkTimeoutToken)
+		}
+		bulkTimeout = time.Duration(value) * time.Millisecond
+	}
+	return bulkTimeout
+}
+
+// NewTransport creates transport selected by 'REPLICATION_TRANSPORT' env var, it authenticates with internal credentials
+func NewTransport() Transport {
+	requestTimeout := RequestTimeout()
+	credentials := auth.InternalCredentials()
+
+	mode, ok := os.LookupEnv("REPLICATION_TRANSPORT")
+	if !ok {
+		mode = modeHttp
+	}
+
+	switch mode {
+	case modeHttp:
+		return NewHttpTransport(requestTimeout, credentials)
+	case modeGrpc:
+		return NewGrpcTransport(requestTimeout, credentials.GrpcDialOptions()...)
+	default:
+		logging.Fatal(logger, "Unexpected replication transport", "transport", mode)
+	}
+
+	return nil
+}
+
+// IsGrpc returns true if gRPC transport is selected by 'REPLICATION_TRANSPORT' env var
+func IsGrpc() bool {
+	return os.Getenv("REPLICATION_TRANSPORT") == modeGrpc
+}
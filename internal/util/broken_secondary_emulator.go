@@ -1,10 +1,12 @@
 package util
 
 import (
-	"log"
+	"replicated-log/internal/logging"
 	"sync"
 )
 
+var logger = logging.Component("broken-secondary")
+
 // USE THIS CODE ONLY FOR SYSTEM TESTING!
 
 type BrokenSecondaryEmulator struct {
@@ -31,14 +33,14 @@ func (emulator *BrokenSecondaryEmulator) BlockActionIfNeeded(action func()) {
 	defer emulator.mu.Unlock()
 
 	if emulator.shouldWait {
-		log.Printf("[BROKEN SECONDARY] Emulation is enabled! Waiting...")
+		logger.Warn("Emulation is enabled! Waiting...")
 		emulator.waitCnt++
 
 		for emulator.shouldWait {
 			emulator.shouldWaitCond.Wait()
 		}
 
-		log.Printf("[BROKEN SECONDARY] Back to normal life. Unblocking action...")
+		logger.Info("Back to normal life. Unblocking action")
 
 		action()
 
@@ -52,7 +54,7 @@ func (emulator *BrokenSecondaryEmulator) BlockActionIfNeeded(action func()) {
 func (emulator *BrokenSecondaryEmulator) ChangeMode(shouldWait bool) {
 	emulator.mu.Lock()
 	defer emulator.mu.Unlock()
-	log.Printf("[BROKEN SECONDARY] Mode: %t\n", shouldWait)
+	logger.Info("Emulation mode is switched", "enabled", shouldWait)
 	emulator.shouldWait = shouldWait
 
 	if !emulator.shouldWait {
@@ -4,6 +4,7 @@ import time
 import requests
 
 HEALTHCHECK_PERIOD = os.getenv("HEALTHCHECK_PERIOD_MILLISECOND")
+HEALTHCHECK_DEAD_AFTER_FAILURES = os.getenv("HEALTHCHECK_DEAD_AFTER_FAILURES", "3")
 
 
 def get_messages(url: str) -> list[str]:
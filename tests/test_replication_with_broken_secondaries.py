@@ -1,7 +1,8 @@
 import threading
 import time
 
-from http_utility import get_messages, block_replication, send_messages, HEALTHCHECK_PERIOD, append_message
+from http_utility import get_messages, block_replication, send_messages, HEALTHCHECK_PERIOD, append_message, \
+    HEALTHCHECK_DEAD_AFTER_FAILURES
 
 
 def test_inconsistency_and_eventual_consistency_during_replication_with_w_2(primary_url, secondary1_url,
@@ -136,7 +137,8 @@ def test_if_primary_rejects_append_request_if_there_is_no_quorum(primary_url, se
     is_blocked = block_replication(secondary2_url, True)
     assert is_blocked
 
-    time.sleep(int(HEALTHCHECK_PERIOD) / 1000 * 1.5)  # wait till health will be updated
+    # wait till secondaries are considered DEAD
+    time.sleep(int(HEALTHCHECK_PERIOD) / 1000 * (int(HEALTHCHECK_DEAD_AFTER_FAILURES) + 0.5))
 
     # THEN
     is_appended = append_message(primary_url, msg, w)